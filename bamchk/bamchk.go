@@ -0,0 +1,307 @@
+// Package bamchk checks that bams and crams are complete, indexed, sorted and match a reference
+// before they are used.
+package bamchk
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	arg "github.com/alexflint/go-arg"
+	"github.com/biogo/hts/sam"
+	"github.com/brentp/goleft"
+	"github.com/brentp/goleft/bamio"
+)
+
+var cli = &struct {
+	Reference string   `arg:"-r,help:optional reference fasta with a .fai. the header must match its names and lengths. also used to decode crams"`
+	N         int      `arg:"-n,help:number of reads from the start of each file to check for sorted order. 0 reads the entire file"`
+	Fai       string   `arg:"--fai,help:optional .fai or genome file to check the header against rather than the .fai of --reference"`
+	JSON      bool     `arg:"--json,help:print a line of JSON for each file rather than a line for each check"`
+	Bams      []string `arg:"positional,required,help:bam(s) or cram(s) to check"`
+}{N: 100000}
+
+// the statuses of a check.
+const (
+	pass = "pass"
+	fail = "fail"
+	skip = "skip"
+)
+
+// result is the outcome of a single check of a file.
+type result struct {
+	Check  string `json:"check"`
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// report holds the results of every check of a file. OK is false if any check failed.
+type report struct {
+	Path   string   `json:"path"`
+	OK     bool     `json:"ok"`
+	Checks []result `json:"checks"`
+}
+
+func (r *report) add(res result) {
+	r.Checks = append(r.Checks, res)
+	if res.Status == fail {
+		r.OK = false
+	}
+}
+
+// bgzfEOF is the empty BGZF block that ends every complete bam.
+var bgzfEOF = []byte{0x1f, 0x8b, 0x08, 0x04, 0x00, 0x00, 0x00, 0x00, 0x00, 0xff, 0x06, 0x00, 0x42, 0x43,
+	0x02, 0x00, 0x1b, 0x00, 0x03, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
+
+// the EOF containers that end a cram of major version 2 and 3.
+var (
+	cram2EOF = []byte{0x0b, 0x00, 0x00, 0x00, 0xff, 0xff, 0xff, 0xff, 0xff, 0xe0, 0x45, 0x4f, 0x46, 0x00,
+		0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x01, 0x00, 0x06, 0x06, 0x01, 0x00, 0x01, 0x00, 0x01, 0x00}
+	cram3EOF = []byte{0x0f, 0x00, 0x00, 0x00, 0xff, 0xff, 0xff, 0xff, 0x0f, 0xe0, 0x45, 0x4f, 0x46, 0x00,
+		0x00, 0x00, 0x00, 0x01, 0x00, 0x05, 0xbd, 0xd9, 0x4f, 0x00, 0x01, 0x00, 0x06, 0x06, 0x01, 0x00,
+		0x01, 0x00, 0x01, 0x00, 0xee, 0x63, 0x01, 0x4b}
+)
+
+// checkEOF reports whether the file at path ends with the EOF marker. Without it, the file was
+// likely truncated by an interrupted copy or a failed job. Only the start and end of a URL are read.
+func checkEOF(path string) result {
+	res := result{Check: "eof", Status: fail}
+	fh, err := bamio.OpenFile(path)
+	if err != nil {
+		res.Detail = err.Error()
+		return res
+	}
+	defer fh.Close()
+	eof := bgzfEOF
+	if bamio.IsCRAM(path) {
+		var magic [6]byte
+		if _, err := io.ReadFull(fh, magic[:]); err != nil || string(magic[:4]) != "CRAM" {
+			res.Detail = "not a cram file"
+			return res
+		}
+		switch magic[4] {
+		case 2:
+			eof = cram2EOF
+		case 3:
+			eof = cram3EOF
+		default:
+			res.Status, res.Detail = skip, fmt.Sprintf("unknown cram version: %d", magic[4])
+			return res
+		}
+	}
+	if fh.Size() < int64(len(eof)) {
+		res.Detail = "file is too small"
+		return res
+	}
+	tail := make([]byte, len(eof))
+	if _, err := fh.ReadAt(tail, fh.Size()-int64(len(eof))); err != nil {
+		res.Detail = err.Error()
+		return res
+	}
+	if !bytes.Equal(tail, eof) {
+		res.Detail = "missing EOF marker. the file is likely truncated"
+		return res
+	}
+	res.Status = pass
+	return res
+}
+
+// checkIndex reports whether the file at path has an index that is at least as new as the file.
+// An older index is likely from a previous version of the file. For a URL, the times are from the
+// Last-Modified of the server and are not compared if it does not send them.
+func checkIndex(path string) result {
+	res := result{Check: "index", Status: fail}
+	ipath, err := bamio.IndexPath(path)
+	if err != nil {
+		res.Detail = err.Error()
+		return res
+	}
+	fh, err := bamio.OpenFile(path)
+	if err != nil {
+		res.Detail = err.Error()
+		return res
+	}
+	defer fh.Close()
+	ifh, err := bamio.OpenFile(ipath)
+	if err != nil {
+		res.Detail = err.Error()
+		return res
+	}
+	defer ifh.Close()
+	fmod, imod := fh.ModTime(), ifh.ModTime()
+	if fmod.IsZero() || imod.IsZero() {
+		res.Status, res.Detail = pass, ipath+". no modification times to compare"
+		return res
+	}
+	if imod.Before(fmod) {
+		res.Detail = fmt.Sprintf("index %s is older than the file by %s", ipath, fmod.Sub(imod))
+		return res
+	}
+	res.Status, res.Detail = pass, ipath
+	return res
+}
+
+// readFai returns the length of each sequence, keyed by name, from a .fai or genome file.
+func readFai(path string) (map[string]int, error) {
+	g, err := goleft.ReadGenome(path)
+	if err != nil {
+		return nil, err
+	}
+	lengths := make(map[string]int, len(g.Contigs))
+	for _, c := range g.Contigs {
+		lengths[c.Name] = c.Len
+	}
+	return lengths, nil
+}
+
+// checkHeader reports whether every reference in h is in the fai with the same length. It is
+// skipped if fai is nil.
+func checkHeader(h *sam.Header, fai map[string]int) result {
+	res := result{Check: "header", Status: fail}
+	if len(h.Refs()) == 0 {
+		res.Detail = "no @SQ lines in header"
+		return res
+	}
+	if fai == nil {
+		res.Status, res.Detail = skip, "no --reference or --fai"
+		return res
+	}
+	var bad []string
+	for _, ref := range h.Refs() {
+		l, ok := fai[ref.Name()]
+		if !ok {
+			bad = append(bad, ref.Name()+" not in reference")
+		} else if l != ref.Len() {
+			bad = append(bad, fmt.Sprintf("%s has length %d in header and %d in reference", ref.Name(), ref.Len(), l))
+		}
+	}
+	if len(bad) > 0 {
+		if len(bad) > 3 {
+			bad = append(bad[:3], fmt.Sprintf("and %d more", len(bad)-3))
+		}
+		res.Detail = strings.Join(bad, "; ")
+		return res
+	}
+	res.Status = pass
+	return res
+}
+
+// recordReader is the interface for the reads that are checked for sorted order.
+type recordReader interface {
+	Read() (*sam.Record, error)
+}
+
+// checkSorted reports whether the header has a coordinate sort order and the first n reads from
+// rdr are sorted. Unmapped reads without a position must follow all others. A read error, e.g.
+// from a corrupt block, is also a failure.
+func checkSorted(rdr recordReader, h *sam.Header, n int) result {
+	res := result{Check: "sorted", Status: fail}
+	if h.SortOrder != sam.Coordinate {
+		res.Detail = fmt.Sprintf("header sort order is %s", h.SortOrder)
+		return res
+	}
+	lastRef, lastPos, unplaced := -1, -1, false
+	for i := 0; n <= 0 || i < n; i++ {
+		rec, err := rdr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			res.Detail = fmt.Sprintf("error reading record %d: %s", i+1, err)
+			return res
+		}
+		if rec.Ref == nil {
+			unplaced = true
+			continue
+		}
+		if unplaced || rec.Ref.ID() < lastRef || (rec.Ref.ID() == lastRef && rec.Pos < lastPos) {
+			res.Detail = fmt.Sprintf("record %d (%s at %s:%d) is out of order", i+1, rec.Name, rec.Ref.Name(), rec.Pos+1)
+			return res
+		}
+		lastRef, lastPos = rec.Ref.ID(), rec.Pos
+	}
+	res.Status = pass
+	return res
+}
+
+// check runs every check on the file at path. fai may be nil.
+func check(path string, fai map[string]int) report {
+	r := report{Path: path, OK: true}
+	if bamio.IsHtsget(path) {
+		// the server returns the reads rather than the file so there is no EOF marker or index.
+		goleft.Warnf("bamchk: the eof and index checks are skipped for htsget: %s", path)
+		r.add(result{Check: "eof", Status: skip, Detail: "htsget"})
+		r.add(result{Check: "index", Status: skip, Detail: "htsget"})
+	} else {
+		r.add(checkEOF(path))
+		r.add(checkIndex(path))
+	}
+	h, err := bamio.Header(path)
+	if err != nil {
+		r.add(result{Check: "header", Status: fail, Detail: err.Error()})
+		return r
+	}
+	r.add(checkHeader(h, fai))
+	if bamio.IsCRAM(path) && cli.Reference == "" {
+		r.add(result{Check: "sorted", Status: skip, Detail: "--reference is required to read a cram"})
+		return r
+	}
+	br, err := bamio.Open(path, cli.Reference, goleft.BgzfWorkers(1))
+	if err != nil {
+		r.add(result{Check: "sorted", Status: fail, Detail: err.Error()})
+		return r
+	}
+	defer br.Close()
+	r.add(checkSorted(br, h, cli.N))
+	return r
+}
+
+// Main is called from the goleft dispatcher.
+func Main() {
+	arg.MustParse(cli)
+	var fai map[string]int
+	if cli.Fai != "" {
+		var err error
+		if fai, err = readFai(cli.Fai); err != nil {
+			log.Fatalf("bamchk: error reading --fai: %s", err)
+		}
+	} else if cli.Reference != "" {
+		var err error
+		if fai, err = readFai(cli.Reference + ".fai"); err != nil {
+			log.Fatalf("bamchk: error reading index for reference: %s", err)
+		}
+	}
+	w := bufio.NewWriter(os.Stdout)
+	enc := json.NewEncoder(w)
+	if !cli.JSON {
+		fmt.Fprintln(w, "#path\tcheck\tstatus\tdetail")
+	}
+	bad := 0
+	for _, path := range cli.Bams {
+		goleft.Infof("bamchk: %s", path)
+		r := check(path, fai)
+		if !r.OK {
+			bad++
+		}
+		if cli.JSON {
+			if err := enc.Encode(r); err != nil {
+				log.Fatal(err)
+			}
+			continue
+		}
+		for _, c := range r.Checks {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", path, c.Check, c.Status, c.Detail)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		log.Fatal(err)
+	}
+	if bad > 0 {
+		log.Fatalf("bamchk: %d of %d files failed", bad, len(cli.Bams))
+	}
+}
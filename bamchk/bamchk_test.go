@@ -0,0 +1,146 @@
+package bamchk
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/biogo/hts/sam"
+)
+
+func TestCheckEOF(t *testing.T) {
+	if res := checkEOF("../depth/test/t.bam"); res.Status != pass {
+		t.Fatalf("expected complete bam to pass, got: %+v", res)
+	}
+	b, err := ioutil.ReadFile("../depth/test/t.bam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmp, err := ioutil.TempDir("", "goleft-bamchk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	p := filepath.Join(tmp, "truncated.bam")
+	if err := ioutil.WriteFile(p, b[:len(b)-100], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if res := checkEOF(p); res.Status != fail {
+		t.Errorf("expected truncated bam to fail, got: %+v", res)
+	}
+	if res := checkIndex(p); res.Status != fail {
+		t.Errorf("expected missing index to fail, got: %+v", res)
+	}
+}
+
+func TestCheckRemote(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "goleft-bamchk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	for _, name := range []string{"t.bam", "t.bam.bai"} {
+		b, err := ioutil.ReadFile(filepath.Join("../depth/test", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(tmp, name), b, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if name == "t.bam" {
+			if err := ioutil.WriteFile(filepath.Join(tmp, "truncated.bam"), b[:len(b)-100], 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// the index is written after the bam.
+	now := time.Now()
+	if err := os.Chtimes(filepath.Join(tmp, "t.bam"), now.Add(-time.Hour), now.Add(-time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.FileServer(http.Dir(tmp)))
+	defer srv.Close()
+
+	// only the ends of the file are requested.
+	if res := checkEOF(srv.URL + "/t.bam"); res.Status != pass {
+		t.Errorf("expected complete remote bam to pass, got: %+v", res)
+	}
+	if res := checkEOF(srv.URL + "/truncated.bam"); res.Status != fail {
+		t.Errorf("expected truncated remote bam to fail, got: %+v", res)
+	}
+	if res := checkIndex(srv.URL + "/t.bam"); res.Status != pass || res.Detail != srv.URL+"/t.bam.bai" {
+		t.Errorf("expected the remote index to pass, got: %+v", res)
+	}
+	if res := checkIndex(srv.URL + "/truncated.bam"); res.Status != fail {
+		t.Errorf("expected missing remote index to fail, got: %+v", res)
+	}
+
+	// an index older than the bam fails as for a local file.
+	if err := os.Chtimes(filepath.Join(tmp, "t.bam.bai"), now.Add(-2*time.Hour), now.Add(-2*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if res := checkIndex(srv.URL + "/t.bam"); res.Status != fail {
+		t.Errorf("expected the older remote index to fail, got: %+v", res)
+	}
+}
+
+type sliceReader []*sam.Record
+
+func (s *sliceReader) Read() (*sam.Record, error) {
+	if len(*s) == 0 {
+		return nil, io.EOF
+	}
+	r := (*s)[0]
+	*s = (*s)[1:]
+	return r, nil
+}
+
+func TestCheckSortedAndHeader(t *testing.T) {
+	r1, _ := sam.NewReference("1", "", "", 1000, nil, nil)
+	r2, _ := sam.NewReference("2", "", "", 2000, nil, nil)
+	h, err := sam.NewHeader(nil, []*sam.Reference{r1, r2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := func(name string, ref *sam.Reference, pos int) *sam.Record {
+		r, err := sam.NewRecord(name, ref, nil, pos, -1, 0, 60, nil, []byte("ACGT"), nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+	sorted := sliceReader{rec("a", r1, 10), rec("b", r1, 10), rec("c", r2, 5), rec("d", nil, -1)}
+	if res := checkSorted(&sorted, h, 0); res.Status != fail || !strings.Contains(res.Detail, "sort order") {
+		t.Errorf("expected failure without a coordinate sort order, got: %+v", res)
+	}
+	h.SortOrder = sam.Coordinate
+	sorted = sliceReader{rec("a", r1, 10), rec("b", r1, 10), rec("c", r2, 5), rec("d", nil, -1)}
+	if res := checkSorted(&sorted, h, 0); res.Status != pass {
+		t.Errorf("expected sorted reads to pass, got: %+v", res)
+	}
+	unsorted := sliceReader{rec("a", r2, 10), rec("b", r1, 20)}
+	if res := checkSorted(&unsorted, h, 0); res.Status != fail || !strings.Contains(res.Detail, "record 2") {
+		t.Errorf("expected the second read to be out of order, got: %+v", res)
+	}
+	// only the first read is checked.
+	unsorted = sliceReader{rec("a", r2, 10), rec("b", r1, 20)}
+	if res := checkSorted(&unsorted, h, 1); res.Status != pass {
+		t.Errorf("expected only 1 read to be checked, got: %+v", res)
+	}
+
+	if res := checkHeader(h, nil); res.Status != skip {
+		t.Errorf("expected header check to be skipped without a reference, got: %+v", res)
+	}
+	if res := checkHeader(h, map[string]int{"1": 1000, "2": 2000, "3": 10}); res.Status != pass {
+		t.Errorf("expected matching header to pass, got: %+v", res)
+	}
+	if res := checkHeader(h, map[string]int{"1": 1000, "2": 2001}); res.Status != fail || !strings.Contains(res.Detail, "2 has length 2000") {
+		t.Errorf("expected length mismatch, got: %+v", res)
+	}
+}
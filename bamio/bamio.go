@@ -0,0 +1,249 @@
+// Package bamio opens BAM and CRAM files for the goleft tools.
+// BAMs are read directly with biogo/hts. CRAMs are decoded by samtools which must
+// be on the users $PATH and must be given the reference fasta.
+package bamio
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/biogo/hts/bam"
+	"github.com/biogo/hts/sam"
+)
+
+// IsCRAM returns true if the path has a .cram extension.
+func IsCRAM(path string) bool {
+	return strings.HasSuffix(strings.ToLower(path), ".cram")
+}
+
+// Reader wraps a bam.Reader and closes the underlying file or samtools process along with it.
+type Reader struct {
+	*bam.Reader
+	fh  io.Closer
+	cmd *exec.Cmd
+}
+
+// Close closes the bam.Reader and the underlying file and waits for samtools to exit if
+// it was used to decode a CRAM.
+func (r *Reader) Close() error {
+	err := r.Reader.Close()
+	if e := r.fh.Close(); err == nil {
+		err = e
+	}
+	if r.cmd != nil {
+		// samtools will get SIGPIPE if we stopped reading early so the exit status is not useful.
+		r.cmd.Wait()
+	}
+	return err
+}
+
+// Open returns a Reader for the BAM or CRAM at path using rd decompression goroutines.
+// fasta is required for CRAM and ignored for BAM. If path is "-", a BAM is read from stdin.
+// For CRAM, an rd above 1 is also the number of threads for samtools. A BAM at a URL (see IsRemote)
+// is read with range requests so it can be used with the index like a local file and an htsget://
+// URL (see IsHtsget) is streamed from the server.
+func Open(path string, fasta string, rd int) (*Reader, error) {
+	if IsHtsget(path) {
+		return openHtsget(path, "", rd)
+	}
+	if path == "-" {
+		br, err := bam.NewReader(os.Stdin, rd)
+		if err != nil {
+			return nil, err
+		}
+		return &Reader{Reader: br, fh: os.Stdin}, nil
+	}
+	if IsRemote(path) && !IsCRAM(path) {
+		fh, err := openRange(remoteURL(path))
+		if err != nil {
+			return nil, err
+		}
+		br, err := bam.NewReader(fh, rd)
+		if err != nil {
+			fh.Close()
+			return nil, err
+		}
+		return &Reader{Reader: br, fh: fh}, nil
+	}
+	if !IsCRAM(path) {
+		fh, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		// pass the *os.File directly so the reader can seek with an index.
+		br, err := bam.NewReader(fh, rd)
+		if err != nil {
+			fh.Close()
+			return nil, err
+		}
+		return &Reader{Reader: br, fh: fh}, nil
+	}
+	return openSamtools(path, fasta, rd, nil)
+}
+
+// OpenRegions is like Open but uses samtools to return only the reads that overlap the regions
+// in the bed file. For BAM, it is faster to use the index directly; this is used mainly for CRAM.
+func OpenRegions(path string, fasta string, bed string, rd int) (*Reader, error) {
+	if IsHtsget(path) {
+		return nil, fmt.Errorf("bamio: a bed of regions is not supported for htsget: %s", path)
+	}
+	return openSamtools(path, fasta, rd, []string{"-L", bed})
+}
+
+// OpenRegion uses samtools to return only the reads from the region (e.g. chr1 or chr1:1-1000)
+// of the indexed BAM or CRAM at path. For an htsget:// URL, only the region is requested from the
+// server but it may send reads outside of the region.
+func OpenRegion(path string, fasta string, region string, rd int) (*Reader, error) {
+	if IsHtsget(path) {
+		return openHtsget(path, region, rd)
+	}
+	return openSamtools(path, fasta, rd, nil, region)
+}
+
+// openSamtools uses samtools to decode the file at path. extra arguments are sent to samtools view
+// before the path and regions after it.
+func openSamtools(path string, fasta string, rd int, extra []string, regions ...string) (*Reader, error) {
+	args := []string{"view", "-u"}
+	if fasta != "" {
+		args = append(args, "-T", fasta)
+	} else if IsCRAM(path) {
+		return nil, fmt.Errorf("bamio: reference fasta is required to read CRAM: %s", path)
+	}
+	if rd > 1 {
+		args = append(args, "-@", strconv.Itoa(rd))
+	}
+	args = append(args, extra...)
+	// -u outputs uncompressed BAM so we don't pay to compress and decompress.
+	args = append(append(args, path), regions...)
+	cmd := exec.Command("samtools", args...)
+	cmd.Stderr = os.Stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("bamio: error starting samtools for %s: %s", path, err)
+	}
+	br, err := bam.NewReader(stdout, rd)
+	if err != nil {
+		stdout.Close()
+		cmd.Wait()
+		return nil, err
+	}
+	return &Reader{Reader: br, fh: stdout, cmd: cmd}, nil
+}
+
+// Header returns only the header of the BAM or CRAM at path. A reference is not needed for CRAM.
+// path may be a URL (see IsRemote) in which case only the start of the BAM is read. For a remote
+// CRAM, samtools must be built with support for the URL scheme. For an htsget:// URL, only the header
+// is requested.
+func Header(path string) (*sam.Header, error) {
+	if IsHtsget(path) {
+		t, err := getTicket(path, "", "header")
+		if err != nil {
+			return nil, err
+		}
+		body := &htsgetBody{t: t}
+		defer body.Close()
+		br, err := bam.NewReader(body, 1)
+		if err != nil {
+			return nil, err
+		}
+		defer br.Close()
+		return br.Header(), nil
+	}
+	if !IsCRAM(path) {
+		var fh io.ReadCloser
+		var err error
+		if IsRemote(path) {
+			fh, err = openRemote(path)
+		} else {
+			fh, err = os.Open(path)
+		}
+		if err != nil {
+			return nil, err
+		}
+		defer fh.Close()
+		br, err := bam.NewReader(fh, 1)
+		if err != nil {
+			return nil, err
+		}
+		defer br.Close()
+		return br.Header(), nil
+	}
+	text, err := exec.Command("samtools", "view", "-H", path).Output()
+	if err != nil {
+		return nil, fmt.Errorf("bamio: error reading header from %s: %s", path, err)
+	}
+	return sam.NewHeader(text, nil)
+}
+
+// SampleName returns the first SM tag in the header or, if there is none, the file name of path
+// without the extension.
+func SampleName(h *sam.Header, path string) string {
+	for _, rg := range h.RGs() {
+		if sm := rg.Get(sam.Tag([2]byte{'S', 'M'})); sm != "" {
+			return sm
+		}
+	}
+	base := filepath.Base(path)
+	return strings.TrimSuffix(base, filepath.Ext(base))
+}
+
+// IndexPath returns the path to the index for the BAM or CRAM at path. It checks the
+// $path.bai and $base.bai style names and then $path.csi for BAM and $path.crai for CRAM. If path is a URL,
+// the returned path is also a URL with only its path changed so that the query of a signed URL is kept.
+func IndexPath(path string) (string, error) {
+	p := path
+	u, err := url.Parse(path)
+	remote := IsRemote(path) && err == nil
+	if remote {
+		p = u.Path
+	}
+	var candidates []string
+	if IsCRAM(p) {
+		candidates = []string{p + ".crai", p[:len(p)-5] + ".crai"}
+	} else {
+		candidates = []string{p + ".bai", strings.TrimSuffix(p, ".bam") + ".bai", p + ".csi"}
+	}
+	for _, c := range candidates {
+		if remote {
+			u.Path, u.RawPath = c, ""
+			if c = u.String(); remoteExists(c) {
+				return c, nil
+			}
+		} else if _, err := os.Stat(c); err == nil {
+			return c, nil
+		}
+	}
+	return "", fmt.Errorf("bamio: no index found for %s", path)
+}
+
+// IdxStats returns the count of mapped reads for each reference (keyed by name) as reported by
+// samtools idxstats. This is used for CRAM where the index does not contain read counts.
+func IdxStats(path string) (map[string]uint64, error) {
+	out, err := exec.Command("samtools", "idxstats", path).Output()
+	if err != nil {
+		return nil, fmt.Errorf("bamio: error running samtools idxstats on %s: %s", path, err)
+	}
+	m := make(map[string]uint64)
+	for _, line := range bytes.Split(bytes.TrimSpace(out), []byte{'\n'}) {
+		toks := strings.Split(string(line), "\t")
+		if len(toks) < 4 || toks[0] == "*" {
+			continue
+		}
+		mapped, err := strconv.ParseUint(toks[2], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		m[toks[0]] = mapped
+	}
+	return m, nil
+}
@@ -0,0 +1,176 @@
+package bamio
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/biogo/hts/bgzf"
+)
+
+// csiIndex is a .csi. Unlike a .bai, the bins cover 2^minShift bases at the deepest of depth
+// levels so long contigs can be indexed. biogo/hts/csi assumes the pseudo-bin of a depth of 5 so
+// it can not read the deeper indexes that long contigs need.
+type csiIndex struct {
+	minShift, depth uint
+	refs            []csiRef
+}
+
+type csiRef struct {
+	bins map[uint32]csiBin
+	// mapped reads from the pseudo-bin and whether it was present.
+	mapped   uint64
+	hasStats bool
+}
+
+type csiBin struct {
+	// loffset is the smallest virtual offset of the reads that overlap the bin.
+	loffset uint64
+	chunks  [][2]uint64
+}
+
+// firstBin returns the number of the first bin at level l.
+func firstBin(l uint) uint32 {
+	return uint32(((1 << (3 * l)) - 1) / 7)
+}
+
+// readCSI reads the bgzf compressed .csi from r.
+func readCSI(r io.Reader) (*csiIndex, error) {
+	gz, err := gzip.NewReader(bufio.NewReader(r))
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+	rdr := bufio.NewReader(gz)
+
+	var h struct {
+		Magic                 [4]byte
+		MinShift, Depth, LAux int32
+	}
+	if err := binary.Read(rdr, binary.LittleEndian, &h); err != nil {
+		return nil, err
+	}
+	if string(h.Magic[:]) != "CSI\x01" {
+		return nil, fmt.Errorf("bamio: not a .csi index")
+	}
+	if h.MinShift < 1 || h.Depth < 1 || h.LAux < 0 || int(h.MinShift)+3*int(h.Depth) > 62 {
+		return nil, fmt.Errorf("bamio: bad header in .csi")
+	}
+	if _, err := rdr.Discard(int(h.LAux)); err != nil {
+		return nil, err
+	}
+	var nRefs int32
+	if err := binary.Read(rdr, binary.LittleEndian, &nRefs); err != nil {
+		return nil, err
+	}
+	x := &csiIndex{minShift: uint(h.MinShift), depth: uint(h.Depth), refs: make([]csiRef, nRefs)}
+	pseudo := firstBin(x.depth+1) + 1
+	for r := range x.refs {
+		var nBins int32
+		if err := binary.Read(rdr, binary.LittleEndian, &nBins); err != nil {
+			return nil, err
+		}
+		ref := csiRef{bins: make(map[uint32]csiBin, nBins)}
+		for b := int32(0); b < nBins; b++ {
+			var bin struct {
+				Bin     uint32
+				LOffset uint64
+				NChunks int32
+			}
+			if err := binary.Read(rdr, binary.LittleEndian, &bin); err != nil {
+				return nil, err
+			}
+			chunks := make([][2]uint64, bin.NChunks)
+			if err := binary.Read(rdr, binary.LittleEndian, chunks); err != nil {
+				return nil, err
+			}
+			if bin.Bin == pseudo {
+				if len(chunks) == 2 {
+					ref.mapped, ref.hasStats = chunks[1][0], true
+				}
+				continue
+			}
+			ref.bins[bin.Bin] = csiBin{loffset: bin.LOffset, chunks: chunks}
+		}
+		x.refs[r] = ref
+	}
+	return x, nil
+}
+
+// chunks returns the merged chunks of the reads that overlap beg to end on reference id as
+// htslib does: those in the bins overlapping the region that end after the smallest offset of the
+// reads in the deepest bin at beg.
+func (x *csiIndex) chunks(id, beg, end int) []bgzf.Chunk {
+	if id < 0 || id >= len(x.refs) {
+		return nil
+	}
+	ref := x.refs[id]
+	if end <= beg {
+		end = beg + 1
+	}
+	var minOff uint64
+	for bin := firstBin(x.depth) + uint32(beg>>x.minShift); ; bin = (bin - 1) >> 3 {
+		if b, ok := ref.bins[bin]; ok {
+			minOff = b.loffset
+			break
+		}
+		if bin == 0 {
+			break
+		}
+	}
+	var cs [][2]uint64
+	for l, s := uint(0), x.minShift+3*x.depth; l <= x.depth; l, s = l+1, s-3 {
+		t := firstBin(l)
+		for k := t + uint32(beg>>s); k <= t+uint32((end-1)>>s); k++ {
+			for _, c := range ref.bins[k].chunks {
+				if c[1] > minOff {
+					cs = append(cs, c)
+				}
+			}
+		}
+	}
+	sort.Slice(cs, func(i, j int) bool { return cs[i][0] < cs[j][0] })
+	var merged []bgzf.Chunk
+	for _, c := range cs {
+		if n := len(merged); n > 0 && vOffset(merged[n-1].End) >= c[0] {
+			if c[1] > vOffset(merged[n-1].End) {
+				merged[n-1].End = offset(c[1])
+			}
+			continue
+		}
+		merged = append(merged, bgzf.Chunk{Begin: offset(c[0]), End: offset(c[1])})
+	}
+	return merged
+}
+
+// leaves returns the offsets of the bins at the deepest level of reference id or -1 for bins
+// without reads.
+func (x *csiIndex) leaves(id int) []int64 {
+	if id < 0 || id >= len(x.refs) {
+		return nil
+	}
+	first, last := firstBin(x.depth), firstBin(x.depth+1)
+	var offs []int64
+	for bin, b := range x.refs[id].bins {
+		if bin < first || bin >= last {
+			continue
+		}
+		k := int(bin - first)
+		for len(offs) <= k {
+			offs = append(offs, -1)
+		}
+		offs[k] = int64(b.loffset)
+	}
+	return offs
+}
+
+func offset(v uint64) bgzf.Offset {
+	return bgzf.Offset{File: int64(v >> 16), Block: uint16(v)}
+}
+
+func vOffset(o bgzf.Offset) uint64 {
+	return uint64(o.File)<<16 | uint64(o.Block)
+}
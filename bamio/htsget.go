@@ -0,0 +1,180 @@
+package bamio
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/biogo/hts/bam"
+)
+
+// IsHtsget returns true if path is an htsget:// URL like htsget://host/reads/id for the reads with
+// that id from the htsget server at https://host/reads/id. The reads are always requested as BAM and
+// a ticket for another format, e.g. from a server that only sends CRAM, is an error.
+func IsHtsget(path string) bool {
+	return strings.HasPrefix(path, "htsget://")
+}
+
+// htsgetTicket is the response from an htsget server with the URLs of the parts of the BAM.
+type htsgetTicket struct {
+	Htsget struct {
+		Format string `json:"format"`
+		URLs   []struct {
+			URL     string            `json:"url"`
+			Headers map[string]string `json:"headers"`
+		} `json:"urls"`
+	} `json:"htsget"`
+}
+
+// htsgetURL returns the https URL of the request for the region (e.g. chr1 or chr1:1-1000 as for
+// samtools) of the reads at path or, if class is "header", for only the header.
+func htsgetURL(path, region, class string) (string, error) {
+	q := url.Values{"format": {"BAM"}}
+	if class != "" {
+		q.Set("class", class)
+	}
+	if region != "" {
+		chrom, span := region, ""
+		if i := strings.LastIndex(region, ":"); i > 0 {
+			chrom, span = region[:i], strings.Replace(region[i+1:], ",", "", -1)
+		}
+		q.Set("referenceName", chrom)
+		if span != "" {
+			se := strings.SplitN(span, "-", 2)
+			start, err := strconv.Atoi(se[0])
+			if err != nil || start < 1 {
+				return "", fmt.Errorf("bamio: bad region %q for %s", region, path)
+			}
+			// htsget is 0-based and half-open.
+			q.Set("start", strconv.Itoa(start-1))
+			if len(se) == 2 && se[1] != "" {
+				end, err := strconv.Atoi(se[1])
+				if err != nil || end < start {
+					return "", fmt.Errorf("bamio: bad region %q for %s", region, path)
+				}
+				q.Set("end", strconv.Itoa(end))
+			}
+		}
+	}
+	return "https://" + strings.TrimPrefix(path, "htsget://") + "?" + q.Encode(), nil
+}
+
+// getTicket requests the ticket for the region of the reads at path.
+func getTicket(path, region, class string) (*htsgetTicket, error) {
+	u, err := htsgetURL(path, region, class)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := HTTPClient.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1000))
+		return nil, fmt.Errorf("bamio: htsget error for %s: %s %s", path, resp.Status, bytes.TrimSpace(body))
+	}
+	var t htsgetTicket
+	if err := json.NewDecoder(resp.Body).Decode(&t); err != nil {
+		return nil, fmt.Errorf("bamio: bad htsget ticket for %s: %s", path, err)
+	}
+	if f := t.Htsget.Format; f != "" && f != "BAM" {
+		return nil, fmt.Errorf("bamio: htsget server sent %s for %s. only BAM is supported", f, path)
+	}
+	return &t, nil
+}
+
+// htsgetBody reads the blocks of a ticket in order as a single BAM. Each URL is requested only when
+// the reader reaches it so that a caller that stops early does not download the rest.
+type htsgetBody struct {
+	t   *htsgetTicket
+	i   int
+	cur io.ReadCloser
+}
+
+func (b *htsgetBody) Read(p []byte) (int, error) {
+	for {
+		if b.cur == nil {
+			if b.i == len(b.t.Htsget.URLs) {
+				return 0, io.EOF
+			}
+			var err error
+			if b.cur, err = openBlock(b.t.Htsget.URLs[b.i].URL, b.t.Htsget.URLs[b.i].Headers); err != nil {
+				return 0, err
+			}
+			b.i++
+		}
+		n, err := b.cur.Read(p)
+		if err == io.EOF {
+			b.cur.Close()
+			b.cur = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (b *htsgetBody) Close() error {
+	if b.cur != nil {
+		return b.cur.Close()
+	}
+	return nil
+}
+
+// openBlock returns the data of a data: URI or the body of a GET request to u with the headers.
+func openBlock(u string, headers map[string]string) (io.ReadCloser, error) {
+	if strings.HasPrefix(u, "data:") {
+		comma := strings.Index(u, ",")
+		if comma < 0 {
+			return nil, fmt.Errorf("bamio: bad data URI in htsget ticket")
+		}
+		data := u[comma+1:]
+		if !strings.HasSuffix(u[:comma], ";base64") {
+			s, err := url.PathUnescape(data)
+			return io.NopCloser(strings.NewReader(s)), err
+		}
+		b, err := base64.StdEncoding.DecodeString(data)
+		return io.NopCloser(bytes.NewReader(b)), err
+	}
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		return nil, fmt.Errorf("bamio: error reading htsget block %s: %s", u, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// openHtsget returns a Reader of the reads in the region, or of all reads if it is empty, from the
+// htsget URL at path. The server may send reads that start before or end after the region.
+func openHtsget(path, region string, rd int) (*Reader, error) {
+	t, err := getTicket(path, region, "")
+	if err != nil {
+		return nil, err
+	}
+	body := &htsgetBody{t: t}
+	br, err := bam.NewReader(body, rd)
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+	return &Reader{Reader: br, fh: body}, nil
+}
@@ -0,0 +1,94 @@
+package bamio
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/biogo/hts/bam"
+	"github.com/biogo/hts/bgzf"
+	"github.com/biogo/hts/sam"
+)
+
+// Index is the index of a BAM for random access. It is read from a .bai or from a .csi which is
+// needed for contigs longer than 2^29 (512Mb), the limit of a .bai.
+type Index struct {
+	bai *bam.Index
+	csi *csiIndex
+}
+
+// WrapBAI returns the Index for a bam.Index or nil if idx is nil.
+func WrapBAI(idx *bam.Index) *Index {
+	if idx == nil {
+		return nil
+	}
+	return &Index{bai: idx}
+}
+
+// Chunks returns the chunks of the BAM with the reads that overlap beg to end on ref.
+func (x *Index) Chunks(ref *sam.Reference, beg, end int) ([]bgzf.Chunk, error) {
+	if x.csi != nil {
+		return x.csi.chunks(ref.ID(), beg, end), nil
+	}
+	return x.bai.Chunks(ref, beg, end)
+}
+
+// NumRefs returns the number of references in the index.
+func (x *Index) NumRefs() int {
+	if x.csi != nil {
+		return len(x.csi.refs)
+	}
+	return x.bai.NumRefs()
+}
+
+// Mapped returns the number of mapped reads on the reference with id. ok is false if the
+// reference has no reads.
+func (x *Index) Mapped(id int) (n uint64, ok bool) {
+	if x.csi != nil {
+		if id < 0 || id >= len(x.csi.refs) {
+			return 0, false
+		}
+		return x.csi.refs[id].mapped, x.csi.refs[id].hasStats
+	}
+	st, ok := x.bai.ReferenceStats(id)
+	return st.Mapped, ok
+}
+
+// Leaves returns, for a .csi, the smallest virtual offset of the reads in each bin of 2^shift
+// bases at its deepest level for reference id or -1 for bins without reads. A .csi has no linear
+// index so this is the closest to that of a .bai. ok is false for a .bai.
+func (x *Index) Leaves(id int) (offsets []int64, shift uint, ok bool) {
+	if x.csi == nil {
+		return nil, 0, false
+	}
+	return x.csi.leaves(id), x.csi.minShift, true
+}
+
+// ReadIndex reads the .bai or .csi index for the BAM at path.
+func ReadIndex(path string) (*Index, error) {
+	ipath, err := IndexPath(path)
+	if err != nil {
+		return nil, err
+	}
+	return ReadIndexFile(ipath)
+}
+
+// ReadIndexFile reads the .bai or .csi at ipath.
+func ReadIndexFile(ipath string) (*Index, error) {
+	fh, err := OpenIndex(ipath)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+	if strings.HasSuffix(ipath, ".csi") {
+		idx, err := readCSI(fh)
+		if err != nil {
+			return nil, fmt.Errorf("bamio: error reading %s: %w", ipath, err)
+		}
+		return &Index{csi: idx}, nil
+	}
+	idx, err := bam.ReadIndex(fh)
+	if err != nil {
+		return nil, err
+	}
+	return &Index{bai: idx}, nil
+}
@@ -0,0 +1,185 @@
+package bamio
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/biogo/hts/bam"
+	"github.com/biogo/hts/bgzf"
+	"github.com/biogo/hts/sam"
+)
+
+// writeCSI writes a .csi for the bam at path as htslib does with the bins at the deepest level
+// covering 2^minShift bases. biogo/hts/csi is not used as it only writes the pseudo-bin of a depth of
+// 5 and the offset in each bin of its first read rather than that of the first read overlapping it.
+func writeCSI(t *testing.T, path string, minShift, depth uint) {
+	fh, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+	br, err := bam.NewReader(fh, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	type ref struct {
+		bins             map[uint32][][2]uint64
+		linear           []uint64
+		first, last      uint64
+		mapped, unmapped uint64
+	}
+	refs := make([]*ref, len(br.Header().Refs()))
+	for {
+		rec, err := br.Read()
+		if err != nil {
+			break
+		}
+		if rec.Ref == nil {
+			continue
+		}
+		r := refs[rec.Ref.ID()]
+		c := br.LastChunk()
+		beg, end := vOffset(c.Begin), vOffset(c.End)
+		if r == nil {
+			r = &ref{bins: make(map[uint32][][2]uint64), first: beg}
+			refs[rec.Ref.ID()] = r
+		}
+		r.last = end
+		if rec.Flags&sam.Unmapped != 0 {
+			r.unmapped++
+		} else {
+			r.mapped++
+		}
+		s, e := rec.Start(), rec.End()
+		if e <= s {
+			e = s + 1
+		}
+		bin := uint32(0)
+		for l, sh := depth, minShift; l > 0; l, sh = l-1, sh+3 {
+			if s>>sh == (e-1)>>sh {
+				bin = firstBin(l) + uint32(s>>sh)
+				break
+			}
+		}
+		if cs := r.bins[bin]; len(cs) > 0 && cs[len(cs)-1][1] == beg {
+			cs[len(cs)-1][1] = end
+		} else {
+			r.bins[bin] = append(cs, [2]uint64{beg, end})
+		}
+		for w := s >> minShift; w <= (e-1)>>minShift; w++ {
+			for len(r.linear) <= w {
+				r.linear = append(r.linear, 0)
+			}
+			if r.linear[w] == 0 {
+				r.linear[w] = beg
+			}
+		}
+	}
+	out, err := os.Create(path + ".csi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bg := bgzf.NewWriter(out, 1)
+	put := func(vs ...interface{}) {
+		for _, v := range vs {
+			binary.Write(bg, binary.LittleEndian, v)
+		}
+	}
+	put([4]byte{'C', 'S', 'I', 1}, int32(minShift), int32(depth), int32(0), int32(len(refs)))
+	for _, r := range refs {
+		if r == nil {
+			put(int32(0))
+			continue
+		}
+		put(int32(len(r.bins) + 1))
+		for bin, cs := range r.bins {
+			// the offset of the first read overlapping the start of the bin.
+			l := depth
+			for ; bin < firstBin(l); l-- {
+			}
+			w := int(bin-firstBin(l)) << (3 * (depth - l))
+			var loff uint64
+			for ; w >= 0; w-- {
+				if w < len(r.linear) && r.linear[w] != 0 {
+					loff = r.linear[w]
+					break
+				}
+			}
+			put(bin, loff, int32(len(cs)), cs)
+		}
+		put(firstBin(depth+1)+1, uint64(0), int32(2), [4]uint64{r.first, r.last, r.mapped, r.unmapped})
+	}
+	bg.Close()
+	out.Close()
+}
+
+func count(t *testing.T, path string, idx *Index, ref *sam.Reference, beg, end int) int {
+	br, err := Open(path, "", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer br.Close()
+	chunks, err := idx.Chunks(ref, beg, end)
+	if err != nil {
+		t.Fatal(err)
+	}
+	it, err := bam.NewIterator(br.Reader, chunks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.Close()
+	n := 0
+	for it.Next() {
+		if r := it.Record(); r.Ref.ID() == ref.ID() && r.Pos < end && r.End() > beg {
+			n++
+		}
+	}
+	return n
+}
+
+func TestReadIndexCSI(t *testing.T) {
+	bai, err := ReadIndex("../depth/test/t.bam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	abs, err := filepath.Abs("../depth/test/t.bam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "t.bam")
+	if err := os.Symlink(abs, path); err != nil {
+		t.Fatal(err)
+	}
+	// a depth of 6 has a different pseudo-bin than a .bai.
+	writeCSI(t, path, 12, 6)
+	if ipath, err := IndexPath(path); err != nil || ipath != path+".csi" {
+		t.Fatalf("expected the .csi to be found, got: %s %v", ipath, err)
+	}
+	idx, err := ReadIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if idx.csi == nil || idx.NumRefs() != bai.NumRefs() {
+		t.Fatalf("expected a .csi with %d references", bai.NumRefs())
+	}
+	h, err := Header(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ref := range h.Refs() {
+		n, ok := idx.Mapped(ref.ID())
+		if en, eok := bai.Mapped(ref.ID()); n != en || ok != eok {
+			t.Errorf("%s: expected %d mapped reads from the .csi, got: %d", ref.Name(), en, n)
+		}
+		if !ok {
+			continue
+		}
+		for _, r := range [][2]int{{0, 100}, {1000, 3000}, {0, ref.Len()}} {
+			if c, e := count(t, path, idx, ref, r[0], r[1]), count(t, path, bai, ref, r[0], r[1]); c != e {
+				t.Errorf("%s:%d-%d: expected %d reads with the .csi, got: %d", ref.Name(), r[0], r[1], e, c)
+			}
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package bamio
+
+import (
+	"sort"
+
+	"github.com/biogo/hts/sam"
+)
+
+var nmTag = sam.Tag([2]byte{'N', 'M'})
+
+// Identity returns the alignment columns (matches, mismatches, insertions and deletions) of rec and
+// the edit distance from its NM tag so that the identity is 1 - edits/columns. ok is false if rec has
+// no NM tag.
+func Identity(rec *sam.Record) (columns, edits int, ok bool) {
+	aux := rec.AuxFields.Get(nmTag)
+	if aux == nil {
+		return 0, 0, false
+	}
+	switch v := aux.Value().(type) {
+	case uint8:
+		edits = int(v)
+	case int8:
+		edits = int(v)
+	case uint16:
+		edits = int(v)
+	case int16:
+		edits = int(v)
+	case uint32:
+		edits = int(v)
+	case int32:
+		edits = int(v)
+	default:
+		return 0, 0, false
+	}
+	for _, co := range rec.Cigar {
+		switch co.Type() {
+		case sam.CigarMatch, sam.CigarEqual, sam.CigarMismatch, sam.CigarInsertion, sam.CigarDeletion:
+			columns += co.Len()
+		}
+	}
+	return columns, edits, true
+}
+
+// ReadLength is the length of the read in rec including soft and hard clips. For a supplementary
+// alignment, the hard clips are the parts of the read that are aligned elsewhere.
+func ReadLength(rec *sam.Record) int {
+	n := 0
+	for _, co := range rec.Cigar {
+		if t := co.Type(); t == sam.CigarHardClipped || t.Consumes().Query == 1 {
+			n += co.Len()
+		}
+	}
+	return n
+}
+
+// N50 returns the length such that lengths at least this long hold half of the total.
+func N50(lengths []int) int {
+	s := append([]int{}, lengths...)
+	sort.Ints(s)
+	total := 0
+	for _, v := range s {
+		total += v
+	}
+	sum := 0
+	for i := len(s) - 1; i >= 0; i-- {
+		if sum += s[i]; 2*sum >= total {
+			return s[i]
+		}
+	}
+	return 0
+}
@@ -0,0 +1,43 @@
+package bamio
+
+import (
+	"testing"
+
+	"github.com/biogo/hts/sam"
+)
+
+func TestIdentity(t *testing.T) {
+	nm, err := sam.NewAux(sam.NewTag("NM"), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cigar := sam.Cigar{sam.NewCigarOp(sam.CigarHardClipped, 500), sam.NewCigarOp(sam.CigarSoftClipped, 100),
+		sam.NewCigarOp(sam.CigarMatch, 890), sam.NewCigarOp(sam.CigarInsertion, 5), sam.NewCigarOp(sam.CigarDeletion, 5),
+		sam.NewCigarOp(sam.CigarMatch, 100)}
+	rec := &sam.Record{Cigar: cigar, AuxFields: sam.AuxFields{nm}}
+	if c, e, ok := Identity(rec); !ok || c != 1000 || e != 10 {
+		t.Errorf("expected 1000 columns and 10 edits, got: %d %d %v", c, e, ok)
+	}
+	if l := ReadLength(rec); l != 1595 {
+		t.Errorf("expected read length of 1595, got: %d", l)
+	}
+	rec.AuxFields = nil
+	if _, _, ok := Identity(rec); ok {
+		t.Error("expected no identity without an NM tag")
+	}
+}
+
+func TestN50(t *testing.T) {
+	if n := N50([]int{2, 2, 2, 3, 3, 4, 8, 8}); n != 8 {
+		t.Errorf("expected N50 of 8, got: %d", n)
+	}
+	if n := N50([]int{10, 1, 1, 1, 7}); n != 10 {
+		t.Errorf("expected N50 of 10, got: %d", n)
+	}
+	if n := N50([]int{5, 4, 3, 2, 1}); n != 4 {
+		t.Errorf("expected N50 of 4, got: %d", n)
+	}
+	if n := N50(nil); n != 0 {
+		t.Errorf("expected N50 of 0 for no lengths, got: %d", n)
+	}
+}
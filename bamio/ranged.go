@@ -0,0 +1,201 @@
+package bamio
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// rangeBlock is the size of each range request to a remote bam.
+	rangeBlock = 1 << 20
+	// rangeCache is the number of blocks that are kept so that reads near an earlier one, as for
+	// the reads of nearby regions, do not request the block again.
+	rangeCache = 32
+)
+
+// rangeFile is an io.ReadSeeker and io.ReaderAt over a URL that is read with HTTP range requests
+// for blocks of rangeBlock bytes. The most recently used blocks are cached so the many small reads
+// of a bgzf reader become a few requests and a seek with the index reads only the blocks it needs.
+type rangeFile struct {
+	url     string
+	size    int64
+	modTime time.Time
+
+	mu     sync.Mutex
+	off    int64
+	lru    *list.List
+	blocks map[int64]*list.Element
+}
+
+type rangeBlockData struct {
+	i    int64
+	data []byte
+}
+
+// openRange returns a rangeFile for the URL after a HEAD request for its size.
+func openRange(url string) (*rangeFile, error) {
+	resp, err := HTTPClient.Head(url)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bamio: error opening %s: %s", url, resp.Status)
+	}
+	if resp.ContentLength < 0 {
+		return nil, fmt.Errorf("bamio: no size for %s", url)
+	}
+	// the modification time is zero if the server does not send it.
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return &rangeFile{url: url, size: resp.ContentLength, modTime: modTime, lru: list.New(), blocks: make(map[int64]*list.Element)}, nil
+}
+
+// Size returns the size of the file.
+func (f *rangeFile) Size() int64 { return f.size }
+
+// ModTime returns the Last-Modified time of the file or the zero time if it is not known.
+func (f *rangeFile) ModTime() time.Time { return f.modTime }
+
+// File is a local file or a URL that can be read at any offset, as to check the end of a bam
+// without reading all of it.
+type File interface {
+	io.ReadSeeker
+	io.ReaderAt
+	io.Closer
+	Size() int64
+	// ModTime is the zero time if it is not known.
+	ModTime() time.Time
+}
+
+type localFile struct {
+	*os.File
+	st os.FileInfo
+}
+
+func (f localFile) Size() int64        { return f.st.Size() }
+func (f localFile) ModTime() time.Time { return f.st.ModTime() }
+
+// OpenFile opens the local file or the URL at path. URLs are read with range requests.
+func OpenFile(path string) (File, error) {
+	if IsRemote(path) {
+		return openRange(remoteURL(path))
+	}
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	st, err := fh.Stat()
+	if err != nil {
+		fh.Close()
+		return nil, err
+	}
+	return localFile{File: fh, st: st}, nil
+}
+
+// block returns block i from the cache or with a range request.
+func (f *rangeFile) block(i int64) ([]byte, error) {
+	if e, ok := f.blocks[i]; ok {
+		f.lru.MoveToFront(e)
+		return e.Value.(*rangeBlockData).data, nil
+	}
+	start := i * rangeBlock
+	end := min(f.size, start+rangeBlock) - 1
+	req, err := http.NewRequest("GET", f.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+	resp, err := HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		return nil, fmt.Errorf("bamio: range request for %s failed: %s", f.url, resp.Status)
+	}
+	data := make([]byte, end-start+1)
+	if _, err := io.ReadFull(resp.Body, data); err != nil {
+		return nil, fmt.Errorf("bamio: error reading %s: %s", f.url, err)
+	}
+	f.blocks[i] = f.lru.PushFront(&rangeBlockData{i: i, data: data})
+	if f.lru.Len() > rangeCache {
+		last := f.lru.Back()
+		f.lru.Remove(last)
+		delete(f.blocks, last.Value.(*rangeBlockData).i)
+	}
+	return data, nil
+}
+
+// ReadAt implements io.ReaderAt.
+func (f *rangeFile) ReadAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.readAt(p, off)
+}
+
+func (f *rangeFile) readAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("bamio: negative offset")
+	}
+	n := 0
+	for n < len(p) && off < f.size {
+		data, err := f.block(off / rangeBlock)
+		if err != nil {
+			return n, err
+		}
+		c := copy(p[n:], data[off%rangeBlock:])
+		n += c
+		off += int64(c)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Read implements io.Reader.
+func (f *rangeFile) Read(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.off >= f.size {
+		return 0, io.EOF
+	}
+	n, err := f.readAt(p, f.off)
+	f.off += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// Seek implements io.Seeker.
+func (f *rangeFile) Seek(offset int64, whence int) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.off
+	case io.SeekEnd:
+		offset += f.size
+	}
+	if offset < 0 {
+		return 0, errors.New("bamio: negative offset")
+	}
+	f.off = offset
+	return offset, nil
+}
+
+// Close drops the cached blocks.
+func (f *rangeFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.lru.Init()
+	f.blocks = make(map[int64]*list.Element)
+	return nil
+}
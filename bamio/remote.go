@@ -0,0 +1,69 @@
+package bamio
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// HTTPClient is used for the requests to remote files and htsget servers. It may be replaced, e.g.
+// to add credentials.
+var HTTPClient = http.DefaultClient
+
+// IsRemote returns true if the path is an http(s), s3 or gs URL.
+func IsRemote(path string) bool {
+	for _, p := range []string{"http://", "https://", "s3://", "gs://"} {
+		if strings.HasPrefix(path, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteURL converts s3:// and gs:// URLs to the https URLs of the public endpoints.
+// Only objects that can be read without credentials are supported.
+func remoteURL(path string) string {
+	if strings.HasPrefix(path, "s3://") {
+		bk := strings.SplitN(path[len("s3://"):], "/", 2)
+		if len(bk) == 2 {
+			return fmt.Sprintf("https://%s.s3.amazonaws.com/%s", bk[0], bk[1])
+		}
+	}
+	if strings.HasPrefix(path, "gs://") {
+		return "https://storage.googleapis.com/" + path[len("gs://"):]
+	}
+	return path
+}
+
+// openRemote returns the body of a GET request to the URL for path.
+func openRemote(path string) (io.ReadCloser, error) {
+	resp, err := HTTPClient.Get(remoteURL(path))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("bamio: error opening %s: %s", path, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// remoteExists returns true if a HEAD request to the URL for path succeeds.
+func remoteExists(path string) bool {
+	resp, err := HTTPClient.Head(remoteURL(path))
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK
+}
+
+// OpenIndex opens the index at ipath which may be a local file or a URL.
+func OpenIndex(ipath string) (io.ReadCloser, error) {
+	if IsRemote(ipath) {
+		return openRemote(ipath)
+	}
+	return os.Open(ipath)
+}
@@ -0,0 +1,198 @@
+package bamio
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestRemoteURL(t *testing.T) {
+	for in, exp := range map[string]string{
+		"s3://bucket/a/b.bam":     "https://bucket.s3.amazonaws.com/a/b.bam",
+		"gs://bucket/a/b.bam":     "https://storage.googleapis.com/bucket/a/b.bam",
+		"https://host/a/b.bam":    "https://host/a/b.bam",
+		"/data/a/b.bam":           "/data/a/b.bam",
+		"s3://bucket-without-key": "s3://bucket-without-key",
+	} {
+		if got := remoteURL(in); got != exp {
+			t.Errorf("%s: expected %s, got: %s", in, exp, got)
+		}
+	}
+}
+
+func TestRemote(t *testing.T) {
+	srv := httptest.NewServer(http.FileServer(http.Dir("../depth/test")))
+	defer srv.Close()
+
+	path := srv.URL + "/t.bam"
+	if !IsRemote(path) {
+		t.Fatalf("expected %s to be remote", path)
+	}
+	h, err := Header(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(h.Refs()) == 0 {
+		t.Errorf("expected references in header")
+	}
+	ipath, err := IndexPath(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ipath != path+".bai" {
+		t.Errorf("unexpected index path: %s", ipath)
+	}
+	idx, err := ReadIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if idx.NumRefs() != len(h.Refs()) {
+		t.Errorf("expected %d references in index, got: %d", len(h.Refs()), idx.NumRefs())
+	}
+	if _, err := IndexPath(srv.URL + "/missing.bam"); err == nil {
+		t.Errorf("expected error for missing index")
+	}
+
+	// the query of a signed URL is kept for the index.
+	query := "?X-Amz-Expires=60&X-Amz-Signature=abc"
+	if ipath, err := IndexPath(path + query); err != nil || ipath != path+".bai"+query {
+		t.Errorf("expected the index of the signed URL to keep the query, got: %s %v", ipath, err)
+	}
+	if idx, err := ReadIndex(path + query); err != nil || idx.NumRefs() != len(h.Refs()) {
+		t.Errorf("expected the index from the signed URL, got: %v", err)
+	}
+}
+
+func TestHtsgetURL(t *testing.T) {
+	for region, exp := range map[string]string{
+		"":                 "https://host/reads/s1?format=BAM",
+		"chr1":             "https://host/reads/s1?format=BAM&referenceName=chr1",
+		"chr1:1,001-2000":  "https://host/reads/s1?end=2000&format=BAM&referenceName=chr1&start=1000",
+		"HLA-A*01:01:1001": "https://host/reads/s1?format=BAM&referenceName=HLA-A%2A01%3A01&start=1000",
+	} {
+		got, err := htsgetURL("htsget://host/reads/s1", region, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != exp {
+			t.Errorf("%q: expected %s, got: %s", region, exp, got)
+		}
+	}
+	if _, err := htsgetURL("htsget://host/reads/s1", "chr1:0-10", ""); err == nil {
+		t.Errorf("expected an error for a 0 start")
+	}
+}
+
+func TestHtsget(t *testing.T) {
+	files := http.FileServer(http.Dir("../depth/test"))
+	var srv *httptest.Server
+	srv = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/reads/t" {
+			files.ServeHTTP(w, r)
+			return
+		}
+		if r.URL.Query().Get("referenceName") == "chrX" {
+			http.Error(w, `{"htsget": {"error": "NotFound"}}`, http.StatusNotFound)
+			return
+		}
+		// the bam is sent in 2 blocks with ranges to check that they are joined in order.
+		fmt.Fprintf(w, `{"htsget": {"format": "BAM", "urls": [{"url": "%[1]s/t.bam", "headers": {"Range": "bytes=0-99999"}},
+			{"url": "%[1]s/t.bam", "headers": {"Range": "bytes=100000-"}}]}}`, srv.URL)
+	}))
+	defer srv.Close()
+	defer func(c *http.Client) { HTTPClient = c }(HTTPClient)
+	HTTPClient = srv.Client()
+
+	path := "htsget://" + strings.TrimPrefix(srv.URL, "https://") + "/reads/t"
+	h, err := Header(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(h.Refs()) == 0 {
+		t.Errorf("expected references in header")
+	}
+	count := func(path string) int {
+		br, err := Open(path, "", 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer br.Close()
+		n := 0
+		for {
+			_, err := br.Read()
+			if err == io.EOF {
+				return n
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			n++
+		}
+	}
+	exp := count("../depth/test/t.bam")
+	if n := count(path); n != exp {
+		t.Errorf("expected %d reads from htsget, got: %d", exp, n)
+	}
+	if _, err := OpenRegion(path, "", "chrX:1-100", 1); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("expected the server error, got: %v", err)
+	}
+}
+
+func TestRangeFile(t *testing.T) {
+	var requests int
+	files := http.FileServer(http.Dir("../depth/test"))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" && r.URL.Path == "/t.bam" {
+			requests++
+		}
+		files.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	path := srv.URL + "/t.bam"
+	h, err := Header("../depth/test/t.bam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx, err := ReadIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ref := range h.Refs() {
+		for _, r := range [][2]int{{0, ref.Len()}, {14000, 16000}} {
+			if local, remote := count(t, "../depth/test/t.bam", idx, ref, r[0], r[1]), count(t, path, idx, ref, r[0], r[1]); local != remote {
+				t.Errorf("%s:%d-%d: expected %d reads with range requests, got: %d", ref.Name(), r[0], r[1], local, remote)
+			}
+		}
+	}
+	// each count opens the bam with its own cache so each of the 4 blocks of the 3.9MB bam is
+	// requested at most once for each of the 4 queries.
+	if requests > 16 {
+		t.Errorf("expected few range requests, got: %d", requests)
+	}
+
+	f, err := openRange(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := os.ReadFile("../depth/test/t.bam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.size != int64(len(want)) {
+		t.Fatalf("expected size %d, got: %d", len(want), f.size)
+	}
+	// a read that spans 2 blocks and one at the end.
+	for _, off := range []int64{rangeBlock - 10, f.size - 5} {
+		p := make([]byte, 20)
+		n, err := f.ReadAt(p, off)
+		if exp := min(20, f.size-off); int64(n) != exp || !bytes.Equal(p[:n], want[off:off+exp]) {
+			t.Errorf("unexpected read at %d: %d %v", off, n, err)
+		}
+	}
+}
@@ -0,0 +1,308 @@
+// Package bedstats merges and summarizes BED files: the total and merged bases, the N50 of the
+// interval lengths, the bases covered on each chromosome and the overlap between 2 files.
+package bedstats
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	arg "github.com/alexflint/go-arg"
+	"github.com/brentp/goleft"
+	"github.com/brentp/xopen"
+)
+
+var cli = &struct {
+	Merge   bool     `arg:"--merge,help:write the merged intervals of all of the beds to stdout rather than the summary."`
+	Chroms  bool     `arg:"--chroms,help:write the intervals and merged bases on each chromosome of each bed rather than the summary."`
+	Overlap string   `arg:"--overlap,help:optional bed to compare to. the summary gets the bases in both and the fraction of each bed that they are and the Jaccard index."`
+	Fai     string   `arg:"--fai,help:optional .fai or genome file. only its contigs are used and they are output in its order. --chroms gets the fraction of each that is covered."`
+	Beds    []string `arg:"positional,required,help:bed file(s) to summarize. may be gzipped."`
+}{}
+
+func pcheck(e error) {
+	if e != nil {
+		log.Fatal(e)
+	}
+}
+
+type interval struct {
+	chrom      string
+	start, end int
+}
+
+// bed is the intervals of a bed file and the chromosomes in the order that they first appear.
+type bed struct {
+	intervals []interval
+	chroms    []string
+}
+
+// readBed reads the first 3 columns of each interval in the bed at path. Empty lines and header,
+// track and browser lines are skipped and lines may end with \r\n. If g is not nil, intervals on
+// other contigs are dropped and the chromosomes are those of g.
+func readBed(path string, g *goleft.Genome) (*bed, error) {
+	rdr, err := xopen.Ropen(path)
+	if err != nil {
+		return nil, err
+	}
+	defer rdr.Close()
+	b := &bed{}
+	seen := make(map[string]bool)
+	for n := 1; ; n++ {
+		line, err := rdr.ReadString('\n')
+		if line = strings.TrimRight(line, "\r\n"); len(strings.TrimSpace(line)) > 0 && !isHeader(line) {
+			toks := strings.Fields(line)
+			if len(toks) < 3 {
+				return nil, &goleft.ParseError{Path: path, Line: n, Err: fmt.Errorf("bedstats: expected at least 3 fields in bed line: %q", line)}
+			}
+			s, serr := strconv.Atoi(toks[1])
+			e, eerr := strconv.Atoi(toks[2])
+			if serr != nil || eerr != nil || s < 0 || e < s {
+				return nil, &goleft.ParseError{Path: path, Line: n, Err: fmt.Errorf("bedstats: bad interval in bed line: %q", line)}
+			}
+			if g.Has(toks[0]) {
+				if !seen[toks[0]] {
+					seen[toks[0]] = true
+					b.chroms = append(b.chroms, toks[0])
+				}
+				b.intervals = append(b.intervals, interval{toks[0], s, e})
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if g != nil {
+		b.chroms = b.chroms[:0]
+		for _, c := range g.Contigs {
+			b.chroms = append(b.chroms, c.Name)
+		}
+	}
+	return b, nil
+}
+
+// isHeader returns true for the comment, track and browser lines of a bed.
+func isHeader(line string) bool {
+	return strings.HasPrefix(line, "#") || strings.HasPrefix(line, "track") || strings.HasPrefix(line, "browser")
+}
+
+// merge returns the intervals sorted by the order of chroms and by start with those that overlap or
+// touch merged as with bedtools merge.
+func merge(ivs []interval, chroms []string) []interval {
+	order := make(map[string]int, len(chroms))
+	for i, c := range chroms {
+		order[c] = i
+	}
+	sorted := append([]interval{}, ivs...)
+	sort.Slice(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		if a.chrom != b.chrom {
+			return order[a.chrom] < order[b.chrom]
+		}
+		return a.start < b.start
+	})
+	merged := make([]interval, 0, len(sorted))
+	for _, iv := range sorted {
+		if n := len(merged); n > 0 && merged[n-1].chrom == iv.chrom && iv.start <= merged[n-1].end {
+			if iv.end > merged[n-1].end {
+				merged[n-1].end = iv.end
+			}
+			continue
+		}
+		merged = append(merged, iv)
+	}
+	return merged
+}
+
+// bases returns the sum of the lengths of ivs.
+func bases(ivs []interval) int {
+	n := 0
+	for _, iv := range ivs {
+		n += iv.end - iv.start
+	}
+	return n
+}
+
+// n50 returns the length such that intervals at least that long have half of the bases.
+func n50(ivs []interval) int {
+	lengths := make([]int, len(ivs))
+	total := 0
+	for i, iv := range ivs {
+		lengths[i] = iv.end - iv.start
+		total += lengths[i]
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(lengths)))
+	sum := 0
+	for _, l := range lengths {
+		if sum += l; 2*sum >= total {
+			return l
+		}
+	}
+	return 0
+}
+
+// intersect returns the bases in both a and b which must be merged with the same order of
+// chromosomes.
+func intersect(a, b []interval, chroms []string) int {
+	order := make(map[string]int, len(chroms))
+	for i, c := range chroms {
+		order[c] = i
+	}
+	n, j := 0, 0
+	for _, iv := range a {
+		// skip the intervals of b that end before iv.
+		for j < len(b) && (order[b[j].chrom] < order[iv.chrom] || (b[j].chrom == iv.chrom && b[j].end <= iv.start)) {
+			j++
+		}
+		for k := j; k < len(b) && b[k].chrom == iv.chrom && b[k].start < iv.end; k++ {
+			n += min(iv.end, b[k].end) - max(iv.start, b[k].start)
+		}
+	}
+	return n
+}
+
+// summaryHeader is the header of the summary. With --overlap, the overlap columns are added.
+const summaryHeader = "#bed\tintervals\tbases\tmerged_intervals\tmerged_bases\tmin\tmedian\tmax\tn50"
+const overlapHeader = "\toverlap_bases\tfraction\toverlap_fraction\tjaccard"
+
+// writeSummary writes the number of intervals and bases of b before and after merging and the
+// distribution of its interval lengths. If other is not nil, it adds the bases in both, the fraction
+// of the merged bases of b and of other that they are and the Jaccard index.
+func writeSummary(w io.Writer, path string, b *bed, other []interval) {
+	merged := merge(b.intervals, b.chroms)
+	lengths := make([]int, len(b.intervals))
+	for i, iv := range b.intervals {
+		lengths[i] = iv.end - iv.start
+	}
+	sort.Ints(lengths)
+	mb := bases(merged)
+	fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d", path, len(b.intervals), bases(b.intervals), len(merged), mb)
+	if n := len(lengths); n > 0 {
+		fmt.Fprintf(w, "\t%d\t%.1f\t%d\t%d", lengths[0], float64(lengths[(n-1)/2]+lengths[n/2])/2, lengths[n-1], n50(b.intervals))
+	} else {
+		fmt.Fprint(w, "\t0\t0\t0\t0")
+	}
+	if other != nil {
+		both, ob := intersect(merged, other, b.chroms), bases(other)
+		fmt.Fprintf(w, "\t%d\t%.4f\t%.4f\t%.4f", both, frac(both, mb), frac(both, ob), frac(both, mb+ob-both))
+	}
+	fmt.Fprintln(w)
+}
+
+func frac(a, b int) float64 {
+	if b == 0 {
+		return 0
+	}
+	return float64(a) / float64(b)
+}
+
+// writeChroms writes the intervals and merged bases on each chromosome of b and, if g is not nil,
+// the length of the chromosome and the fraction of it that is covered.
+func writeChroms(w io.Writer, path string, b *bed, g *goleft.Genome) {
+	counts := make(map[string]int)
+	for _, iv := range b.intervals {
+		counts[iv.chrom]++
+	}
+	covered := make(map[string]int)
+	for _, iv := range merge(b.intervals, b.chroms) {
+		covered[iv.chrom] += iv.end - iv.start
+	}
+	for _, c := range b.chroms {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d", path, c, counts[c], covered[c])
+		if g != nil {
+			l, _ := g.Len(c)
+			fmt.Fprintf(w, "\t%d\t%.4f", l, frac(covered[c], l))
+		}
+		fmt.Fprintln(w)
+	}
+}
+
+// Main is called from the goleft dispatcher.
+func Main() {
+	p := arg.MustParse(cli)
+	if cli.Merge && cli.Chroms {
+		p.Fail("bedstats: use only one of --merge and --chroms")
+	}
+	var g *goleft.Genome
+	var err error
+	if cli.Fai != "" {
+		g, err = goleft.ReadGenome(cli.Fai)
+		pcheck(err)
+	}
+	beds := make([]*bed, len(cli.Beds))
+	for i, path := range cli.Beds {
+		beds[i], err = readBed(path, g)
+		pcheck(err)
+	}
+
+	w := bufio.NewWriter(os.Stdout)
+	defer w.Flush()
+	switch {
+	case cli.Merge:
+		// the chromosomes are in the order that they first appear in any of the beds.
+		all := &bed{}
+		seen := make(map[string]bool)
+		for _, b := range beds {
+			all.intervals = append(all.intervals, b.intervals...)
+			for _, c := range b.chroms {
+				if !seen[c] {
+					seen[c] = true
+					all.chroms = append(all.chroms, c)
+				}
+			}
+		}
+		for _, iv := range merge(all.intervals, all.chroms) {
+			fmt.Fprintf(w, "%s\t%d\t%d\n", iv.chrom, iv.start, iv.end)
+		}
+	case cli.Chroms:
+		h := "#bed\tchrom\tintervals\tmerged_bases"
+		if g != nil {
+			h += "\tlength\tfraction"
+		}
+		fmt.Fprintln(w, h)
+		for i, b := range beds {
+			writeChroms(w, cli.Beds[i], b, g)
+		}
+	default:
+		h := summaryHeader
+		var other *bed
+		if cli.Overlap != "" {
+			other, err = readBed(cli.Overlap, g)
+			pcheck(err)
+			h += overlapHeader
+		}
+		fmt.Fprintln(w, h)
+		for i, b := range beds {
+			var merged []interval
+			if other != nil {
+				// both are merged in the same order of chromosomes so that they can be compared.
+				b.chroms = union(b.chroms, other.chroms)
+				merged = merge(other.intervals, b.chroms)
+			}
+			writeSummary(w, cli.Beds[i], b, merged)
+		}
+	}
+}
+
+// union returns the chromosomes in a followed by those only in b.
+func union(a, b []string) []string {
+	seen := make(map[string]bool, len(a))
+	u := append([]string{}, a...)
+	for _, c := range a {
+		seen[c] = true
+	}
+	for _, c := range b {
+		if !seen[c] {
+			u = append(u, c)
+		}
+	}
+	return u
+}
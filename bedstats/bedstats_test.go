@@ -0,0 +1,77 @@
+package bedstats
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestReadBed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "a.bed")
+	data := "browser position chr1:1-100\ntrack name=a\n#chrom\tstart\tend\n" +
+		"chr2\t10\t20\tx\r\n\nchr1\t5\t15\nchr2\t15\t30"
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	b, err := readBed(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := []interval{{"chr2", 10, 20}, {"chr1", 5, 15}, {"chr2", 15, 30}}
+	if !reflect.DeepEqual(b.intervals, exp) || !reflect.DeepEqual(b.chroms, []string{"chr2", "chr1"}) {
+		t.Errorf("unexpected bed: %+v", b)
+	}
+
+	if err := os.WriteFile(path, []byte("chr1\t20\t10\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readBed(path, nil); err == nil {
+		t.Errorf("expected an error for an end before the start")
+	}
+}
+
+func TestMerge(t *testing.T) {
+	ivs := []interval{{"chr2", 10, 20}, {"chr1", 5, 15}, {"chr2", 15, 30}, {"chr2", 30, 40}, {"chr2", 50, 60}}
+	exp := []interval{{"chr2", 10, 40}, {"chr2", 50, 60}, {"chr1", 5, 15}}
+	got := merge(ivs, []string{"chr2", "chr1"})
+	if !reflect.DeepEqual(got, exp) {
+		t.Errorf("expected %v, got: %v", exp, got)
+	}
+	if b := bases(got); b != 50 {
+		t.Errorf("expected 50 merged bases, got %d", b)
+	}
+}
+
+func TestN50(t *testing.T) {
+	ivs := []interval{{"1", 0, 10}, {"1", 0, 20}, {"1", 0, 30}, {"1", 0, 40}}
+	// 40 + 30 is at least half of 100.
+	if n := n50(ivs); n != 30 {
+		t.Errorf("expected 30, got %d", n)
+	}
+	if n := n50(nil); n != 0 {
+		t.Errorf("expected 0 without intervals, got %d", n)
+	}
+}
+
+func TestIntersect(t *testing.T) {
+	chroms := []string{"chr1", "chr2"}
+	a := []interval{{"chr1", 0, 100}, {"chr1", 200, 300}, {"chr2", 0, 50}}
+	b := []interval{{"chr1", 50, 250}, {"chr2", 40, 100}}
+	if n := intersect(a, b, chroms); n != 50+50+10 {
+		t.Errorf("expected 110, got %d", n)
+	}
+	if n := intersect(b, a, chroms); n != 110 {
+		t.Errorf("expected the same bases in both directions, got %d", n)
+	}
+}
+
+func TestWriteSummary(t *testing.T) {
+	b := &bed{intervals: []interval{{"chr1", 0, 100}, {"chr1", 50, 150}, {"chr1", 300, 310}}, chroms: []string{"chr1"}}
+	var buf bytes.Buffer
+	writeSummary(&buf, "a.bed", b, []interval{{"chr1", 100, 400}})
+	if exp := "a.bed\t3\t210\t2\t160\t10\t100.0\t100\t100\t60\t0.3750\t0.2000\t0.1500\n"; buf.String() != exp {
+		t.Errorf("expected %q, got: %q", exp, buf.String())
+	}
+}
@@ -0,0 +1,460 @@
+// Package bigwig writes bigWig files of intervals with a value (bedGraph) so that goleft output
+// can be loaded directly into IGV or the UCSC browser without bedGraphToBigWig. It also reads
+// bigWig files, such as mappability tracks, that are used as input.
+// Data and zoom blocks are zlib compressed and indexed with an R-tree as described in
+// Kent et al. 2010 (doi:10.1093/bioinformatics/btq351).
+package bigwig
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+)
+
+const (
+	bigWigMagic  = 0x888FFC26
+	bptMagic     = 0x78CA8C91
+	cirTreeMagic = 0x2468ACE0
+	version      = 4
+
+	headerSize  = 64
+	zoomHdrSize = 24
+	summarySize = 40
+
+	// itemsPerSlot is the number of items in each compressed block.
+	itemsPerSlot = 1024
+	// blockSize is the number of children of each R-tree node.
+	blockSize = 256
+	// maxZooms is the most zoom levels that will be written. each is 4 times coarser than the last.
+	maxZooms = 10
+	// firstZoom is the number of bases summarized by each record in the first zoom level.
+	firstZoom = 4096
+
+	bedGraphType = 1
+)
+
+// Chrom is a chromosome name and length. Data must be added in the order of the chroms sent to
+// NewWriter.
+type Chrom struct {
+	Name string
+	Len  int
+}
+
+// summary is the data for a zoom record and for the total summary.
+type summary struct {
+	chrom, start, end uint32
+	valid             uint64
+	min, max          float64
+	sum, sumSquares   float64
+}
+
+func (s *summary) add(v float64, n uint64) {
+	if s.valid == 0 || v < s.min {
+		s.min = v
+	}
+	if s.valid == 0 || v > s.max {
+		s.max = v
+	}
+	s.valid += n
+	s.sum += v * float64(n)
+	s.sumSquares += v * v * float64(n)
+}
+
+// indexItem is a leaf in an R-tree: the genomic extent of a block and its location in the file.
+type indexItem struct {
+	startChrom, startBase, endChrom, endBase uint32
+	offset, size                             uint64
+}
+
+type zoomLevel struct {
+	reduction uint32
+	records   []summary
+	cur       summary
+}
+
+// Writer writes a bigWig file. Intervals must be sorted and must not overlap.
+type Writer struct {
+	w      io.WriteSeeker
+	chroms []Chrom
+	ids    map[string]uint32
+
+	// pending items in the current block.
+	block      []byte
+	blockItems int
+	blockChrom uint32
+	blockStart uint32
+	blockEnd   uint32
+
+	index     []indexItem
+	nBlocks   uint64
+	nItems    int
+	offset    uint64
+	maxBuf    int
+	total     summary
+	zooms     []*zoomLevel
+	lastChrom int
+	lastEnd   uint32
+	dataStart uint64
+}
+
+// NewWriter writes the header and chromosome tree for a bigWig with the given chromosomes to w.
+func NewWriter(w io.WriteSeeker, chroms []Chrom) (*Writer, error) {
+	if len(chroms) == 0 {
+		return nil, fmt.Errorf("bigwig: no chromosomes")
+	}
+	bw := &Writer{w: w, chroms: chroms, ids: make(map[string]uint32, len(chroms)), lastChrom: -1}
+	maxLen := 0
+	for i, c := range chroms {
+		if _, ok := bw.ids[c.Name]; ok {
+			return nil, fmt.Errorf("bigwig: duplicate chromosome: %s", c.Name)
+		}
+		bw.ids[c.Name] = uint32(i)
+		if c.Len > maxLen {
+			maxLen = c.Len
+		}
+	}
+	for r := firstZoom; len(bw.zooms) < maxZooms && r < maxLen; r *= 4 {
+		bw.zooms = append(bw.zooms, &zoomLevel{reduction: uint32(r)})
+	}
+
+	// the header, zoom headers and summary are rewritten in Close once they are known.
+	reserved := headerSize + zoomHdrSize*len(bw.zooms) + summarySize
+	if _, err := w.Write(make([]byte, reserved)); err != nil {
+		return nil, err
+	}
+	bw.offset = uint64(reserved)
+	if err := bw.writeChromTree(); err != nil {
+		return nil, err
+	}
+	bw.dataStart = bw.offset
+	// the count of blocks is also rewritten in Close.
+	if err := bw.write(make([]byte, 8)); err != nil {
+		return nil, err
+	}
+	return bw, nil
+}
+
+func (bw *Writer) write(b []byte) error {
+	n, err := bw.w.Write(b)
+	bw.offset += uint64(n)
+	return err
+}
+
+// writeChromTree writes a B+ tree with all chromosomes in a single leaf.
+func (bw *Writer) writeChromTree() error {
+	keySize := 1
+	for _, c := range bw.chroms {
+		if len(c.Name) > keySize {
+			keySize = len(c.Name)
+		}
+	}
+	names := make([]string, len(bw.chroms))
+	for i, c := range bw.chroms {
+		names[i] = c.Name
+	}
+	// keys must be sorted for the tree to be searched.
+	sort.Strings(names)
+
+	var b bytes.Buffer
+	le := binary.LittleEndian
+	binary.Write(&b, le, []uint32{bptMagic, uint32(len(names)), uint32(keySize), 8})
+	binary.Write(&b, le, []uint64{uint64(len(names)), 0})
+	// leaf node header.
+	binary.Write(&b, le, []uint8{1, 0})
+	binary.Write(&b, le, uint16(len(names)))
+	for _, name := range names {
+		key := make([]byte, keySize)
+		copy(key, name)
+		b.Write(key)
+		id := bw.ids[name]
+		binary.Write(&b, le, []uint32{id, uint32(bw.chroms[id].Len)})
+	}
+	return bw.write(b.Bytes())
+}
+
+// Add adds an interval with the given value. start is 0-based and end is exclusive.
+func (bw *Writer) Add(chrom string, start, end int, value float32) error {
+	id, ok := bw.ids[chrom]
+	if !ok {
+		return fmt.Errorf("bigwig: unknown chromosome: %s", chrom)
+	}
+	if end <= start || end > bw.chroms[id].Len {
+		return fmt.Errorf("bigwig: bad interval: %s:%d-%d", chrom, start, end)
+	}
+	if int(id) < bw.lastChrom || (int(id) == bw.lastChrom && uint32(start) < bw.lastEnd) {
+		return fmt.Errorf("bigwig: intervals must be sorted and not overlap: %s:%d-%d", chrom, start, end)
+	}
+	if bw.blockItems > 0 && (bw.blockItems == itemsPerSlot || id != bw.blockChrom) {
+		if err := bw.flushBlock(); err != nil {
+			return err
+		}
+	}
+	if bw.blockItems == 0 {
+		bw.blockChrom, bw.blockStart = id, uint32(start)
+	}
+	bw.blockEnd = uint32(end)
+	bw.lastChrom, bw.lastEnd = int(id), uint32(end)
+	var item [12]byte
+	binary.LittleEndian.PutUint32(item[0:], uint32(start))
+	binary.LittleEndian.PutUint32(item[4:], uint32(end))
+	binary.LittleEndian.PutUint32(item[8:], math.Float32bits(value))
+	bw.block = append(bw.block, item[:]...)
+	bw.blockItems++
+
+	bw.nItems++
+	bw.total.add(float64(value), uint64(end-start))
+	for _, z := range bw.zooms {
+		z.add(id, uint32(start), uint32(end), float64(value), uint32(bw.chroms[id].Len))
+	}
+	return nil
+}
+
+// add splits the interval across the zoom bins that it overlaps.
+func (z *zoomLevel) add(chrom, start, end uint32, v float64, chromLen uint32) {
+	for start < end {
+		if z.cur.valid == 0 || z.cur.chrom != chrom || start >= z.cur.end {
+			if z.cur.valid > 0 {
+				z.records = append(z.records, z.cur)
+			}
+			bin := start / z.reduction * z.reduction
+			binEnd := bin + z.reduction
+			if binEnd > chromLen {
+				binEnd = chromLen
+			}
+			z.cur = summary{chrom: chrom, start: bin, end: binEnd}
+		}
+		e := end
+		if e > z.cur.end {
+			e = z.cur.end
+		}
+		z.cur.add(v, uint64(e-start))
+		start = e
+	}
+}
+
+func compress(b []byte) ([]byte, error) {
+	var out bytes.Buffer
+	zw := zlib.NewWriter(&out)
+	if _, err := zw.Write(b); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// writeBlock compresses and writes the data and returns the index item for it.
+func (bw *Writer) writeBlock(data []byte, chrom, start, end uint32) (indexItem, error) {
+	if len(data) > bw.maxBuf {
+		bw.maxBuf = len(data)
+	}
+	c, err := compress(data)
+	if err != nil {
+		return indexItem{}, err
+	}
+	item := indexItem{startChrom: chrom, startBase: start, endChrom: chrom, endBase: end, offset: bw.offset, size: uint64(len(c))}
+	return item, bw.write(c)
+}
+
+func (bw *Writer) flushBlock() error {
+	var hdr bytes.Buffer
+	le := binary.LittleEndian
+	binary.Write(&hdr, le, []uint32{bw.blockChrom, bw.blockStart, bw.blockEnd, 0, 0})
+	binary.Write(&hdr, le, []uint8{bedGraphType, 0})
+	binary.Write(&hdr, le, uint16(bw.blockItems))
+	item, err := bw.writeBlock(append(hdr.Bytes(), bw.block...), bw.blockChrom, bw.blockStart, bw.blockEnd)
+	if err != nil {
+		return err
+	}
+	bw.index = append(bw.index, item)
+	bw.nBlocks++
+	bw.block = bw.block[:0]
+	bw.blockItems = 0
+	return nil
+}
+
+// writeIndex writes an R-tree over the items. Each level is written in full before the next so
+// the offset of every child is known when its parent is written.
+func (bw *Writer) writeIndex(items []indexItem) error {
+	le := binary.LittleEndian
+	var hdr bytes.Buffer
+	binary.Write(&hdr, le, []uint32{cirTreeMagic, blockSize})
+	binary.Write(&hdr, le, uint64(len(items)))
+	var first, last indexItem
+	if len(items) > 0 {
+		first, last = items[0], items[len(items)-1]
+	}
+	binary.Write(&hdr, le, []uint32{first.startChrom, first.startBase, last.endChrom, last.endBase})
+	binary.Write(&hdr, le, bw.offset)
+	binary.Write(&hdr, le, []uint32{itemsPerSlot, 0})
+	if err := bw.write(hdr.Bytes()); err != nil {
+		return err
+	}
+
+	// levels[0] are the leaf items. each higher level has 1 item per node of the level below.
+	levels := [][]indexItem{items}
+	for len(levels[len(levels)-1]) > blockSize {
+		below := levels[len(levels)-1]
+		var level []indexItem
+		for i := 0; i < len(below); i += blockSize {
+			node := below[i:min(i+blockSize, len(below))]
+			level = append(level, indexItem{startChrom: node[0].startChrom, startBase: node[0].startBase,
+				endChrom: node[len(node)-1].endChrom, endBase: node[len(node)-1].endBase})
+		}
+		levels = append(levels, level)
+	}
+
+	// nodeSize is the size on disk of a node at level l with n items.
+	nodeSize := func(l, n int) uint64 {
+		if l == 0 {
+			return uint64(4 + 32*n)
+		}
+		return uint64(4 + 24*n)
+	}
+	if len(items) == 0 {
+		// an empty leaf as the root.
+		return bw.write([]byte{1, 0, 0, 0})
+	}
+	offset := bw.offset
+	for l := len(levels) - 1; l >= 0; l-- {
+		level := levels[l]
+		// children start after all of the nodes in this level.
+		childOffset := offset
+		for i := 0; i < len(level); i += blockSize {
+			childOffset += nodeSize(l, min(blockSize, len(level)-i))
+		}
+		var b bytes.Buffer
+		for i := 0; i < len(level); i += blockSize {
+			node := level[i:min(i+blockSize, len(level))]
+			isLeaf := uint8(0)
+			if l == 0 {
+				isLeaf = 1
+			}
+			binary.Write(&b, le, []uint8{isLeaf, 0})
+			binary.Write(&b, le, uint16(len(node)))
+			for j, it := range node {
+				binary.Write(&b, le, []uint32{it.startChrom, it.startBase, it.endChrom, it.endBase})
+				if l == 0 {
+					binary.Write(&b, le, []uint64{it.offset, it.size})
+					continue
+				}
+				binary.Write(&b, le, childOffset)
+				// the child is the node of the level below made from items[k*blockSize:]
+				k := i + j
+				below := levels[l-1]
+				childOffset += nodeSize(l-1, min(blockSize, len(below)-k*blockSize))
+			}
+		}
+		if err := bw.write(b.Bytes()); err != nil {
+			return err
+		}
+		offset = bw.offset
+	}
+	return nil
+}
+
+// writeZoom writes the records and index for a zoom level and returns their offsets.
+func (bw *Writer) writeZoom(z *zoomLevel) (dataOffset, indexOffset uint64, err error) {
+	dataOffset = bw.offset
+	var n [4]byte
+	binary.LittleEndian.PutUint32(n[:], uint32(len(z.records)))
+	if err := bw.write(n[:]); err != nil {
+		return 0, 0, err
+	}
+	var items []indexItem
+	for i := 0; i < len(z.records); {
+		// a block has at most itemsPerSlot records from a single chromosome.
+		j := i + 1
+		for j < len(z.records) && j-i < itemsPerSlot && z.records[j].chrom == z.records[i].chrom {
+			j++
+		}
+		var b bytes.Buffer
+		le := binary.LittleEndian
+		for _, r := range z.records[i:j] {
+			binary.Write(&b, le, []uint32{r.chrom, r.start, r.end, uint32(r.valid)})
+			binary.Write(&b, le, []float32{float32(r.min), float32(r.max), float32(r.sum), float32(r.sumSquares)})
+		}
+		item, err := bw.writeBlock(b.Bytes(), z.records[i].chrom, z.records[i].start, z.records[j-1].end)
+		if err != nil {
+			return 0, 0, err
+		}
+		items = append(items, item)
+		i = j
+	}
+	indexOffset = bw.offset
+	return dataOffset, indexOffset, bw.writeIndex(items)
+}
+
+// Close writes the index and zoom levels and then fills in the header. It does not close the
+// underlying writer.
+func (bw *Writer) Close() error {
+	if bw.blockItems > 0 {
+		if err := bw.flushBlock(); err != nil {
+			return err
+		}
+	}
+	indexOffset := bw.offset
+	if err := bw.writeIndex(bw.index); err != nil {
+		return err
+	}
+	// zoom levels that do not reduce the data are not useful.
+	offsets := make([][2]uint64, 0, len(bw.zooms))
+	var zooms []*zoomLevel
+	for _, z := range bw.zooms {
+		if z.cur.valid > 0 {
+			z.records = append(z.records, z.cur)
+			z.cur = summary{}
+		}
+		if len(z.records) == 0 || len(z.records) >= bw.nItems {
+			z.records = nil
+			continue
+		}
+		d, i, err := bw.writeZoom(z)
+		if err != nil {
+			return err
+		}
+		offsets = append(offsets, [2]uint64{d, i})
+		zooms = append(zooms, z)
+		// free the records now that they are written.
+		z.records = nil
+	}
+
+	le := binary.LittleEndian
+	var b bytes.Buffer
+	binary.Write(&b, le, uint32(bigWigMagic))
+	binary.Write(&b, le, []uint16{version, uint16(len(zooms))})
+	binary.Write(&b, le, []uint64{headerSize + zoomHdrSize*uint64(len(bw.zooms)) + summarySize, bw.dataStart, indexOffset})
+	binary.Write(&b, le, []uint16{0, 0})
+	binary.Write(&b, le, []uint64{0, headerSize + zoomHdrSize*uint64(len(bw.zooms))})
+	binary.Write(&b, le, uint32(bw.maxBuf))
+	binary.Write(&b, le, uint64(0))
+	for i, z := range zooms {
+		binary.Write(&b, le, []uint32{z.reduction, 0})
+		binary.Write(&b, le, []uint64{offsets[i][0], offsets[i][1]})
+	}
+	// space reserved for zoom levels that were not used.
+	b.Write(make([]byte, zoomHdrSize*(len(bw.zooms)-len(zooms))))
+	t := bw.total
+	binary.Write(&b, le, uint64(t.valid))
+	binary.Write(&b, le, []float64{t.min, t.max, t.sum, t.sumSquares})
+
+	if _, err := bw.w.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := bw.w.Write(b.Bytes()); err != nil {
+		return err
+	}
+	if _, err := bw.w.Seek(int64(bw.dataStart), io.SeekStart); err != nil {
+		return err
+	}
+	if err := binary.Write(bw.w, le, bw.nBlocks); err != nil {
+		return err
+	}
+	_, err := bw.w.Seek(0, io.SeekEnd)
+	return err
+}
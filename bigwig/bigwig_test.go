@@ -0,0 +1,180 @@
+package bigwig
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"testing"
+)
+
+type interval struct {
+	chrom      uint32
+	start, end uint32
+	value      float32
+}
+
+// readLeaves walks the R-tree at offset and returns the data blocks that it indexes.
+func readLeaves(t *testing.T, b []byte, offset uint64) []indexItem {
+	le := binary.LittleEndian
+	if m := le.Uint32(b[offset:]); m != cirTreeMagic {
+		t.Fatalf("bad R-tree magic: %x", m)
+	}
+	var walk func(off uint64) []indexItem
+	walk = func(off uint64) []indexItem {
+		isLeaf, n := b[off], int(le.Uint16(b[off+2:]))
+		off += 4
+		var items []indexItem
+		for i := 0; i < n; i++ {
+			if isLeaf == 1 {
+				items = append(items, indexItem{startChrom: le.Uint32(b[off:]), startBase: le.Uint32(b[off+4:]),
+					endChrom: le.Uint32(b[off+8:]), endBase: le.Uint32(b[off+12:]),
+					offset: le.Uint64(b[off+16:]), size: le.Uint64(b[off+24:])})
+				off += 32
+			} else {
+				items = append(items, walk(le.Uint64(b[off+16:]))...)
+				off += 24
+			}
+		}
+		return items
+	}
+	return walk(offset + 48)
+}
+
+func inflate(t *testing.T, b []byte) []byte {
+	zr, err := zlib.NewReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+// readBigWig decodes the intervals in the file and returns the chromosome names keyed by ID and
+// the number of zoom levels.
+func readBigWig(t *testing.T, b []byte) ([]interval, map[uint32]string, int) {
+	le := binary.LittleEndian
+	if m := le.Uint32(b); m != bigWigMagic {
+		t.Fatalf("bad magic: %x", m)
+	}
+	nZooms := int(le.Uint16(b[6:]))
+	chromTree, dataOffset, indexOffset := le.Uint64(b[8:]), le.Uint64(b[16:]), le.Uint64(b[24:])
+
+	if m := le.Uint32(b[chromTree:]); m != bptMagic {
+		t.Fatalf("bad chrom tree magic: %x", m)
+	}
+	keySize := uint64(le.Uint32(b[chromTree+8:]))
+	off := chromTree + 32
+	n := int(le.Uint16(b[off+2:]))
+	off += 4
+	names := make(map[uint32]string)
+	for i := 0; i < n; i++ {
+		names[le.Uint32(b[off+keySize:])] = string(bytes.TrimRight(b[off:off+keySize], "\x00"))
+		off += keySize + 8
+	}
+
+	leaves := readLeaves(t, b, indexOffset)
+	if nb := le.Uint64(b[dataOffset:]); nb != uint64(len(leaves)) {
+		t.Errorf("expected %d blocks, got %d", len(leaves), nb)
+	}
+	var ivs []interval
+	for _, leaf := range leaves {
+		block := inflate(t, b[leaf.offset:leaf.offset+leaf.size])
+		chrom := le.Uint32(block)
+		if block[20] != bedGraphType {
+			t.Fatalf("expected bedGraph block got: %d", block[20])
+		}
+		cnt := int(le.Uint16(block[22:]))
+		for i := 0; i < cnt; i++ {
+			item := block[24+12*i:]
+			ivs = append(ivs, interval{chrom, le.Uint32(item), le.Uint32(item[4:]), math.Float32frombits(le.Uint32(item[8:]))})
+		}
+	}
+	return ivs, names, nZooms
+}
+
+func TestWriter(t *testing.T) {
+	f, err := ioutil.TempFile("", "goleft-bigwig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	chroms := []Chrom{{"chr2", 200000000}, {"chr1", 10000}}
+	w, err := NewWriter(f, chroms)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// enough intervals to need many blocks and a multi-level index.
+	var exp []interval
+	for i := 0; i < itemsPerSlot*blockSize+10; i++ {
+		iv := interval{0, uint32(i * 10), uint32(i*10 + 5), float32(i % 7)}
+		exp = append(exp, iv)
+		if err := w.Add("chr2", int(iv.start), int(iv.end), iv.value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	exp = append(exp, interval{1, 0, 100, 2.5})
+	if err := w.Add("chr1", 0, 100, 2.5); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Add("chr1", 50, 60, 1); err == nil {
+		t.Errorf("expected error for overlapping interval")
+	}
+	if err := w.Add("chr2", 0, 10, 1); err == nil {
+		t.Errorf("expected error for unsorted chromosome")
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, names, nZooms := readBigWig(t, b)
+	if names[0] != "chr2" || names[1] != "chr1" {
+		t.Errorf("unexpected chromosome names: %v", names)
+	}
+	if len(got) != len(exp) {
+		t.Fatalf("expected %d intervals, got %d", len(exp), len(got))
+	}
+	for i := range exp {
+		if got[i] != exp[i] {
+			t.Fatalf("interval %d: expected %v, got %v", i, exp[i], got[i])
+		}
+	}
+	if nZooms == 0 {
+		t.Errorf("expected zoom levels")
+	}
+
+	le := binary.LittleEndian
+	summary := le.Uint64(b[44:])
+	if covered := le.Uint64(b[summary:]); covered != uint64(5*(len(exp)-1)+100) {
+		t.Errorf("unexpected bases covered: %d", covered)
+	}
+	if max := math.Float64frombits(le.Uint64(b[summary+16:])); max != 6 {
+		t.Errorf("expected max of 6, got: %v", max)
+	}
+}
+
+type failWriter struct{ io.WriteSeeker }
+
+func (failWriter) Write([]byte) (int, error) { return 0, errors.New("fail") }
+
+func TestWriterErrors(t *testing.T) {
+	if _, err := NewWriter(nil, nil); err == nil {
+		t.Errorf("expected error without chromosomes")
+	}
+	if _, err := NewWriter(failWriter{}, []Chrom{{"1", 10}}); err == nil {
+		t.Errorf("expected write error")
+	}
+}
@@ -0,0 +1,213 @@
+package bigwig
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"sort"
+)
+
+// the types of data blocks.
+const (
+	varStepType   = 2
+	fixedStepType = 3
+)
+
+// Reader reads the intervals from a bigWig file such as those written by Writer or by the UCSC
+// tools. Only little-endian files are supported.
+type Reader struct {
+	r      io.ReaderAt
+	chroms map[uint32]Chrom
+	// the offset of the R-tree index of the data blocks.
+	indexOffset uint64
+	compressed  bool
+}
+
+var le = binary.LittleEndian
+
+// readAt returns n bytes from offset off.
+func (br *Reader) readAt(off uint64, n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := br.r.ReadAt(b, int64(off)); err != nil {
+		return nil, fmt.Errorf("bigwig: error reading %d bytes at %d: %s", n, off, err)
+	}
+	return b, nil
+}
+
+// NewReader reads the header and chromosomes of the bigWig in r.
+func NewReader(r io.ReaderAt) (*Reader, error) {
+	br := &Reader{r: r, chroms: make(map[uint32]Chrom)}
+	hdr, err := br.readAt(0, headerSize)
+	if err != nil {
+		return nil, err
+	}
+	if m := le.Uint32(hdr); m != bigWigMagic {
+		return nil, fmt.Errorf("bigwig: not a little-endian bigWig file (magic: %x)", m)
+	}
+	chromTree := le.Uint64(hdr[8:])
+	br.indexOffset = le.Uint64(hdr[24:])
+	br.compressed = le.Uint32(hdr[52:]) > 0
+
+	b, err := br.readAt(chromTree, 32)
+	if err != nil {
+		return nil, err
+	}
+	if m := le.Uint32(b); m != bptMagic {
+		return nil, fmt.Errorf("bigwig: bad chromosome tree magic: %x", m)
+	}
+	keySize := int(le.Uint32(b[8:]))
+	if err := br.readChromNode(chromTree+32, keySize); err != nil {
+		return nil, err
+	}
+	return br, nil
+}
+
+// readChromNode adds the chromosomes in the B+ tree node at off and its children.
+func (br *Reader) readChromNode(off uint64, keySize int) error {
+	b, err := br.readAt(off, 4)
+	if err != nil {
+		return err
+	}
+	isLeaf, n := b[0], int(le.Uint16(b[2:]))
+	item := keySize + 8
+	if b, err = br.readAt(off+4, n*item); err != nil {
+		return err
+	}
+	for i := 0; i < n; i++ {
+		it := b[i*item:]
+		if isLeaf == 1 {
+			name := string(bytes.TrimRight(it[:keySize], "\x00"))
+			br.chroms[le.Uint32(it[keySize:])] = Chrom{Name: name, Len: int(le.Uint32(it[keySize+4:]))}
+			continue
+		}
+		if err := br.readChromNode(le.Uint64(it[keySize:]), keySize); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Chroms returns the chromosomes in the file in the order of their IDs.
+func (br *Reader) Chroms() []Chrom {
+	ids := make([]int, 0, len(br.chroms))
+	for id := range br.chroms {
+		ids = append(ids, int(id))
+	}
+	sort.Ints(ids)
+	chroms := make([]Chrom, len(ids))
+	for i, id := range ids {
+		chroms[i] = br.chroms[uint32(id)]
+	}
+	return chroms
+}
+
+// leaves walks the R-tree node at off and returns the data blocks that it indexes in file order.
+func (br *Reader) leaves(off uint64) ([]indexItem, error) {
+	b, err := br.readAt(off, 4)
+	if err != nil {
+		return nil, err
+	}
+	isLeaf, n := b[0], int(le.Uint16(b[2:]))
+	size := 24
+	if isLeaf == 1 {
+		size = 32
+	}
+	if b, err = br.readAt(off+4, n*size); err != nil {
+		return nil, err
+	}
+	var items []indexItem
+	for i := 0; i < n; i++ {
+		it := b[i*size:]
+		if isLeaf == 1 {
+			items = append(items, indexItem{startChrom: le.Uint32(it), startBase: le.Uint32(it[4:]),
+				endChrom: le.Uint32(it[8:]), endBase: le.Uint32(it[12:]),
+				offset: le.Uint64(it[16:]), size: le.Uint64(it[24:])})
+			continue
+		}
+		children, err := br.leaves(le.Uint64(it[16:]))
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, children...)
+	}
+	return items, nil
+}
+
+// Intervals calls fn for each interval in the file in the order that they are stored, which is
+// sorted by chromosome ID and start. start is 0-based and end is exclusive. Iteration stops at the
+// first error from fn.
+func (br *Reader) Intervals(fn func(chrom string, start, end int, value float32) error) error {
+	b, err := br.readAt(br.indexOffset, 48)
+	if err != nil {
+		return err
+	}
+	if m := le.Uint32(b); m != cirTreeMagic {
+		return fmt.Errorf("bigwig: bad R-tree magic: %x", m)
+	}
+	leaves, err := br.leaves(br.indexOffset + 48)
+	if err != nil {
+		return err
+	}
+	for _, leaf := range leaves {
+		block, err := br.readAt(leaf.offset, int(leaf.size))
+		if err != nil {
+			return err
+		}
+		if br.compressed {
+			zr, err := zlib.NewReader(bytes.NewReader(block))
+			if err != nil {
+				return err
+			}
+			if block, err = ioutil.ReadAll(zr); err != nil {
+				return err
+			}
+		}
+		if err := br.block(block, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// block decodes the intervals of a bedGraph, varStep or fixedStep data block.
+func (br *Reader) block(b []byte, fn func(chrom string, start, end int, value float32) error) error {
+	if len(b) < 24 {
+		return fmt.Errorf("bigwig: short data block")
+	}
+	c, ok := br.chroms[le.Uint32(b)]
+	if !ok {
+		return fmt.Errorf("bigwig: unknown chromosome ID in data block: %d", le.Uint32(b))
+	}
+	start, step, span := int(le.Uint32(b[4:])), int(le.Uint32(b[12:])), int(le.Uint32(b[16:]))
+	typ, n := b[20], int(le.Uint16(b[22:]))
+	size := map[uint8]int{bedGraphType: 12, varStepType: 8, fixedStepType: 4}[typ]
+	if size == 0 {
+		return fmt.Errorf("bigwig: unknown data block type: %d", typ)
+	}
+	if len(b) < 24+n*size {
+		return fmt.Errorf("bigwig: short data block")
+	}
+	for i := 0; i < n; i++ {
+		it := b[24+i*size:]
+		var s, e int
+		var v float32
+		switch typ {
+		case bedGraphType:
+			s, e, v = int(le.Uint32(it)), int(le.Uint32(it[4:])), math.Float32frombits(le.Uint32(it[8:]))
+		case varStepType:
+			s, v = int(le.Uint32(it)), math.Float32frombits(le.Uint32(it[4:]))
+			e = s + span
+		case fixedStepType:
+			s, v = start+i*step, math.Float32frombits(le.Uint32(it))
+			e = s + span
+		}
+		if err := fn(c.Name, s, e, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
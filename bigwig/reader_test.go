@@ -0,0 +1,87 @@
+package bigwig
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"os"
+	"testing"
+)
+
+func TestReader(t *testing.T) {
+	f, err := ioutil.TempFile("", "goleft-bigwig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	chroms := []Chrom{{"chr2", 200000000}, {"chr1", 10000}}
+	w, err := NewWriter(f, chroms)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var exp []interval
+	for i := 0; i < 3*itemsPerSlot; i++ {
+		iv := interval{0, uint32(i * 10), uint32(i*10 + 5), float32(i%3) / 2}
+		exp = append(exp, iv)
+		if err := w.Add("chr2", int(iv.start), int(iv.end), iv.value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	exp = append(exp, interval{1, 0, 100, 2.5})
+	if err := w.Add("chr1", 0, 100, 2.5); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	br, err := NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := br.Chroms(); len(got) != 2 || got[0] != chroms[0] || got[1] != chroms[1] {
+		t.Errorf("unexpected chromosomes: %v", got)
+	}
+	ids := map[string]uint32{"chr2": 0, "chr1": 1}
+	var got []interval
+	if err := br.Intervals(func(chrom string, start, end int, v float32) error {
+		got = append(got, interval{ids[chrom], uint32(start), uint32(end), v})
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(exp) {
+		t.Fatalf("expected %d intervals, got %d", len(exp), len(got))
+	}
+	for i := range exp {
+		if got[i] != exp[i] {
+			t.Fatalf("interval %d: expected %v, got %v", i, exp[i], got[i])
+		}
+	}
+}
+
+func TestFixedStep(t *testing.T) {
+	br := &Reader{chroms: map[uint32]Chrom{3: {"chrX", 1000}}}
+	b := make([]byte, 24+2*4)
+	le := binary.LittleEndian
+	// chrom, start, end, step, span then the type and count.
+	for i, v := range []uint32{3, 100, 150, 20, 10} {
+		le.PutUint32(b[4*i:], v)
+	}
+	b[20] = fixedStepType
+	le.PutUint16(b[22:], 2)
+	le.PutUint32(b[24:], math.Float32bits(0.5))
+	le.PutUint32(b[28:], math.Float32bits(1))
+	var got []interval
+	if err := br.block(b, func(chrom string, start, end int, v float32) error {
+		got = append(got, interval{3, uint32(start), uint32(end), v})
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0] != (interval{3, 100, 110, 0.5}) || got[1] != (interval{3, 120, 130, 1}) {
+		t.Errorf("unexpected fixedStep intervals: %v", got)
+	}
+}
@@ -3,34 +3,79 @@ package main
 import (
 	"fmt"
 	"io"
+	"log"
 	"os"
+	"runtime"
 	"sort"
 	"strconv"
+	"strings"
 
 	"github.com/brentp/goleft"
-	"github.com/brentp/goleft/covmed"
+	"github.com/brentp/goleft/bamchk"
+	"github.com/brentp/goleft/bedstats"
+	"github.com/brentp/goleft/contam"
+	"github.com/brentp/goleft/covplot"
+	"github.com/brentp/goleft/covstats"
+	"github.com/brentp/goleft/dcnv"
 	"github.com/brentp/goleft/depth"
 	"github.com/brentp/goleft/depthwed"
+	"github.com/brentp/goleft/depthwindow"
+	"github.com/brentp/goleft/fragdepth"
 	"github.com/brentp/goleft/indexcov"
+	"github.com/brentp/goleft/indexsplit"
+	"github.com/brentp/goleft/merge"
+	"github.com/brentp/goleft/readlen"
+	"github.com/brentp/goleft/samplecheck"
+	"github.com/brentp/goleft/samplename"
 )
 
 type progPair struct {
 	help string
 	main func()
+	// globals are the global options that are passed on to the program.
+	globals []string
 }
 
 var progs = map[string]progPair{
-	"depth":    progPair{"parallelize calls to samtools in user-defined windows", depth.Main},
-	"depthwed": progPair{"matricize output from depth to n-sites * n-samples", depthwed.Main},
-	"covmed":   progPair{"calculate median coverage on a bam by sampling", covmed.Main},
-	"indexcov": progPair{"quick coverage estimate using only the bam index", indexcov.Main},
+	"bamchk":      progPair{"check that bams or crams are complete, indexed, sorted and match the reference", bamchk.Main, []string{"reference", "fai"}},
+	"bedstats":    progPair{"merge bed files and report their bases, N50, coverage of each chromosome and overlap", bedstats.Main, []string{"fai"}},
+	"contam":      progPair{"estimate contamination from another individual from allele fractions at common SNPs", contam.Main, []string{"processes", "reference"}},
+	"depth":       progPair{"parallelize calls to samtools in user-defined windows", depth.Main, []string{"processes", "reference", "fai"}},
+	"depthwed":    progPair{"matricize output from depth to n-sites * n-samples", depthwed.Main, nil},
+	"depthwindow": progPair{"correct binned depth for GC and mappability and report log2 ratios", depthwindow.Main, []string{"reference", "fai"}},
+	"fragdepth":   progPair{"depth of properly-paired fragments from the start of the first read to the end of its mate", fragdepth.Main, []string{"processes", "reference", "fai"}},
+	"covplot":     progPair{"plot the depth of many samples over a region or gene with its exons", covplot.Main, nil},
+	"covstats":    progPair{"coverage and insert-size stats for bams by sampling", covstats.Main, []string{"processes", "reference", "fai"}},
+	"covmed":      progPair{"alias for covstats", covstats.Main, []string{"processes", "reference", "fai"}},
+	"dcnv":        progPair{"call copy-number variants from a depth matrix of many samples", dcnv.Main, []string{"reference"}},
+	"indexcov":    progPair{"quick coverage estimate using only the bam index", indexcov.Main, []string{"fai"}},
+	"indexsplit":  progPair{"split the genome into regions with equal data using the bam indexes", indexsplit.Main, []string{"fai"}},
+	"merge":       progPair{"combine covstats, depth and indexcov output for a cohort into a table and dashboard", merge.Main, nil},
+	"readlen":     progPair{"read-length distribution, base quality by cycle and 3' soft-clip rates from a sample of reads", readlen.Main, []string{"processes", "reference"}},
+	"samplecheck": progPair{"relatedness of bams or crams from their alleles at common SNPs to find duplicates and swaps", samplecheck.Main, []string{"processes", "reference"}},
+	"samplename":  progPair{"print the sample names from the read-groups of bams or crams", samplename.Main, nil},
 }
 
+const globalHelp = `
+global options (before the program name):
+  --threads N      threads for decompression and parallel work. it is also the --processes unless that
+                   is given. default: the number of CPUs
+  --processes N    number of processes for programs with a --processes option
+  --reference FA   reference fasta for programs with a --reference option
+  --fai FAI        .fai or genome file for programs with a --fai option. only its contigs are reported
+  --verbosity N    0 logs only warnings and errors, 1 (default) adds progress, 2 adds source lines
+  --log-format F   text (default) or json for a line per message with the time, level and program
+  --version        print the version and exit
+
+use "goleft help $program" or "goleft $program -h" for the options of each program.
+`
+
 func printProgs() {
 
 	var wtr io.Writer = os.Stdout
 
 	fmt.Fprintf(wtr, "goleft Version: %s\n\n", goleft.Version)
+	fmt.Fprintf(wtr, "usage: goleft [global options] $program [options]\n\n")
 	var keys []string
 	l := 5
 	for k := range progs {
@@ -45,21 +90,111 @@ func printProgs() {
 		fmt.Fprintf(wtr, fmtr, k, progs[k].help)
 
 	}
+	fmt.Fprint(wtr, globalHelp)
 	os.Exit(1)
 
 }
 
+// parseGlobals removes the global options before the program name from args and returns them by name.
+func parseGlobals(args []string) (map[string]string, []string, error) {
+	globals := make(map[string]string)
+	for len(args) > 0 && strings.HasPrefix(args[0], "--") {
+		name := args[0][2:]
+		val, hasVal := "", false
+		if i := strings.Index(name, "="); i != -1 {
+			name, val, hasVal = name[:i], name[i+1:], true
+		}
+		args = args[1:]
+		switch name {
+		case "version":
+			globals[name] = "true"
+			continue
+		case "threads", "processes", "reference", "verbosity", "fai", "log-format":
+		default:
+			return nil, nil, fmt.Errorf("goleft: unknown global option: --%s", name)
+		}
+		if !hasVal {
+			if len(args) == 0 {
+				return nil, nil, fmt.Errorf("goleft: --%s requires a value", name)
+			}
+			val, args = args[0], args[1:]
+		}
+		globals[name] = val
+	}
+	return globals, args, nil
+}
+
+// hasOption reports whether the option is already in the arguments to a program.
+func hasOption(args []string, name string) bool {
+	for _, a := range args {
+		if a == "--"+name || strings.HasPrefix(a, "--"+name+"=") {
+			return true
+		}
+	}
+	return false
+}
+
+// programArgs prepends the global options that p accepts to args unless they are given explicitly.
+func programArgs(p progPair, globals map[string]string, args []string) []string {
+	var pre []string
+	for _, g := range p.globals {
+		if v, ok := globals[g]; ok && !hasOption(args, g) {
+			pre = append(pre, "--"+g, v)
+		}
+	}
+	return append(pre, args...)
+}
+
 func main() {
+	globals, args, err := parseGlobals(os.Args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		printProgs()
+	}
+	if globals["version"] != "" {
+		fmt.Println(goleft.Version)
+		return
+	}
+	if v, ok := globals["verbosity"]; ok {
+		if goleft.Verbosity, err = strconv.Atoi(v); err != nil || goleft.Verbosity < 0 {
+			log.Fatalf("goleft: --verbosity must be 0, 1 or 2; got: %s", v)
+		}
+		if goleft.Verbosity > 1 {
+			log.SetFlags(log.LstdFlags | log.Lshortfile)
+		}
+	}
+	if v, ok := globals["threads"]; ok {
+		if goleft.Threads, err = strconv.Atoi(v); err != nil || goleft.Threads < 1 {
+			log.Fatalf("goleft: --threads must be at least 1; got: %s", v)
+		}
+		runtime.GOMAXPROCS(goleft.Threads)
+		if _, ok := globals["processes"]; !ok {
+			globals["processes"] = v
+		}
+	}
 
-	if len(os.Args) < 2 {
+	if len(args) == 0 {
 		printProgs()
 	}
-	var p progPair
-	var ok bool
-	if p, ok = progs[os.Args[1]]; !ok {
+	name := args[0]
+	args = args[1:]
+	if name == "help" {
+		if len(args) == 0 {
+			printProgs()
+		}
+		name, args = args[0], []string{"-h"}
+	}
+	p, ok := progs[name]
+	if !ok {
 		printProgs()
 	}
-	// remove the prog name from the call
-	os.Args = append(os.Args[:1], os.Args[2:]...)
+	goleft.Program = name
+	if f, ok := globals["log-format"]; ok {
+		if err := goleft.SetLogFormat(f); err != nil {
+			log.Fatal(err)
+		}
+	}
+	// the program name in the usage from each program is "goleft $name".
+	os.Args = append([]string{"goleft " + name}, programArgs(p, globals, args)...)
 	p.main()
 }
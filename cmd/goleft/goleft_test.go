@@ -0,0 +1,55 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseGlobals(t *testing.T) {
+	g, args, err := parseGlobals([]string{"--processes", "4", "--verbosity=0", "covstats", "--processes", "2", "a.bam"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g["processes"] != "4" || g["verbosity"] != "0" {
+		t.Errorf("unexpected globals: %v", g)
+	}
+	if !reflect.DeepEqual(args, []string{"covstats", "--processes", "2", "a.bam"}) {
+		t.Errorf("unexpected args: %v", args)
+	}
+	if g, _, err := parseGlobals([]string{"--threads=8", "depth"}); err != nil || g["threads"] != "8" {
+		t.Errorf("expected --threads, got: %v %v", g, err)
+	}
+	if _, _, err := parseGlobals([]string{"--other", "covstats"}); err == nil {
+		t.Errorf("expected error for unknown option")
+	}
+	if _, _, err := parseGlobals([]string{"--reference"}); err == nil {
+		t.Errorf("expected error for missing value")
+	}
+}
+
+func TestProgramArgs(t *testing.T) {
+	g := map[string]string{"processes": "4", "reference": "ref.fa"}
+	got := programArgs(progs["dcnv"], g, []string{"m.bed"})
+	if !reflect.DeepEqual(got, []string{"--reference", "ref.fa", "m.bed"}) {
+		t.Errorf("unexpected args: %v", got)
+	}
+	got = programArgs(progs["covstats"], g, []string{"--processes", "2", "a.bam"})
+	if !reflect.DeepEqual(got, []string{"--reference", "ref.fa", "--processes", "2", "a.bam"}) {
+		t.Errorf("unexpected args: %v", got)
+	}
+	g["fai"] = "genome.txt"
+	got = programArgs(progs["indexcov"], g, []string{"a.bam"})
+	if !reflect.DeepEqual(got, []string{"--fai", "genome.txt", "a.bam"}) {
+		t.Errorf("unexpected args: %v", got)
+	}
+
+	// --threads and --log-format are set for every program before it is run so only --fai is passed.
+	g, args, err := parseGlobals([]string{"--fai", "ref.fai", "--threads", "2", "--log-format=json", "indexsplit", "-n", "10", "a.bam"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = programArgs(progs[args[0]], g, args[1:])
+	if !reflect.DeepEqual(got, []string{"--fai", "ref.fai", "-n", "10", "a.bam"}) {
+		t.Errorf("unexpected args: %v", got)
+	}
+}
@@ -0,0 +1,316 @@
+// Package contam estimates the fraction of the reads of a sample that are from another individual
+// from the allele fractions at common SNPs with known population allele frequencies.
+package contam
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	arg "github.com/alexflint/go-arg"
+	"github.com/brentp/goleft"
+	"github.com/brentp/goleft/bamio"
+	"github.com/brentp/goleft/depth"
+	"github.com/brentp/xopen"
+)
+
+var cli = &struct {
+	Sites     string   `arg:"-s,required,help:VCF of common biallelic SNPs with the population allele frequency in an AF INFO field"`
+	Reference string   `arg:"-r,help:reference fasta. required for cram"`
+	MinDepth  int      `arg:"--min-depth,help:sites with fewer reads are not used"`
+	MaxDepth  int      `arg:"--max-depth,help:sites with more reads are not used as they are likely in repeats or duplications"`
+	MinAF     float64  `arg:"--min-af,help:sites with a population allele frequency below this or above 1 minus this are not used"`
+	MinMapQ   int      `arg:"-Q,--min-mapq,help:reads with a lower mapping quality are not counted"`
+	MinBaseQ  int      `arg:"-q,--min-base-quality,help:bases with a lower base quality are not counted"`
+	Processes int      `arg:"-p,help:number of bams or crams to read in parallel"`
+	Bams      []string `arg:"positional,required,help:bam(s) or cram(s) to check"`
+}{MinDepth: 5, MaxDepth: 1000, MinAF: 0.05, MinMapQ: 20, MinBaseQ: 20, Processes: 1}
+
+// contaminated is the estimate above which a sample is flagged.
+const contaminated = 0.03
+
+// minSites is the number of sites below which an estimate is flagged as unreliable.
+const minSites = 100
+
+// minErr is the lowest rate of sequencing errors to each of the other bases that is used.
+const minErr = 0.001
+
+// site is a biallelic SNP from the VCF with the population frequency of the alternate allele.
+// pos is 0-based.
+type site struct {
+	chrom    string
+	pos      int
+	ref, alt byte
+	af       float64
+}
+
+// readSites returns the biallelic SNPs with an AF from the VCF at path. Indels, multi-allelic sites
+// and sites without an AF are skipped.
+func readSites(path string) ([]site, error) {
+	rdr, err := xopen.Ropen(path)
+	if err != nil {
+		return nil, err
+	}
+	defer rdr.Close()
+	var sites []site
+	for i := 1; ; i++ {
+		line, err := rdr.ReadString('\n')
+		if line = strings.TrimRight(line, "\r\n"); len(line) > 0 && line[0] != '#' {
+			toks := strings.SplitN(line, "\t", 9)
+			if len(toks) < 8 {
+				return nil, &goleft.ParseError{Path: path, Line: i, Err: fmt.Errorf("contam: expected at least 8 fields in VCF line: %q", line)}
+			}
+			pos, err := strconv.Atoi(toks[1])
+			if err != nil {
+				return nil, &goleft.ParseError{Path: path, Line: i, Err: fmt.Errorf("contam: bad position in VCF line: %q", line)}
+			}
+			ref, alt := strings.ToUpper(toks[3]), strings.ToUpper(toks[4])
+			af, ok := infoAF(toks[7])
+			if ok && len(ref) == 1 && len(alt) == 1 && strings.Contains("ACGT", ref) && strings.Contains("ACGT", alt) && ref != alt {
+				sites = append(sites, site{chrom: toks[0], pos: pos - 1, ref: ref[0], alt: alt[0], af: af})
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return sites, nil
+}
+
+// infoAF returns the value of the AF field of a VCF INFO column.
+func infoAF(info string) (float64, bool) {
+	for _, kv := range strings.Split(info, ";") {
+		if strings.HasPrefix(kv, "AF=") {
+			af, err := strconv.ParseFloat(kv[3:], 64)
+			return af, err == nil && af >= 0 && af <= 1
+		}
+	}
+	return 0, false
+}
+
+// obs are the reads with the reference, the alternate and another base at a site.
+type obs struct {
+	ref, alt, other int
+}
+
+// countSites returns the sample name and the reads at each site for the bam or cram at path using
+// depth.BaseCounts for each chromosome. The VCF chromosomes are matched with or without a chr
+// prefix.
+func countSites(path string, sites []site) (string, []obs, error) {
+	h, err := bamio.Header(path)
+	if err != nil {
+		return "", nil, err
+	}
+	names := make(map[string]bool, len(h.Refs()))
+	for _, ref := range h.Refs() {
+		names[ref.Name()] = true
+	}
+	// the index of the sites on each chromosome of the bam.
+	byChrom := make(map[string][]int)
+	var order []string
+	for i, s := range sites {
+		chrom := s.chrom
+		if !names[chrom] {
+			if chrom = "chr" + s.chrom; !names[chrom] {
+				chrom = strings.TrimPrefix(s.chrom, "chr")
+			}
+		}
+		if !names[chrom] {
+			continue
+		}
+		if _, ok := byChrom[chrom]; !ok {
+			order = append(order, chrom)
+		}
+		byChrom[chrom] = append(byChrom[chrom], i)
+	}
+	out := make([]obs, len(sites))
+	for _, chrom := range order {
+		idx := byChrom[chrom]
+		positions := make([]int, len(idx))
+		for k, i := range idx {
+			positions[k] = sites[i].pos
+		}
+		counts, err := depth.BaseCounts(path, cli.Reference, chrom, positions, cli.MinMapQ, cli.MinBaseQ)
+		if err != nil {
+			return "", nil, err
+		}
+		for k, i := range idx {
+			c, s := counts[k], sites[i]
+			ref, alt := c.Base(s.ref), c.Base(s.alt)
+			out[i] = obs{ref: ref, alt: alt, other: c.Depth() - c.Base('N') - ref - alt}
+		}
+	}
+	return bamio.SampleName(h, path), out, nil
+}
+
+// model holds the sites used for the estimate and the rate of sequencing errors to each base.
+type model struct {
+	obs []obs
+	// gp are the Hardy-Weinberg frequencies of 0, 1 and 2 alternate alleles at each site.
+	gp  [][3]float64
+	err float64
+}
+
+// newModel returns the model of the sites with depth from minDepth to maxDepth and a population
+// frequency from minAF to 1 - minAF. The error rate is from the reads with neither allele, which
+// are errors to 2 of the 3 other bases.
+func newModel(sites []site, obs []obs, minDepth, maxDepth int, minAF float64) *model {
+	m := &model{}
+	var other, n int
+	for i, o := range obs {
+		d := o.ref + o.alt
+		af := sites[i].af
+		if d < minDepth || d > maxDepth || af < minAF || af > 1-minAF {
+			continue
+		}
+		m.obs = append(m.obs, o)
+		m.gp = append(m.gp, [3]float64{(1 - af) * (1 - af), 2 * af * (1 - af), af * af})
+		other += o.other
+		n += d + o.other
+	}
+	m.err = minErr
+	if n > 0 {
+		m.err = math.Max(minErr, float64(other)/float64(2*n))
+	}
+	return m
+}
+
+// llk returns the log-likelihood of the reads if a fraction alpha of them are from an unrelated
+// individual. The genotypes of the sample and of the contaminant at each site are unknown and have
+// the population frequencies so no genotypes are needed for either.
+func (m *model) llk(alpha float64) float64 {
+	// the probability of an alternate and of a reference read for each genotype of the sample and the
+	// contaminant.
+	var logAlt, logRef [3][3]float64
+	for g := 0; g < 3; g++ {
+		for c := 0; c < 3; c++ {
+			f := (1-alpha)*float64(g)/2 + alpha*float64(c)/2
+			logAlt[g][c] = math.Log(f*(1-3*m.err) + (1-f)*m.err)
+			logRef[g][c] = math.Log((1-f)*(1-3*m.err) + f*m.err)
+		}
+	}
+	sum := 0.0
+	var terms [9]float64
+	for i, o := range m.obs {
+		top := math.Inf(-1)
+		for g := 0; g < 3; g++ {
+			for c := 0; c < 3; c++ {
+				t := math.Log(m.gp[i][g]*m.gp[i][c]) + float64(o.alt)*logAlt[g][c] + float64(o.ref)*logRef[g][c]
+				terms[3*g+c] = t
+				top = math.Max(top, t)
+			}
+		}
+		s := 0.0
+		for _, t := range terms {
+			s += math.Exp(t - top)
+		}
+		sum += top + math.Log(s)
+	}
+	return sum
+}
+
+// estimate returns the contamination from 0 to 0.5 with the highest likelihood and the gain in
+// log-likelihood over no contamination. A grid search is refined by a golden-section search.
+func (m *model) estimate() (alpha, gain float64) {
+	const step = 0.01
+	best, bestL := 0.0, m.llk(0)
+	l0 := bestL
+	for a := step; a <= 0.5+1e-9; a += step {
+		if l := m.llk(a); l > bestL {
+			best, bestL = a, l
+		}
+	}
+	lo, hi := math.Max(0, best-step), math.Min(0.5, best+step)
+	phi := (math.Sqrt(5) - 1) / 2
+	for hi-lo > 1e-5 {
+		a, b := hi-phi*(hi-lo), lo+phi*(hi-lo)
+		if m.llk(a) > m.llk(b) {
+			hi = b
+		} else {
+			lo = a
+		}
+	}
+	if l := m.llk((lo + hi) / 2); l > bestL {
+		best, bestL = (lo+hi)/2, l
+	}
+	return best, bestL - l0
+}
+
+// meanDepth is the mean number of reads with either allele at the sites of the model.
+func (m *model) meanDepth() float64 {
+	if len(m.obs) == 0 {
+		return 0
+	}
+	n := 0
+	for _, o := range m.obs {
+		n += o.ref + o.alt
+	}
+	return float64(n) / float64(len(m.obs))
+}
+
+// Main is called from the goleft dispatcher.
+func Main() {
+	arg.MustParse(cli)
+	if cli.Processes < 1 {
+		cli.Processes = 1
+	}
+	sites, err := readSites(cli.Sites)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(sites) == 0 {
+		log.Fatalf("contam: no biallelic SNPs with an AF in %s", cli.Sites)
+	}
+
+	lines := make([]string, len(cli.Bams))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	wg.Add(cli.Processes)
+	for k := 0; k < cli.Processes; k++ {
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				goleft.Infof("contam: %s", cli.Bams[i])
+				name, obs, err := countSites(cli.Bams[i], sites)
+				if err != nil {
+					log.Fatalf("contam: error with %s: %s", cli.Bams[i], err)
+				}
+				m := newModel(sites, obs, cli.MinDepth, cli.MaxDepth, cli.MinAF)
+				if len(m.obs) == 0 {
+					goleft.Warnf("contam: no sites with at least %d reads for %s", cli.MinDepth, name)
+					lines[i] = fmt.Sprintf("%s\tNA\t0\t0\t%.4f\tNA\tlow-sites", name, m.err)
+					continue
+				}
+				alpha, gain := m.estimate()
+				flag := "ok"
+				if len(m.obs) < minSites {
+					flag = "low-sites"
+				} else if alpha > contaminated {
+					flag = "contaminated"
+				}
+				lines[i] = fmt.Sprintf("%s\t%.4f\t%d\t%.1f\t%.4f\t%.2f\t%s", name, alpha, len(m.obs), m.meanDepth(), m.err, gain, flag)
+			}
+		}()
+	}
+	for i := range cli.Bams {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	w := bufio.NewWriter(os.Stdout)
+	defer w.Flush()
+	fmt.Fprintln(w, "#sample\tcontamination\tsites\tmean_depth\terror_rate\tllk_gain\tflag")
+	for _, l := range lines {
+		fmt.Fprintln(w, l)
+	}
+}
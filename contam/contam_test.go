@@ -0,0 +1,98 @@
+package contam
+
+import (
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestReadSites(t *testing.T) {
+	vcf := filepath.Join(t.TempDir(), "sites.vcf")
+	data := "##fileformat=VCFv4.2\n#CHROM\tPOS\tID\tREF\tALT\tQUAL\tFILTER\tINFO\n" +
+		"1\t10\t.\tA\tG\t.\t.\tAC=3;AF=0.25\n" +
+		"1\t20\t.\tAT\tA\t.\t.\tAF=0.5\n" +
+		"1\t30\t.\tC\tT\t.\t.\tAC=3\n" +
+		"2\t5\trs1\tc\tt\t.\tPASS\tAF=0.5;DP=10\n"
+	if err := os.WriteFile(vcf, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sites, err := readSites(vcf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := []site{{"1", 9, 'A', 'G', 0.25}, {"2", 4, 'C', 'T', 0.5}}
+	if !reflect.DeepEqual(sites, exp) {
+		t.Errorf("expected: %v, got: %v", exp, sites)
+	}
+}
+
+// perr is the rate of sequencing errors to each base in simulate.
+const perr = 0.003
+
+// simulate returns the reads at n sites at depth d for a sample with a fraction alpha of reads from
+// another individual.
+func simulate(rng *rand.Rand, n, d int, alpha float64) ([]site, []obs) {
+	sites := make([]site, n)
+	o := make([]obs, n)
+	gt := func(af float64) int {
+		g := 0
+		for k := 0; k < 2; k++ {
+			if rng.Float64() < af {
+				g++
+			}
+		}
+		return g
+	}
+	for i := range sites {
+		af := 0.05 + 0.9*rng.Float64()
+		sites[i] = site{chrom: "1", pos: i, ref: 'A', alt: 'G', af: af}
+		g, c := gt(af), gt(af)
+		f := (1-alpha)*float64(g)/2 + alpha*float64(c)/2
+		for k := 0; k < d; k++ {
+			alt := rng.Float64() < f
+			// an error gives each of the 3 other bases with the same probability.
+			if rng.Float64() < 3*perr {
+				switch rng.Intn(3) {
+				case 0:
+					alt = !alt
+				default:
+					o[i].other++
+					continue
+				}
+			}
+			if alt {
+				o[i].alt++
+			} else {
+				o[i].ref++
+			}
+		}
+	}
+	return sites, o
+}
+
+func TestEstimate(t *testing.T) {
+	rng := rand.New(rand.NewSource(42))
+	for _, alpha := range []float64{0, 0.02, 0.1, 0.3} {
+		sites, o := simulate(rng, 3000, 40, alpha)
+		m := newModel(sites, o, 5, 1000, 0.05)
+		if len(m.obs) == 0 {
+			t.Fatal("expected sites in the model")
+		}
+		est, gain := m.estimate()
+		if math.Abs(est-alpha) > 0.01 {
+			t.Errorf("expected contamination near %.2f, got %.4f", alpha, est)
+		}
+		if gain < 0 {
+			t.Errorf("expected the estimate to be at least as likely as 0, got %.2f", gain)
+		}
+	}
+
+	// sites below the minimum depth are not used.
+	sites, o := simulate(rng, 10, 4, 0)
+	if m := newModel(sites, o, 5, 1000, 0.05); len(m.obs) != 0 || m.err != minErr {
+		t.Errorf("expected no sites, got %d", len(m.obs))
+	}
+}
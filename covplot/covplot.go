@@ -0,0 +1,206 @@
+// Package covplot plots the depth from bed or bedGraph files of many samples over a region, such as
+// a gene, with the exons from a GFF so that coverage can be shown for a report without a browser.
+package covplot
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	arg "github.com/alexflint/go-arg"
+	"github.com/brentp/goleft"
+	"github.com/brentp/xopen"
+)
+
+var cli = &struct {
+	Region string   `arg:"-r,required,help:region to plot as chrom:start-end or a gene name from --gff"`
+	GFF    string   `arg:"--gff,help:optional GFF3 or GTF of genes. the exons in the region are drawn below the depth"`
+	Column int      `arg:"-c,help:1-based column of the depth in the beds. 4 for bedGraph and goleft depth"`
+	Bins   int      `arg:"-b,help:the mean depth is plotted in at most this many bins across the region"`
+	Pad    int      `arg:"help:bases to add on each side of the region"`
+	PNG    bool     `arg:"--png,help:also write $prefix.png"`
+	Prefix string   `arg:"required,help:prefix for $prefix.html and $prefix.png"`
+	Beds   []string `arg:"positional,required,help:bed or bedGraph files of depth with one sample each"`
+}{Column: 4, Bins: 1000}
+
+func pcheck(e error) {
+	if e != nil {
+		log.Fatal(e)
+	}
+}
+
+// region is a 0-based, half-open interval.
+type region struct {
+	chrom      string
+	start, end int
+	// name is the gene if the region was given by name.
+	name string
+}
+
+func (r region) String() string {
+	s := fmt.Sprintf("%s:%d-%d", r.chrom, r.start+1, r.end)
+	if r.name != "" {
+		s = r.name + " " + s
+	}
+	return s
+}
+
+var regionRe = regexp.MustCompile(`^(.+):([\d,]+)-([\d,]+)$`)
+
+// parseRegion parses chrom:start-end with a 1-based start. ok is false if s is not a region.
+func parseRegion(s string) (region, bool) {
+	m := regionRe.FindStringSubmatch(s)
+	if m == nil {
+		return region{}, false
+	}
+	start, err := strconv.Atoi(strings.Replace(m[2], ",", "", -1))
+	if err != nil {
+		return region{}, false
+	}
+	end, err := strconv.Atoi(strings.Replace(m[3], ",", "", -1))
+	if err != nil || end < start {
+		return region{}, false
+	}
+	return region{chrom: m[1], start: start - 1, end: end}, true
+}
+
+// sameChrom is true if a and b are the same chromosome with or without a chr prefix.
+func sameChrom(a, b string) bool {
+	return strings.TrimPrefix(a, "chr") == strings.TrimPrefix(b, "chr")
+}
+
+// track is the mean depth of a sample in each bin of the region.
+type track struct {
+	sample string
+	depths []float64
+}
+
+// binWidth returns the width of each bin so that the region has at most n bins.
+func binWidth(r region, n int) int {
+	w := (r.end - r.start + n - 1) / n
+	if w < 1 {
+		w = 1
+	}
+	return w
+}
+
+// readDepth returns the mean depth in each bin of width w from column col (0-based) of the bed at
+// path. Bases without an interval have a depth of 0. The bed must be sorted.
+func readDepth(path string, r region, w, col int) ([]float64, error) {
+	n := (r.end - r.start + w - 1) / w
+	sums := make([]float64, n)
+	rdr, err := xopen.Ropen(path)
+	if err != nil {
+		return nil, err
+	}
+	defer rdr.Close()
+	seen := false
+	for i := 1; ; i++ {
+		line, err := rdr.ReadString('\n')
+		if err == io.EOF && line == "" {
+			break
+		}
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if line == "" || line[0] == '#' || strings.HasPrefix(line, "track") {
+			continue
+		}
+		toks := strings.Split(strings.TrimRight(line, "\r\n"), "\t")
+		if !sameChrom(toks[0], r.chrom) {
+			if seen {
+				// the bed is sorted so the rest of the chromosome has been read.
+				break
+			}
+			continue
+		}
+		seen = true
+		if len(toks) <= col {
+			return nil, &goleft.ParseError{Path: path, Line: i, Err: fmt.Errorf("expected at least %d columns", col+1)}
+		}
+		start, err := strconv.Atoi(toks[1])
+		if err != nil {
+			return nil, &goleft.ParseError{Path: path, Line: i, Err: err}
+		}
+		if start >= r.end {
+			break
+		}
+		end, err := strconv.Atoi(toks[2])
+		if err != nil {
+			return nil, &goleft.ParseError{Path: path, Line: i, Err: err}
+		}
+		if end <= r.start {
+			continue
+		}
+		d, err := strconv.ParseFloat(toks[col], 64)
+		if err != nil {
+			return nil, &goleft.ParseError{Path: path, Line: i, Err: err}
+		}
+		// add the depth times the bases of the interval in each bin it overlaps.
+		s, e := max(start, r.start)-r.start, min(end, r.end)-r.start
+		for b := s / w; b*w < e; b++ {
+			sums[b] += d * float64(min(e, (b+1)*w)-max(s, b*w))
+		}
+	}
+	for b := range sums {
+		sums[b] /= float64(min(r.end-r.start, (b+1)*w) - b*w)
+	}
+	return sums, nil
+}
+
+// sampleName is the name of the bed file without the directory or the usual suffixes.
+func sampleName(path string) string {
+	name := filepath.Base(path)
+	for _, suf := range []string{".gz", ".bed", ".bedgraph", ".bedGraph", ".bg", ".depth", ".regions", ".per-base"} {
+		name = strings.TrimSuffix(name, suf)
+	}
+	return name
+}
+
+// Main is called from the goleft dispatcher.
+func Main() {
+	p := arg.MustParse(cli)
+	if cli.Column < 4 {
+		p.Fail("covplot: --column must be at least 4")
+	}
+	if cli.Bins < 1 {
+		p.Fail("covplot: --bins must be at least 1")
+	}
+	r, ok := parseRegion(cli.Region)
+	if !ok && cli.GFF == "" {
+		p.Fail("covplot: --region must be chrom:start-end without --gff")
+	}
+	var err error
+	if !ok {
+		r, err = findGene(cli.GFF, cli.Region)
+		pcheck(err)
+	}
+	r.start, r.end = max(0, r.start-cli.Pad), r.end+cli.Pad
+	var exons []exon
+	if cli.GFF != "" {
+		exons, err = readExons(cli.GFF, r)
+		pcheck(err)
+	}
+
+	w := binWidth(r, cli.Bins)
+	tracks := make([]track, len(cli.Beds))
+	for i, path := range cli.Beds {
+		depths, err := readDepth(path, r, w, cli.Column-1)
+		pcheck(err)
+		tracks[i] = track{sample: sampleName(path), depths: depths}
+	}
+	goleft.Infof("covplot: plotting %d samples over %s in %d bins of %dbp with %d exons", len(tracks), r, len(tracks[0].depths), w, len(exons))
+
+	fh, err := os.Create(cli.Prefix + ".html")
+	pcheck(err)
+	pcheck(writeHTML(fh, r, w, tracks, exons))
+	pcheck(fh.Close())
+	if cli.PNG {
+		pcheck(writePNG(cli.Prefix+".png", r, w, tracks, exons))
+	}
+}
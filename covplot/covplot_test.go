@@ -0,0 +1,83 @@
+package covplot
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseRegion(t *testing.T) {
+	r, ok := parseRegion("chr17:41,196,312-41277500")
+	if !ok || r != (region{chrom: "chr17", start: 41196311, end: 41277500}) {
+		t.Errorf("unexpected region: %v %v", r, ok)
+	}
+	if _, ok := parseRegion("BRCA1"); ok {
+		t.Errorf("expected a gene name not to parse as a region")
+	}
+}
+
+func TestReadDepth(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "s1.depth.bed")
+	data := "#chrom\tstart\tend\tdepth\nchr1\t0\t100\t5\n1\t100\t105\t10\n1\t105\t110\t20\n1\t120\t200\t1\n2\t0\t100\t50\n"
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// 2 bins of 10 bases; 110-120 has no interval so it has no depth.
+	r := region{chrom: "1", start: 100, end: 120}
+	depths, err := readDepth(path, r, binWidth(r, 2), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := []float64{15, 0}; !reflect.DeepEqual(depths, exp) {
+		t.Errorf("expected: %v, got: %v", exp, depths)
+	}
+	// a last bin that is smaller than the others.
+	r = region{chrom: "chr1", start: 95, end: 125}
+	if depths, err = readDepth(path, r, 20, 3); err != nil {
+		t.Fatal(err)
+	}
+	if exp := []float64{(5*5 + 5*10 + 5*20) / 20.0, 5 / 10.0}; !reflect.DeepEqual(depths, exp) {
+		t.Errorf("expected: %v, got: %v", exp, depths)
+	}
+	if s := sampleName(path + ".gz"); s != "s1" {
+		t.Errorf("unexpected sample name: %s", s)
+	}
+}
+
+func TestGFF(t *testing.T) {
+	dir := t.TempDir()
+	gff := filepath.Join(dir, "genes.gff3")
+	data := "##gff-version 3\n" +
+		"chr1\t.\tgene\t1001\t5000\t.\t+\t.\tID=gene:G1;Name=ABC1\n" +
+		"chr1\t.\texon\t1001\t1200\t.\t+\t.\tParent=transcript:T1\n" +
+		"chr1\t.\texon\t1101\t1300\t.\t+\t.\tParent=transcript:T2\n" +
+		"chr1\t.\texon\t4001\t5000\t.\t+\t.\tParent=transcript:T1\n" +
+		"chr2\t.\texon\t4001\t5000\t.\t+\t.\tParent=transcript:T3\n"
+	gtf := filepath.Join(dir, "genes.gtf")
+	gtfData := "chr1\t.\tgene\t1001\t5000\t.\t+\t.\tgene_id \"G1\"; gene_name \"ABC1\";\n"
+	for p, d := range map[string]string{gff: data, gtf: gtfData} {
+		if err := os.WriteFile(p, []byte(d), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, p := range []string{gff, gtf} {
+		r, err := findGene(p, "ABC1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r != (region{chrom: "chr1", start: 1000, end: 5000, name: "ABC1"}) {
+			t.Errorf("unexpected gene region from %s: %v", p, r)
+		}
+	}
+	if _, err := findGene(gff, "XYZ"); err == nil {
+		t.Errorf("expected an error for a missing gene")
+	}
+	exons, err := readExons(gff, region{chrom: "chr1", start: 1000, end: 4500})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := []exon{{1000, 1300}, {4000, 4500}}; !reflect.DeepEqual(exons, exp) {
+		t.Errorf("expected: %v, got: %v", exp, exons)
+	}
+}
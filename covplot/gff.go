@@ -0,0 +1,126 @@
+package covplot
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/brentp/goleft"
+	"github.com/brentp/xopen"
+)
+
+// exon is a 0-based, half-open interval of the exons of any transcript in the region.
+type exon struct {
+	start, end int
+}
+
+// feature is a line of a GFF3 or GTF with a 0-based start.
+type feature struct {
+	chrom, typ string
+	start, end int
+	attrs      string
+}
+
+// attr returns the value of key from the attributes of a GFF3 (key=value;) or GTF (key "value";).
+func (f feature) attr(key string) string {
+	for _, kv := range strings.Split(f.attrs, ";") {
+		kv = strings.TrimSpace(kv)
+		if strings.HasPrefix(kv, key+"=") {
+			return kv[len(key)+1:]
+		}
+		if strings.HasPrefix(kv, key+" ") {
+			return strings.Trim(kv[len(key)+1:], `"`)
+		}
+	}
+	return ""
+}
+
+// eachFeature calls fn with each feature in the GFF at path until it returns false.
+func eachFeature(path string, fn func(feature) bool) error {
+	rdr, err := xopen.Ropen(path)
+	if err != nil {
+		return err
+	}
+	defer rdr.Close()
+	for i := 1; ; i++ {
+		line, err := rdr.ReadString('\n')
+		if err == io.EOF && line == "" {
+			return nil
+		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		toks := strings.SplitN(strings.TrimRight(line, "\r\n"), "\t", 9)
+		if len(toks) < 9 {
+			return &goleft.ParseError{Path: path, Line: i, Err: fmt.Errorf("expected 9 columns, got %d", len(toks))}
+		}
+		start, err := strconv.Atoi(toks[3])
+		if err != nil {
+			return &goleft.ParseError{Path: path, Line: i, Err: err}
+		}
+		end, err := strconv.Atoi(toks[4])
+		if err != nil {
+			return &goleft.ParseError{Path: path, Line: i, Err: err}
+		}
+		if !fn(feature{chrom: toks[0], typ: toks[2], start: start - 1, end: end, attrs: toks[8]}) {
+			return nil
+		}
+	}
+}
+
+// findGene returns the region of the gene with the given name or id in the GFF at path.
+func findGene(path, name string) (region, error) {
+	var r region
+	found := false
+	err := eachFeature(path, func(f feature) bool {
+		if f.typ != "gene" {
+			return true
+		}
+		for _, k := range []string{"Name", "gene_name", "gene", "gene_id", "ID"} {
+			if v := f.attr(k); v == name || v == "gene:"+name {
+				r, found = region{chrom: f.chrom, start: f.start, end: f.end, name: name}, true
+				return false
+			}
+		}
+		return true
+	})
+	if err == nil && !found {
+		err = fmt.Errorf("covplot: %s is not a region or a gene in %s", name, path)
+	}
+	return r, err
+}
+
+// readExons returns the exons in the GFF at path that overlap r. Overlapping exons from different
+// transcripts are merged.
+func readExons(path string, r region) ([]exon, error) {
+	var exons []exon
+	err := eachFeature(path, func(f feature) bool {
+		if f.typ == "exon" && sameChrom(f.chrom, r.chrom) && f.start < r.end && f.end > r.start {
+			exons = append(exons, exon{max(f.start, r.start), min(f.end, r.end)})
+		}
+		return true
+	})
+	return mergeExons(exons), err
+}
+
+func mergeExons(exons []exon) []exon {
+	if len(exons) == 0 {
+		return exons
+	}
+	sort.Slice(exons, func(i, j int) bool { return exons[i].start < exons[j].start })
+	merged := exons[:1]
+	for _, e := range exons[1:] {
+		last := &merged[len(merged)-1]
+		if e.start <= last.end {
+			last.end = max(last.end, e.end)
+			continue
+		}
+		merged = append(merged, e)
+	}
+	return merged
+}
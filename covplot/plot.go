@@ -0,0 +1,183 @@
+package covplot
+
+import (
+	"fmt"
+	"image/color"
+	"io"
+	"math/rand"
+
+	chartjs "github.com/brentp/go-chartjs"
+	"github.com/brentp/go-chartjs/types"
+	"github.com/brentp/goleft"
+	"github.com/gonum/plot"
+	"github.com/gonum/plot/plotter"
+	"github.com/gonum/plot/vg"
+)
+
+type vs struct {
+	xs []float64
+	ys []float64
+}
+
+func (v *vs) Xs() []float64 { return v.xs }
+func (v *vs) Ys() []float64 { return v.ys }
+func (v *vs) Rs() []float64 { return nil }
+
+// Len, XY and the above let vs be used for both chartjs and gonum plots.
+func (v *vs) Len() int                    { return len(v.xs) }
+func (v *vs) XY(i int) (float64, float64) { return v.xs[i], v.ys[i] }
+
+func sampleColor(i int) *types.RGBA {
+	rand.Seed(int64(i))
+	return &types.RGBA{R: uint8(rand.Intn(256)), G: uint8(rand.Intn(256)), B: uint8(rand.Intn(256)), A: 240}
+}
+
+// depthPoints are the mean depths of t at the middle of each bin with 1-based positions.
+func depthPoints(r region, w int, t track) *vs {
+	v := &vs{xs: make([]float64, len(t.depths)), ys: t.depths}
+	for b := range t.depths {
+		v.xs[b] = float64(r.start+b*w) + float64(min(w, r.end-r.start-b*w))/2 + 1
+	}
+	return v
+}
+
+// maxDepth is the largest depth in any track so the exons can be drawn below 0 in proportion.
+func maxDepth(tracks []track) float64 {
+	m := 1.0
+	for _, t := range tracks {
+		for _, d := range t.depths {
+			if d > m {
+				m = d
+			}
+		}
+	}
+	return m
+}
+
+// exonPoints draws the exons as a gene model below the depth: the line is at -h in the exons and
+// at -h/4 between them.
+func exonPoints(r region, exons []exon, h float64) *vs {
+	v := &vs{}
+	add := func(x int, y float64) {
+		v.xs = append(v.xs, float64(x)+1)
+		v.ys = append(v.ys, y)
+	}
+	add(r.start, -h/4)
+	for _, e := range exons {
+		add(e.start, -h/4)
+		add(e.start, -h)
+		add(e.end, -h)
+		add(e.end, -h/4)
+	}
+	add(r.end, -h/4)
+	return v
+}
+
+// plotDepth makes a chart with a line of the depth for each sample and the exons below.
+func plotDepth(r region, w int, tracks []track, exons []exon) (chartjs.Chart, error) {
+	c := chartjs.Chart{Label: r.String()}
+	xa, err := c.AddXAxis(chartjs.Axis{Type: chartjs.Linear, Position: chartjs.Bottom, ScaleLabel: &chartjs.ScaleLabel{FontSize: 16,
+		LabelString: fmt.Sprintf("%s position", r.chrom), Display: chartjs.True}})
+	if err != nil {
+		return c, err
+	}
+	ya, err := c.AddYAxis(chartjs.Axis{Type: chartjs.Linear, Position: chartjs.Left, ScaleLabel: &chartjs.ScaleLabel{FontSize: 16,
+		LabelString: "depth", Display: chartjs.True}})
+	if err != nil {
+		return c, err
+	}
+	for i, t := range tracks {
+		col := sampleColor(i)
+		d := chartjs.Dataset{Data: depthPoints(r, w, t), Label: t.sample, Fill: chartjs.False, PointRadius: 0, PointHitRadius: 4,
+			BorderWidth: 1.5, BorderColor: col, BackgroundColor: col, XAxisID: xa, YAxisID: ya}
+		if err := c.AddDataset(d); err != nil {
+			return c, err
+		}
+	}
+	if len(exons) > 0 {
+		black := &types.RGBA{R: 20, G: 20, B: 20, A: 255}
+		d := chartjs.Dataset{Data: exonPoints(r, exons, maxDepth(tracks)/20), Label: "exons", Fill: chartjs.False, PointRadius: 0,
+			BorderWidth: 2, BorderColor: black, BackgroundColor: black, XAxisID: xa, YAxisID: ya}
+		if err := c.AddDataset(d); err != nil {
+			return c, err
+		}
+	}
+	c.Options.Responsive = chartjs.False
+	c.Options.Legend = &chartjs.Legend{Display: chartjs.True}
+	c.Options.Tooltip = &chartjs.Tooltip{Mode: "nearest"}
+	return c, nil
+}
+
+// writeHTML writes the interactive plot of the depth in the region.
+func writeHTML(wr io.Writer, r region, w int, tracks []track, exons []exon) error {
+	chart, err := plotDepth(r, w, tracks, exons)
+	if err != nil {
+		return err
+	}
+	return chartjs.SaveCharts(wr, map[string]interface{}{
+		"template": covTemplate,
+		"region":   r.String(),
+		"version":  goleft.Version,
+		"binWidth": w,
+		"depth":    chart,
+	}, chartjs.Chart{})
+}
+
+// writePNG writes a static version of the plot for reports.
+func writePNG(path string, r region, w int, tracks []track, exons []exon) error {
+	chart, err := plotDepth(r, w, tracks, exons)
+	if err != nil {
+		return err
+	}
+	p, err := plot.New()
+	if err != nil {
+		return err
+	}
+	p.Title.Text = r.String()
+	p.X.Label.Text = chart.Options.Scales.XAxes[0].ScaleLabel.LabelString
+	p.Y.Label.Text = chart.Options.Scales.YAxes[0].ScaleLabel.LabelString
+	for _, ds := range chart.Data.Datasets {
+		l, err := plotter.NewLine(ds.Data.(*vs))
+		if err != nil {
+			return err
+		}
+		l.Color = color.RGBA(*ds.BorderColor)
+		l.LineStyle.Width = vg.Points(ds.BorderWidth / 2)
+		p.Add(l)
+		p.Legend.Add(ds.Label, l)
+	}
+	p.Legend.Top = true
+	return p.Save(10*vg.Inch, 4*vg.Inch, path)
+}
+
+const covTemplate = `<!DOCTYPE html>
+<html>
+    <head>
+	<title>{{ index . "region" }}:goleft covplot</title>
+		<script src="{{ index . "JQuery" }}"></script>
+		<script src="{{ index . "ChartJS" }}"></script>
+		<style type="text/css">
+section {
+    width: 96%;
+    margin: auto;
+    padding: 8px;
+}
+		</style>
+    </head>
+    <body>
+<span class="top-help">
+Depth over {{ index . "region" }} in bins of {{ index . "binWidth" }}bp from <a href="https://github.com/brentp/goleft">goleft covplot</a>
+version {{ index . "version" }}. Click a sample in the legend to hide it.
+</span>
+<section>
+	<canvas id="canvas-depth" style="height:500px;width:1400px"></canvas>
+</section>
+    </body>
+    <script>
+	Chart.defaults.global.animation.duration = 0;
+    {{ $depth_json := index . "depth" }}
+	var depth_ctx = document.getElementById("canvas-depth").getContext("2d");
+	var depth_chart = new Chart(depth_ctx, {{ $depth_json }});
+    </script>
+</html>
+`
@@ -0,0 +1,59 @@
+package covstats
+
+import (
+	"math/rand"
+	"sort"
+)
+
+// bootstrap resamples n items with replacement reps times and returns the 2.5th and 97.5th percentiles
+// of stat, which is given the number of times each item was drawn. The draws are from seed so the
+// output is reproducible.
+func bootstrap(n, reps int, seed int64, stat func(counts []int) float64) (lo, hi float64) {
+	if n == 0 || reps < 1 {
+		return 0, 0
+	}
+	rng := rand.New(rand.NewSource(seed))
+	counts := make([]int, n)
+	vals := make([]float64, reps)
+	for r := range vals {
+		for i := range counts {
+			counts[i] = 0
+		}
+		for i := 0; i < n; i++ {
+			counts[rng.Intn(n)]++
+		}
+		vals[r] = stat(counts)
+	}
+	sort.Float64s(vals)
+	return vals[int(0.025*float64(reps-1)+0.5)], vals[int(0.975*float64(reps-1)+0.5)]
+}
+
+// medianCI is the confidence interval of the median of the sorted values.
+func medianCI(sorted []int, reps int, seed int64) (lo, hi float64) {
+	return bootstrap(len(sorted), reps, seed, func(counts []int) float64 {
+		// the median of the resample is the value at the middle of the cumulative counts.
+		mid, cum := (len(sorted)-1)/2, 0
+		for i, c := range counts {
+			if cum += c; cum > mid {
+				return float64(sorted[i])
+			}
+		}
+		return float64(sorted[len(sorted)-1])
+	})
+}
+
+// depthCI is the confidence interval of the mean depth across regions from the length and aligned
+// bases of each region.
+func depthCI(regions []regionDepth, reps int, seed int64) (lo, hi float64) {
+	return bootstrap(len(regions), reps, seed, func(counts []int) float64 {
+		var l, b int
+		for i, c := range counts {
+			l += c * regions[i].length
+			b += c * regions[i].bases
+		}
+		if l == 0 {
+			return 0
+		}
+		return float64(b) / float64(l)
+	})
+}
@@ -0,0 +1,76 @@
+package covstats
+
+import (
+	"strings"
+
+	"github.com/biogo/hts/sam"
+)
+
+// Builds are the names returned by GenomeBuild. hg19 is GRCh37 with the UCSC chr prefix and chrM.
+var Builds = []string{"GRCh37", "hg19", "GRCh38", "CHM13", "unknown"}
+
+// buildLengths are the lengths of chromosomes 1, 2 and X in each build. GRCh37 and hg19 differ
+// only in the names and in chrM.
+var buildLengths = map[string]map[string]int{
+	"GRCh37": {"1": 249250621, "2": 243199373, "X": 155270560},
+	"GRCh38": {"1": 248956422, "2": 242193529, "X": 156040895},
+	"CHM13":  {"1": 248387328, "2": 242696752, "X": 154259566},
+}
+
+// GenomeBuild returns the build of the reference from the names and lengths of the @SQ lines in h:
+// the build where every one of chromosomes 1, 2 and X in h, with or without a chr prefix, has the
+// length from that build. GRCh37 with chr names is hg19. It is "unknown" if none or more than 1
+// build matches, as for a non-human genome.
+func GenomeBuild(h *sam.Header) string {
+	found := ""
+	for build, lengths := range buildLengths {
+		n := 0
+		for _, ref := range h.Refs() {
+			want, ok := lengths[strings.TrimPrefix(ref.Name(), "chr")]
+			if !ok {
+				continue
+			}
+			if ref.Len() != want {
+				n = 0
+				break
+			}
+			n++
+		}
+		if n == 0 {
+			continue
+		}
+		if found != "" {
+			return "unknown"
+		}
+		found = build
+	}
+	if found == "" {
+		return "unknown"
+	}
+	if found == "GRCh37" {
+		for _, ref := range h.Refs() {
+			if strings.HasPrefix(ref.Name(), "chr") {
+				return "hg19"
+			}
+		}
+	}
+	return found
+}
+
+// knownBuild returns the name in Builds that matches b ignoring case.
+func knownBuild(b string) (string, bool) {
+	for _, k := range Builds {
+		if strings.EqualFold(k, b) {
+			return k, true
+		}
+	}
+	return "", false
+}
+
+// setBuild sets the Build of each result from the header.
+func setBuild(res []Result, h *sam.Header) {
+	b := GenomeBuild(h)
+	for i := range res {
+		res[i].Build = b
+	}
+}
@@ -0,0 +1,70 @@
+package covstats
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/biogo/hts/sam"
+)
+
+// ChromCoverage is the coverage of a single chromosome.
+type ChromCoverage struct {
+	Chrom  string `json:"chrom"`
+	Length int    `json:"length"`
+	Mapped uint64 `json:"mapped_reads"`
+	// Coverage is mapped reads * read length / Length.
+	Coverage float64 `json:"coverage"`
+	// Relative is Coverage divided by the coverage of all autosomes. A value near 0.5 for X indicates
+	// 1 copy in a diploid sample and values near 1.5 on an autosome indicate a trisomy. It is 0 if no
+	// autosomes have reads.
+	Relative float64 `json:"relative_coverage"`
+}
+
+// isAutosome returns true for chromosomes named as a number, with or without a "chr" prefix.
+func isAutosome(name string) bool {
+	n, err := strconv.Atoi(strings.TrimPrefix(name, "chr"))
+	return err == nil && n > 0
+}
+
+// chromCoverage returns the coverage of each reference in mapped from the number of mapped reads
+// and the read length. bases, if not nil, is the observed aligned bases of each reference and is
+// used instead of the read length.
+func chromCoverage(refs []*sam.Reference, mapped map[string]uint64, bases map[string]int, readLength float64) []ChromCoverage {
+	chroms := make([]ChromCoverage, 0, len(refs))
+	autoBases, autoLen := 0.0, 0
+	for _, ref := range refs {
+		m, ok := mapped[ref.Name()]
+		if !ok || ref.Len() == 0 {
+			continue
+		}
+		b := float64(m) * readLength
+		if bases != nil {
+			b = float64(bases[ref.Name()])
+		}
+		chroms = append(chroms, ChromCoverage{Chrom: ref.Name(), Length: ref.Len(), Mapped: m, Coverage: b / float64(ref.Len())})
+		if isAutosome(ref.Name()) {
+			autoBases += b
+			autoLen += ref.Len()
+		}
+	}
+	if autoBases == 0 {
+		return chroms
+	}
+	auto := autoBases / float64(autoLen)
+	for i := range chroms {
+		chroms[i].Relative = chroms[i].Coverage / auto
+	}
+	return chroms
+}
+
+// writeChroms writes the coverage of each chromosome for a sample.
+func writeChroms(w io.Writer, sample string, chroms []ChromCoverage) error {
+	for _, c := range chroms {
+		if _, err := fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%.2f\t%.3f\n", sample, c.Chrom, c.Length, c.Mapped, c.Coverage, c.Relative); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package covstats
+
+import (
+	"testing"
+
+	"github.com/biogo/hts/sam"
+)
+
+func TestChromCoverage(t *testing.T) {
+	var refs []*sam.Reference
+	for _, r := range []struct {
+		name string
+		l    int
+	}{{"chr1", 1000}, {"chr2", 3000}, {"chrX", 2000}, {"chrM", 100}, {"chrUn", 50}} {
+		ref, err := sam.NewReference(r.name, "", "", r.l, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		refs = append(refs, ref)
+	}
+	// chrUn is not in the index so it is not reported.
+	mapped := map[string]uint64{"chr1": 300, "chr2": 900, "chrX": 300, "chrM": 100}
+	chroms := chromCoverage(refs, mapped, nil, 100)
+	if len(chroms) != 4 {
+		t.Fatalf("expected 4 chromosomes, got: %+v", chroms)
+	}
+	if chroms[0].Coverage != 30 || chroms[0].Relative != 1 || chroms[1].Relative != 1 {
+		t.Errorf("unexpected autosome coverage: %+v", chroms[:2])
+	}
+	if chroms[2].Coverage != 15 || chroms[2].Relative != 0.5 {
+		t.Errorf("expected X at half of the autosomes, got: %+v", chroms[2])
+	}
+
+	// observed bases are used if given.
+	chroms = chromCoverage(refs[2:], mapped, map[string]int{"chrX": 4000, "chrM": 1000}, 0)
+	if chroms[0].Coverage != 2 || chroms[1].Coverage != 10 || chroms[0].Relative != 0 {
+		t.Errorf("unexpected coverage without autosomes: %+v", chroms)
+	}
+}
+
+func TestIsAutosome(t *testing.T) {
+	for name, exp := range map[string]bool{"1": true, "chr22": true, "X": false, "chrY": false, "MT": false, "chr1_gl000191_random": false, "0": false} {
+		if isAutosome(name) != exp {
+			t.Errorf("expected %v for %s", exp, name)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package covstats
+
+import (
+	"fmt"
+	"io"
+	"math"
+)
+
+// complexityMultiples are the multiples of the current sequencing for which the duplicates are
+// projected by writeComplexity.
+var complexityMultiples = []float64{1, 2, 4, 8, 16}
+
+// librarySize returns the number of unique molecules in a library from which n molecules were
+// sequenced and unique were observed as in Picard EstimateLibraryComplexity. It solves
+// unique/x = 1 - exp(-n/x) for x by bisection. It returns 0 if there are no duplicates.
+func librarySize(n, unique float64) float64 {
+	if unique <= 0 || unique >= n {
+		return 0
+	}
+	f := func(x float64) float64 { return unique/x - 1 + math.Exp(-n/x) }
+	// the size is bracketed by lo and hi times unique.
+	lo, hi := 1.0, 100.0
+	for f(hi*unique) > 0 {
+		hi *= 10
+	}
+	for i := 0; i < 40; i++ {
+		m := (lo + hi) / 2
+		if u := f(m * unique); u == 0 {
+			break
+		} else if u > 0 {
+			lo = m
+		} else {
+			hi = m
+		}
+	}
+	return unique * (lo + hi) / 2
+}
+
+// projectedUnique returns the unique molecules expected from sequencing multiple times the n
+// molecules already sequenced from a library of size molecules.
+func projectedUnique(size, n, multiple float64) float64 {
+	return size * (1 - math.Exp(-multiple*n/size))
+}
+
+// setComplexity sets the library size and the projected duplicate rate from the number of primary
+// reads in the bam and the duplicate rate of the sampled reads. Pairs are counted as 1 molecule.
+func (r *Result) setComplexity(reads float64) {
+	if !r.SingleEnd {
+		reads /= 2
+	}
+	r.molecules = reads
+	if r.LibrarySize = librarySize(reads, reads*(1-r.DuplicateRate)); r.LibrarySize > 0 {
+		r.DuplicateRate2X = 1 - projectedUnique(r.LibrarySize, reads, 2)/(2*reads)
+	}
+}
+
+// writeComplexity writes the molecules, unique molecules and duplicate rate expected for each of the
+// complexityMultiples of the current sequencing.
+func writeComplexity(w io.Writer, r Result) error {
+	if r.LibrarySize == 0 {
+		return nil
+	}
+	name := r.Sample
+	if r.ReadGroup != "" {
+		name += ":" + r.ReadGroup
+	}
+	for _, m := range complexityMultiples {
+		n := m * r.molecules
+		u := projectedUnique(r.LibrarySize, r.molecules, m)
+		if _, err := fmt.Fprintf(w, "%s\t%g\t%.0f\t%.0f\t%.4f\n", name, m, n, u, 1-u/n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package covstats
+
+import (
+	"bytes"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestLibrarySize(t *testing.T) {
+	// sequencing a library of 1M molecules to 1M gives 1 - exp(-1) unique.
+	n, size := 1e6, 1e6
+	u := projectedUnique(size, n, 1)
+	if got := librarySize(n, u); math.Abs(got-size)/size > 1e-4 {
+		t.Errorf("expected a library size of %v, got: %v", size, got)
+	}
+	if got := librarySize(n, n); got != 0 {
+		t.Errorf("expected 0 without duplicates, got: %v", got)
+	}
+
+	r := Result{Sample: "s1", Sizes: Sizes{DuplicateRate: 1 - u/n}}
+	r.setComplexity(2 * n)
+	if math.Abs(r.LibrarySize-size)/size > 1e-4 {
+		t.Errorf("expected the pairs to give a library size of %v, got: %v", size, r.LibrarySize)
+	}
+	if exp := 1 - projectedUnique(size, n, 2)/(2*n); math.Abs(r.DuplicateRate2X-exp) > 1e-4 || r.DuplicateRate2X <= r.DuplicateRate {
+		t.Errorf("expected a projected duplicate rate of %v, got: %v", exp, r.DuplicateRate2X)
+	}
+	var b bytes.Buffer
+	if err := writeComplexity(&b, r); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != len(complexityMultiples) || !strings.HasPrefix(lines[0], "s1\t1\t1000000\t632121\t0.3679") {
+		t.Errorf("unexpected complexity output: %q", b.String())
+	}
+}
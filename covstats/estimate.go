@@ -0,0 +1,445 @@
+package covstats
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/biogo/hts/bam"
+	"github.com/biogo/hts/sam"
+	"github.com/brentp/faidx"
+	"github.com/brentp/goleft"
+	"github.com/brentp/goleft/bamio"
+)
+
+// ErrNoReads is returned when no reads could be sampled, e.g. for an empty bam or regions without reads.
+var ErrNoReads = errors.New("covstats: no reads were sampled")
+
+// ErrNoReference is returned when Options.GC is set without Options.Reference.
+var ErrNoReference = errors.New("covstats: GC requires a reference")
+
+// Options control how reads are sampled by Estimate and EstimateFromReader. Start from DefaultOptions
+// since the zero value samples no reads.
+type Options struct {
+	// N is the number of reads to sample.
+	N int
+	// Reference is the fasta used to decode crams and to get the GC content of windows.
+	Reference string
+	// Regions is an optional bed file of target regions. Only reads in the regions are sampled.
+	Regions string
+	// ByRG gives a Result for each read-group.
+	ByRG bool
+	// TrimPct is the percent of the largest and smallest insert sizes to drop before the mean and SD.
+	TrimPct float64
+	// MaxMADs excludes insert sizes more than this many MADs from the median before the mean and SD.
+	MaxMADs float64
+	// First samples the first reads rather than reads from random offsets across the genome.
+	First bool
+	// SampleSites is the number of evenly spaced sites from which N/SampleSites reads each are
+	// sampled. If it is 0, reads are sampled from random offsets.
+	SampleSites int
+	// GC sets Result.GC to the coverage by GC content of the sampled windows. It requires Reference.
+	GC bool
+	// Bootstrap is the number of replicates for the confidence interval of the coverage. 0 disables it.
+	Bootstrap int
+	// Threads is the number of goroutines used to decompress the bam. For cram, it is also the number
+	// of threads used by samtools.
+	Threads int
+	// LongReads samples supplementary alignments and estimates the coverage from the aligned length
+	// of each alignment rather than the read length which, for long reads, includes large soft-clips.
+	LongReads bool
+	// Chroms sets Result.Chroms to the coverage of each chromosome. It is ignored with Regions.
+	Chroms bool
+	// Genome limits the coverage and Chroms to its contigs. If it is nil, every contig in the header is used.
+	Genome *goleft.Genome
+	// Seed seeds the random offsets and the bootstrap. The same Seed and N give the same reads and
+	// Result for a file in every run regardless of Threads.
+	Seed int64
+
+	// parsed Regions shared across calls.
+	regions     []region
+	targetBases int
+}
+
+// DefaultOptions returns the Options used by the covstats command.
+func DefaultOptions() Options {
+	return Options{N: 100000, Bootstrap: 200, Threads: 2, Seed: 42}
+}
+
+// init parses the regions if they haven't been already.
+func (o *Options) init() error {
+	if o.GC && o.Reference == "" {
+		return ErrNoReference
+	}
+	if o.Regions == "" || o.regions != nil {
+		return nil
+	}
+	var err error
+	o.regions, o.targetBases, err = readRegions(o.Regions)
+	return err
+}
+
+// Estimate returns the coverage and size info for the bam or cram at path (or "-" for a bam stream
+// on stdin). It returns a Result for each read-group if opts.ByRG is true.
+func Estimate(path string, opts Options) ([]Result, error) {
+	if err := opts.init(); err != nil {
+		return nil, err
+	}
+	if bamio.IsHtsget(path) {
+		h, err := bamio.Header(path)
+		if err != nil {
+			return nil, err
+		}
+		// the sort order is only checked from the header so that the stream is not requested.
+		if so := h.SortOrder; so != sam.QueryName && so != sam.Unsorted {
+			return estimateHtsget(path, h, opts)
+		}
+	}
+	brdr, err := bamio.Open(path, opts.Reference, max(opts.Threads, 1))
+	if err != nil {
+		return nil, err
+	}
+	defer brdr.Close()
+
+	if bamio.IsHtsget(path) {
+		// the header sort order is queryname or unsorted so the server can not send regions.
+		goleft.Warnf("covstats: %s is not sorted by coordinate: the header sort order is %s. estimating coverage with a full pass over the stream", path, brdr.Header().SortOrder)
+		return fullPass(brdr.Reader, path, opts)
+	}
+	if path != "-" {
+		why, err := unsorted(path, brdr.Header(), opts)
+		if err != nil {
+			return nil, err
+		}
+		if why != "" {
+			// the index and the random offsets assume coordinate order so every record is read.
+			goleft.Warnf("covstats: %s is not sorted by coordinate: %s. ignoring the index and estimating coverage with a full pass over the file", path, why)
+			return fullPass(brdr.Reader, path, opts)
+		}
+	}
+
+	var idx *bamio.Index
+	if path != "-" && !bamio.IsCRAM(path) {
+		if idx, err = bamio.ReadIndex(path); err != nil {
+			goleft.Warnf("covstats: %s. estimating coverage with a full pass over the file", err)
+			idx = nil
+		}
+	}
+	return estimate(brdr.Reader, idx, path, opts)
+}
+
+// Sampled is an open bam or cram and a reader of the reads that covstats samples from it.
+type Sampled struct {
+	RecordReader
+	Header *sam.Header
+	// Sample is the first SM tag in the header or the file name without the extension.
+	Sample string
+	br     *bamio.Reader
+}
+
+// Close closes the file.
+func (s *Sampled) Close() error { return s.br.Close() }
+
+// OpenSampled opens the bam or cram at path and returns the reads as covstats samples them: for an
+// indexed bam sorted by coordinate with at least 2N mapped reads, the reads from random offsets
+// across the chromosomes with mapped reads, otherwise the first reads. opts.N is the number of reads the caller expects to
+// need and Regions and the insert-size options are ignored.
+func OpenSampled(path string, opts Options) (*Sampled, error) {
+	br, err := bamio.Open(path, opts.Reference, max(opts.Threads, 1))
+	if err != nil {
+		return nil, err
+	}
+	h := br.Header()
+	s := &Sampled{RecordReader: br.Reader, Header: h, Sample: bamio.SampleName(h, path), br: br}
+	if path == "-" || bamio.IsCRAM(path) || bamio.IsHtsget(path) || opts.First || h.SortOrder == sam.QueryName || h.SortOrder == sam.Unsorted {
+		return s, nil
+	}
+	idx, err := bamio.ReadIndex(path)
+	if err != nil {
+		goleft.Warnf("covstats: %s. sampling the first reads", err)
+		return s, nil
+	}
+	refs := genomeRefs(h.Refs(), opts.Genome)
+	mapped, err := getMapped(path, idx, refs)
+	if err != nil {
+		br.Close()
+		return nil, err
+	}
+	var withReads []*sam.Reference
+	var total uint64
+	for _, ref := range refs {
+		if mapped[ref.Name()] > 0 {
+			withReads = append(withReads, ref)
+			total += mapped[ref.Name()]
+		}
+	}
+	// with few reads, reading them all is faster than seeking and gives each read once.
+	if total < 2*uint64(opts.N) {
+		return s, nil
+	}
+	s.RecordReader = newRandomReader(br.Reader, idx, withReads, opts.N, opts.SampleSites, opts.Seed)
+	return s, nil
+}
+
+// EstimateFromReader is like Estimate for an open bam. If idx is nil, every record is read to get
+// the coverage. The sample name is from the SM tag of the first read-group.
+func EstimateFromReader(br *bam.Reader, idx *bam.Index, opts Options) ([]Result, error) {
+	if err := opts.init(); err != nil {
+		return nil, err
+	}
+	return estimate(br, bamio.WrapBAI(idx), "", opts)
+}
+
+// estimate returns the coverage and size info for a single bam. path is needed to read a cram; it
+// may be empty for a bam. If regions are given, only reads in those regions are sampled and the
+// target bases are used as the denominator.
+func estimate(br *bam.Reader, idx *bamio.Index, path string, opts Options) ([]Result, error) {
+	cram := path != "" && bamio.IsCRAM(path)
+	if so := br.Header().SortOrder; idx != nil && (so == sam.QueryName || so == sam.Unsorted) {
+		goleft.Warnf("covstats: the header sort order is %s so the index is not used. estimating coverage with a full pass over the file", so)
+		idx = nil
+	}
+	if idx == nil && !cram {
+		return fullPass(br, path, opts)
+	}
+
+	genomeBases := 0
+	mapped := uint64(0)
+	refs := genomeRefs(br.Header().Refs(), opts.Genome)
+	mappedByRef, err := getMapped(path, idx, refs)
+	if err != nil {
+		return nil, err
+	}
+	var withReads []*sam.Reference
+	for _, ref := range refs {
+		m, ok := mappedByRef[ref.Name()]
+		if !ok {
+			goleft.Warnf("covstats: chromosome %s not found in %s", ref.Name(), path)
+			continue
+		}
+		genomeBases += ref.Len()
+		mapped += m
+		if m > 0 {
+			withReads = append(withReads, ref)
+		}
+	}
+	var rdr RecordReader = br
+	var rr *regionReader
+	// with few reads, reading them all is faster than seeking and gives each read once.
+	if opts.regions == nil && idx != nil && !opts.First && mapped >= 2*uint64(opts.N) {
+		rdr = newRandomReader(br, idx, withReads, opts.N, opts.SampleSites, opts.Seed)
+	}
+	if opts.regions != nil {
+		genomeBases = opts.targetBases
+		if idx != nil {
+			rr = newRegionReader(br, idx, opts.regions)
+			rr.supplementary = opts.LongReads
+			rdr = rr
+		} else {
+			// for cram, samtools does the filtering.
+			crdr, err := bamio.OpenRegions(path, opts.Reference, opts.Regions, max(opts.Threads, 1))
+			if err != nil {
+				return nil, err
+			}
+			defer crdr.Close()
+			rdr = crdr.Reader
+		}
+	}
+
+	sizes, byRG, gc, err := sample(rdr, br.Header(), opts)
+	if err != nil {
+		return nil, err
+	}
+	if sizes.nReads == 0 {
+		return nil, fmt.Errorf("%w from %s", ErrNoReads, path)
+	}
+	scale := float64(mapped) / float64(genomeBases)
+	lengths, median := sizes.readLengths, sizes.ReadLengthMedian
+	if opts.LongReads {
+		lengths = sizes.refLengths
+		median = percentile(lengths, 0.5) - 1
+	}
+	coverage := scale * median
+	// the mapped count is exact so the uncertainty is from the sampled read lengths.
+	lo, hi := medianCI(lengths, opts.Bootstrap, opts.Seed)
+	lo, hi = scale*(lo-1), scale*(hi-1)
+	// with regions, we prefer the depth observed in the sampled regions since off-target
+	// reads inflate the estimate from the mapped count.
+	if rr != nil {
+		if c, ok := rr.Coverage(); ok {
+			coverage = c
+			lo, hi = depthCI(rr.done, opts.Bootstrap, opts.Seed)
+		}
+	}
+	if opts.Bootstrap < 1 {
+		lo, hi = coverage, coverage
+	}
+	// the index counts every mapped record so the secondary and supplementary are removed.
+	reads := float64(mapped) * (1 - sizes.SecondarySuppFrac)
+	res := results(bamio.SampleName(br.Header(), path), [3]float64{coverage, lo, hi}, reads, sizes, byRG, gc)
+	if opts.Chroms && opts.regions == nil && len(res) > 0 {
+		res[0].Chroms = chromCoverage(refs, mappedByRef, nil, median)
+	}
+	zf, zb := indexZeroCoverage(refs, mappedByRef, idx, opts.regions)
+	setZeroCoverage(res, zf, zb)
+	setBuild(res, br.Header())
+	return res, nil
+}
+
+// sortCheckReads is the number of reads from the start of a file that must be in coordinate order
+// for its index to be used.
+const sortCheckReads = 10000
+
+// unsorted returns why the bam or cram at path can not be sampled with its index or "" if it is
+// sorted by coordinate. A name-sorted file has no meaningful index and offsets into it sample reads
+// of arbitrary pairs so the header sort order is checked and, as it is not always right, the order
+// of the first sortCheckReads reads. Unmapped reads without a position must follow all others.
+func unsorted(path string, h *sam.Header, opts Options) (string, error) {
+	if so := h.SortOrder; so == sam.QueryName || so == sam.Unsorted {
+		return fmt.Sprintf("the header sort order is %s", so), nil
+	}
+	br, err := bamio.Open(path, opts.Reference, 1)
+	if err != nil {
+		return "", err
+	}
+	defer br.Close()
+	lastRef, lastPos, unplaced := -1, -1, false
+	for i := 0; i < sortCheckReads; i++ {
+		rec, err := br.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		if rec.Ref == nil {
+			unplaced = true
+			continue
+		}
+		if unplaced || rec.Ref.ID() < lastRef || (rec.Ref.ID() == lastRef && rec.Pos < lastPos) {
+			return fmt.Sprintf("read %d (%s at %s:%d) is out of order", i+1, rec.Name, rec.Ref.Name(), rec.Pos+1), nil
+		}
+		lastRef, lastPos = rec.Ref.ID(), rec.Pos
+	}
+	return "", nil
+}
+
+// sample gets the Sizes for the reader and, if requested, for each read-group and the coverage
+// by GC content.
+func sample(rdr RecordReader, h *sam.Header, opts Options) (sizes Sizes, byRG map[string]Sizes, gc []GCBin, err error) {
+	var gr *gcReader
+	if opts.GC {
+		gr = newGCReader(rdr)
+		rdr = gr
+	}
+	if !opts.ByRG {
+		sizes, err = insertSizes(rdr, opts)
+	} else {
+		rgs := make([]string, 0, len(h.RGs()))
+		for _, rg := range h.RGs() {
+			rgs = append(rgs, rg.Name())
+		}
+		if len(rgs) == 0 {
+			rgs = append(rgs, "")
+		}
+		sizes, byRG, err = readGroupInsertSizes(rdr, rgs, opts)
+	}
+	if err != nil {
+		return sizes, nil, nil, err
+	}
+	if gr != nil {
+		fa, err := faidx.New(opts.Reference)
+		if err != nil {
+			return sizes, nil, nil, err
+		}
+		defer fa.Close()
+		if gc, err = gr.bins(fa); err != nil {
+			return sizes, nil, nil, err
+		}
+	}
+	return sizes, byRG, gc, nil
+}
+
+// results returns a single Result or, if byRG is not nil, 1 per read-group. cov is the coverage and
+// the bounds of its confidence interval. The coverage for each read-group is the sample coverage scaled
+// by the proportion of sampled reads from that read-group. The GC bins are for the whole sample and are
+// set only on the first Result as are the Chroms. reads is the number of primary reads in the bam
+// which, like the coverage, is scaled for each read-group to estimate its library complexity.
+func results(name string, cov [3]float64, reads float64, sizes Sizes, byRG map[string]Sizes, gc []GCBin) []Result {
+	if byRG == nil {
+		r := Result{Sample: name, Coverage: cov[0], CoverageLo: cov[1], CoverageHi: cov[2], Sizes: sizes, GC: gc}
+		r.setComplexity(reads)
+		return []Result{r}
+	}
+	rgs := make([]string, 0, len(byRG))
+	for rg := range byRG {
+		rgs = append(rgs, rg)
+	}
+	sort.Strings(rgs)
+	res := make([]Result, 0, len(rgs))
+	for _, rg := range rgs {
+		s := byRG[rg]
+		p := float64(s.nReads) / float64(sizes.nReads)
+		r := Result{Sample: name, ReadGroup: rg, Coverage: cov[0] * p, CoverageLo: cov[1] * p, CoverageHi: cov[2] * p, Sizes: s}
+		r.setComplexity(reads * p)
+		res = append(res, r)
+	}
+	if len(res) > 0 {
+		res[0].GC = gc
+	}
+	return res
+}
+
+// fullPass estimates coverage by reading every record. It is used for streams and for bams
+// without an index.
+func fullPass(br *bam.Reader, path string, opts Options) ([]Result, error) {
+	genomeBases := 0
+	refs := genomeRefs(br.Header().Refs(), opts.Genome)
+	for _, ref := range refs {
+		genomeBases += ref.Len()
+	}
+	if opts.regions != nil {
+		genomeBases = opts.targetBases
+	}
+	cr := newCountingReader(br, opts.regions)
+	cr.supplementary = opts.LongReads
+	cr.genome = opts.Genome
+	if opts.regions == nil {
+		cr.mapped, cr.refBases = make(map[string]uint64), make(map[string]int)
+	}
+	sizes, byRG, gc, err := sample(cr, br.Header(), opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := cr.drain(); err != nil {
+		return nil, err
+	}
+	if sizes.nReads == 0 {
+		return nil, fmt.Errorf("%w from %s", ErrNoReads, path)
+	}
+	// every read is counted so there is no sampling error in the coverage.
+	coverage := float64(cr.bases) / float64(genomeBases)
+	res := results(bamio.SampleName(br.Header(), path), [3]float64{coverage, coverage, coverage}, float64(cr.reads), sizes, byRG, gc)
+	if opts.Chroms && cr.mapped != nil && len(res) > 0 {
+		res[0].Chroms = chromCoverage(refs, cr.mapped, cr.refBases, 0)
+	}
+	zf, zb := cr.zeroCoverage(refs)
+	setZeroCoverage(res, zf, zb)
+	setBuild(res, br.Header())
+	return res, nil
+}
+
+// genomeRefs returns the references that are in g or all of them if g is nil.
+func genomeRefs(refs []*sam.Reference, g *goleft.Genome) []*sam.Reference {
+	if g == nil {
+		return refs
+	}
+	var kept []*sam.Reference
+	for _, ref := range refs {
+		if g.Has(ref.Name()) {
+			kept = append(kept, ref)
+		}
+	}
+	return kept
+}
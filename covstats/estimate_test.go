@@ -0,0 +1,187 @@
+package covstats
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/biogo/hts/bam"
+	"github.com/biogo/hts/sam"
+	"github.com/brentp/goleft"
+	"github.com/brentp/goleft/bamio"
+)
+
+func TestEstimate(t *testing.T) {
+	path := "../depth/test/t.bam"
+	// t.bam has 80K reads in 5KB of chrM so random sites are slow to read.
+	opts := DefaultOptions()
+	opts.First = true
+	res, err := Estimate(path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 1 || res[0].Sample != "Test1" || res[0].Coverage <= 0 {
+		t.Fatalf("unexpected result: %+v", res)
+	}
+	if res[0].CoverageLo > res[0].Coverage || res[0].CoverageHi < res[0].Coverage {
+		t.Errorf("expected coverage within its interval: %+v", res[0])
+	}
+
+	fh, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+	br, err := bam.NewReader(fh, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ifh, err := os.Open(path + ".bai")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ifh.Close()
+	idx, err := bam.ReadIndex(ifh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fres, err := EstimateFromReader(br, idx, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fres[0].Coverage != res[0].Coverage || fres[0].Sample != res[0].Sample {
+		t.Errorf("expected the same result from the reader: %+v %+v", fres[0], res[0])
+	}
+
+	opts = DefaultOptions()
+	opts.Regions = "missing.bed"
+	if _, err := Estimate(path, opts); err == nil {
+		t.Errorf("expected error for missing regions")
+	}
+	opts = DefaultOptions()
+	opts.GC = true
+	if _, err := Estimate(path, opts); err != ErrNoReference {
+		t.Errorf("expected ErrNoReference for GC without a reference, got: %v", err)
+	}
+
+	bad := filepath.Join(t.TempDir(), "bad.bed")
+	if err := os.WriteFile(bad, []byte("chrM\t0\t100\nchrM\tx\t100\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	opts = DefaultOptions()
+	opts.Regions = bad
+	_, err = Estimate(path, opts)
+	var perr *goleft.ParseError
+	if !errors.As(err, &perr) || perr.Line != 2 {
+		t.Errorf("expected a ParseError at line 2, got: %v", err)
+	}
+}
+
+// writeShuffled writes the reads of the bam at path to a new bam in dir in reverse order with the
+// sort order so in the header along with a copy of the now stale index.
+func writeShuffled(t *testing.T, path, dir string, so sam.SortOrder) string {
+	fh, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+	br, err := bam.NewReader(fh, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var recs []*sam.Record
+	for {
+		rec, err := br.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		recs = append(recs, rec)
+	}
+	h := br.Header().Clone()
+	h.SortOrder = so
+	out := filepath.Join(dir, fmt.Sprintf("shuffled-%s.bam", so))
+	ofh, err := os.Create(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bw, err := bam.NewWriter(ofh, h, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := len(recs) - 1; i >= 0; i-- {
+		if err := bw.Write(recs[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := bw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ofh.Close(); err != nil {
+		t.Fatal(err)
+	}
+	bai, err := os.ReadFile(path + ".bai")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(out+".bai", bai, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestUnsorted(t *testing.T) {
+	path := "../depth/test/t.bam"
+	opts := DefaultOptions()
+	h, err := bamio.Header(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if why, err := unsorted(path, h, opts); err != nil || why != "" {
+		t.Fatalf("expected t.bam to be sorted, got: %q %v", why, err)
+	}
+
+	dir := t.TempDir()
+	for _, so := range []sam.SortOrder{sam.UnknownOrder, sam.QueryName} {
+		shuffled := writeShuffled(t, path, dir, so)
+		sh, err := bamio.Header(shuffled)
+		if err != nil {
+			t.Fatal(err)
+		}
+		why, err := unsorted(shuffled, sh, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if why == "" || (so == sam.QueryName && !strings.Contains(why, "queryname")) {
+			t.Errorf("expected %s to be unsorted, got: %q", so, why)
+		}
+
+		// the stale index is ignored so the result is that of a full pass.
+		res, err := Estimate(shuffled, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fh, err := os.Open(shuffled)
+		if err != nil {
+			t.Fatal(err)
+		}
+		br, err := bam.NewReader(fh, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		full, err := EstimateFromReader(br, nil, opts)
+		fh.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res[0].Coverage != full[0].Coverage || res[0].InsertMean != full[0].InsertMean {
+			t.Errorf("expected the result of a full pass for %s: %+v %+v", so, res[0], full[0])
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package covstats
+
+import (
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/biogo/hts/sam"
+	"github.com/brentp/faidx"
+)
+
+// gcWindow is the size of the windows that are assigned a GC content.
+const gcWindow = 100
+
+// gcBinWidth is the width of each GC bin in percent.
+const gcBinWidth = 5
+
+// GCBin holds the reads starting in windows with GC content in [GC, GC + 5) percent.
+type GCBin struct {
+	GC      int `json:"gc"`
+	Windows int `json:"windows"`
+	Reads   int `json:"reads"`
+	// Normalized is the reads per window in this bin relative to the reads per window overall.
+	// A value of 1 indicates no bias.
+	Normalized float64 `json:"normalized_coverage"`
+}
+
+// gcMaxGap is the largest gap, in windows, between sampled reads that is still counted as sampled.
+// Larger gaps occur between regions or random sites.
+const gcMaxGap = 10
+
+// gcReader counts the starts of primary, mapped reads in each window as they are read so that
+// coverage can be stratified by the GC content of the windows spanned by the sample.
+type gcReader struct {
+	RecordReader
+	// the count of read starts in each sampled window, keyed by chromosome. windows between
+	// nearby reads are included with a count of 0.
+	starts map[string]map[int]int
+	chrom  string
+	last   int
+}
+
+func newGCReader(r RecordReader) *gcReader {
+	return &gcReader{RecordReader: r, starts: make(map[string]map[int]int)}
+}
+
+func (g *gcReader) Read() (*sam.Record, error) {
+	rec, err := g.RecordReader.Read()
+	if err != nil || rec.Ref == nil || rec.Flags&(sam.Unmapped|sam.Secondary|sam.Supplementary|sam.QCFail|sam.Duplicate) != 0 {
+		return rec, err
+	}
+	chrom, w := rec.Ref.Name(), rec.Start()/gcWindow
+	m, ok := g.starts[chrom]
+	if !ok {
+		m = make(map[int]int)
+		g.starts[chrom] = m
+	}
+	if chrom == g.chrom && w > g.last && w-g.last <= gcMaxGap {
+		for k := g.last + 1; k < w; k++ {
+			if _, ok := m[k]; !ok {
+				m[k] = 0
+			}
+		}
+	}
+	m[w]++
+	g.chrom, g.last = chrom, w
+	return rec, nil
+}
+
+// gcContent returns the GC percent of seq. ok is false if seq contains an N.
+func gcContent(seq string) (pct int, ok bool) {
+	gc := 0
+	for i := 0; i < len(seq); i++ {
+		switch seq[i] {
+		case 'G', 'C', 'g', 'c':
+			gc++
+		case 'N', 'n':
+			return 0, false
+		}
+	}
+	return 100 * gc / len(seq), true
+}
+
+// bins assigns every sampled window a GC content from the reference and returns the read and
+// window counts for each GC bin. Windows with an N in the reference are skipped.
+func (g *gcReader) bins(fa *faidx.Faidx) ([]GCBin, error) {
+	bins := make([]GCBin, 100/gcBinWidth+1)
+	for i := range bins {
+		bins[i].GC = i * gcBinWidth
+	}
+	windows, reads := 0, 0
+	chroms := make([]string, 0, len(g.starts))
+	for chrom := range g.starts {
+		chroms = append(chroms, chrom)
+	}
+	sort.Strings(chroms)
+	for _, chrom := range chroms {
+		ws := make([]int, 0, len(g.starts[chrom]))
+		for w := range g.starts[chrom] {
+			ws = append(ws, w)
+		}
+		sort.Ints(ws)
+		for _, w := range ws {
+			seq, err := fa.Get(chrom, w*gcWindow, (w+1)*gcWindow)
+			if err != nil {
+				return nil, err
+			}
+			if len(seq) == 0 {
+				continue
+			}
+			pct, ok := gcContent(seq)
+			if !ok {
+				continue
+			}
+			b := &bins[pct/gcBinWidth]
+			b.Windows++
+			b.Reads += g.starts[chrom][w]
+			windows++
+			reads += g.starts[chrom][w]
+		}
+	}
+	if reads == 0 {
+		return bins, nil
+	}
+	mean := float64(reads) / float64(windows)
+	for i := range bins {
+		if bins[i].Windows > 0 {
+			bins[i].Normalized = float64(bins[i].Reads) / float64(bins[i].Windows) / mean
+		}
+	}
+	return bins, nil
+}
+
+// writeGC writes the GC bins for a sample. Bins without any windows are not reported.
+func writeGC(w io.Writer, sample string, bins []GCBin) error {
+	for _, b := range bins {
+		if b.Windows == 0 {
+			continue
+		}
+		if _, err := fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%.3f\n", sample, b.GC, b.Windows, b.Reads, b.Normalized); err != nil {
+			return err
+		}
+	}
+	return nil
+}
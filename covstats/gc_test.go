@@ -0,0 +1,47 @@
+package covstats
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGCContent(t *testing.T) {
+	if pct, ok := gcContent("GGCCAATT"); !ok || pct != 50 {
+		t.Errorf("expected 50%% GC, got: %d %v", pct, ok)
+	}
+	if pct, ok := gcContent("gcgA"); !ok || pct != 75 {
+		t.Errorf("expected lower-case bases to count, got: %d %v", pct, ok)
+	}
+	if _, ok := gcContent("ACGN"); ok {
+		t.Errorf("expected sequence with N to be skipped")
+	}
+}
+
+func TestRunGC(t *testing.T) {
+	gc := filepath.Join(t.TempDir(), "gc.txt")
+	defer func(args []string, stdout *os.File) { os.Args, os.Stdout = args, stdout }(os.Args, os.Stdout)
+	os.Args = []string{"covstats", "--first", "-r", "../depth/test/hg19.fa", "--gc", gc, "../depth/test/t.bam"}
+	devnull, err := os.Create(os.DevNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer devnull.Close()
+	os.Stdout = devnull
+	run()
+
+	b, err := os.ReadFile(gc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(lines) < 2 || !strings.HasPrefix(lines[0], "#sample\tgc") {
+		t.Fatalf("expected a header and GC bins, got: %q", b)
+	}
+	for _, l := range lines[1:] {
+		if !strings.HasPrefix(l, "Test1\t") {
+			t.Errorf("expected a bin for Test1, got: %q", l)
+		}
+	}
+}
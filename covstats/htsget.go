@@ -0,0 +1,97 @@
+package covstats
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/biogo/hts/sam"
+	"github.com/brentp/goleft"
+	"github.com/brentp/goleft/bamio"
+)
+
+// htsgetWindow is the length of the window at each random site whose reads are requested from an
+// htsget server.
+const htsgetWindow = 10000
+
+// sampleWindows returns windows of htsgetWindow bases at the sites that a randomReader would draw
+// in its first round on refs, merged where they overlap and in a random order so that the windows
+// that are read to completion before enough reads are sampled are not all from the first
+// chromosomes.
+func sampleWindows(refs []*sam.Reference, opts Options) []region {
+	r := newRandomReader(nil, nil, refs, opts.N, opts.SampleSites, opts.Seed)
+	if r.total == 0 {
+		return nil
+	}
+	r.draw()
+	windows := make([]region, 0, len(r.sites))
+	for _, s := range r.sites {
+		windows = append(windows, region{chrom: s.ref.Name(), start: s.pos, end: min(s.pos+htsgetWindow, s.ref.Len())})
+	}
+	windows = mergeRegions(windows)
+	r.rng.Shuffle(len(windows), func(i, j int) { windows[i], windows[j] = windows[j], windows[i] })
+	return windows
+}
+
+// estimateHtsget returns the coverage and size info for the reads at the htsget URL path. An htsget
+// server has no index for the mapped count so the coverage is the depth in the regions or, without
+// regions, in windows at random sites. Each is requested from the server as it is read so only the
+// reads of the regions are downloaded. h is the header from the server.
+func estimateHtsget(path string, h *sam.Header, opts Options) ([]Result, error) {
+	regions := opts.regions
+	if regions == nil {
+		regions = sampleWindows(genomeRefs(h.Refs(), opts.Genome), opts)
+		if opts.Chroms {
+			goleft.Warnf("covstats: the coverage of each chromosome is not available for htsget: %s", path)
+		}
+	}
+	rr := newHtsgetRegionReader(path, h, regions)
+	rr.supplementary = opts.LongReads
+	defer rr.close()
+	sizes, byRG, gc, err := sample(rr, h, opts)
+	if err != nil {
+		return nil, err
+	}
+	if sizes.nReads == 0 {
+		return nil, fmt.Errorf("%w from %s", ErrNoReads, path)
+	}
+	// the depth is only known for the regions that were read to completion so the first is finished
+	// if the reads were sampled from it alone.
+	for len(rr.done) == 0 {
+		if _, err := rr.Read(); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	coverage, _ := rr.Coverage()
+	lo, hi := depthCI(rr.done, opts.Bootstrap, opts.Seed)
+	if opts.Bootstrap < 1 {
+		lo, hi = coverage, coverage
+	}
+	// the total reads are not known so the library complexity is not estimated.
+	res := results(bamio.SampleName(h, path), [3]float64{coverage, lo, hi}, 0, sizes, byRG, gc)
+	// windows without reads are mostly in gaps of the reference rather than missing contigs.
+	if opts.regions != nil {
+		zf, zb := doneZeroCoverage(rr.done)
+		setZeroCoverage(res, zf, zb)
+	}
+	setBuild(res, h)
+	return res, nil
+}
+
+// doneZeroCoverage returns the fraction of the regions without reads and of the bases in them among
+// the regions that were read to completion.
+func doneZeroCoverage(done []regionDepth) (frac, bases float64) {
+	n, total := 0, 0
+	for _, d := range done {
+		total += d.length
+		if d.bases == 0 {
+			n++
+			bases += float64(d.length)
+		}
+	}
+	if len(done) == 0 || total == 0 {
+		return 0, 0
+	}
+	return float64(n) / float64(len(done)), bases / float64(total)
+}
@@ -0,0 +1,147 @@
+package covstats
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/biogo/hts/bam"
+	"github.com/brentp/goleft/bamio"
+)
+
+// htsgetServer returns a server for the reads of the bam at path as htsget://host/reads/t that
+// sends only the reads of the region of each ticket and the queries of the tickets for reads.
+func htsgetServer(t *testing.T, path string) (*httptest.Server, *[]url.Values) {
+	fh, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { fh.Close() })
+	br, err := bam.NewReader(fh, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx, err := bamio.ReadIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tickets []url.Values
+	// a client that stops reading a region early may request the next before the last is written.
+	var mu sync.Mutex
+	var srv *httptest.Server
+	srv = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if r.URL.Path == "/reads/t" {
+			if q.Get("class") != "header" {
+				tickets = append(tickets, q)
+			}
+			fmt.Fprintf(w, `{"htsget": {"format": "BAM", "urls": [{"url": "%s/data?%s"}]}}`, srv.URL, q.Encode())
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		bw, err := bam.NewWriter(w, br.Header(), 1)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer bw.Close()
+		chrom := q.Get("referenceName")
+		if q.Get("class") == "header" || chrom == "" {
+			return
+		}
+		var start, end int
+		for _, ref := range br.Header().Refs() {
+			if ref.Name() == chrom {
+				start, end = 0, ref.Len()
+				if s := q.Get("start"); s != "" {
+					start, _ = strconv.Atoi(s)
+				}
+				if e := q.Get("end"); e != "" {
+					end, _ = strconv.Atoi(e)
+				}
+				chunks, err := idx.Chunks(ref, start, end)
+				if err != nil {
+					return
+				}
+				it, err := bam.NewIterator(br, chunks)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				for it.Next() {
+					if rec := it.Record(); rec.Ref == ref && rec.Pos < end && rec.End() > start {
+						bw.Write(rec)
+					}
+				}
+				it.Close()
+			}
+		}
+	}))
+	return srv, &tickets
+}
+
+func TestEstimateHtsget(t *testing.T) {
+	path := "../depth/test/t.bam"
+	srv, tickets := htsgetServer(t, path)
+	defer srv.Close()
+	defer func(c *http.Client) { bamio.HTTPClient = c }(bamio.HTTPClient)
+	bamio.HTTPClient = srv.Client()
+	hpath := "htsget://" + strings.TrimPrefix(srv.URL, "https://") + "/reads/t"
+
+	// with regions, the depth is the same as from the index.
+	bed := filepath.Join(t.TempDir(), "r.bed")
+	if err := os.WriteFile(bed, []byte("chrM\t1000\t3000\nchrM\t5000\t9000\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	opts := DefaultOptions()
+	opts.Regions = bed
+	local, err := Estimate(path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote, err := Estimate(hpath, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if remote[0].Coverage != local[0].Coverage || remote[0].Sample != local[0].Sample {
+		t.Errorf("expected the coverage from the regions of the index: %+v %+v", remote[0], local[0])
+	}
+	if len(*tickets) != 2 {
+		t.Errorf("expected a ticket for each region, got: %v", *tickets)
+	}
+
+	// without regions, only windows at random sites are requested.
+	*tickets = nil
+	opts = DefaultOptions()
+	res, err := Estimate(hpath, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res[0].Coverage <= 0 || res[0].CoverageLo > res[0].Coverage || res[0].CoverageHi < res[0].Coverage {
+		t.Errorf("unexpected coverage from the windows: %+v", res[0])
+	}
+	if len(*tickets) == 0 {
+		t.Fatal("expected tickets for the windows")
+	}
+	bases := 0
+	for _, q := range *tickets {
+		s, err := strconv.Atoi(q.Get("start"))
+		e, eerr := strconv.Atoi(q.Get("end"))
+		if q.Get("referenceName") == "" || err != nil || eerr != nil {
+			t.Fatalf("expected only windows to be requested, got: %v", q)
+		}
+		bases += e - s
+	}
+	// the windows are merged where they overlap.
+	if bases > randomSites*htsgetWindow {
+		t.Errorf("expected at most %d bases to be requested, got: %d", randomSites*htsgetWindow, bases)
+	}
+}
@@ -0,0 +1,287 @@
+package covstats
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	arg "github.com/alexflint/go-arg"
+	"github.com/biogo/hts/sam"
+	"github.com/brentp/goleft"
+	"github.com/brentp/goleft/bamio"
+	"github.com/brentp/xopen"
+)
+
+var cli = struct {
+	N         int      `arg:"-n,help:number of reads to sample for length"`
+	Reference string   `arg:"-r,help:path to reference fasta. required for cram"`
+	Format    string   `arg:"help:output format. one of 'tsv' (with a header) or 'json'. the default is the original headerless columns"`
+	Regions   string   `arg:"-R,help:optional bed file to specify target regions"`
+	Processes int      `arg:"-p,help:number of processes. with fewer bams than processes the rest are used to decompress each bam"`
+	Hist      string   `arg:"help:optional path to write histograms of insert size and template length"`
+	ByRG      bool     `arg:"--by-rg,help:report stats for each read-group"`
+	TrimPct   float64  `arg:"--trim-pct,help:percent of the largest and smallest insert sizes to drop before calculating mean and SD"`
+	MaxMADs   float64  `arg:"--max-mads,help:exclude insert sizes more than this many MADs from the median before calculating mean and SD"`
+	First     bool     `arg:"help:sample the first reads in the bam rather than reads from random offsets across the genome"`
+	Sites     int      `arg:"--sample-sites,help:sample N/K reads from each of K evenly spaced sites across the genome rather than from random offsets"`
+	GC        string   `arg:"--gc,help:optional path to write coverage by GC content of the sampled windows. requires --reference"`
+	Bootstrap int      `arg:"help:number of bootstrap replicates for the 95% confidence interval of the coverage. 0 disables"`
+	Seed      int64    `arg:"--seed,help:seed for the random offsets and the bootstrap. the output for a bam is the same in every run with the same seed and -n"`
+	Chroms    string   `arg:"--chroms,help:optional path to write mapped reads and coverage for each chromosome and the coverage relative to the autosomes"`
+	LongReads bool     `arg:"--long-reads,help:for ONT or PacBio reads. include supplementary alignments and estimate coverage from aligned rather than read length"`
+	Complex   string   `arg:"--complexity,help:optional path to write the unique molecules and duplicate rate expected from sequencing each sample to 1 2 4 8 and 16 times the current reads"`
+	MultiQC   string   `arg:"--multiqc,help:optional path ending in _mqc.json to write the stats as a table for MultiQC"`
+	Fai       string   `arg:"--fai,help:optional .fai or genome file. only its contigs are used for the coverage and --chroms"`
+	MinCov    float64  `arg:"--min-coverage,help:exit with 3 if the coverage of a sample is below this"`
+	MaxInsSD  float64  `arg:"--max-insert-sd,help:exit with 3 if the insert-size SD of a sample is above this"`
+	MaxDups   float64  `arg:"--max-duplicate-rate,help:exit with 3 if the duplicate rate of a sample is above this"`
+	MinProper float64  `arg:"--min-proper-pair-fraction,help:exit with 3 if the proper-pair fraction of a sample is below this"`
+	MaxNM     float64  `arg:"--max-nm-rate,help:exit with 3 if the NM per aligned base of a sample is above this"`
+	Build     string   `arg:"--expect-build,help:exit with 3 if the genome build from the header of a sample is not this: GRCh37 or hg19 or GRCh38 or CHM13"`
+	Bams      []string `arg:"positional,required,help:bam(s) or cram(s) for which to estimate coverage. may also be a glob or a file with one path per line or '-' for a bam stream on stdin or the URL of a bam including htsget://"`
+}{N: 100000, Processes: 1, Bootstrap: 200, Seed: 42}
+
+func pcheck(e error) {
+	if e != nil {
+		log.Fatal(e)
+	}
+}
+
+// getMapped returns the number of mapped reads for each reference from the bam index or,
+// for cram, from samtools idxstats.
+func getMapped(path string, idx *bamio.Index, refs []*sam.Reference) (map[string]uint64, error) {
+	if bamio.IsCRAM(path) {
+		return bamio.IdxStats(path)
+	}
+	m := make(map[string]uint64, len(refs))
+	for _, ref := range refs {
+		if n, ok := idx.Mapped(ref.ID()); ok {
+			m[ref.Name()] = n
+		}
+	}
+	return m, nil
+}
+
+// expandPaths turns the positional arguments into a list of alignment files.
+// each argument can be a bam/cram, a URL, a glob, or a file containing one path per line.
+// For backwards compatibility, a bed file is used as the regions.
+func expandPaths(args []string) (paths []string, regions string) {
+	for _, a := range args {
+		la := strings.ToLower(a)
+		switch {
+		case a == "-" || strings.HasSuffix(la, ".bam") || strings.HasSuffix(la, ".cram"):
+			paths = append(paths, a)
+		case strings.HasSuffix(la, ".bed") || strings.HasSuffix(la, ".bed.gz"):
+			regions = a
+		case bamio.IsHtsget(a) || bamio.IsRemote(a):
+			// URLs may have no extension or a query with a '?'.
+			paths = append(paths, a)
+		case strings.ContainsAny(a, "*?["):
+			matches, err := filepath.Glob(a)
+			pcheck(err)
+			paths = append(paths, matches...)
+		default:
+			fh, err := xopen.Ropen(a)
+			pcheck(err)
+			for {
+				line, err := fh.ReadString('\n')
+				if line = strings.TrimSpace(line); line != "" {
+					paths = append(paths, line)
+				}
+				if err == io.EOF {
+					break
+				}
+				pcheck(err)
+			}
+			fh.Close()
+		}
+	}
+	return paths, regions
+}
+
+// Main is called from the dispatcher
+func Main() {
+	if n := run(); n > 0 {
+		goleft.Warnf("covstats: %d sample(s) failed the QC thresholds", n)
+		os.Exit(qcExitCode)
+	}
+}
+
+// run writes the results and returns the number that fail the thresholds.
+func run() int {
+	p := arg.MustParse(&cli)
+	if cli.Format != "" && cli.Format != "tsv" && cli.Format != "json" {
+		p.Fail("covstats: --format must be 'tsv' or 'json'")
+	}
+	paths, regionsPath := expandPaths(cli.Bams)
+	if regionsPath != "" && cli.Regions == "" {
+		cli.Regions = regionsPath
+	}
+	if len(paths) == 0 {
+		p.Fail("covstats: expected at least 1 bam or cram")
+	}
+	if cli.GC != "" && cli.Reference == "" {
+		p.Fail("covstats: --gc requires --reference")
+	}
+	if cli.Chroms != "" && cli.Regions != "" {
+		p.Fail("covstats: --chroms can not be used with --regions")
+	}
+	if cli.Sites < 0 {
+		p.Fail("covstats: --sample-sites must be at least 0")
+	}
+	if cli.Build != "" {
+		b, ok := knownBuild(cli.Build)
+		if !ok || b == "unknown" {
+			p.Fail(fmt.Sprintf("covstats: unknown --expect-build %s", cli.Build))
+		}
+		cli.Build = b
+	}
+	if cli.Processes < 1 {
+		cli.Processes = 1
+	}
+
+	// bams are processed in parallel and the --threads, or the processes if there are more, are
+	// divided among them to decompress each bam.
+	workers := min(cli.Processes, len(paths))
+	opts := Options{N: cli.N, Reference: cli.Reference, Regions: cli.Regions, ByRG: cli.ByRG, TrimPct: cli.TrimPct,
+		MaxMADs: cli.MaxMADs, First: cli.First, SampleSites: cli.Sites, GC: cli.GC != "", Bootstrap: cli.Bootstrap,
+		Threads: max(1, max(cli.Processes, goleft.NumThreads())/workers), LongReads: cli.LongReads, Chroms: cli.Chroms != "", Seed: cli.Seed}
+	if cli.Fai != "" {
+		var err error
+		if opts.Genome, err = goleft.ReadGenome(cli.Fai); err != nil {
+			log.Fatal(err)
+		}
+	}
+	// parse the regions once and share them across samples.
+	if err := opts.init(); err != nil {
+		log.Fatal(err)
+	}
+
+	type indexed struct {
+		i int
+		r []Result
+	}
+	jobs := make(chan int)
+	resultc := make(chan indexed, cli.Processes)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for k := 0; k < workers; k++ {
+		go func() {
+			for i := range jobs {
+				goleft.Infof("covstats: %s", paths[i])
+				r, err := Estimate(paths[i], opts)
+				if err != nil {
+					log.Fatalf("covstats: error with %s: %s", paths[i], err)
+				}
+				if len(r) > 0 && r[0].SingleEnd {
+					goleft.Infof("covstats: no paired reads in %s. insert sizes are not estimated", paths[i])
+				}
+				if len(r) > 0 && r[0].MatePair {
+					goleft.Infof("covstats: %s looks like a mate-pair library with %.1f%% of pairs in RF orientation", paths[i], 100*r[0].RFFrac)
+				}
+				resultc <- indexed{i, r}
+			}
+			wg.Done()
+		}()
+	}
+	go func() {
+		for i := range paths {
+			jobs <- i
+		}
+		close(jobs)
+		wg.Wait()
+		close(resultc)
+	}()
+
+	var hist *bufio.Writer
+	if cli.Hist != "" {
+		hfh, err := os.Create(cli.Hist)
+		pcheck(err)
+		defer hfh.Close()
+		hist = bufio.NewWriter(hfh)
+		defer hist.Flush()
+		fmt.Fprintln(hist, "#sample\tsize\tinsert_count\ttemplate_count")
+	}
+	var gcw *bufio.Writer
+	if cli.GC != "" {
+		gfh, err := os.Create(cli.GC)
+		pcheck(err)
+		defer gfh.Close()
+		gcw = bufio.NewWriter(gfh)
+		defer gcw.Flush()
+		fmt.Fprintln(gcw, "#sample\tgc\twindows\treads\tnormalized_coverage")
+	}
+	var chw *bufio.Writer
+	if cli.Chroms != "" {
+		cfh, err := os.Create(cli.Chroms)
+		pcheck(err)
+		defer cfh.Close()
+		chw = bufio.NewWriter(cfh)
+		defer chw.Flush()
+		fmt.Fprintln(chw, "#sample\tchrom\tlength\tmapped_reads\tcoverage\trelative_coverage")
+	}
+
+	var cxw *bufio.Writer
+	if cli.Complex != "" {
+		xfh, err := os.Create(cli.Complex)
+		pcheck(err)
+		defer xfh.Close()
+		cxw = bufio.NewWriter(xfh)
+		defer cxw.Flush()
+		fmt.Fprintln(cxw, "#sample\tmultiple\tmolecules\tunique_molecules\tduplicate_rate")
+	}
+
+	qc := thresholds{minCoverage: cli.MinCov, maxInsertSD: cli.MaxInsSD, maxDuplicateRate: cli.MaxDups,
+		minProperPair: cli.MinProper, maxNMRate: cli.MaxNM, build: cli.Build}
+	failed := 0
+	var all []Result
+	// write results in the same order as the input.
+	w := newResultWriter(os.Stdout, cli.Format, len(paths) > 1 || cli.ByRG)
+	w.readGroups = cli.ByRG
+	pending := make(map[int][]Result)
+	next := 0
+	for ir := range resultc {
+		pending[ir.i] = ir.r
+		for rs, ok := pending[next]; ok; rs, ok = pending[next] {
+			for _, r := range rs {
+				if err := w.Write(r); err != nil {
+					log.Fatal(err)
+				}
+				if hist != nil {
+					pcheck(writeHist(hist, r))
+				}
+				if gcw != nil && r.GC != nil {
+					pcheck(writeGC(gcw, r.Sample, r.GC))
+				}
+				if chw != nil && r.Chroms != nil {
+					pcheck(writeChroms(chw, r.Sample, r.Chroms))
+				}
+				if cxw != nil {
+					pcheck(writeComplexity(cxw, r))
+				}
+				if cli.MultiQC != "" {
+					all = append(all, r)
+				}
+				if fs := qc.failures(r); len(fs) > 0 {
+					name := r.Sample
+					if r.ReadGroup != "" {
+						name += ":" + r.ReadGroup
+					}
+					goleft.Warnf("covstats: %s failed QC: %s", name, strings.Join(fs, ", "))
+					failed++
+				}
+			}
+			delete(pending, next)
+			next++
+		}
+	}
+	if cli.MultiQC != "" {
+		pcheck(goleft.WriteMultiQC(cli.MultiQC, multiQC(all)))
+	}
+	return failed
+}
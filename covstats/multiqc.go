@@ -0,0 +1,50 @@
+package covstats
+
+import "github.com/brentp/goleft"
+
+// multiQCHeaders are the columns of the covstats table in a MultiQC report.
+var multiQCHeaders = []goleft.MultiQCHeader{
+	{Key: "coverage", Title: "Coverage", Description: "estimated mean coverage", Format: "{:,.1f}", Suffix: "X", Scale: "RdYlGn"},
+	{Key: "insert_median", Title: "Insert median", Description: "median insert size", Format: "{:,.0f}", Scale: "PuBu"},
+	{Key: "insert_sd", Title: "Insert SD", Description: "standard deviation of the insert size", Format: "{:,.1f}", Scale: "OrRd"},
+	{Key: "read_len_median", Title: "Read length", Description: "median read length", Format: "{:,.0f}", Scale: "Blues"},
+	{Key: "duplicate_rate", Title: "Duplicates", Description: "fraction of sampled reads marked as duplicates", Format: "{:,.3f}", Scale: "OrRd", Max: 1},
+	{Key: "proper_pair_fraction", Title: "Proper pairs", Description: "fraction of sampled reads that are properly paired", Format: "{:,.3f}", Scale: "RdYlGn", Max: 1},
+	{Key: "secondary_supplementary_fraction", Title: "Sec/supp", Description: "fraction of sampled alignments that are secondary or supplementary", Format: "{:,.3f}", Scale: "OrRd", Max: 1},
+	{Key: "nm_rate", Title: "NM rate", Description: "mismatches and indels (NM) per aligned base", Format: "{:,.4f}", Scale: "OrRd"},
+	{Key: "duplicate_rate_2x", Title: "Duplicates 2X", Description: "duplicate rate expected from sequencing twice the reads", Format: "{:,.3f}", Scale: "OrRd", Max: 1},
+	{Key: "zero_coverage_bases", Title: "No reads", Description: "fraction of the genome or target bases in contigs or targets without mapped reads", Format: "{:,.3f}", Scale: "OrRd", Max: 1},
+	{Key: "build", Title: "Build", Description: "genome build from the @SQ lengths of the header"},
+}
+
+// multiQC returns the results as a table for MultiQC. Samples with read-groups are named sample:rg.
+func multiQC(results []Result) goleft.MultiQC {
+	m := goleft.MultiQC{ID: "goleft_covstats", Section: "goleft covstats", Headers: multiQCHeaders,
+		Description: "coverage and insert sizes estimated by goleft covstats from a sample of reads",
+		Data:        make(map[string]map[string]interface{}, len(results))}
+	for _, r := range results {
+		name := r.Sample
+		if r.ReadGroup != "" {
+			name += ":" + r.ReadGroup
+		}
+		m.Data[name] = map[string]interface{}{
+			"coverage":                         r.Coverage,
+			"insert_median":                    r.InsertMedian,
+			"insert_sd":                        r.InsertSD,
+			"read_len_median":                  r.ReadLengthMedian,
+			"duplicate_rate":                   r.DuplicateRate,
+			"proper_pair_fraction":             r.ProperPairFrac,
+			"secondary_supplementary_fraction": r.SecondarySuppFrac,
+			"nm_rate":                          r.NMRate,
+			"duplicate_rate_2x":                r.DuplicateRate2X,
+			"zero_coverage_bases":              r.ZeroCoverageBases,
+			"build":                            r.Build,
+		}
+		if r.SingleEnd {
+			delete(m.Data[name], "insert_median")
+			delete(m.Data[name], "insert_sd")
+			delete(m.Data[name], "proper_pair_fraction")
+		}
+	}
+	return m
+}
@@ -0,0 +1,166 @@
+package covstats
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Result holds the values reported by covstats for a single bam.
+type Result struct {
+	Sample    string  `json:"sample"`
+	ReadGroup string  `json:"read_group,omitempty"`
+	Coverage  float64 `json:"coverage"`
+	// bounds of the 95% bootstrap confidence interval of Coverage.
+	CoverageLo float64 `json:"coverage_lo"`
+	CoverageHi float64 `json:"coverage_hi"`
+	Sizes
+	// GC is the coverage by GC content. It is only set with Options.GC.
+	GC []GCBin `json:"-"`
+	// Chroms is the coverage of each chromosome. It is only set with Options.Chroms.
+	Chroms []ChromCoverage `json:"-"`
+	// LibrarySize is the estimated number of unique molecules (pairs for paired-end) in the library
+	// from the number of reads and the duplicate rate of the sampled reads. It is 0 if no sampled
+	// reads are marked as duplicates.
+	LibrarySize float64 `json:"library_size"`
+	// DuplicateRate2X is the duplicate rate expected if the library is sequenced to twice the reads.
+	DuplicateRate2X float64 `json:"duplicate_rate_2x"`
+	// Build is the reference genome build from the header. See GenomeBuild.
+	Build string `json:"build"`
+	// ZeroCoverageFrac is the fraction of the contigs, or of the target regions, with no mapped reads
+	// and ZeroCoverageBases is the fraction of the genome or target bases in them. A high value
+	// indicates a partial alignment, e.g. after a merge that stopped early.
+	ZeroCoverageFrac  float64 `json:"zero_coverage_fraction"`
+	ZeroCoverageBases float64 `json:"zero_coverage_bases"`
+	// number of molecules sequenced for the projections of writeComplexity.
+	molecules float64
+}
+
+// names of the columns in the same order as Result.Values.
+var header = []string{"coverage", "insert_mean", "insert_sd", "template_mean", "template_sd", "read_len_median",
+	"insert_median", "insert_mad", "insert_p5", "insert_p25", "insert_p75", "insert_p95",
+	"duplicate_rate", "secondary_supplementary_fraction", "proper_pair_fraction", "coverage_lo", "coverage_hi",
+	"single_end", "read_len_n50", "aligned_fraction", "identity", "fr_fraction", "rf_fraction", "ff_fraction",
+	"orientation", "mate_pair", "soft_clip_mean", "nm_rate",
+	"library_size", "duplicate_rate_2x", "build", "zero_coverage_fraction", "zero_coverage_bases"}
+
+// Values returns the formatted values for each column in header.
+func (r Result) Values() []string {
+	return []string{
+		fmt.Sprintf("%.2f", r.Coverage),
+		fmt.Sprintf("%.2f", r.InsertMean),
+		fmt.Sprintf("%.2f", r.InsertSD),
+		fmt.Sprintf("%.2f", r.TemplateMean),
+		fmt.Sprintf("%.2f", r.TemplateSD),
+		fmt.Sprintf("%.0f", r.ReadLengthMedian),
+		fmt.Sprintf("%.0f", r.InsertMedian),
+		fmt.Sprintf("%.0f", r.InsertMAD),
+		fmt.Sprintf("%.0f", r.InsertP5),
+		fmt.Sprintf("%.0f", r.InsertP25),
+		fmt.Sprintf("%.0f", r.InsertP75),
+		fmt.Sprintf("%.0f", r.InsertP95),
+		fmt.Sprintf("%.4f", r.DuplicateRate),
+		fmt.Sprintf("%.4f", r.SecondarySuppFrac),
+		fmt.Sprintf("%.4f", r.ProperPairFrac),
+		fmt.Sprintf("%.2f", r.CoverageLo),
+		fmt.Sprintf("%.2f", r.CoverageHi),
+		fmt.Sprintf("%v", r.SingleEnd),
+		fmt.Sprintf("%.0f", r.ReadLengthN50),
+		fmt.Sprintf("%.4f", r.AlignedFraction),
+		fmt.Sprintf("%.4f", r.Identity),
+		fmt.Sprintf("%.4f", r.FRFrac),
+		fmt.Sprintf("%.4f", r.RFFrac),
+		fmt.Sprintf("%.4f", r.FFFrac),
+		r.Orientation,
+		fmt.Sprintf("%v", r.MatePair),
+		fmt.Sprintf("%.2f", r.SoftClipMean),
+		fmt.Sprintf("%.5f", r.NMRate),
+		fmt.Sprintf("%.0f", r.LibrarySize),
+		fmt.Sprintf("%.4f", r.DuplicateRate2X),
+		r.Build,
+		fmt.Sprintf("%.4f", r.ZeroCoverageFrac),
+		fmt.Sprintf("%.4f", r.ZeroCoverageBases),
+	}
+}
+
+// writeHist writes the count of each observed insert size and template length.
+func writeHist(w io.Writer, r Result) error {
+	counts := make(map[int][2]int)
+	for _, v := range r.insertSizes {
+		c := counts[v]
+		c[0]++
+		counts[v] = c
+	}
+	for _, v := range r.templateLengths {
+		c := counts[v]
+		c[1]++
+		counts[v] = c
+	}
+	keys := make([]int, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+	for _, k := range keys {
+		name := r.Sample
+		if r.ReadGroup != "" {
+			name += ":" + r.ReadGroup
+		}
+		if _, err := fmt.Fprintf(w, "%s\t%d\t%d\t%d\n", name, k, counts[k][0], counts[k][1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type resultWriter struct {
+	w      io.Writer
+	format string
+	// if labeled is true, the sample name is included in the headerless output.
+	labeled bool
+	// if readGroups is true, the read-group is included in the output.
+	readGroups  bool
+	wroteHeader bool
+}
+
+// newResultWriter returns a writer for the requested format. An empty format gives the original
+// headerless output.
+func newResultWriter(w io.Writer, format string, labeled bool) *resultWriter {
+	return &resultWriter{w: w, format: format, labeled: labeled}
+}
+
+// Write writes a single result. For json, each result is a single line.
+func (rw *resultWriter) Write(r Result) error {
+	var err error
+	switch rw.format {
+	case "json":
+		err = json.NewEncoder(rw.w).Encode(r)
+	case "tsv":
+		label := r.Sample
+		if rw.readGroups {
+			label += "\t" + r.ReadGroup
+		}
+		if !rw.wroteHeader {
+			rw.wroteHeader = true
+			h := "sample"
+			if rw.readGroups {
+				h += "\tread_group"
+			}
+			if _, err = fmt.Fprintf(rw.w, "%s\t%s\n", h, strings.Join(header, "\t")); err != nil {
+				return err
+			}
+		}
+		_, err = fmt.Fprintf(rw.w, "%s\t%s\n", label, strings.Join(r.Values(), "\t"))
+	default:
+		if rw.readGroups {
+			_, err = fmt.Fprintf(rw.w, "%s\t%s\t%.2f\t%s\n", r.Sample, r.ReadGroup, r.Coverage, r.Sizes.String())
+		} else if rw.labeled {
+			_, err = fmt.Fprintf(rw.w, "%s\t%.2f\t%s\n", r.Sample, r.Coverage, r.Sizes.String())
+		} else {
+			_, err = fmt.Fprintf(rw.w, "%.2f\t%s\n", r.Coverage, r.Sizes.String())
+		}
+	}
+	return err
+}
@@ -0,0 +1,62 @@
+package covstats
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestWriteResult(t *testing.T) {
+	r := Result{Sample: "s1", Coverage: 31.234, Sizes: Sizes{InsertMean: 300, InsertSD: 50, TemplateMean: 500, TemplateSD: 60, ReadLengthMedian: 150}}
+
+	var b bytes.Buffer
+	w := newResultWriter(&b, "tsv", true)
+	for i := 0; i < 2; i++ {
+		if err := w.Write(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expected header and 2 rows, got: %q", b.String())
+	}
+	if len(strings.Split(lines[0], "\t")) != len(strings.Split(lines[1], "\t")) {
+		t.Errorf("header and row have different lengths: %q", b.String())
+	}
+	if !strings.HasPrefix(lines[1], "s1\t31.23\t300.00") {
+		t.Errorf("unexpected row: %s", lines[1])
+	}
+
+	b.Reset()
+	if err := newResultWriter(&b, "json", true).Write(r); err != nil {
+		t.Fatal(err)
+	}
+	m := make(map[string]interface{})
+	if err := json.Unmarshal(b.Bytes(), &m); err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range append(header, "sample") {
+		if _, ok := m[k]; !ok {
+			t.Errorf("expected key %s in json output: %s", k, b.String())
+		}
+	}
+}
+
+func TestMultiQC(t *testing.T) {
+	rs := []Result{{Sample: "s1", Coverage: 30, Build: "GRCh38", Sizes: Sizes{InsertSD: 50, ProperPairFrac: 0.9}},
+		{Sample: "s2", ReadGroup: "rg1", Coverage: 12, Sizes: Sizes{SingleEnd: true}}}
+	m := multiQC(rs)
+	if len(m.Data) != 2 || m.Data["s1"]["coverage"] != 30.0 || m.Data["s1"]["build"] != "GRCh38" {
+		t.Fatalf("unexpected data: %v", m.Data)
+	}
+	// single-end reads have no insert sizes.
+	if _, ok := m.Data["s2:rg1"]["insert_sd"]; ok {
+		t.Errorf("expected no insert SD for single-end reads, got: %v", m.Data["s2:rg1"])
+	}
+	for _, h := range m.Headers {
+		if _, ok := m.Data["s1"][h.Key]; !ok {
+			t.Errorf("expected a value for %s", h.Key)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package covstats
+
+import "fmt"
+
+// qcExitCode is the exit code when a sample fails a threshold. It differs from the exit code of
+// log.Fatal so that a workflow can tell a bad sample from an error.
+const qcExitCode = 3
+
+// thresholds are the QC limits on the results. A zero value is not checked.
+type thresholds struct {
+	minCoverage, maxInsertSD, maxDuplicateRate, minProperPair, maxNMRate float64
+	// build is the expected genome build. An empty string is not checked.
+	build string
+}
+
+// failures returns a message for each threshold that r fails.
+func (t thresholds) failures(r Result) []string {
+	var out []string
+	check := func(fail bool, name string, v, limit float64) {
+		if fail {
+			out = append(out, fmt.Sprintf("%s: %.4g (limit %.4g)", name, v, limit))
+		}
+	}
+	check(t.minCoverage > 0 && r.Coverage < t.minCoverage, "coverage", r.Coverage, t.minCoverage)
+	// single-end data has no insert sizes or proper pairs.
+	check(t.maxInsertSD > 0 && !r.SingleEnd && r.InsertSD > t.maxInsertSD, "insert_sd", r.InsertSD, t.maxInsertSD)
+	check(t.minProperPair > 0 && !r.SingleEnd && r.ProperPairFrac < t.minProperPair, "proper_pair_fraction", r.ProperPairFrac, t.minProperPair)
+	check(t.maxDuplicateRate > 0 && r.DuplicateRate > t.maxDuplicateRate, "duplicate_rate", r.DuplicateRate, t.maxDuplicateRate)
+	check(t.maxNMRate > 0 && r.NMRate > t.maxNMRate, "nm_rate", r.NMRate, t.maxNMRate)
+	if t.build != "" && r.Build != t.build {
+		out = append(out, fmt.Sprintf("build: %s (expected %s)", r.Build, t.build))
+	}
+	return out
+}
@@ -0,0 +1,64 @@
+package covstats
+
+import (
+	"testing"
+
+	"github.com/biogo/hts/sam"
+)
+
+func TestFailures(t *testing.T) {
+	qc := thresholds{minCoverage: 20, maxInsertSD: 150, maxDuplicateRate: 0.2, minProperPair: 0.9}
+	good := Result{Coverage: 30, Sizes: Sizes{InsertSD: 100, DuplicateRate: 0.1, ProperPairFrac: 0.95, NMRate: 0.05}}
+	if fs := qc.failures(good); len(fs) != 0 {
+		t.Errorf("expected no failures, got: %v", fs)
+	}
+	bad := good
+	bad.Coverage, bad.InsertSD = 10, 200
+	if fs := qc.failures(bad); len(fs) != 2 {
+		t.Errorf("expected coverage and insert_sd failures, got: %v", fs)
+	}
+	// single-end samples have no insert sizes or proper pairs to check.
+	se := Result{Coverage: 30, Sizes: Sizes{SingleEnd: true}}
+	if fs := qc.failures(se); len(fs) != 0 {
+		t.Errorf("expected no failures for single-end, got: %v", fs)
+	}
+	if fs := (thresholds{}).failures(Result{}); len(fs) != 0 {
+		t.Errorf("expected no failures without thresholds, got: %v", fs)
+	}
+}
+
+func TestGenomeBuild(t *testing.T) {
+	header := func(names []string, lengths []int) *sam.Header {
+		var refs []*sam.Reference
+		for i, n := range names {
+			ref, err := sam.NewReference(n, "", "", lengths[i], nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			refs = append(refs, ref)
+		}
+		h, err := sam.NewHeader(nil, refs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+	for exp, h := range map[string]*sam.Header{
+		"GRCh37":  header([]string{"1", "2", "MT"}, []int{249250621, 243199373, 16569}),
+		"hg19":    header([]string{"chr1", "chrX", "chrM"}, []int{249250621, 155270560, 16571}),
+		"GRCh38":  header([]string{"chr1", "chr2", "chrX"}, []int{248956422, 242193529, 156040895}),
+		"CHM13":   header([]string{"chr1"}, []int{248387328}),
+		"unknown": header([]string{"chrM", "chr22"}, []int{16571, 51304566}),
+	} {
+		if got := GenomeBuild(h); got != exp {
+			t.Errorf("expected %s, got: %s", exp, got)
+		}
+	}
+	// a chromosome 2 from another build is not a match.
+	if got := GenomeBuild(header([]string{"1", "2"}, []int{248956422, 243199373})); got != "unknown" {
+		t.Errorf("expected unknown for mixed lengths, got: %s", got)
+	}
+	if fs := (thresholds{build: "GRCh38"}).failures(Result{Build: "hg19"}); len(fs) != 1 {
+		t.Errorf("expected a build failure, got: %v", fs)
+	}
+}
@@ -0,0 +1,223 @@
+package covstats
+
+import (
+	"io"
+	"math/rand"
+	"sort"
+
+	"github.com/biogo/hts/bam"
+	"github.com/biogo/hts/sam"
+	"github.com/brentp/goleft/bamio"
+)
+
+// randomSites is the number of offsets sampled in each round by a randomReader.
+const randomSites = 100
+
+// maxRounds limits the number of rounds so that a sparse bam can not cause an endless search.
+const maxRounds = 50
+
+// siteWindow is the number of bases after a site whose reads are read for it, which is plenty for
+// perSite reads.
+const siteWindow = 1000000
+
+type site struct {
+	ref *sam.Reference
+	pos int
+}
+
+// randomReader uses the bam index to seek to random offsets across the genome and returns
+// perSite reads from each. The first N reads in a bam are all from the start of the first
+// chromosome which often has atypical coverage and insert sizes. Sites are drawn in rounds of
+// randomSites so that the caller can read until it has enough. With spaced sites, the first
+// round is that many evenly spaced sites instead. The positions that have been read are tracked so
+// that no read is returned twice and it stops after a round that finds no new reads.
+type randomReader struct {
+	br      *bam.Reader
+	idx     *bamio.Index
+	refs    []*sam.Reference
+	total   int
+	rng     *rand.Rand
+	perSite int
+	spaced  int
+
+	sites  []site
+	rounds int
+	it     *bam.Iterator
+	cur    site
+	n      int
+	// last is the position of the last read returned for cur or -1.
+	last int
+	// at is the position of the last read from it and end is the end of the window of its chunks.
+	at, end int
+	// sampled are the sorted, merged positions of each chromosome, by ID, from which reads were
+	// returned or that have none. Every read that starts in them was returned or skipped so they
+	// are not read again.
+	sampled map[int][]region
+	// reads returned in the current round.
+	found int
+}
+
+// newRandomReader returns a randomReader that uses refs with mapped reads. n is the number of
+// reads the caller expects to need. If spaced is greater than 0, n/spaced reads are taken from
+// each of spaced evenly spaced sites before any random sites are drawn. The random sites are drawn
+// from seed.
+func newRandomReader(br *bam.Reader, idx *bamio.Index, refs []*sam.Reference, n, spaced int, seed int64) *randomReader {
+	r := &randomReader{br: br, idx: idx, refs: refs, rng: rand.New(rand.NewSource(seed)), spaced: spaced, last: -1,
+		sampled: make(map[int][]region)}
+	for _, ref := range refs {
+		r.total += ref.Len()
+	}
+	if spaced > 0 {
+		r.perSite = max(n/spaced, 1)
+	} else {
+		r.perSite = max(n/randomSites, 1)
+	}
+	return r
+}
+
+// draw chooses the sites for the next round with probability proportional to chromosome length.
+// The first round is evenly spaced across the genome if spaced sites were requested.
+func (r *randomReader) draw() {
+	r.sites = r.sites[:0]
+	spaced := r.rounds == 0 && r.spaced > 0
+	n := randomSites
+	if spaced {
+		n = r.spaced
+	}
+	for i := 0; i < n; i++ {
+		var off int
+		if spaced {
+			off = int((float64(i) + 0.5) * float64(r.total) / float64(n))
+		} else {
+			off = r.rng.Intn(r.total)
+		}
+		for _, ref := range r.refs {
+			if off < ref.Len() {
+				r.sites = append(r.sites, site{ref: ref, pos: off})
+				break
+			}
+			off -= ref.Len()
+		}
+	}
+	// visit the sites in order so the seeks are mostly forward.
+	sort.Slice(r.sites, func(i, j int) bool {
+		if r.sites[i].ref.ID() != r.sites[j].ref.ID() {
+			return r.sites[i].ref.ID() < r.sites[j].ref.ID()
+		}
+		return r.sites[i].pos < r.sites[j].pos
+	})
+	r.rounds++
+}
+
+// next seeks to the next site for which the index has data and that has not been read. The open
+// iterator is kept for a site further on the same chromosome if its chunks have the reads of the
+// site so that short chromosomes with many sites are not read again from the start for each.
+func (r *randomReader) next() error {
+	if r.last >= 0 {
+		r.addSampled(r.cur.ref.ID(), region{start: r.cur.pos, end: r.last + 1})
+	}
+	for {
+		if len(r.sites) == 0 {
+			// a round without new reads means that the rest are unlikely to find any.
+			if r.rounds >= maxRounds || r.total == 0 || (r.rounds > 0 && r.found == 0) {
+				return r.close()
+			}
+			r.draw()
+			r.found = 0
+		}
+		prev := r.cur
+		r.cur, r.sites = r.sites[0], r.sites[1:]
+		r.n, r.last = 0, -1
+		if _, ok := r.inSampled(r.cur.ref.ID(), r.cur.pos); ok {
+			continue
+		}
+		end := min(r.cur.pos+siteWindow, r.cur.ref.Len())
+		if r.it != nil && r.cur.ref == prev.ref && r.cur.pos > r.at && r.end >= end {
+			return nil
+		}
+		if err := r.close(); err != io.EOF {
+			return err
+		}
+		chunks, err := r.idx.Chunks(r.cur.ref, r.cur.pos, end)
+		if err != nil || len(chunks) == 0 {
+			continue
+		}
+		r.at, r.end = -1, end
+		r.it, err = bam.NewIterator(r.br, chunks)
+		return err
+	}
+}
+
+// close closes the iterator, if any, and returns io.EOF if that succeeds.
+func (r *randomReader) close() error {
+	if r.it == nil {
+		return io.EOF
+	}
+	err := r.it.Close()
+	r.it = nil
+	if err != nil {
+		return err
+	}
+	return io.EOF
+}
+
+// Read returns the next read at or after the current site.
+func (r *randomReader) Read() (*sam.Record, error) {
+	for {
+		if r.it == nil || r.n >= r.perSite {
+			if err := r.next(); err != nil {
+				return nil, err
+			}
+		}
+		if !r.it.Next() {
+			if err := r.it.Error(); err != nil {
+				return nil, err
+			}
+			// no reads start after the last one in the window.
+			if start := max(r.at+1, r.cur.pos); start < r.end {
+				r.addSampled(r.cur.ref.ID(), region{start: start, end: r.end})
+			}
+			if err := r.close(); err != io.EOF {
+				return nil, err
+			}
+			continue
+		}
+		rec := r.it.Record()
+		if rec.Ref == nil || rec.Ref.ID() != r.cur.ref.ID() {
+			continue
+		}
+		r.at = rec.Pos
+		if rec.Pos < r.cur.pos {
+			continue
+		}
+		if _, ok := r.inSampled(rec.Ref.ID(), rec.Pos); ok {
+			// the reads from here were returned for an earlier site.
+			r.n = r.perSite
+			continue
+		}
+		r.n++
+		r.found++
+		r.last = rec.Pos
+		return rec, nil
+	}
+}
+
+// inSampled returns the index of the sampled region of the chromosome with ID id that contains
+// pos.
+func (r *randomReader) inSampled(id, pos int) (int, bool) {
+	regs := r.sampled[id]
+	i := sort.Search(len(regs), func(i int) bool { return regs[i].end > pos })
+	return i, i < len(regs) && regs[i].start <= pos
+}
+
+// addSampled adds reg to the sampled regions of the chromosome with ID id, merging it with those
+// it overlaps or touches.
+func (r *randomReader) addSampled(id int, reg region) {
+	regs := r.sampled[id]
+	i := sort.Search(len(regs), func(i int) bool { return regs[i].end >= reg.start })
+	j := i
+	for ; j < len(regs) && regs[j].start <= reg.end; j++ {
+		reg.start, reg.end = min(reg.start, regs[j].start), max(reg.end, regs[j].end)
+	}
+	r.sampled[id] = append(regs[:i], append([]region{reg}, regs[j:]...)...)
+}
@@ -0,0 +1,117 @@
+package covstats
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/biogo/hts/sam"
+	"github.com/brentp/goleft/bamio"
+)
+
+func TestDraw(t *testing.T) {
+	var refs []*sam.Reference
+	for _, name := range []string{"1", "2"} {
+		ref, err := sam.NewReference(name, "", "", 1000, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		refs = append(refs, ref)
+	}
+	if _, err := sam.NewHeader(nil, refs); err != nil {
+		t.Fatal(err)
+	}
+	r := newRandomReader(nil, nil, refs, 1000, 0, 42)
+	r.draw()
+	if len(r.sites) != randomSites {
+		t.Fatalf("expected %d sites, got: %d", randomSites, len(r.sites))
+	}
+	for i, s := range r.sites {
+		if s.pos < 0 || s.pos >= s.ref.Len() {
+			t.Errorf("site outside of reference: %v", s)
+		}
+		if i > 0 && (s.ref.ID() < r.sites[i-1].ref.ID() || s.ref == r.sites[i-1].ref && s.pos < r.sites[i-1].pos) {
+			t.Errorf("expected sites to be sorted")
+		}
+	}
+	if r.perSite != 10 {
+		t.Errorf("expected 10 reads per site, got: %d", r.perSite)
+	}
+
+	// the same seed draws the same sites and another seed draws others.
+	same, other := newRandomReader(nil, nil, refs, 1000, 0, 42), newRandomReader(nil, nil, refs, 1000, 0, 7)
+	same.draw()
+	other.draw()
+	if !reflect.DeepEqual(same.sites, r.sites) {
+		t.Errorf("expected the same sites with the same seed")
+	}
+	if reflect.DeepEqual(other.sites, r.sites) {
+		t.Errorf("expected different sites with a different seed")
+	}
+}
+
+func TestDrawSpaced(t *testing.T) {
+	var refs []*sam.Reference
+	for _, name := range []string{"1", "2"} {
+		ref, err := sam.NewReference(name, "", "", 1000, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		refs = append(refs, ref)
+	}
+	if _, err := sam.NewHeader(nil, refs); err != nil {
+		t.Fatal(err)
+	}
+	r := newRandomReader(nil, nil, refs, 1000, 4, 42)
+	r.draw()
+	exp := []site{{refs[0], 250}, {refs[0], 750}, {refs[1], 250}, {refs[1], 750}}
+	if !reflect.DeepEqual(r.sites, exp) {
+		t.Errorf("expected evenly spaced sites: %v, got: %v", exp, r.sites)
+	}
+	if r.perSite != 250 {
+		t.Errorf("expected 250 reads per site, got: %d", r.perSite)
+	}
+	// later rounds are random.
+	r.draw()
+	if len(r.sites) != randomSites {
+		t.Errorf("expected %d random sites, got: %d", randomSites, len(r.sites))
+	}
+}
+
+func TestRandomReaderUnique(t *testing.T) {
+	path := "../depth/test/t.bam"
+	br, err := bamio.Open(path, "", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer br.Close()
+	idx, err := bamio.ReadIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// t.bam has 80K reads in 5KB of chrM so the sites overlap the reads of earlier ones and all of
+	// them are read in a few rounds.
+	r := newRandomReader(br.Reader, idx, br.Header().Refs()[:1], 100000, 0, 42)
+	seen := make(map[string]bool)
+	for {
+		rec, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		key := fmt.Sprintf("%s:%d:%d", rec.Name, rec.Flags, rec.Pos)
+		if seen[key] {
+			t.Fatalf("read returned twice: %s", key)
+		}
+		seen[key] = true
+	}
+	if len(seen) == 0 {
+		t.Error("expected reads from the random sites")
+	}
+	if r.rounds >= maxRounds {
+		t.Errorf("expected to stop after a round without new reads, got: %d rounds", r.rounds)
+	}
+}
@@ -0,0 +1,408 @@
+package covstats
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/biogo/hts/bam"
+	"github.com/biogo/hts/sam"
+	"github.com/brentp/goleft"
+	"github.com/brentp/goleft/bamio"
+	"github.com/brentp/xopen"
+)
+
+type region struct {
+	chrom string
+	start int
+	end   int
+}
+
+// readRegions returns the regions in the bed file at path, merged where they overlap or touch, along
+// with the total bases they cover. Empty lines and comment, track and browser lines are skipped and
+// lines may end with \r\n.
+func readRegions(path string) ([]region, int, error) {
+	fh, err := xopen.Ropen(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer fh.Close()
+	var regions []region
+	for i := 1; ; i++ {
+		line, err := fh.ReadString('\n')
+		if line = strings.TrimRight(line, "\r\n"); len(strings.TrimSpace(line)) > 0 && !isBedHeader(line) {
+			toks := strings.SplitN(line, "\t", 5)
+			if len(toks) < 3 {
+				return nil, 0, &goleft.ParseError{Path: path, Line: i, Err: fmt.Errorf("covstats: expected at least 3 fields in bed line: %q", line)}
+			}
+			s, err := strconv.Atoi(toks[1])
+			if err != nil {
+				return nil, 0, &goleft.ParseError{Path: path, Line: i, Err: fmt.Errorf("covstats: bad start: %s", err)}
+			}
+			e, err := strconv.Atoi(strings.TrimSpace(toks[2]))
+			if err != nil {
+				return nil, 0, &goleft.ParseError{Path: path, Line: i, Err: fmt.Errorf("covstats: bad end: %s", err)}
+			}
+			if s < 0 || e < s {
+				return nil, 0, &goleft.ParseError{Path: path, Line: i, Err: fmt.Errorf("covstats: bad interval in bed line: %q", line)}
+			}
+			regions = append(regions, region{chrom: toks[0], start: s, end: e})
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	regions = mergeRegions(regions)
+	cov := 0
+	for _, r := range regions {
+		cov += r.end - r.start
+	}
+	return regions, cov, nil
+}
+
+// isBedHeader returns true for the comment, track and browser lines of a bed.
+func isBedHeader(line string) bool {
+	return strings.HasPrefix(line, "#") || strings.HasPrefix(line, "track") || strings.HasPrefix(line, "browser")
+}
+
+// mergeRegions returns the regions sorted by start within each chromosome, with the chromosomes in
+// the order that they first appear, and with those that overlap or touch merged so that no base is
+// counted twice.
+func mergeRegions(regions []region) []region {
+	order := make(map[string]int)
+	for _, r := range regions {
+		if _, ok := order[r.chrom]; !ok {
+			order[r.chrom] = len(order)
+		}
+	}
+	sort.SliceStable(regions, func(i, j int) bool {
+		a, b := regions[i], regions[j]
+		if a.chrom != b.chrom {
+			return order[a.chrom] < order[b.chrom]
+		}
+		return a.start < b.start
+	})
+	merged := regions[:0]
+	for _, r := range regions {
+		if n := len(merged); n > 0 && merged[n-1].chrom == r.chrom && r.start <= merged[n-1].end {
+			merged[n-1].end = max(merged[n-1].end, r.end)
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// RecordReader is satisfied by a *bam.Reader and by the region-restricted readers used here.
+type RecordReader interface {
+	Read() (*sam.Record, error)
+}
+
+// recordIterator is a *bam.Iterator over the chunks of a region or the reads of a region from an
+// htsget server.
+type recordIterator interface {
+	Next() bool
+	Record() *sam.Record
+	Error() error
+	Close() error
+}
+
+// regionReader uses the bam index to seek to each region in turn and returns only
+// reads that overlap a region. It also tracks the aligned bases within each region so
+// that coverage can be estimated directly from the fully-traversed regions. Without an index,
+// the reads of each region are requested from the htsget server at path.
+type regionReader struct {
+	br      *bam.Reader
+	idx     *bamio.Index
+	path    string
+	refs    map[string]*sam.Reference
+	regions []region
+
+	it  recordIterator
+	cur region
+	// aligned bases overlapping cur.
+	curBases int
+
+	// total length of the regions that have been read to completion and the aligned bases in them.
+	doneLen   int
+	doneBases int
+	// each of the regions that was read to completion for the confidence interval.
+	done []regionDepth
+	// supplementary alignments are also counted, e.g. for long reads.
+	supplementary bool
+	// the chromosomes of regions that are not in the header, which are warned about once.
+	missing map[string]bool
+}
+
+// regionDepth is the length of a region and the aligned bases in it.
+type regionDepth struct {
+	length, bases int
+}
+
+func newRegionReader(br *bam.Reader, idx *bamio.Index, regions []region) *regionReader {
+	return &regionReader{br: br, idx: idx, refs: refsByName(br.Header()), regions: regions, missing: make(map[string]bool)}
+}
+
+// newHtsgetRegionReader returns a regionReader that requests the reads of each region from the
+// htsget server at path so that only those reads are downloaded. h is the header from the server.
+func newHtsgetRegionReader(path string, h *sam.Header, regions []region) *regionReader {
+	return &regionReader{path: path, refs: refsByName(h), regions: regions, missing: make(map[string]bool)}
+}
+
+func refsByName(h *sam.Header) map[string]*sam.Reference {
+	refs := make(map[string]*sam.Reference, len(h.Refs()))
+	for _, r := range h.Refs() {
+		refs[r.Name()] = r
+	}
+	return refs
+}
+
+// countsBases reports whether the aligned bases of a mapped record with flags f are counted for the
+// coverage. Those of secondary and QC-fail records never are and those of supplementary alignments
+// only if supplementary is true, e.g. for long reads.
+func countsBases(f sam.Flags, supplementary bool) bool {
+	if supplementary {
+		return f&(sam.Secondary|sam.QCFail) == 0
+	}
+	return f&(sam.Secondary|sam.Supplementary|sam.QCFail) == 0
+}
+
+// next seeks to the next region for which the index has data.
+func (r *regionReader) next() error {
+	if r.it != nil {
+		if err := r.it.Close(); err != nil {
+			return err
+		}
+		r.doneLen += r.cur.end - r.cur.start
+		r.doneBases += r.curBases
+		r.done = append(r.done, regionDepth{r.cur.end - r.cur.start, r.curBases})
+		r.it = nil
+	}
+	for len(r.regions) > 0 {
+		r.cur, r.regions = r.regions[0], r.regions[1:]
+		r.curBases = 0
+		ref, ok := r.refs[r.cur.chrom]
+		if !ok {
+			// the region has no reads but still counts toward the denominator.
+			if !r.missing[r.cur.chrom] {
+				goleft.Warnf("covstats: chromosome %s from the regions not found in the bam header", r.cur.chrom)
+				r.missing[r.cur.chrom] = true
+			}
+			r.doneLen += r.cur.end - r.cur.start
+			r.done = append(r.done, regionDepth{r.cur.end - r.cur.start, 0})
+			continue
+		}
+		if r.idx == nil {
+			// htsget regions are 1-based and inclusive as for samtools.
+			br, err := bamio.OpenRegion(r.path, "", fmt.Sprintf("%s:%d-%d", r.cur.chrom, r.cur.start+1, r.cur.end), 1)
+			if err != nil {
+				return err
+			}
+			r.it = &readerIterator{r: br}
+			return nil
+		}
+		chunks, err := r.idx.Chunks(ref, r.cur.start, r.cur.end)
+		if err != nil {
+			// no data for this region, but it still counts toward the denominator.
+			r.doneLen += r.cur.end - r.cur.start
+			r.done = append(r.done, regionDepth{r.cur.end - r.cur.start, 0})
+			continue
+		}
+		r.it, err = bam.NewIterator(r.br, chunks)
+		return err
+	}
+	return io.EOF
+}
+
+// Read returns the next read that overlaps one of the regions.
+func (r *regionReader) Read() (*sam.Record, error) {
+	for {
+		if r.it == nil {
+			if err := r.next(); err != nil {
+				return nil, err
+			}
+		}
+		if !r.it.Next() {
+			if err := r.it.Error(); err != nil {
+				return nil, err
+			}
+			if err := r.next(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		rec := r.it.Record()
+		if rec.Ref == nil || rec.Ref.Name() != r.cur.chrom || rec.Pos >= r.cur.end || rec.End() <= r.cur.start {
+			continue
+		}
+		if rec.Flags&sam.Unmapped == 0 && countsBases(rec.Flags, r.supplementary) {
+			r.curBases += min(rec.End(), r.cur.end) - max(rec.Pos, r.cur.start)
+		}
+		return rec, nil
+	}
+}
+
+// close closes the reads of the current region, if any.
+func (r *regionReader) close() error {
+	if r.it == nil {
+		return nil
+	}
+	err := r.it.Close()
+	r.it = nil
+	return err
+}
+
+// readerIterator iterates over the reads of a Reader for a region.
+type readerIterator struct {
+	r   *bamio.Reader
+	rec *sam.Record
+	err error
+}
+
+func (it *readerIterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+	it.rec, it.err = it.r.Read()
+	return it.err == nil
+}
+
+func (it *readerIterator) Record() *sam.Record { return it.rec }
+
+// Error returns the error from the reads of the region other than io.EOF.
+func (it *readerIterator) Error() error {
+	if it.err == io.EOF {
+		return nil
+	}
+	return it.err
+}
+
+func (it *readerIterator) Close() error { return it.r.Close() }
+
+// Coverage returns the mean depth in the regions that were read to completion.
+// It returns false if no region was completed.
+func (r *regionReader) Coverage() (float64, bool) {
+	if r.doneLen == 0 {
+		return 0, false
+	}
+	return float64(r.doneBases) / float64(r.doneLen), true
+}
+
+// countingReader tallies the aligned bases of every primary, mapped read that passes through it.
+// It is used for a full pass over a stream when no index is available. If regions is not empty, only
+// the bases within the regions are counted and only reads that overlap a region are returned.
+type countingReader struct {
+	RecordReader
+	regions map[string][]region
+	bases   int
+	// primary, mapped reads on any contig and in or out of the regions for the library complexity.
+	reads int
+	// supplementary alignments are also counted, e.g. for long reads.
+	supplementary bool
+	// if not nil, the reads and bases counted for each chromosome.
+	mapped   map[string]uint64
+	refBases map[string]int
+	// hit is true for each of the regions of a chromosome that a mapped read overlaps.
+	hit map[string][]bool
+	// if not nil, only the bases on its contigs are counted.
+	genome *goleft.Genome
+}
+
+func newCountingReader(r RecordReader, regions []region) *countingReader {
+	cr := &countingReader{RecordReader: r}
+	if len(regions) > 0 {
+		cr.regions = make(map[string][]region)
+		for _, reg := range regions {
+			cr.regions[reg.chrom] = append(cr.regions[reg.chrom], reg)
+		}
+		cr.hit = make(map[string][]bool, len(cr.regions))
+		for chrom, regs := range cr.regions {
+			sort.Slice(regs, func(i, j int) bool { return regs[i].start < regs[j].start })
+			cr.hit[chrom] = make([]bool, len(regs))
+		}
+	}
+	return cr
+}
+
+// overlap returns the number of bases of rec that are in the regions.
+func (c *countingReader) overlap(rec *sam.Record) int {
+	regs := c.regions[rec.Ref.Name()]
+	// regions are sorted by start so we find the first that could overlap.
+	i := sort.Search(len(regs), func(i int) bool { return regs[i].end > rec.Pos })
+	o := 0
+	for ; i < len(regs) && regs[i].start < rec.End(); i++ {
+		if regs[i].end > rec.Pos {
+			o += min(rec.End(), regs[i].end) - max(rec.Pos, regs[i].start)
+			c.hit[rec.Ref.Name()][i] = true
+		}
+	}
+	return o
+}
+
+func (c *countingReader) Read() (*sam.Record, error) {
+	for {
+		rec, err := c.RecordReader.Read()
+		if err != nil {
+			return rec, err
+		}
+		if rec.Ref == nil || rec.Flags&sam.Unmapped != 0 {
+			if c.regions == nil {
+				return rec, nil
+			}
+			continue
+		}
+		if rec.Flags&(sam.Secondary|sam.Supplementary|sam.QCFail) == 0 {
+			c.reads++
+		}
+		primary := countsBases(rec.Flags, c.supplementary)
+		if c.regions == nil {
+			if primary && c.genome.Has(rec.Ref.Name()) {
+				c.bases += rec.End() - rec.Pos
+				if c.mapped != nil {
+					c.mapped[rec.Ref.Name()]++
+					c.refBases[rec.Ref.Name()] += rec.End() - rec.Pos
+				}
+			}
+			return rec, nil
+		}
+		if o := c.overlap(rec); o > 0 {
+			if primary {
+				c.bases += o
+			}
+			return rec, nil
+		}
+	}
+}
+
+// zeroCoverage returns zeroCoverage of the regions or, without regions, of the contigs in refs from
+// the reads that were counted.
+func (c *countingReader) zeroCoverage(refs []*sam.Reference) (frac, bases float64) {
+	if c.regions == nil {
+		regions := refRegions(refs)
+		return zeroCoverage(regions, func(i int) bool { return c.mapped[regions[i].chrom] == 0 })
+	}
+	var regions []region
+	var hit []bool
+	for chrom, regs := range c.regions {
+		regions = append(regions, regs...)
+		hit = append(hit, c.hit[chrom]...)
+	}
+	return zeroCoverage(regions, func(i int) bool { return !hit[i] })
+}
+
+// drain reads to the end of the stream so that all bases are counted.
+func (c *countingReader) drain() error {
+	for {
+		if _, err := c.Read(); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+	}
+}
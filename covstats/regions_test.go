@@ -0,0 +1,119 @@
+package covstats
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/biogo/hts/sam"
+	"github.com/brentp/goleft/bamio"
+)
+
+type sliceReader []*sam.Record
+
+func (s *sliceReader) Read() (*sam.Record, error) {
+	if len(*s) == 0 {
+		return nil, io.EOF
+	}
+	r := (*s)[0]
+	*s = (*s)[1:]
+	return r, nil
+}
+
+func TestCountingReader(t *testing.T) {
+	ref, err := sam.NewReference("1", "", "", 10000, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := func(pos int, flags sam.Flags) *sam.Record {
+		return &sam.Record{Ref: ref, Pos: pos, Flags: flags, Cigar: sam.Cigar{sam.NewCigarOp(sam.CigarMatch, 100)}}
+	}
+	reads := func() *sliceReader {
+		return &sliceReader{rec(0, 0), rec(150, 0), rec(500, sam.Secondary), rec(900, sam.Unmapped), rec(1000, 0)}
+	}
+
+	cr := newCountingReader(reads(), nil)
+	if err := cr.drain(); err != nil {
+		t.Fatal(err)
+	}
+	if cr.bases != 300 {
+		t.Errorf("expected 300 bases without regions, got: %d", cr.bases)
+	}
+
+	// second region overlaps only the secondary read, which is returned but not counted.
+	cr = newCountingReader(reads(), []region{{"1", 500, 600}, {"1", 50, 200}})
+	n := 0
+	for {
+		if _, err := cr.Read(); err != nil {
+			break
+		}
+		n++
+	}
+	if n != 3 {
+		t.Errorf("expected 3 reads overlapping regions, got: %d", n)
+	}
+	if cr.bases != 100 {
+		t.Errorf("expected 100 bases in regions, got: %d", cr.bases)
+	}
+}
+
+func TestReadRegions(t *testing.T) {
+	bed := filepath.Join(t.TempDir(), "t.bed")
+	// the last line has no newline.
+	data := "track name=targets\r\nbrowser position 1:1-1000\n#chrom\tstart\tend\n\n" +
+		"1\t100\t200\ta\r\n2\t0\t50\n1\t150\t300\n1\t300\t310\n1\t0\t10"
+	if err := os.WriteFile(bed, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	regions, n, err := readRegions(bed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := []region{{"1", 0, 10}, {"1", 100, 310}, {"2", 0, 50}}
+	if !reflect.DeepEqual(regions, exp) {
+		t.Errorf("expected: %v, got: %v", exp, regions)
+	}
+	if n != 270 {
+		t.Errorf("expected 270 bases without counting overlaps twice, got: %d", n)
+	}
+
+	if err := os.WriteFile(bed, []byte("1\t200\t100\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := readRegions(bed); err == nil {
+		t.Error("expected an error for an end before the start")
+	}
+}
+
+func TestRegionReader(t *testing.T) {
+	path := "../depth/test/t.bam"
+	idx, err := bamio.ReadIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	coverage := func(regions []region) float64 {
+		br, err := bamio.Open(path, "", 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer br.Close()
+		rr := newRegionReader(br.Reader, idx, regions)
+		for {
+			if _, err := rr.Read(); err != nil {
+				break
+			}
+		}
+		c, ok := rr.Coverage()
+		if !ok {
+			t.Fatalf("expected a completed region in %v", regions)
+		}
+		return c
+	}
+	c := coverage([]region{{"chrM", 1000, 2000}})
+	// a region on a chromosome that is not in the header has no reads.
+	if m := coverage([]region{{"chrM", 1000, 2000}, {"chrZ", 0, 1000}}); c <= 0 || m != c/2 {
+		t.Errorf("expected half of the coverage %.2f with a missing chromosome, got: %.2f", c, m)
+	}
+}
@@ -0,0 +1,428 @@
+package covstats
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+
+	"github.com/biogo/hts/sam"
+	"github.com/brentp/goleft"
+	"github.com/brentp/goleft/bamio"
+)
+
+func meanStd(arr []int) (mean, std float64) {
+	l := float64(len(arr))
+	for _, a := range arr {
+		mean += float64(a) / l
+	}
+	for _, a := range arr {
+		std += math.Pow(float64(a)-mean, 2) / l
+	}
+	return mean, math.Sqrt(std)
+}
+
+// percentile returns the value at p (0 to 1) in the sorted slice.
+func percentile(sorted []int, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	return float64(sorted[int(p*float64(len(sorted)-1)+0.5)])
+}
+
+// medianMAD returns the median and the median absolute deviation from the median of the sorted slice.
+func medianMAD(sorted []int) (med, mad float64) {
+	if len(sorted) == 0 {
+		return 0, 0
+	}
+	med = percentile(sorted, 0.5)
+	devs := make([]int, len(sorted))
+	for i, v := range sorted {
+		devs[i] = int(math.Abs(float64(v) - med))
+	}
+	sort.Ints(devs)
+	return med, percentile(devs, 0.5)
+}
+
+// trim returns the portion of the sorted slice after removing pct percent of values from each end
+// and then values more than mads median absolute deviations from the median. A value of 0 disables
+// either filter.
+func trim(sorted []int, pct float64, mads float64) []int {
+	if pct > 0 && len(sorted) > 0 {
+		k := int(float64(len(sorted)) * pct / 100)
+		if 2*k >= len(sorted) {
+			k = (len(sorted) - 1) / 2
+		}
+		sorted = sorted[k : len(sorted)-k]
+	}
+	if mads > 0 && len(sorted) > 0 {
+		med, mad := medianMAD(sorted)
+		if mad == 0 {
+			mad = 1
+		}
+		lo := sort.SearchInts(sorted, int(math.Ceil(med-mads*mad)))
+		hi := sort.SearchInts(sorted, int(math.Floor(med+mads*mad))+1)
+		sorted = sorted[lo:hi]
+	}
+	return sorted
+}
+
+// Sizes hold info about a bam returned from BamInsertSizes
+type Sizes struct {
+	InsertMean       float64 `json:"insert_mean"`
+	InsertSD         float64 `json:"insert_sd"`
+	TemplateMean     float64 `json:"template_mean"`
+	TemplateSD       float64 `json:"template_sd"`
+	ReadLengthMean   float64 `json:"read_len_mean"`
+	ReadLengthMedian float64 `json:"read_len_median"`
+
+	// robust statistics are less affected by chimeric pairs.
+	InsertMedian float64 `json:"insert_median"`
+	InsertMAD    float64 `json:"insert_mad"`
+	InsertP5     float64 `json:"insert_p5"`
+	InsertP25    float64 `json:"insert_p25"`
+	InsertP75    float64 `json:"insert_p75"`
+	InsertP95    float64 `json:"insert_p95"`
+
+	// flag rates of the sampled records like those from samtools flagstat.
+	DuplicateRate     float64 `json:"duplicate_rate"`
+	SecondarySuppFrac float64 `json:"secondary_supplementary_fraction"`
+	ProperPairFrac    float64 `json:"proper_pair_fraction"`
+
+	// SingleEnd is true when none of the sampled reads are paired. The insert sizes are not estimated
+	// and are 0. ReadLengthN50 and AlignedFraction describe single-end and long-read data better.
+	SingleEnd bool `json:"single_end"`
+	// ReadLengthN50 is the length such that reads at least this long hold half of the sampled bases.
+	ReadLengthN50 float64 `json:"read_len_n50"`
+	// AlignedFraction is the fraction of the sampled read bases that are not soft-clipped.
+	AlignedFraction float64 `json:"aligned_fraction"`
+	// Identity is 1 - edits/alignment columns from the NM tags of the sampled reads. It is 0 without NM tags.
+	Identity float64 `json:"identity"`
+	// SoftClipMean is the mean number of soft-clipped bases per sampled read. A high value can
+	// indicate adapter read-through.
+	SoftClipMean float64 `json:"soft_clip_mean"`
+	// NMRate is the mean NM per aligned (not soft-clipped) base of the sampled reads with an NM tag.
+	// A high value can indicate the wrong reference. It is 0 without NM tags.
+	NMRate float64 `json:"nm_rate"`
+
+	// fractions of the sampled pairs with both mates on the same chromosome in each orientation of the
+	// strands of the leftmost and rightmost mates. FF also counts RR.
+	FRFrac float64 `json:"fr_fraction"`
+	RFFrac float64 `json:"rf_fraction"`
+	FFFrac float64 `json:"ff_fraction"`
+	// Orientation is the most common of FR, RF and FF or empty if no pairs were sampled. SV callers
+	// use it to decide which pairs are discordant.
+	Orientation string `json:"orientation"`
+	// MatePair is true when most pairs are RF as from a mate-pair (jumping) library. The FR pairs are
+	// then likely short-insert contaminants.
+	MatePair bool `json:"mate_pair"`
+
+	// sorted values kept for the histogram.
+	insertSizes     []int
+	templateLengths []int
+	// sorted read lengths kept for the confidence interval of the coverage.
+	readLengths []int
+	// number of reads that were sampled for read length.
+	nReads int
+	// sorted reference lengths of the sampled alignments; only kept for long reads.
+	refLengths []int
+}
+
+func (s Sizes) String() string {
+	return fmt.Sprintf("%.2f\t%.2f\t%.2f\t%.2f", s.InsertMean, s.InsertSD, s.TemplateMean, s.TemplateSD)
+}
+
+// sampler accumulates read lengths, insert sizes and template lengths.
+type sampler struct {
+	n int
+	// trimming applied to insert sizes before the mean and SD.
+	trimPct, maxMADs float64
+	sizes            []int
+	insertSizes      []int
+	templateLengths  []int
+	flags            flagCounts
+	// read bases of the sampled reads and those that are not soft-clipped.
+	readBases, alignedBases int
+	// alignment columns and edits from the NM tag of the sampled reads.
+	idColumns, idEdits int
+	// edits from the NM tag and aligned bases of the sampled reads that have one.
+	nmEdits, nmBases int
+	// longReads also samples supplementary alignments and keeps their reference lengths.
+	longReads  bool
+	refLengths []int
+}
+
+// flagCounts tallies the flags of every record seen by a sampler.
+type flagCounts struct {
+	// all records and those that are secondary or supplementary.
+	records, secondarySupp int
+	// primary, mapped, non-QC-fail records and those that are duplicates.
+	primary, duplicates int
+	// primary records that are paired and those that are properly paired.
+	paired, properPair int
+	// pairs in the FR, RF and FF orientations counted from the leftmost mate.
+	fr, rf, ff int
+}
+
+func (f *flagCounts) add(rec *sam.Record) {
+	f.records++
+	if rec.Flags&(sam.Secondary|sam.Supplementary) != 0 {
+		f.secondarySupp++
+		return
+	}
+	if rec.Flags&(sam.Unmapped|sam.QCFail) != 0 {
+		return
+	}
+	f.primary++
+	if rec.Flags&sam.Duplicate != 0 {
+		f.duplicates++
+	}
+	if rec.Flags&sam.Paired != 0 {
+		f.paired++
+		if rec.Flags&sam.ProperPair != 0 {
+			f.properPair++
+		}
+		f.addOrientation(rec)
+	}
+}
+
+// addOrientation counts the orientation of the pair of rec if it is the leftmost mate of a
+// non-duplicate pair with both mates on the same chromosome.
+func (f *flagCounts) addOrientation(rec *sam.Record) {
+	if rec.Flags&(sam.MateUnmapped|sam.Duplicate) != 0 || rec.Ref == nil || rec.MateRef == nil || rec.Ref.ID() != rec.MateRef.ID() {
+		return
+	}
+	if rec.Pos > rec.MatePos || (rec.Pos == rec.MatePos && rec.Flags&sam.Read1 == 0) {
+		return
+	}
+	rev, mateRev := rec.Flags&sam.Reverse != 0, rec.Flags&sam.MateReverse != 0
+	switch {
+	case rev == mateRev:
+		f.ff++
+	case mateRev:
+		f.fr++
+	default:
+		f.rf++
+	}
+}
+
+func frac(n, d int) float64 {
+	if d == 0 {
+		return 0
+	}
+	return float64(n) / float64(d)
+}
+
+func newSampler(n int, opts Options) *sampler {
+	return &sampler{n: n, trimPct: opts.TrimPct, maxMADs: opts.MaxMADs, longReads: opts.LongReads,
+		sizes: make([]int, 0, n), insertSizes: make([]int, 0, n), templateLengths: make([]int, 0, n)}
+}
+
+// done is true when enough insert sizes have been collected or, for single-end data which has no
+// insert sizes, when enough reads have been sampled.
+func (s *sampler) done() bool {
+	return len(s.insertSizes) >= s.n || (len(s.sizes) >= s.n && s.flags.paired == 0)
+}
+
+// add the record to the sample. it returns false if the record was not used.
+func (s *sampler) add(rec *sam.Record) bool {
+	s.flags.add(rec)
+	skip := sam.Secondary | sam.Supplementary | sam.Unmapped | sam.QCFail
+	if s.longReads {
+		// long reads are often split into supplementary alignments which the index also counts.
+		skip &^= sam.Supplementary
+	}
+	if rec.Flags&skip != 0 {
+		return false
+	}
+	supp := rec.Flags&sam.Supplementary != 0
+	if len(s.sizes) < s.n {
+		ref, read := rec.Cigar.Lengths()
+		aligned := read - softClipped(rec.Cigar)
+		if !supp {
+			s.sizes = append(s.sizes, read)
+			s.readBases += read
+			s.alignedBases += aligned
+		}
+		if s.longReads {
+			s.refLengths = append(s.refLengths, ref)
+		}
+		if c, e, ok := bamio.Identity(rec); ok {
+			s.idColumns += c
+			s.idEdits += e
+			if !supp {
+				s.nmEdits += e
+				s.nmBases += aligned
+			}
+		}
+	}
+
+	if !supp && rec.Pos < rec.MatePos && rec.Flags&sam.ProperPair == sam.ProperPair && len(rec.Cigar) == 1 && rec.Cigar[0].Type() == sam.CigarMatch {
+		s.insertSizes = append(s.insertSizes, rec.MatePos-rec.End())
+		s.templateLengths = append(s.templateLengths, rec.TempLen)
+	}
+	return true
+}
+
+func softClipped(c sam.Cigar) int {
+	n := 0
+	for _, op := range c {
+		if op.Type() == sam.CigarSoftClipped {
+			n += op.Len()
+		}
+	}
+	return n
+}
+
+// Sizes calculates the summary statistics from the sampled values.
+func (s *sampler) Sizes() Sizes {
+	sizes, insertSizes, templateLengths := s.sizes, s.insertSizes, s.templateLengths
+	sort.Ints(sizes)
+
+	r := Sizes{nReads: len(sizes), readLengths: sizes}
+	// the flag rates are of every record so they are known for a read-group without sampled reads.
+	f := s.flags
+	r.DuplicateRate = frac(f.duplicates, f.primary)
+	r.SecondarySuppFrac = frac(f.secondarySupp, f.records)
+	r.ProperPairFrac = frac(f.properPair, f.paired)
+	if n := f.fr + f.rf + f.ff; n > 0 {
+		r.FRFrac, r.RFFrac, r.FFFrac = frac(f.fr, n), frac(f.rf, n), frac(f.ff, n)
+		r.Orientation = "FR"
+		if f.rf > f.fr && f.rf >= f.ff {
+			r.Orientation = "RF"
+		} else if f.ff > f.fr && f.ff > f.rf {
+			r.Orientation = "FF"
+		}
+		r.MatePair = f.rf > n/2
+	}
+	if len(sizes) == 0 {
+		return r
+	}
+	r.ReadLengthMedian = float64(sizes[(len(sizes)-1)/2]) - 1
+	r.ReadLengthMean, _ = meanStd(sizes)
+	r.ReadLengthN50 = float64(bamio.N50(sizes))
+	r.AlignedFraction = frac(s.alignedBases, s.readBases)
+	r.SoftClipMean = frac(s.readBases-s.alignedBases, len(sizes))
+	r.NMRate = frac(s.nmEdits, s.nmBases)
+	if s.idColumns > 0 {
+		r.Identity = 1 - frac(s.idEdits, s.idColumns)
+	}
+	sort.Ints(s.refLengths)
+	r.refLengths = s.refLengths
+
+	if f.paired == 0 {
+		r.SingleEnd = true
+		return r
+	}
+
+	sort.Ints(insertSizes)
+	sort.Ints(templateLengths)
+	// a few pairs spanning translocations can inflate the SD so these can be trimmed.
+	r.InsertMean, r.InsertSD = meanStd(trim(insertSizes, s.trimPct, s.maxMADs))
+	r.TemplateMean, r.TemplateSD = meanStd(trim(templateLengths, s.trimPct, s.maxMADs))
+
+	r.InsertMedian, r.InsertMAD = medianMAD(insertSizes)
+	r.InsertP5, r.InsertP25 = percentile(insertSizes, 0.05), percentile(insertSizes, 0.25)
+	r.InsertP75, r.InsertP95 = percentile(insertSizes, 0.75), percentile(insertSizes, 0.95)
+	r.insertSizes, r.templateLengths = insertSizes, templateLengths
+	return r
+}
+
+// BamInsertSizes takes bam reader sample N well-behaved sites and return the coverage and insert-size info.
+func BamInsertSizes(br RecordReader, n int) (Sizes, error) {
+	opts := DefaultOptions()
+	opts.N = n
+	return insertSizes(br, opts)
+}
+
+func insertSizes(br RecordReader, opts Options) (Sizes, error) {
+	s := newSampler(opts.N, opts)
+	for !s.done() {
+		rec, err := br.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return Sizes{}, err
+		}
+		s.add(rec)
+	}
+	return s.Sizes(), nil
+}
+
+// unassigned is the read-group of the reads without an RG tag in a bam whose header has read-groups.
+const unassigned = "unassigned"
+
+// ReadGroupInsertSizes is like BamInsertSizes but it also returns the Sizes for each read-group with
+// reads, including those of read-groups that are not in rgs and, as unassigned, of reads without one.
+// Sampling stops when every read-group in rgs has n insert sizes or when n * len(rgs) sizes have been
+// seen in total.
+func ReadGroupInsertSizes(br RecordReader, n int, rgs []string) (Sizes, map[string]Sizes, error) {
+	opts := DefaultOptions()
+	opts.N = n
+	return readGroupInsertSizes(br, rgs, opts)
+}
+
+func readGroupInsertSizes(br RecordReader, rgs []string, opts Options) (Sizes, map[string]Sizes, error) {
+	n := opts.N
+	all := newSampler(n*len(rgs), opts)
+	samplers := make(map[string]*sampler, len(rgs))
+	for _, rg := range rgs {
+		samplers[rg] = newSampler(n, opts)
+	}
+	rgTag := sam.Tag{'R', 'G'}
+	// reads without a read-group in a bam with read-groups get their own row.
+	none := unassigned
+	if _, ok := samplers[""]; ok {
+		none = ""
+	}
+	allDone := func() bool {
+		for _, rg := range rgs {
+			if !samplers[rg].done() {
+				return false
+			}
+		}
+		return true
+	}
+
+	for k := 0; !all.done(); k++ {
+		// checking every sampler is not free so we do it occasionally.
+		if k%1000 == 0 && allDone() {
+			break
+		}
+		rec, err := br.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return Sizes{}, nil, err
+		}
+		rg := none
+		if aux := rec.AuxFields.Get(rgTag); aux != nil {
+			if v, ok := aux.Value().(string); ok && v != "" {
+				rg = v
+			}
+		}
+		s, ok := samplers[rg]
+		if !ok {
+			if rg != none {
+				goleft.Warnf("covstats: read-group %s of read %s is not in the header. reporting it as is", rg, rec.Name)
+			}
+			s = newSampler(n, opts)
+			samplers[rg] = s
+		}
+		if !all.add(rec) {
+			// records that aren't sampled still count toward the flag rates.
+			s.flags.add(rec)
+			continue
+		}
+		s.add(rec)
+	}
+	byRG := make(map[string]Sizes, len(samplers))
+	for rg, s := range samplers {
+		if s.flags.records > 0 {
+			byRG[rg] = s.Sizes()
+		}
+	}
+	return all.Sizes(), byRG, nil
+}
@@ -0,0 +1,274 @@
+package covstats
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/biogo/hts/bam"
+	"github.com/biogo/hts/sam"
+)
+
+func TestTrim(t *testing.T) {
+	vals := []int{1, 300, 301, 302, 303, 304, 305, 306, 307, 100000}
+	if got := trim(vals, 0, 0); !reflect.DeepEqual(got, vals) {
+		t.Errorf("expected no trimming, got: %v", got)
+	}
+	if got := trim(vals, 10, 0); !reflect.DeepEqual(got, vals[1:9]) {
+		t.Errorf("expected 1 value trimmed from each end, got: %v", got)
+	}
+	if got := trim(vals, 0, 5); !reflect.DeepEqual(got, vals[1:9]) {
+		t.Errorf("expected outliers removed by MAD, got: %v", got)
+	}
+	if got := trim([]int{4}, 50, 0); len(got) != 1 {
+		t.Errorf("expected trim to keep at least 1 value, got: %v", got)
+	}
+}
+
+func TestMedianMAD(t *testing.T) {
+	vals := []int{1, 2, 3, 4, 100}
+	med, mad := medianMAD(vals)
+	if med != 3 || mad != 1 {
+		t.Errorf("expected median 3 and MAD 1, got: %v %v", med, mad)
+	}
+	if p := percentile(vals, 1); p != 100 {
+		t.Errorf("expected 100th percentile of 100, got: %v", p)
+	}
+}
+
+func TestFlagRates(t *testing.T) {
+	s := newSampler(10, DefaultOptions())
+	cigar := sam.Cigar{sam.NewCigarOp(sam.CigarMatch, 100)}
+	for i, f := range []sam.Flags{
+		sam.Paired | sam.ProperPair,
+		sam.Paired | sam.ProperPair | sam.Duplicate,
+		sam.Paired,
+		sam.Paired | sam.ProperPair,
+		sam.Paired | sam.ProperPair | sam.Secondary,
+		sam.Paired | sam.Supplementary,
+		sam.Paired | sam.Unmapped,
+		sam.Paired | sam.ProperPair,
+	} {
+		s.add(&sam.Record{Flags: f, Pos: i * 10, MatePos: i*10 + 300, Cigar: cigar})
+	}
+	r := s.Sizes()
+	if r.DuplicateRate != 0.2 {
+		t.Errorf("expected duplicate rate of 1/5, got: %v", r.DuplicateRate)
+	}
+	if r.SecondarySuppFrac != 0.25 {
+		t.Errorf("expected secondary/supplementary fraction of 2/8, got: %v", r.SecondarySuppFrac)
+	}
+	if r.ProperPairFrac != 0.8 {
+		t.Errorf("expected proper-pair fraction of 4/5, got: %v", r.ProperPairFrac)
+	}
+}
+
+func TestBootstrap(t *testing.T) {
+	same := []int{100, 100, 100, 100, 100}
+	if lo, hi := medianCI(same, 100, 42); lo != 100 || hi != 100 {
+		t.Errorf("expected no interval for equal values, got: %v %v", lo, hi)
+	}
+	vals := make([]int, 101)
+	for i := range vals {
+		vals[i] = i
+	}
+	lo, hi := medianCI(vals, 200, 42)
+	if !(lo < 50 && hi > 50 && lo > 30 && hi < 70) {
+		t.Errorf("unexpected interval for median: %v %v", lo, hi)
+	}
+
+	regions := []regionDepth{{100, 1000}, {100, 3000}, {100, 2000}, {100, 2000}}
+	lo, hi = depthCI(regions, 200, 42)
+	if !(lo <= 20 && hi >= 20 && lo >= 10 && hi <= 30 && lo < hi) {
+		t.Errorf("unexpected interval for depth: %v %v", lo, hi)
+	}
+}
+
+func TestSingleEnd(t *testing.T) {
+	var recs []*sam.Record
+	// long reads with soft-clips; no read is paired so sampling stops after n reads.
+	for i, l := range []int{1000, 2000, 3000, 4000, 10000, 500} {
+		cigar := sam.Cigar{sam.NewCigarOp(sam.CigarSoftClipped, l/10), sam.NewCigarOp(sam.CigarMatch, l-l/10)}
+		recs = append(recs, &sam.Record{Pos: i * 100, Cigar: cigar})
+	}
+	br := sliceReader(recs)
+	opts := DefaultOptions()
+	opts.N = 5
+	s, err := insertSizes(&br, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.SingleEnd || s.InsertMean != 0 || s.ProperPairFrac != 0 {
+		t.Errorf("expected single-end sizes without inserts, got: %+v", s)
+	}
+	if s.nReads != 5 || len(br) != 1 {
+		t.Errorf("expected sampling to stop after 5 reads, got: %d with %d left", s.nReads, len(br))
+	}
+	// 20000 bases from the first 5 reads; the longest (10000) has half of them.
+	if s.ReadLengthN50 != 10000 {
+		t.Errorf("expected N50 of 10000, got: %v", s.ReadLengthN50)
+	}
+	if s.AlignedFraction != 0.9 || s.SoftClipMean != 400 {
+		t.Errorf("expected aligned fraction of 0.9 and 400 clipped bases per read, got: %v, %v", s.AlignedFraction, s.SoftClipMean)
+	}
+}
+
+func TestLongReads(t *testing.T) {
+	nm, err := sam.NewAux(sam.NewTag("NM"), 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clipped := sam.Cigar{sam.NewCigarOp(sam.CigarSoftClipped, 4000), sam.NewCigarOp(sam.CigarMatch, 1000)}
+	supp := sam.Cigar{sam.NewCigarOp(sam.CigarHardClipped, 1000), sam.NewCigarOp(sam.CigarMatch, 4000)}
+	recs := []*sam.Record{
+		{Cigar: clipped, AuxFields: sam.AuxFields{nm}},
+		{Cigar: supp, Flags: sam.Supplementary, AuxFields: sam.AuxFields{nm}},
+		{Cigar: clipped, Flags: sam.Secondary, AuxFields: sam.AuxFields{nm}},
+	}
+	opts := DefaultOptions()
+	opts.N = 10
+	br := sliceReader(append([]*sam.Record{}, recs...))
+	s, err := insertSizes(&br, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.nReads != 1 || s.refLengths != nil || s.Identity != 0.95 {
+		t.Errorf("expected only the primary alignment without --long-reads, got: %+v", s)
+	}
+
+	opts.LongReads = true
+	br = sliceReader(append([]*sam.Record{}, recs...))
+	if s, err = insertSizes(&br, opts); err != nil {
+		t.Fatal(err)
+	}
+	if s.nReads != 1 || len(s.refLengths) != 2 || s.refLengths[1] != 4000 {
+		t.Errorf("expected the supplementary alignment to be sampled for aligned length, got: %+v", s)
+	}
+	// 100 edits over 5000 columns.
+	if s.Identity != 0.98 || s.AlignedFraction != 0.2 {
+		t.Errorf("unexpected identity: %v or aligned fraction: %v", s.Identity, s.AlignedFraction)
+	}
+	// the supplementary alignment is not used for the per-read rates.
+	if s.SoftClipMean != 4000 || s.NMRate != 0.05 {
+		t.Errorf("unexpected soft-clip mean: %v or NM rate: %v", s.SoftClipMean, s.NMRate)
+	}
+}
+
+func TestOrientation(t *testing.T) {
+	ref, err := sam.NewReference("chr1", "", "", 100000, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newSampler(10, DefaultOptions())
+	cigar := sam.Cigar{sam.NewCigarOp(sam.CigarMatch, 100)}
+	for i, f := range []sam.Flags{
+		// RF pairs counted from the leftmost mate only.
+		sam.Paired | sam.Reverse,
+		sam.Paired | sam.Reverse,
+		sam.Paired | sam.Reverse | sam.Read1,
+		sam.Paired | sam.MateReverse,
+		sam.Paired | sam.Reverse | sam.MateReverse,
+		// not counted.
+		sam.Paired | sam.Reverse | sam.Duplicate,
+		sam.Paired | sam.Reverse | sam.MateUnmapped,
+	} {
+		s.add(&sam.Record{Flags: f, Ref: ref, MateRef: ref, Pos: i * 10, MatePos: i*10 + 3000, Cigar: cigar})
+	}
+	// the rightmost mate of a pair is not counted.
+	s.add(&sam.Record{Flags: sam.Paired | sam.Reverse, Ref: ref, MateRef: ref, Pos: 5000, MatePos: 10, Cigar: cigar})
+	r := s.Sizes()
+	if r.RFFrac != 0.6 || r.FRFrac != 0.2 || r.FFFrac != 0.2 {
+		t.Errorf("unexpected orientation fractions: %v %v %v", r.FRFrac, r.RFFrac, r.FFFrac)
+	}
+	if r.Orientation != "RF" || !r.MatePair {
+		t.Errorf("expected a mate-pair library in RF orientation, got: %s %v", r.Orientation, r.MatePair)
+	}
+}
+
+// writeReadGroups writes a bam to dir with pairs from read-groups rg1 and rg2, which have inserts of
+// 150 and 400 and, for rg2, 1 duplicate in 4, and pairs with inserts of 250 from rg3, which is not in
+// the header, and of 300 without a read-group.
+func writeReadGroups(t *testing.T, dir string) string {
+	h, err := sam.NewHeader([]byte("@HD\tVN:1.6\tSO:coordinate\n@SQ\tSN:chr1\tLN:100000\n"+
+		"@RG\tID:rg1\tSM:s1\n@RG\tID:rg2\tSM:s1\n"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "rgs.bam")
+	fh, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+	bw, err := bam.NewWriter(fh, h, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref := h.Refs()[0]
+	cigar := []sam.CigarOp{sam.NewCigarOp(sam.CigarMatch, 100)}
+	seq, qual := bytes.Repeat([]byte("A"), 100), bytes.Repeat([]byte{30}, 100)
+	for i := 0; i < 600; i++ {
+		rg, insert, flags := "", 300, sam.Paired|sam.ProperPair|sam.Read1|sam.MateReverse
+		switch {
+		case i%10 == 8:
+			rg, insert = "rg3", 250
+		case i%10 == 9:
+		case i%2 == 0:
+			rg, insert = "rg1", 150
+		default:
+			rg, insert = "rg2", 400
+			if i%10 == 1 {
+				flags |= sam.Duplicate
+			}
+		}
+		var aux []sam.Aux
+		if rg != "" {
+			a, err := sam.NewAux(sam.NewTag("RG"), rg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			aux = append(aux, a)
+		}
+		pos := i * 150
+		rec, err := sam.NewRecord("r"+strconv.Itoa(i), ref, ref, pos, pos+100+insert, 200+insert, 60, cigar, seq, qual, aux)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec.Flags = flags
+		if err := bw.Write(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := bw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadGroups(t *testing.T) {
+	path := writeReadGroups(t, t.TempDir())
+	opts := DefaultOptions()
+	opts.ByRG = true
+	res, err := Estimate(path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := []struct {
+		rg           string
+		insert, dups float64
+		nReads       int
+	}{{"rg1", 150, 0, 240}, {"rg2", 400, 0.25, 240}, {"rg3", 250, 0, 60}, {unassigned, 300, 0, 60}}
+	if len(res) != len(exp) {
+		t.Fatalf("expected a row for each read-group and for the reads without one, got: %+v", res)
+	}
+	for i, e := range exp {
+		r := res[i]
+		if r.ReadGroup != e.rg || r.Sample != "s1" || r.InsertMedian != e.insert || r.DuplicateRate != e.dups ||
+			r.ProperPairFrac != 1 || r.nReads != e.nReads {
+			t.Errorf("expected %+v, got: %s %s %+v", e, r.Sample, r.ReadGroup, r.Sizes)
+		}
+	}
+}
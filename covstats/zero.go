@@ -0,0 +1,77 @@
+package covstats
+
+import (
+	"github.com/biogo/hts/sam"
+	"github.com/brentp/goleft"
+	"github.com/brentp/goleft/bamio"
+)
+
+// zeroCoverage returns the fraction of regions with no mapped reads and the fraction of the bases in
+// the regions that are in those. empty reports whether regions[i] has no reads.
+func zeroCoverage(regions []region, empty func(i int) bool) (frac, bases float64) {
+	n, tot := 0, 0
+	for i, r := range regions {
+		tot += r.end - r.start
+		if empty(i) {
+			n++
+			bases += float64(r.end - r.start)
+		}
+	}
+	if len(regions) == 0 || tot == 0 {
+		return 0, 0
+	}
+	return float64(n) / float64(len(regions)), bases / float64(tot)
+}
+
+// refRegions returns a region for the whole of each reference in refs with a length.
+func refRegions(refs []*sam.Reference) []region {
+	regions := make([]region, 0, len(refs))
+	for _, ref := range refs {
+		if ref.Len() > 0 {
+			regions = append(regions, region{chrom: ref.Name(), start: 0, end: ref.Len()})
+		}
+	}
+	return regions
+}
+
+// indexZeroCoverage returns zeroCoverage of the contigs in refs or, if regions is not nil, of the
+// regions from the mapped reads of each contig from the index or samtools idxstats. A region has no
+// reads if its contig has none or, if idx is not nil, the index has no reads that overlap it. A
+// contig that is not in the index has no reads.
+func indexZeroCoverage(refs []*sam.Reference, mapped map[string]uint64, idx *bamio.Index, regions []region) (frac, bases float64) {
+	if regions == nil {
+		regions = refRegions(refs)
+		return zeroCoverage(regions, func(i int) bool { return mapped[regions[i].chrom] == 0 })
+	}
+	byName := make(map[string]*sam.Reference, len(refs))
+	for _, ref := range refs {
+		byName[ref.Name()] = ref
+	}
+	return zeroCoverage(regions, func(i int) bool {
+		r := regions[i]
+		ref, ok := byName[r.chrom]
+		if !ok || mapped[r.chrom] == 0 {
+			return true
+		}
+		if idx == nil {
+			return false
+		}
+		chunks, err := idx.Chunks(ref, r.start, r.end)
+		return err != nil || len(chunks) == 0
+	})
+}
+
+// maxZeroBases is the fraction of the genome or target bases without reads above which a warning is
+// given.
+const maxZeroBases = 0.05
+
+// setZeroCoverage sets the fraction of contigs or targets with no reads and of the bases in them
+// for each result of a sample.
+func setZeroCoverage(res []Result, frac, bases float64) {
+	if bases > maxZeroBases && len(res) > 0 {
+		goleft.Warnf("covstats: %s has no mapped reads on %.1f%% of the genome or target bases. the alignment may be incomplete", res[0].Sample, 100*bases)
+	}
+	for i := range res {
+		res[i].ZeroCoverageFrac, res[i].ZeroCoverageBases = frac, bases
+	}
+}
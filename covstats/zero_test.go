@@ -0,0 +1,48 @@
+package covstats
+
+import (
+	"testing"
+
+	"github.com/biogo/hts/sam"
+)
+
+func TestZeroCoverage(t *testing.T) {
+	var refs []*sam.Reference
+	for _, r := range []struct {
+		name string
+		l    int
+	}{{"chr1", 6000}, {"chr2", 3000}, {"chr3", 1000}} {
+		ref, err := sam.NewReference(r.name, "", "", r.l, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		refs = append(refs, ref)
+	}
+	// only chr1 has reads as after a merge that stopped early.
+	mapped := map[string]uint64{"chr1": 300, "chr2": 0}
+	frac, bases := indexZeroCoverage(refs, mapped, nil, nil)
+	if frac != 2.0/3 || bases != 0.4 {
+		t.Errorf("expected 2/3 of contigs and 0.4 of bases without reads, got %v %v", frac, bases)
+	}
+
+	regions := []region{{"chr1", 0, 100}, {"chr2", 0, 100}, {"chr4", 0, 200}, {"chr1", 500, 700}}
+	frac, bases = indexZeroCoverage(refs, mapped, nil, regions)
+	if frac != 0.5 || bases != 0.5 {
+		t.Errorf("expected half the targets without reads, got %v %v", frac, bases)
+	}
+
+	// a full pass marks the targets that reads overlap.
+	cr := newCountingReader(nil, regions)
+	r := &sam.Record{Ref: refs[0], Pos: 50, Cigar: sam.Cigar{sam.NewCigarOp(sam.CigarMatch, 100)}}
+	if o := cr.overlap(r); o != 50 {
+		t.Fatalf("expected 50 bases in the targets, got %d", o)
+	}
+	frac, bases = cr.zeroCoverage(refs)
+	if frac != 0.75 || bases != 5.0/6 {
+		t.Errorf("expected 3 of 4 targets without reads, got %v %v", frac, bases)
+	}
+
+	if frac, bases := zeroCoverage(nil, nil); frac != 0 || bases != 0 {
+		t.Errorf("expected 0 without regions, got %v %v", frac, bases)
+	}
+}
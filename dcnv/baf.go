@@ -0,0 +1,265 @@
+package dcnv
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/brentp/goleft"
+	"github.com/brentp/xopen"
+)
+
+const (
+	// minAlleleDepth is the depth of the 2 alleles of a SNV in a sample for its B-allele frequency to
+	// be used.
+	minAlleleDepth = 10
+	// hetLo and hetHi bound the B-allele frequency of a heterozygous SNV. They include the 1/3 and 2/3
+	// expected in a duplication.
+	hetLo, hetHi = 0.15, 0.85
+	// minSNVs is the number of SNVs in a deletion and minHets the number of heterozygous SNVs in a
+	// duplication needed to support or contradict it.
+	minSNVs = 10
+	minHets = 5
+	// lohP is the largest probability that a run of homozygous SNVs is from chance, given the rate of
+	// heterozygous SNVs in the sample, for it to be called as loss of heterozygosity.
+	lohP = 1e-4
+)
+
+// minLOH is the shortest run of homozygous SNVs that is called as loss of heterozygosity.
+var minLOH = 1000000
+
+// baf is the B-allele frequency of a sample at a SNV. pos is 0-based.
+type baf struct {
+	pos int
+	f   float32
+}
+
+// snvs holds the B-allele frequencies from --snps for each sample by chromosome, sorted by position.
+type snvs struct {
+	bafs []map[string][]baf
+	// hetRate is the fraction of the SNVs of each sample that are heterozygous.
+	hetRate []float64
+}
+
+// readSNVs reads the biallelic SNVs that pass the filters from the VCF at path and keeps the
+// B-allele frequency from FORMAT/AD of each of samples where the alleles have at least
+// minAlleleDepth reads. Samples are matched by name and those not in the VCF have no SNVs.
+func readSNVs(path string, samples []string) (*snvs, error) {
+	rdr, err := xopen.Ropen(path)
+	if err != nil {
+		return nil, err
+	}
+	defer rdr.Close()
+	s := &snvs{bafs: make([]map[string][]baf, len(samples)), hetRate: make([]float64, len(samples))}
+	for i := range s.bafs {
+		s.bafs[i] = make(map[string][]baf)
+	}
+	idx := make(map[string]int, len(samples))
+	for i, sm := range samples {
+		idx[sm] = i
+	}
+	// cols[k] is the index in samples of the sample in column 9+k of the VCF or -1.
+	var cols []int
+	for i := 1; ; i++ {
+		line, err := rdr.ReadString('\n')
+		line = strings.TrimRight(line, "\r\n")
+		if strings.HasPrefix(line, "#CHROM") {
+			toks, matched := strings.Split(line, "\t"), 0
+			if len(toks) < 10 {
+				return nil, &goleft.ParseError{Path: path, Line: i, Err: fmt.Errorf("dcnv: expected samples in the VCF header")}
+			}
+			for _, sm := range toks[9:] {
+				k, ok := idx[sm]
+				if !ok {
+					k = -1
+				} else {
+					matched++
+				}
+				cols = append(cols, k)
+			}
+			if matched == 0 {
+				return nil, fmt.Errorf("dcnv: none of the samples in the depths are in %s", path)
+			}
+		} else if len(line) > 0 && line[0] != '#' {
+			if cols == nil {
+				return nil, &goleft.ParseError{Path: path, Line: i, Err: fmt.Errorf("dcnv: expected a #CHROM header before the first record")}
+			}
+			if err := s.add(line, cols); err != nil {
+				return nil, &goleft.ParseError{Path: path, Line: i, Err: err}
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	for i, m := range s.bafs {
+		var n, hets int
+		for _, bs := range m {
+			sort.Slice(bs, func(a, b int) bool { return bs[a].pos < bs[b].pos })
+			n += len(bs)
+			for _, b := range bs {
+				if isHet(b.f) {
+					hets++
+				}
+			}
+		}
+		if n > 0 {
+			s.hetRate[i] = float64(hets) / float64(n)
+		}
+	}
+	return s, nil
+}
+
+// add keeps the B-allele frequencies from the VCF line if it is a biallelic SNV that passes the filters.
+func (s *snvs) add(line string, cols []int) error {
+	toks := strings.Split(line, "\t")
+	if len(toks) < 9 {
+		return fmt.Errorf("dcnv: expected at least 9 fields in VCF line: %q", line)
+	}
+	if len(toks[3]) != 1 || len(toks[4]) != 1 || !strings.Contains("ACGTacgt", toks[4]) || (toks[6] != "PASS" && toks[6] != ".") {
+		return nil
+	}
+	pos, err := strconv.Atoi(toks[1])
+	if err != nil {
+		return fmt.Errorf("dcnv: bad position in VCF line: %q", line)
+	}
+	ad := -1
+	for k, f := range strings.Split(toks[8], ":") {
+		if f == "AD" {
+			ad = k
+		}
+	}
+	if ad == -1 {
+		return nil
+	}
+	for k, col := range toks[9:] {
+		if k >= len(cols) || cols[k] == -1 {
+			continue
+		}
+		fields := strings.Split(col, ":")
+		if ad >= len(fields) {
+			continue
+		}
+		alleles := strings.Split(fields[ad], ",")
+		if len(alleles) != 2 {
+			continue
+		}
+		r, rerr := strconv.Atoi(alleles[0])
+		a, aerr := strconv.Atoi(alleles[1])
+		if rerr != nil || aerr != nil || r+a < minAlleleDepth {
+			continue
+		}
+		m := s.bafs[cols[k]]
+		m[toks[0]] = append(m[toks[0]], baf{pos: pos - 1, f: float32(a) / float32(r+a)})
+	}
+	return nil
+}
+
+func isHet(f float32) bool {
+	return f > hetLo && f < hetHi
+}
+
+// in returns the B-allele frequencies of sample i from start to end of chrom.
+func (s *snvs) in(i int, chrom string, start, end int) []baf {
+	bs := s.bafs[i][chrom]
+	a := sort.Search(len(bs), func(k int) bool { return bs[k].pos >= start })
+	b := sort.Search(len(bs), func(k int) bool { return bs[k].pos >= end })
+	return bs[a:b]
+}
+
+// balance summarizes the B-allele frequencies of a sample in a region: the number of SNVs, the
+// number that are heterozygous and the median distance of those from 0.5.
+type balance struct {
+	n, hets int
+	dev     float64
+}
+
+func summarize(bs []baf) balance {
+	b := balance{n: len(bs)}
+	var devs []float64
+	for _, v := range bs {
+		if isHet(v.f) {
+			devs = append(devs, math.Abs(float64(v.f)-0.5))
+		}
+	}
+	b.hets = len(devs)
+	if len(devs) > 0 {
+		sort.Float64s(devs)
+		b.dev = devs[len(devs)/2]
+	}
+	return b
+}
+
+// format returns the BS, BH and BD FORMAT fields.
+func (b balance) format() string {
+	if b.hets == 0 {
+		return fmt.Sprintf("%d:%d:.", b.n, b.hets)
+	}
+	return fmt.Sprintf("%d:%d:%.3f", b.n, b.hets, b.dev)
+}
+
+// supports returns 1 if the allele balance supports a copy-number of cn in a sample where a fraction
+// h of SNVs are heterozygous, -1 if it contradicts it and 0 if there are too few SNVs to tell. A
+// deletion of 1 copy leaves few heterozygous SNVs and those in a duplication are away from 0.5,
+// e.g. 1/3 or 2/3 for 3 copies. Without SNVs, a deletion of both copies gets 0.
+func (b balance) supports(cn int, h float64) int {
+	switch {
+	case cn < 2 && b.n >= minSNVs:
+		frac := float64(b.hets) / float64(b.n)
+		if frac <= 0.25*h {
+			return 1
+		}
+		if frac >= 0.5*h && b.dev < 0.1 {
+			return -1
+		}
+	case cn > 2 && b.hets >= minHets:
+		if b.dev >= 0.1 {
+			return 1
+		}
+		// 4 or more copies can be balanced, e.g. 2 on each haplotype.
+		if cn == 3 && b.dev < 0.06 {
+			return -1
+		}
+	}
+	return 0
+}
+
+// lohRun is a run of homozygous SNVs in a sample. p is the probability of the run by chance.
+type lohRun struct {
+	start, end int
+	p          float64
+}
+
+// lohRuns returns the runs of SNVs of sample i on chrom without a heterozygous SNV that span at
+// least minLOH bases and are unlikely by chance given the rate of heterozygous SNVs in the sample.
+func (s *snvs) lohRuns(i int, chrom string) []lohRun {
+	h := s.hetRate[i]
+	if h <= 0 {
+		return nil
+	}
+	var runs []lohRun
+	bs := s.bafs[i][chrom]
+	first := 0
+	// flush adds the run of bs[first:last].
+	flush := func(last int) {
+		if n := last - first; n > 0 && bs[last-1].pos+1-bs[first].pos >= minLOH {
+			if p := math.Pow(1-h, float64(n)); p < lohP {
+				runs = append(runs, lohRun{start: bs[first].pos, end: bs[last-1].pos + 1, p: p})
+			}
+		}
+	}
+	for k, b := range bs {
+		if isHet(b.f) {
+			flush(k)
+			first = k + 1
+		}
+	}
+	flush(len(bs))
+	return runs
+}
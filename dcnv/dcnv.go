@@ -1,6 +1,8 @@
-package main
+// Package dcnv calls copy-number variants from a matrix of depths with a column per sample.
+package dcnv
 
 import (
+	"bufio"
 	"fmt"
 	"io"
 	"log"
@@ -12,14 +14,36 @@ import (
 	"time"
 
 	"github.com/JaderDias/movingmedian"
+	arg "github.com/alexflint/go-arg"
 	"github.com/brentp/faidx"
+	"github.com/brentp/goleft"
 	"github.com/brentp/goleft/emdepth"
 	"github.com/brentp/xopen"
 	"go4.org/sort"
 )
 
+var cli = &struct {
+	Reference string   `arg:"-r,required,help:path to reference fasta used to get the GC content of each window."`
+	Window    int      `arg:"-w,help:size of the moving median used to correct for GC."`
+	Depthwed  bool     `arg:"help:the matrix is from depthwed which reports the total (not mean) depth in each window."`
+	VCF       bool     `arg:"--vcf,help:write VCF 4.2 with a record per CNV instead of the default bed output."`
+	Ped       string   `arg:"help:optional PED file. trios in the matrix get FORMAT fields flagging candidate de novo CNVs. requires --vcf."`
+	Snps      string   `arg:"--snps,help:optional VCF of small variants with FORMAT/AD for the samples. the B-allele frequencies of SNVs flag CNVs that they support or contradict and give records for copy-neutral LOH. requires --vcf."`
+	Pon       string   `arg:"--pon,help:optional directory from --write-pon with the normalized depths of a panel of normals. they are called with the samples so that fewer than 3 can be given but only the CNVs of the samples are reported."`
+	WritePon  string   `arg:"--write-pon,help:optional directory to which the normalized depth of each sample is written for use with --pon."`
+	Tracks    string   `arg:"--tracks,help:optional prefix for IGV .seg files of the segments and window log2 ratios of each sample and a BED track of the CNVs. written with either output."`
+	Depths    []string `arg:"positional,required,help:a depth matrix from goleft depth --events or depthwed or a depth.bed from goleft depth for each sample."`
+}{Window: 15}
+
+func pcheck(e error) {
+	if e != nil {
+		log.Fatal(e)
+	}
+}
+
 // Interval is the struct used by dcnv
 type Interval struct {
+	Chrom          string
 	Start          uint32
 	End            uint32
 	Depths         []float32
@@ -30,7 +54,7 @@ type Interval struct {
 
 func (i *Interval) copy(cns []int) *Interval {
 	n := len(i.Depths)
-	c := &Interval{Start: i.Start, End: i.End, Depths: make([]float32, n),
+	c := &Interval{Chrom: i.Chrom, Start: i.Start, End: i.End, Depths: make([]float32, n),
 		cns: cns,
 		GC:  i.GC, AdjustedDepths: make([]float32, n)}
 	for k := 0; k < n; k++ {
@@ -55,17 +79,28 @@ func (i *Interval) update(b *Interval) {
 
 // Intervals is the wrapper for a slice of intervals.
 type Intervals struct {
-	Chrom         string
 	Intervals     []*Interval
+	chroms        map[string]int
 	sampleMedians []float32
 	sampleScalars []float32
 	samples       []string
+	// panel is the number of samples at the end that are from a panel of normals.
+	panel int
 }
 
 func (ivs Intervals) Samples() []string {
 	return ivs.samples
 }
 
+// Chroms returns the chromosomes in the order they appeared in the input.
+func (ivs Intervals) Chroms() []string {
+	chroms := make([]string, len(ivs.chroms))
+	for c, i := range ivs.chroms {
+		chroms[i] = c
+	}
+	return chroms
+}
+
 func (ivs Intervals) NSamples() int {
 	return len(ivs.Intervals[0].Depths)
 }
@@ -84,41 +119,53 @@ func sortRandom(ivs *Intervals) {
 	}
 }
 
-func mustAtoi(a string) uint32 {
-	v, err := strconv.Atoi(a)
-	if err != nil {
-		panic(err)
+// intervalFromLine parses a line from a depth matrix. If sums is true, the values are the total depth
+// in each window and they are divided by the window length to get the mean depth. The GC is only set
+// if fa is not nil.
+func intervalFromLine(l string, fa *faidx.Faidx, sums bool) (*Interval, error) {
+	toks := strings.Split(strings.TrimRight(l, "\r\n"), "\t")
+	if len(toks) < 4 {
+		return nil, fmt.Errorf("dcnv: expected at least 4 fields in line: %q", l)
 	}
-	return uint32(v)
-}
-
-func mustAtof(a string) float32 {
-	v, err := strconv.ParseFloat(a, 32)
+	start, err := strconv.Atoi(toks[1])
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("dcnv: bad start in line: %q", l)
 	}
-	return float32(v)
-}
-
-func intervalFromLine(l string, fa *faidx.Faidx) *Interval {
-	toks := strings.Split(l, "\t")
-	toks[len(toks)-1] = strings.TrimSpace(toks[len(toks)-1])
-	iv := &Interval{Start: mustAtoi(toks[1]), End: mustAtoi(toks[2]),
+	end, err := strconv.Atoi(toks[2])
+	if err != nil || end <= start {
+		return nil, fmt.Errorf("dcnv: bad end in line: %q", l)
+	}
+	iv := &Interval{Chrom: toks[0], Start: uint32(start), End: uint32(end),
 		Depths:         make([]float32, 0, len(toks)-3),
 		AdjustedDepths: make([]float32, 0, len(toks)-3),
 	}
 	for c := 3; c < len(toks); c++ {
-		d := mustAtof(toks[c])
-		d /= float32(iv.End - iv.Start)
+		v, err := strconv.ParseFloat(toks[c], 32)
+		if err != nil {
+			return nil, fmt.Errorf("dcnv: bad depth in line: %q", l)
+		}
+		d := float32(v)
+		if sums {
+			d /= float32(iv.End - iv.Start)
+		}
 		iv.Depths = append(iv.Depths, d)
 		iv.AdjustedDepths = append(iv.AdjustedDepths, d)
 	}
-	st, err := fa.Stats(toks[0], int(iv.Start), int(iv.End))
+	if fa != nil {
+		if err := iv.setGC(fa); err != nil {
+			return nil, err
+		}
+	}
+	return iv, nil
+}
+
+func (i *Interval) setGC(fa *faidx.Faidx) error {
+	st, err := fa.Stats(i.Chrom, int(i.Start), int(i.End))
 	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
+		return fmt.Errorf("dcnv: error getting GC for %s:%d-%d: %s", i.Chrom, i.Start, i.End, err)
 	}
-	iv.GC = float32(st.GC)
-	return iv
+	i.GC = float32(st.GC)
+	return nil
 }
 
 // SampleMedians gets the Median log2 values for each sample.
@@ -170,8 +217,8 @@ func median(b []float32) float32 {
 
 	sort.Slice(a, func(i, j int) bool { return a[i] < a[j] })
 	if len(a)%2 == 0 {
-		am := a[len(a)/2]
-		bm := a[len(a)/2+1]
+		am := a[len(a)/2-1]
+		bm := a[len(a)/2]
 		return (am + bm) / 2
 	}
 	return a[len(a)/2]
@@ -261,15 +308,40 @@ func pLess(Depths []float32, val float32) float32 {
 	return c / float32(len(Depths))
 }
 
-// CallCopyNumbers returns Intervals for which any sample has non-zero copy-number
-func (ivs *Intervals) CallCopyNumbers() {
+// Reporter receives the CNVs on a chromosome sorted by start along with the copy-number estimates for
+// every window on the chromosome that was not skipped for low depth. It is called for each
+// chromosome with windows even if it has no CNVs.
+type Reporter func(chrom string, cnvs []*emdepth.CNV, ems []*emdepth.EMD)
+
+// CallCopyNumbers sends the CNVs for any sample with a non-2 copy-number to report once per chromosome.
+func (ivs *Intervals) CallCopyNumbers(report Reporter) {
 	ivs.SortByPosition()
-	samples := ivs.Samples()
 
 	cache := &emdepth.Cache{}
 	nskip := 0
+	chrom := ""
+	var cnvs []*emdepth.CNV
+	var ems []*emdepth.EMD
+	// CNVs can't span chromosomes so we flush the cache at each new one.
+	flush := func() {
+		cnvs = append(cnvs, cache.Flush()...)
+		sort.Slice(cnvs, func(i, j int) bool { return cnvs[i].Position[0].Start < cnvs[j].Position[0].Start })
+		kept := cnvs[:0]
+		for _, cnv := range cnvs {
+			if l := len(cnv.Position) - 1; cnv.Position[l].End-cnv.Position[0].Start > 600 {
+				kept = append(kept, cnv)
+			}
+		}
+		if len(kept) > 0 || len(ems) > 0 {
+			report(chrom, kept, ems)
+		}
+		cnvs, ems = nil, nil
+	}
 	for _, iv := range ivs.Intervals {
-		//fmt.Fprintf(os.Stdout, "%s\t%d\t%d\t%s\n", ivs.Chrom, iv.Start, iv.End, formatIV(iv))
+		if iv.Chrom != chrom {
+			flush()
+			chrom = iv.Chrom
+		}
 		if pLess(iv.Depths, 7) > 0.5 {
 			nskip++
 			continue
@@ -280,17 +352,15 @@ func (ivs *Intervals) CallCopyNumbers() {
 		}
 
 		em := emdepth.EMDepth(iv.AdjustedDepths, emdepth.Position{Start: iv.Start, End: iv.End})
-		cnvs := cache.Add(em)
-		ivs.printCNVs(cnvs, samples)
+		ems = append(ems, em)
+		cnvs = append(cnvs, cache.Add(em)...)
 	}
-
-	ivs.printCNVs(cache.Clear(nil), samples)
-	log.Println("skipped:", nskip)
-
-	//fmt.Fprintf(os.Stdout, "%s\t%d\t%d\t%s\t%s\n", ivs.Chrom, last.Start, last.End, formatCns(emdepth.EMDepth(last.AdjustedDepths)), formatFloats(last.AdjustedDepths))
+	flush()
+	goleft.Infof("dcnv: skipped %d of %d windows with low depth", nskip, len(ivs.Intervals))
 }
 
-func (ivs *Intervals) printCNVs(cnvs []*emdepth.CNV, samples []string) {
+// bedReporter writes a line to w for each CNV with the values for each window in the CNV.
+func bedReporter(w io.Writer, samples []string) Reporter {
 	fs := make([]string, 0, len(samples))
 	fjoin := func(sl []float32) string {
 		fs = fs[:0]
@@ -306,15 +376,12 @@ func (ivs *Intervals) printCNVs(cnvs []*emdepth.CNV, samples []string) {
 		}
 		return strings.Join(fs, ",")
 	}
-	sort.Slice(cnvs, func(i, j int) bool { return cnvs[i].Position[0].Start < cnvs[j].Position[0].Start })
-	for _, cnv := range cnvs {
-		l := len(cnv.Position) - 1
-		if cnv.Position[0].End-cnv.Position[l].Start <= 600 {
-			continue
+	return func(chrom string, cnvs []*emdepth.CNV, _ []*emdepth.EMD) {
+		for _, cnv := range cnvs {
+			l := len(cnv.Position) - 1
+			fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%s\t%s\t%s\t%d\n", chrom, cnv.Position[0].Start, cnv.Position[l].End,
+				samples[cnv.SampleI], ijoin(cnv.CN), fjoin(cnv.Depth), fjoin(cnv.Log2FC), cnv.PSize)
 		}
-		sample := samples[cnv.SampleI]
-		fmt.Fprintf(os.Stdout, "%s\t%d\t%d\t%s\t%s\t%s\t%s\t%d\n", ivs.Chrom, cnv.Position[0].Start, cnv.Position[l].End,
-			sample, ijoin(cnv.CN), fjoin(cnv.Depth), fjoin(cnv.Log2FC), cnv.PSize)
 	}
 }
 
@@ -327,46 +394,148 @@ func allEqual(a, b []int) bool {
 	return true
 }
 
+// SortByPosition sorts the intervals by start within each chromosome. The chromosomes are kept in
+// the order that they appeared in the input.
 func (ivs *Intervals) SortByPosition() {
-	sort.Slice(ivs.Intervals, func(i, j int) bool { return ivs.Intervals[i].Start < ivs.Intervals[j].Start })
+	sort.Slice(ivs.Intervals, func(i, j int) bool {
+		a, b := ivs.Intervals[i], ivs.Intervals[j]
+		if a.Chrom != b.Chrom {
+			return ivs.chroms[a.Chrom] < ivs.chroms[b.Chrom]
+		}
+		return a.Start < b.Start
+	})
+}
+
+func (ivs *Intervals) add(iv *Interval) {
+	if ivs.chroms == nil {
+		ivs.chroms = make(map[string]int)
+	}
+	if _, ok := ivs.chroms[iv.Chrom]; !ok {
+		ivs.chroms[iv.Chrom] = len(ivs.chroms)
+	}
+	ivs.Intervals = append(ivs.Intervals, iv)
 }
 
-func (ivs *Intervals) ReadRegions(path string, fasta string) {
+// ReadRegions reads a depth matrix with a header of #chrom, start, end and then one column per sample.
+// If sums is true, the values are the total depth in each window as output by depthwed.
+func (ivs *Intervals) ReadRegions(path string, fasta string, sums bool) error {
 	fai, err := faidx.New(fasta)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	m := make([]*Interval, 0, 100000)
 	rdr, err := xopen.Ropen(path)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	i := 0
-	for {
+	defer rdr.Close()
+	ivs.Intervals = make([]*Interval, 0, 100000)
+	for n := 1; ; n++ {
 		line, err := rdr.ReadString('\n')
+		if len(line) > 0 {
+			if ivs.samples == nil {
+				if !strings.HasPrefix(line, "#chrom") && !strings.HasPrefix(line, "chrom") {
+					return fmt.Errorf("dcnv: expected header with sample names in %s", path)
+				}
+				ivs.samples = strings.Split(strings.TrimSpace(line), "\t")[3:]
+			} else {
+				iv, perr := intervalFromLine(line, fai, sums)
+				if perr != nil {
+					return &goleft.ParseError{Path: path, Line: n, Err: perr}
+				}
+				if len(iv.Depths) != len(ivs.samples) {
+					return &goleft.ParseError{Path: path, Line: n, Err: fmt.Errorf("dcnv: expected %d samples in line: %q", len(ivs.samples), line)}
+				}
+				ivs.add(iv)
+			}
+		}
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
-			panic(err)
+			return err
 		}
-		if i == 0 && (line[0] == '#' || strings.HasPrefix(line, "chrom")) {
-			ivs.samples = strings.Split(strings.TrimSpace(line), "\t")[3:]
-			continue
+	}
+	if len(ivs.Intervals) == 0 {
+		return fmt.Errorf("dcnv: no intervals found in %s", path)
+	}
+	return nil
+}
+
+// ReadBeds reads a depth.bed from goleft depth for each sample. The files must all have the same
+// windows in the same order. The GC is not set if fasta is empty.
+func (ivs *Intervals) ReadBeds(paths []string, fasta string) error {
+	var fai *faidx.Faidx
+	var err error
+	if fasta != "" {
+		if fai, err = faidx.New(fasta); err != nil {
+			return err
 		}
-		if i == 0 || i == 1 {
-			ivs.Chrom = string(line[:strings.Index(line, "\t")])
+	}
+	rdrs := make([]*xopen.Reader, len(paths))
+	ivs.samples = make([]string, len(paths))
+	for i, p := range paths {
+		if rdrs[i], err = xopen.Ropen(p); err != nil {
+			return err
 		}
-		i++
-		iv := intervalFromLine(line, fai)
-		/*
-			if all0(iv.Depths) {
+		defer rdrs[i].Close()
+		ivs.samples[i] = sampleFromPath(p)
+	}
+	ivs.Intervals = make([]*Interval, 0, 100000)
+	for n := 1; ; n++ {
+		var iv *Interval
+		var eofs int
+		for i, rdr := range rdrs {
+			line, err := rdr.ReadString('\n')
+			if err != nil && err != io.EOF {
+				return err
+			}
+			if err == io.EOF && len(line) == 0 {
+				eofs++
+				continue
+			}
+			civ, err := intervalFromLine(line, nil, false)
+			if err != nil {
+				return &goleft.ParseError{Path: paths[i], Line: n, Err: err}
+			}
+			if len(civ.Depths) != 1 {
+				return &goleft.ParseError{Path: paths[i], Line: n, Err: fmt.Errorf("dcnv: expected a single depth column")}
+			}
+			if i == 0 {
+				iv = civ
 				continue
 			}
-		*/
-		m = append(m, iv)
+			if iv == nil || civ.Chrom != iv.Chrom || civ.Start != iv.Start || civ.End != iv.End {
+				return &goleft.ParseError{Path: paths[i], Line: n, Err: fmt.Errorf("dcnv: expected the same window as %s", paths[0])}
+			}
+			iv.Depths = append(iv.Depths, civ.Depths[0])
+			iv.AdjustedDepths = append(iv.AdjustedDepths, civ.Depths[0])
+		}
+		if eofs == len(rdrs) {
+			break
+		}
+		if eofs != 0 {
+			return fmt.Errorf("dcnv: depth files do not all have the same number of lines")
+		}
+		if fai != nil {
+			if err := iv.setGC(fai); err != nil {
+				return err
+			}
+		}
+		ivs.add(iv)
+	}
+	if len(ivs.Intervals) == 0 {
+		return fmt.Errorf("dcnv: no intervals found in %s", paths[0])
 	}
-	ivs.Intervals = m
+	return nil
+}
+
+func sampleFromPath(p string) string {
+	tmp := strings.Split(p, "/")
+	name := tmp[len(tmp)-1]
+	for _, suff := range []string{".gz", ".bed", ".depth"} {
+		name = strings.TrimSuffix(name, suff)
+	}
+	return name
 }
 
 func (ivs *Intervals) Write(n int) {
@@ -387,52 +556,88 @@ func (ivs *Intervals) Write(n int) {
 		if i == n {
 			break
 		}
-		fmt.Printf("%s:%d-%d\t%s\n", ivs.Chrom, iv.Start, iv.End, formatIV(iv))
+		fmt.Printf("%s:%d-%d\t%s\n", iv.Chrom, iv.Start, iv.End, formatIV(iv))
 	}
 }
 
-func main() {
-
-	/*
-		f, err := os.Create("dcnv.cpu.pprof")
-		if err != nil {
-			panic(err)
-		}
-		pprof.StartCPUProfile(f)
-		defer pprof.StopCPUProfile()
-	*/
-
-	window := 15
-	bed := os.Args[1]
-	fasta := os.Args[2]
+// Main is called from the goleft dispatcher.
+func Main() {
+	p := arg.MustParse(cli)
+	if cli.Ped != "" && !cli.VCF {
+		p.Fail("dcnv: --ped requires --vcf")
+	}
+	if cli.Snps != "" && !cli.VCF {
+		p.Fail("dcnv: --snps requires --vcf")
+	}
 	ivs := &Intervals{}
-	ivs.ReadRegions(bed, fasta)
-	fmt.Fprintln(os.Stderr, ivs.Samples())
-	fmt.Fprintln(os.Stderr, ivs.SampleScalars())
+	if len(cli.Depths) == 1 && !isBed(cli.Depths[0]) {
+		pcheck(ivs.ReadRegions(cli.Depths[0], cli.Reference, cli.Depthwed))
+	} else {
+		if cli.Depthwed {
+			log.Fatal("dcnv: --depthwed can only be used with a single depth matrix")
+		}
+		pcheck(ivs.ReadBeds(cli.Depths, cli.Reference))
+	}
+	if cli.Pon != "" {
+		pcheck(ivs.AddPanel(cli.Pon))
+		goleft.Infof("dcnv: added %d samples from the panel of normals in %s", ivs.panel, cli.Pon)
+	}
+	if ivs.NSamples() < 3 {
+		log.Fatalf("dcnv: need at least 3 samples (including any from --pon) to call CNVs, got: %d", ivs.NSamples())
+	}
 
+	// this corrects by the median of all samples.
 	ivs.CorrectBySampleMedian()
-	//ivs.Write(10)
-	ivs.CorrectByGC(window)
-	//fmt.Println("\n\n")
-	//ivs.Write(10)
-
-	/*
-		m := make([]string, len(ivs.Samples()))
-		for _, r := range ivs.Intervals {
-			for i, d := range r.Depths {
-				m[i] = fmt.Sprintf("%.1f\t%.1f", d, r.AdjustedDepths[i])
-			}
-			fmt.Printf("%s\t%d\t%d\t%s\n", ivs.Chrom, r.Start, r.End, strings.Join(m, "\t"))
-		}
-		os.Exit(0)
-	*/
+	ivs.CorrectByGC(cli.Window)
+	if cli.WritePon != "" {
+		pcheck(ivs.WritePanel(cli.WritePon))
+	}
 
-	// this correct by median of all samples.
-	//fmt.Println("\n")
-	//ivs.Write(10)
-	//os.Exit(1)
+	// report adds the browser tracks to the CNVs sent to the output.
+	report := func(r Reporter) Reporter { return r }
+	if cli.Tracks != "" {
+		tw, err := newTrackWriter(cli.Tracks, ivs.Cases())
+		pcheck(err)
+		defer func() { pcheck(tw.Close()) }()
+		report = func(r Reporter) Reporter { return tee(r, tw.report) }
+	}
 
-	log.Println("writing")
-	ivs.CallCopyNumbers()
+	w := bufio.NewWriter(os.Stdout)
+	defer w.Flush()
+	if cli.VCF {
+		fa, err := faidx.New(cli.Reference)
+		pcheck(err)
+		// the samples from a panel of normals are not written.
+		vw := &vcfWriter{w: w, fa: fa, samples: ivs.Cases()}
+		if cli.Ped != "" {
+			vw.trios, err = readTrios(cli.Ped, ivs.Cases())
+			pcheck(err)
+			if len(vw.trios) == 0 {
+				log.Fatalf("dcnv: no trios from %s with all 3 samples in the depths", cli.Ped)
+			}
+			goleft.Infof("dcnv: found %d trios in %s", len(vw.trios), cli.Ped)
+		}
+		if cli.Snps != "" {
+			vw.snvs, err = readSNVs(cli.Snps, ivs.Cases())
+			pcheck(err)
+			goleft.Infof("dcnv: read B-allele frequencies from %s", cli.Snps)
+		}
+		vw.writeHeader(ivs.Chroms(), cli.Reference)
+		ivs.CallCopyNumbers(casesOnly(report(vw.report), ivs.panel, ivs.NSamples()))
+		return
+	}
+	fmt.Fprintln(w, "#chrom\tstart\tend\tsample\tcns\tdepths\tlog2fcs\tn")
+	ivs.CallCopyNumbers(casesOnly(report(bedReporter(w, ivs.Samples())), ivs.panel, ivs.NSamples()))
+}
 
+// isBed returns true if the file at path doesn't start with a header of sample names as in a depth matrix.
+func isBed(path string) bool {
+	rdr, err := xopen.Ropen(path)
+	pcheck(err)
+	defer rdr.Close()
+	line, err := rdr.ReadString('\n')
+	if err != nil && err != io.EOF {
+		pcheck(err)
+	}
+	return !(strings.HasPrefix(line, "#chrom") || strings.HasPrefix(line, "chrom"))
 }
@@ -1,33 +1,353 @@
-package main
+package dcnv
 
 import (
-	"log"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
 func TestMedian(t *testing.T) {
-	m := []*interval{
-		&interval{log2: 22},
-		&interval{log2: 42},
-		&interval{log2: 32},
-		&interval{log2: 92},
-		&interval{log2: 12},
-		&interval{log2: 12},
-		&interval{log2: 12},
-		&interval{log2: 12},
-		&interval{log2: 12},
-		&interval{log2: 92},
-		&interval{log2: 12},
-		&interval{log2: 13},
-		&interval{log2: 14},
-		&interval{log2: 100},
-		&interval{log2: 12},
-		&interval{log2: 13},
-		&interval{log2: 14},
-	}
-
-	log.Println(m)
-	correctByMovingMedian(m, 3)
-	log.Println(m)
+	if m := median([]float32{4, 1, 3, 2}); m != 2.5 {
+		t.Errorf("expected 2.5, got: %f", m)
+	}
+	if m := median([]float32{5, 1, 3}); m != 3 {
+		t.Errorf("expected 3, got: %f", m)
+	}
+	if m := median([]float32{6, 2}); m != 4 {
+		t.Errorf("expected 4, got: %f", m)
+	}
+}
+
+func TestIntervalFromLine(t *testing.T) {
+	iv, err := intervalFromLine("chr1\t100\t200\t1000\t2000\n", nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if iv.Chrom != "chr1" || iv.Start != 100 || iv.End != 200 {
+		t.Errorf("unexpected interval: %+v", iv)
+	}
+	if iv.Depths[0] != 10 || iv.Depths[1] != 20 {
+		t.Errorf("expected depths to be divided by length, got: %v", iv.Depths)
+	}
+	iv, err = intervalFromLine("chr1\t100\t200\t10.5\t20", nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if iv.Depths[0] != 10.5 || iv.Depths[1] != 20 {
+		t.Errorf("expected mean depths to be unchanged, got: %v", iv.Depths)
+	}
+	if _, err := intervalFromLine("chr1\t200\t100\t10", nil, false); err == nil {
+		t.Errorf("expected error for end before start")
+	}
+}
+
+func TestCorrectBySampleMedian(t *testing.T) {
+	ivs := &Intervals{}
+	for i, d := range [][]float32{{10, 20, 30}, {12, 24, 36}, {8, 16, 24}} {
+		ivs.add(&Interval{Chrom: "chr1", Start: uint32(i * 100), End: uint32(i*100 + 100), Depths: d, AdjustedDepths: make([]float32, len(d))})
+	}
+	ivs.CorrectBySampleMedian()
+	for _, iv := range ivs.Intervals {
+		for _, d := range iv.AdjustedDepths[1:] {
+			if d != iv.AdjustedDepths[0] {
+				t.Errorf("expected equal depths after normalization, got: %v", iv.AdjustedDepths)
+			}
+		}
+	}
+}
+
+func testIntervals() *Intervals {
+	ivs := &Intervals{samples: []string{"a", "b", "c", "d", "e"}}
+	for _, chrom := range []string{"chr2", "chr1"} {
+		for i := 0; i < 50; i++ {
+			d := []float32{30, 31, 29, 30, 30}
+			// a deletion in sample "c" on chr2 only.
+			if chrom == "chr2" && i >= 20 && i < 30 {
+				d[2] = 15
+			}
+			ivs.add(&Interval{Chrom: chrom, Start: uint32(i * 1000), End: uint32(i*1000 + 1000), Depths: d, AdjustedDepths: append([]float32{}, d...)})
+		}
+	}
+	return ivs
+}
+
+func TestCallCopyNumbers(t *testing.T) {
+	ivs := testIntervals()
+	var buf bytes.Buffer
+	ivs.CallCopyNumbers(bedReporter(&buf, ivs.Samples()))
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("expected 1 CNV, got: %q", buf.String())
+	}
+	toks := strings.Split(lines[0], "\t")
+	// a window is added to a CNV only if it agrees with the previous window so the first is not included.
+	if toks[0] != "chr2" || toks[1] != "21000" || toks[2] != "30000" || toks[3] != "c" {
+		t.Errorf("unexpected CNV: %s", lines[0])
+	}
+	if ivs.Intervals[0].Chrom != "chr2" {
+		t.Errorf("expected chromosomes in input order after sorting")
+	}
+}
+
+func TestTracks(t *testing.T) {
+	ivs := testIntervals()
+	var seg, log2, bed bytes.Buffer
+	tw := &trackWriter{seg: &seg, log2: &log2, bed: &bed, samples: ivs.Samples()}
+	ivs.CallCopyNumbers(tw.report)
+
+	var segs []string
+	for _, l := range strings.Split(strings.TrimSpace(seg.String()), "\n") {
+		if strings.HasPrefix(l, "c\tchr2\t") {
+			segs = append(segs, l)
+		}
+	}
+	// the deletion splits the windows of c on chr2 into 3 segments.
+	if len(segs) != 3 || !strings.HasPrefix(segs[0], "c\tchr2\t0\t21000\t21\t") ||
+		!strings.HasPrefix(segs[1], "c\tchr2\t21000\t30000\t9\t-") || !strings.HasPrefix(segs[2], "c\tchr2\t30000\t50000\t20\t") {
+		t.Errorf("unexpected segments: %q", segs)
+	}
+	if n := strings.Count(seg.String(), "\n"); n != 4+2*(len(ivs.Samples())-1) {
+		t.Errorf("expected a segment per chromosome for the other samples, got %d lines", n)
+	}
+	if n := strings.Count(log2.String(), "\n"); n != len(ivs.Intervals)*len(ivs.Samples()) {
+		t.Errorf("expected a line per window and sample, got %d", n)
+	}
+	if exp := "chr2\t21000\t30000\tc:DEL:CN1\t0\t.\t21000\t30000\t" + delColor + "\n"; bed.String() != exp {
+		t.Errorf("expected: %q, got: %q", exp, bed.String())
+	}
+}
+
+func TestVCF(t *testing.T) {
+	ivs := testIntervals()
+	var buf bytes.Buffer
+	vw := &vcfWriter{w: &buf, samples: ivs.Samples()}
+	vw.writeHeader(ivs.Chroms(), "ref.fa")
+	ivs.CallCopyNumbers(vw.report)
+
+	var recs []string
+	for _, l := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if strings.HasPrefix(l, "##contig") && l != "##contig=<ID=chr2>" && l != "##contig=<ID=chr1>" {
+			t.Errorf("unexpected contig line: %s", l)
+		}
+		if !strings.HasPrefix(l, "#") {
+			recs = append(recs, l)
+		}
+	}
+	if len(recs) != 1 {
+		t.Fatalf("expected 1 record, got: %q", recs)
+	}
+	toks := strings.Split(recs[0], "\t")
+	if toks[0] != "chr2" || toks[1] != "21000" || toks[3] != "N" || toks[4] != "<DEL>" {
+		t.Errorf("unexpected record: %s", recs[0])
+	}
+	if !strings.HasPrefix(toks[7], "SVTYPE=DEL;END=30000;SVLEN=-9000;") {
+		t.Errorf("unexpected INFO: %s", toks[7])
+	}
+	if toks[8] != "GT:CN:GQ:ND" || len(toks) != 9+len(ivs.Samples()) {
+		t.Fatalf("unexpected FORMAT: %s", recs[0])
+	}
+	for i, f := range toks[9:] {
+		exp := "0/0:2:"
+		if i == 2 {
+			exp = "0/1:1:"
+		}
+		if !strings.HasPrefix(f, exp) {
+			t.Errorf("sample %d: expected %s, got: %s", i, exp, f)
+		}
+	}
+}
+
+func TestGT(t *testing.T) {
+	for _, c := range []struct {
+		cn  int
+		del bool
+		exp string
+	}{{0, true, "1/1"}, {1, true, "0/1"}, {2, true, "0/0"}, {3, true, "./."}, {4, false, "0/1"}, {1, false, "./."}} {
+		if g := gt(c.cn, c.del); g != c.exp {
+			t.Errorf("%d %v: expected %s, got: %s", c.cn, c.del, c.exp, g)
+		}
+	}
+}
+
+func TestDenovo(t *testing.T) {
+	ped := filepath.Join(t.TempDir(), "trio.ped")
+	if err := os.WriteFile(ped, []byte("#family\tsample\tdad\tmom\tsex\tpheno\nf\tc\ta\tb\t1\t2\nf\ta\t0\t0\t1\t1\nf2\tx\ta\tb\t1\t1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ivs := testIntervals()
+	trios, err := readTrios(ped, ivs.Samples())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trios) != 1 || trios[0] != (trio{kid: 2, dad: 0, mom: 1}) {
+		t.Fatalf("unexpected trios: %v", trios)
+	}
+
+	var buf bytes.Buffer
+	vw := &vcfWriter{w: &buf, samples: ivs.Samples(), trios: trios}
+	vw.writeHeader(ivs.Chroms(), "ref.fa")
+	ivs.CallCopyNumbers(vw.report)
+	var rec string
+	for _, l := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if !strings.HasPrefix(l, "#") {
+			rec = l
+		}
+	}
+	toks := strings.Split(rec, "\t")
+	if !strings.HasSuffix(toks[7], ";DENOVO") || toks[8] != "GT:CN:GQ:ND:DN:DQ" {
+		t.Fatalf("expected de novo record, got: %s", rec)
+	}
+	if !strings.HasSuffix(toks[9+2], ":1:99") || !strings.HasSuffix(toks[9], ":.:.") {
+		t.Errorf("unexpected sample fields: %s", rec)
+	}
+
+	// the CNV is inherited when a parent has it.
+	buf.Reset()
+	vw.trios = []trio{{kid: 3, dad: 2, mom: 4}}
+	ivs.CallCopyNumbers(vw.report)
+	toks = strings.Split(strings.TrimSpace(buf.String()), "\t")
+	if strings.Contains(toks[7], "DENOVO") {
+		t.Errorf("did not expect de novo for an inherited CNV: %s", buf.String())
+	}
+}
+
+func TestPanel(t *testing.T) {
+	dir := t.TempDir()
+	if err := testIntervals().WritePanel(dir); err != nil {
+		t.Fatal(err)
+	}
+	// use the samples without the deletion as the panel.
+	if err := os.Remove(filepath.Join(dir, "c"+ponSuffix)); err != nil {
+		t.Fatal(err)
+	}
+	single := func() *Intervals {
+		ivs := &Intervals{samples: []string{"x"}}
+		for _, iv := range testIntervals().Intervals {
+			d := []float32{iv.Depths[2]}
+			ivs.add(&Interval{Chrom: iv.Chrom, Start: iv.Start, End: iv.End, Depths: d, AdjustedDepths: append([]float32{}, d...)})
+		}
+		return ivs
+	}
+	ivs := single()
+	if err := ivs.AddPanel(dir); err != nil {
+		t.Fatal(err)
+	}
+	if ivs.NSamples() != 5 || ivs.panel != 4 || strings.Join(ivs.Cases(), ",") != "x" {
+		t.Fatalf("unexpected samples after adding the panel: %v", ivs.Samples())
+	}
+	var buf bytes.Buffer
+	ivs.CallCopyNumbers(casesOnly(bedReporter(&buf, ivs.Samples()), ivs.panel, ivs.NSamples()))
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1 || !strings.HasPrefix(lines[0], "chr2\t21000\t30000\tx\t") {
+		t.Errorf("expected the deletion in x, got: %q", buf.String())
+	}
+
+	ivs = single()
+	ivs.add(&Interval{Chrom: "chr3", Start: 0, End: 1000, Depths: []float32{30}, AdjustedDepths: []float32{30}})
+	if err := ivs.AddPanel(dir); err == nil {
+		t.Errorf("expected an error for a window that is not in the panel")
+	}
+}
 
+func TestReadSNVs(t *testing.T) {
+	vcf := filepath.Join(t.TempDir(), "snvs.vcf")
+	data := `##fileformat=VCFv4.2
+#CHROM	POS	ID	REF	ALT	QUAL	FILTER	INFO	FORMAT	c	x	a
+chr1	100	.	A	G	50	PASS	.	GT:AD	0/1:10,10	0/1:5,5	1/1:0,20
+chr1	50	.	A	G	50	.	.	GT:AD	0/1:3,3	0/1:5,5	0/0:20,0
+chr1	200	.	A	GT	50	PASS	.	GT:AD	0/1:10,10	0/1:5,5	0/1:10,10
+chr1	300	.	A	G	50	LowQual	.	GT:AD	0/1:10,10	0/1:5,5	0/1:10,10
+`
+	if err := os.WriteFile(vcf, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := readSNVs(vcf, []string{"a", "b", "c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the indel and the filtered SNV are skipped as is c at 50 with fewer than minAlleleDepth reads.
+	if a := s.bafs[0]["chr1"]; len(a) != 2 || a[0] != (baf{49, 0}) || a[1] != (baf{99, 1}) {
+		t.Errorf("unexpected B-allele frequencies for a: %v", a)
+	}
+	if c := s.bafs[2]["chr1"]; len(c) != 1 || c[0] != (baf{99, 0.5}) {
+		t.Errorf("unexpected B-allele frequencies for c: %v", c)
+	}
+	if len(s.bafs[1]) != 0 || s.hetRate[0] != 0 || s.hetRate[2] != 1 {
+		t.Errorf("unexpected het rates: %v", s.hetRate)
+	}
+	if _, err := readSNVs(vcf, []string{"y"}); err == nil {
+		t.Errorf("expected an error without any of the samples")
+	}
+}
+
+// testSNVs returns an SNV every 100 bases of chr1 and chr2 to 50000 for each sample with a B-allele
+// frequency of 0.5 at every other SNV except from start to end of chr2 in sample c where it is f.
+func testSNVs(start, end int, f float32) *snvs {
+	s := &snvs{hetRate: []float64{0.5, 0.5, 0.5, 0.5, 0.5}}
+	for i := 0; i < 5; i++ {
+		m := make(map[string][]baf)
+		for _, chrom := range []string{"chr1", "chr2"} {
+			for p := 50; p < 50000; p += 100 {
+				b := baf{pos: p, f: float32(p/100%2) * 0.5}
+				if i == 2 && chrom == "chr2" && p >= start && p < end {
+					b.f = f
+				}
+				m[chrom] = append(m[chrom], b)
+			}
+		}
+		s.bafs = append(s.bafs, m)
+	}
+	return s
+}
+
+func TestVCFBAF(t *testing.T) {
+	call := func(s *snvs) []string {
+		ivs := testIntervals()
+		var buf bytes.Buffer
+		vw := &vcfWriter{w: &buf, samples: ivs.Samples(), snvs: s}
+		vw.writeHeader(ivs.Chroms(), "ref.fa")
+		ivs.CallCopyNumbers(vw.report)
+		var recs []string
+		for _, l := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+			if !strings.HasPrefix(l, "#") {
+				recs = append(recs, l)
+			}
+		}
+		return recs
+	}
+	// the deletion in c has only homozygous SNVs.
+	recs := call(testSNVs(20000, 30000, 1))
+	if len(recs) != 1 {
+		t.Fatalf("expected 1 record, got: %q", recs)
+	}
+	toks := strings.Split(recs[0], "\t")
+	if toks[6] != "PASS" || !strings.Contains(toks[7], ";BAFSUPPORT") || toks[8] != "GT:CN:GQ:ND:BS:BH:BD" {
+		t.Errorf("expected the deletion to be supported, got: %s", recs[0])
+	}
+	if !strings.HasSuffix(toks[11], ":90:0:.") || !strings.HasSuffix(toks[9], ":90:45:0.000") {
+		t.Errorf("unexpected allele balance fields: %s", recs[0])
+	}
+
+	// heterozygous SNVs contradict the deletion.
+	recs = call(testSNVs(20000, 30000, 0.5))
+	if toks = strings.Split(recs[0], "\t"); toks[6] != "BAF" || strings.Contains(toks[7], "BAFSUPPORT") {
+		t.Errorf("expected the deletion to be filtered, got: %s", recs[0])
+	}
+
+	// a run without heterozygous SNVs where c has 2 copies is copy-neutral LOH.
+	defer func(n int) { minLOH = n }(minLOH)
+	minLOH = 5000
+	recs = call(testSNVs(35000, 50000, 0))
+	if len(recs) != 2 {
+		t.Fatalf("expected the deletion and LOH, got: %q", recs)
+	}
+	toks = strings.Split(recs[1], "\t")
+	if toks[0] != "chr2" || toks[1] != "35050" || toks[4] != "<CNV>" || !strings.HasSuffix(toks[7], ";LOH") {
+		t.Errorf("unexpected LOH record: %s", recs[1])
+	}
+	if !strings.HasPrefix(toks[11], "0/1:2:") || !strings.HasPrefix(toks[9], "0/0:2:") {
+		t.Errorf("unexpected LOH genotypes: %s", recs[1])
+	}
 }
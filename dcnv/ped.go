@@ -0,0 +1,59 @@
+package dcnv
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/brentp/goleft"
+	"github.com/brentp/xopen"
+)
+
+// trio holds the indexes into the samples of a child and both parents.
+type trio struct {
+	kid, dad, mom int
+}
+
+// readTrios reads a PED file and returns the trios for which the child and both parents are in samples.
+func readTrios(path string, samples []string) ([]trio, error) {
+	rdr, err := xopen.Ropen(path)
+	if err != nil {
+		return nil, err
+	}
+	defer rdr.Close()
+	idx := make(map[string]int, len(samples))
+	for i, s := range samples {
+		idx[s] = i
+	}
+	var trios []trio
+	seen := make(map[int]bool)
+	for i := 1; ; i++ {
+		line, err := rdr.ReadString('\n')
+		if line = strings.TrimSpace(line); len(line) > 0 && line[0] != '#' {
+			toks := strings.Fields(line)
+			if len(toks) < 4 {
+				return nil, &goleft.ParseError{Path: path, Line: i, Err: fmt.Errorf("dcnv: expected at least 4 fields in ped line: %q", line)}
+			}
+			kid, kok := idx[toks[1]]
+			dad, dok := idx[toks[2]]
+			mom, mok := idx[toks[3]]
+			if kok && dok && mok && !seen[kid] {
+				seen[kid] = true
+				trios = append(trios, trio{kid: kid, dad: dad, mom: mom})
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return trios, nil
+}
+
+// denovo returns the probability that the child in t has a copy-number other than 2 while both parents
+// have copy-number 2 given the posterior probability of each copy-number for each sample.
+func denovo(t trio, post [][]float64) float64 {
+	return (1 - post[t.kid][2]) * post[t.dad][2] * post[t.mom][2]
+}
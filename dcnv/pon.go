@@ -0,0 +1,95 @@
+package dcnv
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/brentp/goleft/emdepth"
+	"github.com/brentp/xopen"
+)
+
+// ponSuffix is the suffix of the normalized depth of each sample in a panel of normals directory.
+// The files are depth.beds so sampleFromPath gives the sample name.
+const ponSuffix = ".depth.bed.gz"
+
+// WritePanel writes the normalized depth of each sample to dir so that it can be used as a panel of
+// normals with AddPanel. It must be called after the corrections. Samples from a panel are not written.
+func (ivs *Intervals) WritePanel(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	ivs.SortByPosition()
+	for i, s := range ivs.Cases() {
+		w, err := xopen.Wopen(filepath.Join(dir, s+ponSuffix))
+		if err != nil {
+			return err
+		}
+		for _, iv := range ivs.Intervals {
+			fmt.Fprintf(w, "%s\t%d\t%d\t%.2f\n", iv.Chrom, iv.Start, iv.End, iv.AdjustedDepths[i])
+		}
+		if err := w.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AddPanel adds the samples from a panel of normals written by WritePanel to dir as the last samples
+// in each interval. The panel must have every window in the intervals.
+func (ivs *Intervals) AddPanel(dir string) error {
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+ponSuffix))
+	if err != nil {
+		return err
+	}
+	if len(paths) == 0 {
+		return fmt.Errorf("dcnv: no %s files in panel of normals directory %s", ponSuffix, dir)
+	}
+	pon := &Intervals{}
+	// the GC is only needed for the intervals that are called.
+	if err := pon.ReadBeds(paths, ""); err != nil {
+		return err
+	}
+	type window struct {
+		chrom      string
+		start, end uint32
+	}
+	byWindow := make(map[window]*Interval, len(pon.Intervals))
+	for _, iv := range pon.Intervals {
+		byWindow[window{iv.Chrom, iv.Start, iv.End}] = iv
+	}
+	for _, iv := range ivs.Intervals {
+		p, ok := byWindow[window{iv.Chrom, iv.Start, iv.End}]
+		if !ok {
+			return fmt.Errorf("dcnv: %s:%d-%d is not in the panel of normals in %s", iv.Chrom, iv.Start, iv.End, dir)
+		}
+		iv.Depths = append(iv.Depths, p.Depths...)
+		iv.AdjustedDepths = append(iv.AdjustedDepths, p.AdjustedDepths...)
+	}
+	ivs.samples = append(ivs.samples, pon.samples...)
+	ivs.panel = len(pon.samples)
+	ivs.sampleMedians, ivs.sampleScalars = nil, nil
+	return nil
+}
+
+// Cases returns the samples that are not from a panel of normals.
+func (ivs Intervals) Cases() []string {
+	return ivs.samples[:len(ivs.samples)-ivs.panel]
+}
+
+// casesOnly drops the CNVs of the last nPanel samples, which are from a panel of normals, before
+// they are sent to report.
+func casesOnly(report Reporter, nPanel, nSamples int) Reporter {
+	if nPanel == 0 {
+		return report
+	}
+	return func(chrom string, cnvs []*emdepth.CNV, ems []*emdepth.EMD) {
+		kept := cnvs[:0]
+		for _, cnv := range cnvs {
+			if cnv.SampleI < nSamples-nPanel {
+				kept = append(kept, cnv)
+			}
+		}
+		report(chrom, kept, ems)
+	}
+}
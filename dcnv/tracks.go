@@ -0,0 +1,153 @@
+package dcnv
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/brentp/goleft/emdepth"
+	"github.com/brentp/xopen"
+)
+
+// trackWriter writes files for a genome browser from the CNVs and windows of each chromosome:
+// $prefix.seg has a segment of the CNVs or of the windows between them for each sample,
+// $prefix.log2.seg has the log2 fold-change of each window for each sample and $prefix.cnvs.bed
+// has a feature for each CNV colored by type. Both .seg files assign log2 ratios to each sample and
+// can be loaded in IGV.
+type trackWriter struct {
+	seg, log2, bed io.Writer
+	// samples are the samples with tracks. Any after these are from a panel of normals.
+	samples []string
+	files   []*xopen.Writer
+}
+
+// delColor and dupColor are the itemRgb of deletions and duplications in the BED track.
+const delColor = "200,0,0"
+const dupColor = "0,0,200"
+
+// newTrackWriter creates the files for prefix and writes their headers.
+func newTrackWriter(prefix string, samples []string) (*trackWriter, error) {
+	t := &trackWriter{samples: samples}
+	for _, suffix := range []string{".seg", ".log2.seg", ".cnvs.bed"} {
+		w, err := xopen.Wopen(prefix + suffix)
+		if err != nil {
+			t.Close()
+			return nil, err
+		}
+		t.files = append(t.files, w)
+	}
+	t.seg, t.log2, t.bed = t.files[0], t.files[1], t.files[2]
+	fmt.Fprintln(t.seg, "ID\tchrom\tloc.start\tloc.end\tnum.mark\tseg.mean")
+	fmt.Fprintln(t.log2, "ID\tchrom\tloc.start\tloc.end\tnum.mark\tseg.mean")
+	fmt.Fprintf(t.bed, "track name=\"%s CNVs\" description=\"dcnv deletions (red) and duplications (blue)\" itemRgb=On\n", prefix)
+	return t, nil
+}
+
+// Close closes the files of t.
+func (t *trackWriter) Close() error {
+	var err error
+	for _, f := range t.files {
+		if e := f.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// segment is a run of windows for a sample with the mean log2 fold-change.
+type segment struct {
+	start, end uint32
+	n          int
+	log2       float64
+}
+
+// segments returns the CNVs of a sample (sorted by start) and the runs of windows in ems between them
+// as segments sorted by start. fcs are the log2 fold-changes of each window in ems.
+func segments(ems []*emdepth.EMD, fcs [][]float64, cnvs []*emdepth.CNV, sampleI int) []segment {
+	var segs []segment
+	var cur *segment
+	end := func() {
+		if cur != nil {
+			cur.log2 /= float64(cur.n)
+			segs = append(segs, *cur)
+			cur = nil
+		}
+	}
+	k := 0
+	for i, em := range ems {
+		for k < len(cnvs) && cnvs[k].Position[len(cnvs[k].Position)-1].End <= em.Position.Start {
+			end()
+			segs = append(segs, cnvSegment(cnvs[k]))
+			k++
+		}
+		if k < len(cnvs) && em.Position.End > cnvs[k].Position[0].Start {
+			// the window is part of the next CNV.
+			end()
+			continue
+		}
+		if cur == nil {
+			cur = &segment{start: em.Position.Start}
+		}
+		cur.end = em.Position.End
+		cur.n++
+		cur.log2 += fcs[i][sampleI]
+	}
+	end()
+	for ; k < len(cnvs); k++ {
+		segs = append(segs, cnvSegment(cnvs[k]))
+	}
+	return segs
+}
+
+// cnvSegment is the segment of the windows of a CNV.
+func cnvSegment(cnv *emdepth.CNV) segment {
+	s := segment{start: cnv.Position[0].Start, end: cnv.Position[len(cnv.Position)-1].End, n: len(cnv.Log2FC)}
+	for _, v := range cnv.Log2FC {
+		s.log2 += float64(v)
+	}
+	s.log2 /= float64(s.n)
+	return s
+}
+
+// report is a Reporter that writes the tracks for a chromosome.
+func (t *trackWriter) report(chrom string, cnvs []*emdepth.CNV, ems []*emdepth.EMD) {
+	// cnvs are sorted by start so those of each sample are too.
+	bySample := make([][]*emdepth.CNV, len(t.samples))
+	for _, cnv := range cnvs {
+		if cnv.SampleI < len(t.samples) {
+			bySample[cnv.SampleI] = append(bySample[cnv.SampleI], cnv)
+		}
+	}
+	fcs := make([][]float64, len(ems))
+	for i, em := range ems {
+		fcs[i] = em.Log2FC()
+	}
+	for i, s := range t.samples {
+		for k, em := range ems {
+			fmt.Fprintf(t.log2, "%s\t%s\t%d\t%d\t1\t%.3f\n", s, chrom, em.Position.Start, em.Position.End, fcs[k][i])
+		}
+		for _, seg := range segments(ems, fcs, bySample[i], i) {
+			fmt.Fprintf(t.seg, "%s\t%s\t%d\t%d\t%d\t%.3f\n", s, chrom, seg.start, seg.end, seg.n, seg.log2)
+		}
+	}
+	for _, cnv := range cnvs {
+		if cnv.SampleI >= len(t.samples) {
+			continue
+		}
+		start, end := cnv.Position[0].Start, cnv.Position[len(cnv.Position)-1].End
+		cn := medianCN(cnv.CN)
+		typ, color := "DUP", dupColor
+		if cn < 2 {
+			typ, color = "DEL", delColor
+		}
+		fmt.Fprintf(t.bed, "%s\t%d\t%d\t%s:%s:CN%d\t0\t.\t%d\t%d\t%s\n", chrom, start, end, t.samples[cnv.SampleI], typ, cn, start, end, color)
+	}
+}
+
+// tee returns a Reporter that sends the CNVs and windows to each of reports.
+func tee(reports ...Reporter) Reporter {
+	return func(chrom string, cnvs []*emdepth.CNV, ems []*emdepth.EMD) {
+		for _, r := range reports {
+			r(chrom, cnvs, ems)
+		}
+	}
+}
@@ -0,0 +1,334 @@
+package dcnv
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/brentp/faidx"
+	"github.com/brentp/goleft"
+	"github.com/brentp/goleft/emdepth"
+)
+
+// maxGQ and maxQual cap the phred-scaled qualities.
+const maxGQ = 99
+const maxQual = 999
+
+// vcfWriter writes a VCF 4.2 record with symbolic <DEL> or <DUP> alleles for each CNV.
+type vcfWriter struct {
+	w       io.Writer
+	fa      *faidx.Faidx
+	samples []string
+	// trios from --ped add the DN and DQ fields for each child.
+	trios []trio
+	// snvs from --snps add the BS, BH and BD fields, the BAF filter and records for LOH.
+	snvs *snvs
+}
+
+// record is a line of the VCF and its position so that the records of a chromosome can be sorted.
+type record struct {
+	pos  int
+	line string
+}
+
+func (v *vcfWriter) writeHeader(chroms []string, reference string) {
+	fmt.Fprintln(v.w, "##fileformat=VCFv4.2")
+	fmt.Fprintf(v.w, "##source=goleft dcnv %s\n", goleft.Version)
+	fmt.Fprintf(v.w, "##reference=%s\n", reference)
+	for _, c := range chroms {
+		fmt.Fprintf(v.w, "##contig=<ID=%s>\n", c)
+	}
+	fmt.Fprintln(v.w, `##ALT=<ID=DEL,Description="Deletion">`)
+	fmt.Fprintln(v.w, `##ALT=<ID=DUP,Description="Duplication">`)
+	if v.snvs != nil {
+		fmt.Fprintln(v.w, `##ALT=<ID=CNV,Description="Copy number variable region">`)
+	}
+	fmt.Fprintln(v.w, `##INFO=<ID=SVTYPE,Number=1,Type=String,Description="Type of structural variant">`)
+	fmt.Fprintln(v.w, `##INFO=<ID=END,Number=1,Type=Integer,Description="End position of the variant">`)
+	fmt.Fprintln(v.w, `##INFO=<ID=SVLEN,Number=1,Type=Integer,Description="Difference in length between REF and ALT alleles">`)
+	fmt.Fprintln(v.w, `##INFO=<ID=IMPRECISE,Number=0,Type=Flag,Description="Imprecise structural variant">`)
+	fmt.Fprintln(v.w, `##INFO=<ID=NWINDOWS,Number=1,Type=Integer,Description="Number of depth windows in the variant">`)
+	if v.snvs != nil {
+		fmt.Fprintln(v.w, `##INFO=<ID=BAFSUPPORT,Number=0,Type=Flag,Description="The B-allele frequencies of the SNVs in the sample with the CNV support its copy number">`)
+		fmt.Fprintln(v.w, `##INFO=<ID=LOH,Number=0,Type=Flag,Description="Copy-neutral loss of heterozygosity in the sample with GT 0/1">`)
+	}
+	if v.trios != nil {
+		fmt.Fprintln(v.w, `##INFO=<ID=DENOVO,Number=0,Type=Flag,Description="At least 1 child is a candidate de novo CNV">`)
+	}
+	fmt.Fprintln(v.w, `##FILTER=<ID=PASS,Description="All filters passed">`)
+	if v.snvs != nil {
+		fmt.Fprintln(v.w, `##FILTER=<ID=BAF,Description="The B-allele frequencies of the SNVs in the sample with the CNV contradict its copy number">`)
+	}
+	fmt.Fprintln(v.w, `##FORMAT=<ID=GT,Number=1,Type=String,Description="Genotype">`)
+	fmt.Fprintln(v.w, `##FORMAT=<ID=CN,Number=1,Type=Integer,Description="Copy number">`)
+	fmt.Fprintln(v.w, `##FORMAT=<ID=GQ,Number=1,Type=Integer,Description="Phred-scaled probability that the copy number is wrong">`)
+	fmt.Fprintln(v.w, `##FORMAT=<ID=ND,Number=1,Type=Float,Description="Mean normalized depth across the windows of the variant">`)
+	if v.snvs != nil {
+		fmt.Fprintln(v.w, `##FORMAT=<ID=BS,Number=1,Type=Integer,Description="SNVs from --snps with allele depths in the variant">`)
+		fmt.Fprintln(v.w, `##FORMAT=<ID=BH,Number=1,Type=Integer,Description="SNVs in BS that are heterozygous with a B-allele frequency between 0.15 and 0.85">`)
+		fmt.Fprintln(v.w, `##FORMAT=<ID=BD,Number=1,Type=Float,Description="Median distance from 0.5 of the B-allele frequencies of the SNVs in BH">`)
+	}
+	if v.trios != nil {
+		fmt.Fprintln(v.w, `##FORMAT=<ID=DN,Number=1,Type=Integer,Description="1 if the child has the CNV and both parents have copy number 2. missing for samples that are not the child of a trio">`)
+		fmt.Fprintln(v.w, `##FORMAT=<ID=DQ,Number=1,Type=Integer,Description="Phred-scaled probability that the CNV is not de novo">`)
+	}
+	fmt.Fprintf(v.w, "#CHROM\tPOS\tID\tREF\tALT\tQUAL\tFILTER\tINFO\tFORMAT\t%s\n", strings.Join(v.samples, "\t"))
+}
+
+// phred converts a probability of error to a phred-scaled quality capped at max.
+func phred(p float64, max int) int {
+	if p <= 0 {
+		return max
+	}
+	q := int(-10*math.Log10(p) + 0.5)
+	if q > max {
+		return max
+	}
+	if q < 0 {
+		return 0
+	}
+	return q
+}
+
+// posteriors sums the log-likelihoods of each copy-number across the windows for each sample and
+// returns the posterior probability of each copy-number with a flat prior.
+func posteriors(ems []*emdepth.EMD, nSamples int) [][]float64 {
+	post := make([][]float64, nSamples)
+	for i := range post {
+		for _, em := range ems {
+			ll := em.LogLikelihoods(em.Depths[i])
+			if post[i] == nil {
+				post[i] = ll
+				continue
+			}
+			for cn, l := range ll {
+				post[i][cn] += l
+			}
+		}
+		mx := math.Inf(-1)
+		for _, l := range post[i] {
+			mx = math.Max(mx, l)
+		}
+		var tot float64
+		for cn, l := range post[i] {
+			post[i][cn] = math.Exp(l - mx)
+			tot += post[i][cn]
+		}
+		for cn := range post[i] {
+			post[i][cn] /= tot
+		}
+	}
+	return post
+}
+
+// windows returns the windows in ems (sorted by start) that are within the CNV.
+func windows(ems []*emdepth.EMD, cnv *emdepth.CNV) []*emdepth.EMD {
+	return windowsIn(ems, cnv.Position[0].Start, cnv.Position[len(cnv.Position)-1].End)
+}
+
+// windowsIn returns the windows in ems (sorted by start) that are within start to end.
+func windowsIn(ems []*emdepth.EMD, start, end uint32) []*emdepth.EMD {
+	i := sort.Search(len(ems), func(i int) bool { return ems[i].Position.Start >= start })
+	j := i
+	for j < len(ems) && ems[j].Position.End <= end {
+		j++
+	}
+	return ems[i:j]
+}
+
+func argmax(a []float64) int {
+	m := 0
+	for i, v := range a {
+		if v > a[m] {
+			m = i
+		}
+	}
+	return m
+}
+
+// medianCN is the median of the copy-numbers called for each window of a CNV.
+func medianCN(cns []int) int {
+	c := append([]int{}, cns...)
+	sort.Ints(c)
+	return c[len(c)/2]
+}
+
+// gt converts a copy-number to a genotype for a record with a deletion or duplication allele.
+// duplications are 0/1 for any copy-number above 2 as the number of copies on each haplotype is unknown.
+func gt(cn int, del bool) string {
+	switch {
+	case cn == 2:
+		return "0/0"
+	case del && cn == 1:
+		return "0/1"
+	case del && cn == 0:
+		return "1/1"
+	case !del && cn > 2:
+		return "0/1"
+	}
+	return "./."
+}
+
+func (v *vcfWriter) ref(chrom string, pos int) string {
+	if v.fa != nil {
+		if b, err := v.fa.Get(chrom, pos-1, pos); err == nil && len(b) == 1 {
+			return strings.ToUpper(b)
+		}
+	}
+	return "N"
+}
+
+// report writes a record for each CNV. The sample with the CNV has the copy-number from the caller
+// and the other samples have the most likely copy-number over the same windows. With --snps, the
+// records for runs of copy-neutral LOH are also written, sorted with those of the CNVs.
+func (v *vcfWriter) report(chrom string, cnvs []*emdepth.CNV, ems []*emdepth.EMD) {
+	var recs []record
+	fields := make([]string, len(v.samples))
+	for _, cnv := range cnvs {
+		wins := windows(ems, cnv)
+		if len(wins) == 0 {
+			continue
+		}
+		post := posteriors(wins, len(v.samples))
+		start, end := int(cnv.Position[0].Start), int(cnv.Position[len(cnv.Position)-1].End)
+		cn := medianCN(cnv.CN)
+		if cn >= len(post[cnv.SampleI]) {
+			cn = len(post[cnv.SampleI]) - 1
+		}
+		del := cn < 2
+		cns := make([]int, len(v.samples))
+		var bal []balance
+		for i := range v.samples {
+			scn := argmax(post[i])
+			if i == cnv.SampleI {
+				scn = cn
+			}
+			cns[i] = scn
+			fields[i] = fmt.Sprintf("%s:%d:%d:%.2f", gt(scn, del), scn, phred(1-post[i][scn], maxGQ), meanDepth(wins, i))
+			if v.snvs != nil {
+				bal = append(bal, summarize(v.snvs.in(i, chrom, start, end)))
+				fields[i] += ":" + bal[i].format()
+			}
+		}
+		format, info, filter := "GT:CN:GQ:ND", "", "PASS"
+		if v.snvs != nil {
+			format += ":BS:BH:BD"
+			switch bal[cnv.SampleI].supports(cn, v.snvs.hetRate[cnv.SampleI]) {
+			case 1:
+				info += ";BAFSUPPORT"
+			case -1:
+				filter = "BAF"
+			}
+		}
+		if v.trios != nil {
+			format += ":DN:DQ"
+			isKid := make([]bool, len(v.samples))
+			denovos := false
+			for _, t := range v.trios {
+				isKid[t.kid] = true
+				p := denovo(t, post)
+				dn := 0
+				if g := gt(cns[t.kid], del); p >= 0.5 && g != "0/0" && g != "./." {
+					dn = 1
+					denovos = true
+				}
+				fields[t.kid] += fmt.Sprintf(":%d:%d", dn, phred(1-p, maxGQ))
+			}
+			for i, kid := range isKid {
+				if !kid {
+					fields[i] += ":.:."
+				}
+			}
+			if denovos {
+				info += ";DENOVO"
+			}
+		}
+
+		// POS is the base before the event.
+		pos := start
+		if pos < 1 {
+			pos = 1
+		}
+		alt, svlen := "<DUP>", end-start
+		if del {
+			alt, svlen = "<DEL>", start-end
+		}
+		qual := phred(post[cnv.SampleI][2], maxQual)
+		recs = append(recs, record{pos: pos, line: fmt.Sprintf("%s\t%d\t.\t%s\t%s\t%d\t%s\tSVTYPE=%s;END=%d;SVLEN=%d;IMPRECISE;NWINDOWS=%d%s\t%s\t%s\n",
+			chrom, pos, v.ref(chrom, pos), alt, qual, filter, alt[1:4], end, svlen, len(wins), info, format, strings.Join(fields, "\t"))})
+	}
+	if v.snvs != nil {
+		recs = append(recs, v.loh(chrom, cnvs, ems)...)
+		sort.SliceStable(recs, func(i, j int) bool { return recs[i].pos < recs[j].pos })
+	}
+	for _, r := range recs {
+		fmt.Fprint(v.w, r.line)
+	}
+}
+
+// loh returns a record for each run of homozygous SNVs from lohRuns in a sample where the median
+// copy-number of the sample in the windows is 2 and that does not overlap a deletion of the sample.
+// The sample with the LOH is 0/1 and other samples are 0/0 if they have a heterozygous SNV in the
+// run. QUAL is the phred-scaled probability of the run by chance.
+func (v *vcfWriter) loh(chrom string, cnvs []*emdepth.CNV, ems []*emdepth.EMD) []record {
+	var recs []record
+	fields := make([]string, len(v.samples))
+	format := "GT:CN:GQ:ND:BS:BH:BD"
+	if v.trios != nil {
+		format += ":DN:DQ"
+	}
+	for i := range v.samples {
+	runs:
+		for _, r := range v.snvs.lohRuns(i, chrom) {
+			for _, cnv := range cnvs {
+				if cnv.SampleI == i && medianCN(cnv.CN) < 2 && int(cnv.Position[0].Start) < r.end && int(cnv.Position[len(cnv.Position)-1].End) > r.start {
+					continue runs
+				}
+			}
+			wins := windowsIn(ems, uint32(r.start), uint32(r.end))
+			if len(wins) == 0 {
+				continue
+			}
+			cns := make([]int, len(wins))
+			for k, em := range wins {
+				cns[k] = em.Type(em.Depths[i])
+			}
+			if medianCN(cns) != 2 {
+				continue
+			}
+			post := posteriors(wins, len(v.samples))
+			for j := range v.samples {
+				b := summarize(v.snvs.in(j, chrom, r.start, r.end))
+				g := "./."
+				if j == i {
+					g = "0/1"
+				} else if b.hets > 0 {
+					g = "0/0"
+				}
+				cn := argmax(post[j])
+				fields[j] = fmt.Sprintf("%s:%d:%d:%.2f:%s", g, cn, phred(1-post[j][cn], maxGQ), meanDepth(wins, j), b.format())
+				if v.trios != nil {
+					fields[j] += ":.:."
+				}
+			}
+			pos := r.start
+			if pos < 1 {
+				pos = 1
+			}
+			recs = append(recs, record{pos: pos, line: fmt.Sprintf("%s\t%d\t.\t%s\t<CNV>\t%d\tPASS\tSVTYPE=CNV;END=%d;SVLEN=%d;IMPRECISE;NWINDOWS=%d;LOH\t%s\t%s\n",
+				chrom, pos, v.ref(chrom, pos), phred(r.p, maxQual), r.end, r.end-r.start, len(wins), format, strings.Join(fields, "\t"))})
+		}
+	}
+	return recs
+}
+
+// meanDepth is the mean normalized depth of sample i in the windows.
+func meanDepth(wins []*emdepth.EMD, i int) float64 {
+	var nd float64
+	for _, em := range wins {
+		nd += float64(em.Depths[i])
+	}
+	return nd / float64(len(wins))
+}
@@ -0,0 +1,58 @@
+package depth
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"time"
+
+	"github.com/biogo/hts/bgzf"
+	"github.com/brentp/goleft/tabix"
+	"github.com/brentp/xopen"
+)
+
+// bedWriter is a buffered bed output that closes the files under it in order.
+type bedWriter struct {
+	*bufio.Writer
+	closers []io.Closer
+}
+
+// openBed opens a bed output at path. With bgzip it is written with bgzf to path + ".gz" and with
+// index it also gets a tabix index so that the output is only written once.
+func openBed(path string, bgzip, index bool) (*bedWriter, error) {
+	if index {
+		w, err := tabix.Create(path+".gz", 1)
+		if err != nil {
+			return nil, err
+		}
+		return &bedWriter{Writer: bufio.NewWriter(w), closers: []io.Closer{w}}, nil
+	}
+	if bgzip {
+		fh, err := os.Create(path + ".gz")
+		if err != nil {
+			return nil, err
+		}
+		w := bgzf.NewWriter(fh, 1)
+		w.ModTime = time.Unix(0, 0)
+		w.OS = 0xff
+		return &bedWriter{Writer: bufio.NewWriter(w), closers: []io.Closer{w, fh}}, nil
+	}
+	w, err := xopen.Wopen(path)
+	if err != nil {
+		return nil, err
+	}
+	return &bedWriter{Writer: bufio.NewWriter(w), closers: []io.Closer{w}}, nil
+}
+
+// Close flushes the buffer and closes the files.
+func (b *bedWriter) Close() error {
+	if err := b.Flush(); err != nil {
+		return err
+	}
+	for _, c := range b.closers {
+		if err := c.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,303 @@
+package depth
+
+import (
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/biogo/hts/bam"
+	"github.com/biogo/hts/sam"
+	"github.com/brentp/faidx"
+	"github.com/brentp/goleft"
+	"github.com/brentp/goleft/bamio"
+)
+
+// Counts are the bases, insertions and deletions of the reads at a position. An insertion is
+// counted at the base before it as in samtools mpileup.
+type Counts struct {
+	// Bases are the counts of A, C, G, T and N.
+	Bases    [5]int
+	Ins, Del int
+}
+
+// baseIndex is the index in Counts.Bases of each base.
+var baseIndex = [256]int8{'A': 0, 'C': 1, 'G': 2, 'T': 3, 'a': 0, 'c': 1, 'g': 2, 't': 3}
+
+func init() {
+	for i := range baseIndex {
+		switch i {
+		case 'A', 'C', 'G', 'T', 'a', 'c', 'g', 't':
+		default:
+			baseIndex[i] = 4
+		}
+	}
+}
+
+// Base returns the count of base b (one of ACGTN).
+func (c Counts) Base(b byte) int {
+	return c.Bases[baseIndex[b]]
+}
+
+// Depth returns the number of bases counted.
+func (c Counts) Depth() int {
+	return c.Bases[0] + c.Bases[1] + c.Bases[2] + c.Bases[3] + c.Bases[4]
+}
+
+// pileup holds the Counts at each base of a set of regions of a chromosome. Only the bases in the
+// regions are stored so a few targets on a large chromosome use little memory.
+type pileup struct {
+	// regions are sorted and merged and offs[i] is the index in counts of the start of regions[i].
+	regions []region
+	offs    []int
+	counts  []Counts
+}
+
+func newPileup(regions []region) *pileup {
+	sorted := append([]region{}, regions...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].start < sorted[j].start })
+	p := &pileup{}
+	for _, r := range sorted {
+		if r.end <= r.start {
+			continue
+		}
+		if n := len(p.regions); n > 0 && r.start <= p.regions[n-1].end {
+			p.regions[n-1].end = max(p.regions[n-1].end, r.end)
+			continue
+		}
+		p.regions = append(p.regions, r)
+	}
+	n := 0
+	for _, r := range p.regions {
+		p.offs = append(p.offs, n)
+		n += r.end - r.start
+	}
+	p.counts = make([]Counts, n)
+	return p
+}
+
+// at returns the Counts at pos or nil if it is not in any region.
+func (p *pileup) at(pos int) *Counts {
+	i := sort.Search(len(p.regions), func(i int) bool { return p.regions[i].end > pos })
+	if i == len(p.regions) || pos < p.regions[i].start {
+		return nil
+	}
+	return &p.counts[p.offs[i]+pos-p.regions[i].start]
+}
+
+// add counts the bases and indels of rec. Bases with quality below minBaseQ are not counted.
+func (p *pileup) add(rec *sam.Record, minBaseQ int) {
+	if len(p.regions) == 0 || rec.End() <= p.regions[0].start || rec.Pos >= p.regions[len(p.regions)-1].end {
+		return
+	}
+	// qualities of 0xff mean that they are missing so every base is kept.
+	useQual := minBaseQ > 0 && len(rec.Qual) > 0 && rec.Qual[0] != 0xff
+	var seq []byte
+	pos, qpos := rec.Pos, 0
+	for _, co := range rec.Cigar {
+		t, n := co.Type(), co.Len()
+		switch t {
+		case sam.CigarMatch, sam.CigarEqual, sam.CigarMismatch:
+			for i := 0; i < n; i++ {
+				c := p.at(pos + i)
+				if c == nil || (useQual && int(rec.Qual[qpos+i]) < minBaseQ) {
+					continue
+				}
+				if seq == nil {
+					seq = rec.Seq.Expand()
+				}
+				c.Bases[baseIndex[seq[qpos+i]]]++
+			}
+		case sam.CigarInsertion:
+			if c := p.at(pos - 1); c != nil {
+				c.Ins++
+			}
+		case sam.CigarDeletion:
+			for i := 0; i < n; i++ {
+				if c := p.at(pos + i); c != nil {
+					c.Del++
+				}
+			}
+		}
+		c := t.Consumes()
+		if c.Reference == 1 {
+			pos += n
+		}
+		if c.Query == 1 {
+			qpos += n
+		}
+	}
+}
+
+// pass reports whether rec is counted by f other than for --max-depth, which depends on the
+// reads before it.
+func (f filter) pass(rec *sam.Record) bool {
+	if rec.Flags&f.exclude != 0 || rec.Flags&f.include != f.include || int(rec.MapQ) < f.minMapQ {
+		return false
+	}
+	return f.downsample == 0 || keepRead(rec.Name, f.downsample)
+}
+
+// countReader adds the reads that pass its filter to a pileup as they pass through it.
+type countReader struct {
+	RecordReader
+	ref *sam.Reference
+	f   filter
+	p   *pileup
+}
+
+func (r *countReader) Read() (*sam.Record, error) {
+	rec, err := r.RecordReader.Read()
+	if err == nil && rec.Ref != nil && rec.Ref.ID() == r.ref.ID() && r.f.pass(rec) {
+		r.p.add(rec, r.f.minBaseQ)
+	}
+	return rec, err
+}
+
+// countsHeader is the header of $prefix.counts.bed.
+const countsHeader = "#chrom\tstart\tend\tref\tA\tC\tG\tT\tN\tins\tdel\tmismatches\n"
+
+// writeCounts writes the Counts at each base from start to end with the reference base and the
+// number of A, C, G and T bases that differ from it.
+func writeCounts(w io.Writer, fa *faidx.Faidx, chrom string, p *pileup, start, end int) {
+	seq := ""
+	if fa != nil {
+		var err error
+		if seq, err = fa.Get(chrom, start, end); err != nil {
+			goleft.Warnf("depth: %s", err)
+		}
+	}
+	for i := start; i < end; i++ {
+		c := p.at(i)
+		if c == nil {
+			continue
+		}
+		ref, mismatches := byte('N'), 0
+		if i-start < len(seq) {
+			ref = seq[i-start] &^ 0x20
+		}
+		if bi := baseIndex[ref]; bi < 4 {
+			mismatches = c.Bases[0] + c.Bases[1] + c.Bases[2] + c.Bases[3] - c.Bases[bi]
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%c\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\n", chrom, i, i+1, ref,
+			c.Bases[0], c.Bases[1], c.Bases[2], c.Bases[3], c.Bases[4], c.Ins, c.Del, mismatches)
+	}
+}
+
+// BaseCounts returns the Counts at each of the 0-based positions of chrom in the bam or cram at path
+// from reads with mapping quality of at least minMapQ. Bases with quality below minBaseQ are not
+// counted. Reads are skipped as in ChromDepth. For a bam, only the reads near the positions are read
+// using the index. reference is only needed for a cram.
+func BaseCounts(path, reference, chrom string, positions []int, minMapQ, minBaseQ int) ([]Counts, error) {
+	out := make([]Counts, len(positions))
+	if len(positions) == 0 {
+		return out, nil
+	}
+	idx, err := readIndex(path)
+	if err != nil {
+		return nil, err
+	}
+	sorted := append([]int{}, positions...)
+	sort.Ints(sorted)
+	regions := make([]region, len(sorted))
+	for i, pos := range sorted {
+		regions[i] = region{pos, pos + 1}
+	}
+	p := newPileup(regions)
+	f := filter{minMapQ: minMapQ, minBaseQ: minBaseQ, exclude: skipFlags}
+	if idx == nil {
+		rdr, ref, done, err := openChrom(path, reference, idx, chrom, sorted[0], sorted[len(sorted)-1]+1, goleft.BgzfWorkers(1))
+		if err != nil {
+			return nil, err
+		}
+		err = addReads(&countReader{RecordReader: rdr, ref: ref, f: f, p: p})
+		done()
+		if err != nil {
+			return nil, err
+		}
+	} else if err := indexedCounts(path, reference, idx, chrom, p, f); err != nil {
+		return nil, err
+	}
+	for i, pos := range positions {
+		if c := p.at(pos); c != nil {
+			out[i] = *c
+		}
+	}
+	return out, nil
+}
+
+// indexedCounts adds the reads near the regions of p to it. Regions within 16KB share a seek with
+// the index.
+func indexedCounts(path, reference string, idx *bamio.Index, chrom string, p *pileup, f filter) error {
+	br, err := bamio.Open(path, reference, goleft.BgzfWorkers(1))
+	if err != nil {
+		return err
+	}
+	defer br.Close()
+	var ref *sam.Reference
+	for _, r := range br.Header().Refs() {
+		if r.Name() == chrom {
+			ref = r
+		}
+	}
+	if ref == nil {
+		return fmt.Errorf("depth: chromosome %s not found in %s", chrom, path)
+	}
+	regs, from := p.regions, 0
+	for len(regs) > 0 {
+		k := 1
+		for k < len(regs) && regs[k].start-regs[k-1].end < 1<<14 {
+			k++
+		}
+		start, end := regs[0].start, regs[k-1].end
+		regs = regs[k:]
+		chunks, err := idx.Chunks(ref, start, end)
+		if err != nil || len(chunks) == 0 {
+			continue
+		}
+		it, err := bam.NewIterator(br.Reader, chunks)
+		if err != nil {
+			return err
+		}
+		// a read that starts before from was counted with an earlier group.
+		err = addReads(&countReader{RecordReader: spanReader{iterReader{it}, from, start, end}, ref: ref, f: f, p: p})
+		from = end
+		it.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// spanReader passes through only the reads that start at or after from and overlap start to end
+// and stops after them.
+type spanReader struct {
+	RecordReader
+	from, start, end int
+}
+
+func (r spanReader) Read() (*sam.Record, error) {
+	for {
+		rec, err := r.RecordReader.Read()
+		if err != nil {
+			return rec, err
+		}
+		if rec.Pos >= r.end {
+			return nil, io.EOF
+		}
+		if rec.Pos >= r.from && rec.End() > r.start {
+			return rec, nil
+		}
+	}
+}
+
+// addReads reads rdr, a countReader, to the end.
+func addReads(rdr RecordReader) error {
+	for {
+		if _, err := rdr.Read(); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
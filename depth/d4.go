@@ -0,0 +1,61 @@
+package depth
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+
+	"github.com/brentp/goleft/bigwig"
+)
+
+// d4Writer writes per-base depth to a d4 file. The runs are written to a bedGraph next to the
+// output that is converted by `d4tools create` in Close, as samtools is used for crams.
+type d4Writer struct {
+	path, bedGraph, genome string
+	fh                     *os.File
+	w                      *bufio.Writer
+}
+
+// newD4Writer starts a d4 at path for the given chromosomes. Runs must be added in their order.
+func newD4Writer(path string, chroms []bigwig.Chrom) (*d4Writer, error) {
+	d := &d4Writer{path: path, bedGraph: path + ".tmp.bedgraph", genome: path + ".tmp.genome"}
+	gfh, err := os.Create(d.genome)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range chroms {
+		fmt.Fprintf(gfh, "%s\t%d\n", c.Name, c.Len)
+	}
+	if err := gfh.Close(); err != nil {
+		return nil, err
+	}
+	if d.fh, err = os.Create(d.bedGraph); err != nil {
+		return nil, err
+	}
+	d.w = bufio.NewWriter(d.fh)
+	return d, nil
+}
+
+// Add adds a run of bases with the same depth. start is 0-based and end is exclusive.
+func (d *d4Writer) Add(chrom string, start, end int, depth int32) error {
+	_, err := fmt.Fprintf(d.w, "%s\t%d\t%d\t%d\n", chrom, start, end, depth)
+	return err
+}
+
+// Close converts the bedGraph to d4 and removes the intermediate files.
+func (d *d4Writer) Close() error {
+	if err := d.w.Flush(); err != nil {
+		return err
+	}
+	if err := d.fh.Close(); err != nil {
+		return err
+	}
+	out, err := exec.Command("d4tools", "create", "-g", d.genome, d.bedGraph, d.path).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("depth: error running d4tools create: %s %s", err, out)
+	}
+	os.Remove(d.bedGraph)
+	os.Remove(d.genome)
+	return nil
+}
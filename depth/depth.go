@@ -12,41 +12,76 @@ import (
 	"io"
 	"log"
 	"os"
+	"os/exec"
 	"regexp"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 
 	arg "github.com/alexflint/go-arg"
 	"github.com/brentp/faidx"
 	"github.com/brentp/gargs/process"
+	"github.com/brentp/goleft"
 	"github.com/brentp/xopen"
-	"github.com/fatih/color"
 )
 
 type dargs struct {
-	WindowSize   int       `arg:"-w,help:window size in which to calculate high-depth regions"`
-	MaxMeanDepth int       `arg:"-m,help:windows with depth > than this are high-depth. The default reports the depth of all regions."`
-	Ordered      bool      `arg:"-o,help:force output to be in same order as input even with -p."`
-	Q            int       `arg:"-Q,help:mapping quality cutoff"`
-	Chrom        string    `arg:"-c,help:optional chromosome to limit analysis"`
-	MinCov       int       `arg:"help:minimum depth considered callable"`
-	Stats        bool      `arg:"-s,help:report sequence stats [GC CpG masked] for each window"`
-	Reference    string    `arg:"-r,required,help:path to reference fasta"`
-	Processes    int       `arg:"-p,help:number of processors to parallelize."`
-	Bed          string    `arg:"-b,help:optional file of positions or regions to restrict depth calculations."`
-	Prefix       string    `arg:"required,help:prefix for output files depth.bed and callable.bed"`
-	Bam          string    `arg:"positional,required,help:bam for which to calculate depth"`
-	stdout       io.Writer `arg:"-"`
+	WindowSize   int            `arg:"-w,help:window size in which to calculate high-depth regions"`
+	MaxMeanDepth int            `arg:"-m,help:windows with depth > than this are high-depth. The default reports the depth of all regions."`
+	Ordered      bool           `arg:"-o,help:force output to be in same order as input even with -p."`
+	Q            int            `arg:"-Q,--min-mapq,help:mapping quality cutoff"`
+	BaseQ        int            `arg:"-q,--min-base-quality,help:base quality cutoff"`
+	Chrom        string         `arg:"-c,help:optional chromosome to limit analysis"`
+	MinCov       int            `arg:"help:minimum depth considered callable"`
+	Stats        bool           `arg:"-s,help:report sequence stats [GC CpG masked] for each window"`
+	Reference    string         `arg:"-r,required,help:path to reference fasta"`
+	Processes    int            `arg:"-p,help:number of processors to parallelize."`
+	Stat         string         `arg:"--stat,help:how the depth of the bases in each window of depth.bed is summarized: mean median min or max. the median is not skewed by a few bases of extreme depth. only used with --events."`
+	Bed          string         `arg:"-b,help:optional file of positions or regions to restrict depth calculations. a GTF or GFF3 gives the exons of each gene and implies --genes. requires --events for a GTF or GFF3."`
+	Events       bool           `arg:"-e,help:calculate depth in-process from read start and end events (like mosdepth) rather than with samtools depth. parallelized in chunks of --chunk-size bases."`
+	ChunkSize    int            `arg:"--chunk-size,help:bases of each part of a chromosome that is processed in parallel. each process holds about 4 bytes of depth per base of its part (12 with --by-strand and --max-low-mapq) so this caps the memory for deep data. regions of --bed are grouped into parts but not split."`
+	MaxLowMapQ   float64        `arg:"--max-low-mapq,help:bases where more than this fraction of reads have mapping quality below -Q are POOR_MAPPING_QUALITY in callable.bed. only used with --events."`
+	Quantize     string         `arg:"help:write $prefix.quantized.bed merging adjacent bases in the same depth bin. e.g. 0:1:4:100: only used with --events."`
+	BigWig       bool           `arg:"--bigwig,help:write per-base depth to $prefix.depth.bw. only used with --events."`
+	D4           bool           `arg:"--d4,help:write per-base depth to $prefix.depth.d4 for d4tools and mosdepth. requires d4tools on the $PATH for the conversion. only used with --events."`
+	NoOverlaps   bool           `arg:"--no-double-count-overlaps,help:count the bases where the mates of a pair overlap only once. only used with --events."`
+	IncludeFlags string         `arg:"--include-flags,help:only count reads with all of these flags as an integer or names like PAIRED|PROPER_PAIR. only used with --events."`
+	ExcludeFlags string         `arg:"--exclude-flags,help:skip reads with any of these flags. the default is UNMAP|SECONDARY|QCFAIL|DUP as for samtools depth. only used with --events."`
+	ByStrand     bool           `arg:"--by-strand,help:add the mean forward and reverse-strand depth of each window as the last 2 columns of depth.bed. only used with --events."`
+	LongReads    bool           `arg:"--long-reads,help:for ONT or PacBio reads. implies --events and writes the read N50 and alignment identity to $prefix.long-reads.txt."`
+	Thresholds   string         `arg:"-t,help:comma-delimited depths for which to report the fraction of bases at or above in each region of --bed. only used with --events."`
+	Downsample   float64        `arg:"--downsample,help:count only this fraction of read pairs chosen by read name. e.g. 0.1 to compare libraries sequenced to different depths. only used with --events."`
+	MaxDepth     int            `arg:"--max-depth,help:drop reads that start where this many reads already start or overlap to cap the depth. only used with --events."`
+	Gaps         bool           `arg:"--gaps,help:write $prefix.gaps.bed with the merged intervals with depth below --gap-depth and their length. only used with --events."`
+	GapDepth     int            `arg:"--gap-depth,help:bases with depth below this are gaps for --gaps."`
+	Counts       bool           `arg:"--counts,help:write $prefix.counts.bed with the number of A C G T and N bases and of insertions and deletions at each base of --bed. requires --bed and --events."`
+	Genes        bool           `arg:"--genes,help:write $prefix.genes.txt with the mean and min depth and the fraction of bases at or above each of --thresholds for each gene named in the 4th column of --bed. requires --events."`
+	Bgzip        bool           `arg:"--bgzip,help:write the bed outputs compressed with bgzip as $prefix.depth.bed.gz etc."`
+	Tabix        bool           `arg:"--tabix,help:also write a tabix index for each bed output in the same pass. implies --bgzip and -o."`
+	Fai          string         `arg:"--fai,help:optional .fai or genome file. only its contigs are reported."`
+	Prefix       string         `arg:"required,help:prefix for output files depth.bed and callable.bed"`
+	Bams         []string       `arg:"positional,required,help:bam(s) or cram(s) for which to calculate depth. more than 1 requires --events and gives a single matrix."`
+	Bam          string         `arg:"-"`
+	stdout       io.Writer      `arg:"-"`
+	thresholds   []int          `arg:"-"`
+	quantize     *quantize      `arg:"-"`
+	filter       filter         `arg:"-"`
+	genome       *goleft.Genome `arg:"-"`
+	stat         windowStat     `arg:"-"`
 }
 
 // we echo the region first so the callback knows the full extents even if there is NOTE
-// coverage for part of it.
-const command = "echo %s; samtools depth -Q %d -d %d -r %s %s"
+// coverage for part of it. The reference is passed so that crams can be decoded.
+const command = "echo %s; samtools depth --reference %s -Q %d -q %d -d %d -r %s %s"
 
-// this is the size in basepairs of the genomic chunks for parallelization.
+// this is the size in basepairs of the genomic chunks for parallelization. It is set by --chunk-size.
 var step = 10000000
 
+// maxPending is the number of jobs per process that are running or have results waiting to be
+// written before another is started.
+const maxPending = 2
+
 var exitCode = 0
 
 func pcheck(e error) {
@@ -55,55 +90,41 @@ func pcheck(e error) {
 	}
 }
 
-func min(a, b int) int {
-	if a < b {
-		return a
-	}
-	return b
-}
-
-func max(a, b int) int {
-	if a > b {
-		return a
-	}
-	return b
-}
-
 // match chrom:start-end and chrom\tstart\tend
 var re = regexp.MustCompile("(.+?)[:\t](\\d+)([\\-\t])(\\d+).*?")
 
-func chromStartEndFromLine(line []byte) (string, int, int) {
+func chromStartEndFromLine(line []byte) (string, int, int, error) {
 	ret := re.FindSubmatch(line)
 	if len(ret) != 5 {
-		log.Fatal("couldn't get region from line", string(line))
+		return "", 0, 0, fmt.Errorf("depth: couldn't get region from line: %q", bytes.TrimSpace(line))
 	}
 	chrom, start, isep, end := ret[1], ret[2], ret[3], ret[4]
 	// convert from bed to chrom:start-end region so add 1 to start
 	istart, err := strconv.Atoi(string(start))
 	if err != nil {
-		log.Fatal(err)
+		return "", 0, 0, err
 	}
 	if bytes.Equal(isep, []byte{'-'}) {
 		istart--
 	}
 	iend, err := strconv.Atoi(string(end))
 	if err != nil {
-		log.Fatal(err)
+		return "", 0, 0, err
 	}
-	return string(chrom), max(istart, 0), iend
+	return string(chrom), max(istart, 0), iend, nil
 }
 
-func regionFromLine(line []byte) string {
-	chrom, start, end := chromStartEndFromLine(line)
+func regionFromLine(line []byte) (chrom, region string, err error) {
+	chrom, start, end, err := chromStartEndFromLine(line)
 	// convert from bed to chrom:start-end region so add 1 to start
-	return fmt.Sprintf("%s:%d-%d", chrom, start+1, end)
+	return chrom, fmt.Sprintf("%s:%d-%d", chrom, start+1, end), err
 }
 
 // when the user specified a Bed file of regions for coverage, this is used.
 func genFromBed(ch chan string, args dargs) {
 	rdr, err := xopen.Ropen(args.Bed)
 	pcheck(err)
-	for {
+	for i := 1; ; i++ {
 		line, err := rdr.ReadBytes('\n')
 		if err == io.EOF {
 			break
@@ -112,8 +133,14 @@ func genFromBed(ch chan string, args dargs) {
 		if len(line) == 0 {
 			continue
 		}
-		region := regionFromLine(line)
-		ch <- fmt.Sprintf(command, region, args.Q, args.MaxMeanDepth+2500,
+		chrom, region, err := regionFromLine(line)
+		if err != nil {
+			pcheck(&goleft.ParseError{Path: args.Bed, Line: i, Err: err})
+		}
+		if !args.genome.Has(chrom) {
+			continue
+		}
+		ch <- fmt.Sprintf(command, region, args.Reference, args.Q, args.BaseQ, args.MaxMeanDepth+2500,
 			region, args.Bam)
 	}
 	close(ch)
@@ -142,14 +169,14 @@ func genCommands(args dargs) chan string {
 			toks := strings.Split(line, "\t")
 
 			chrom := toks[0]
-			if args.Chrom != "" && chrom != args.Chrom {
+			if (args.Chrom != "" && chrom != args.Chrom) || !args.genome.Has(chrom) {
 				continue
 			}
 			length, err := strconv.Atoi(toks[1])
 			pcheck(err)
 			for i := 0; i < length; i += step {
 				region := fmt.Sprintf("%s:%d-%d", chrom, i+1, min(i+step, length))
-				ch <- fmt.Sprintf(command, region, args.Q, args.MaxMeanDepth+2500,
+				ch <- fmt.Sprintf(command, region, args.Reference, args.Q, args.BaseQ, args.MaxMeanDepth+2500,
 					region, args.Bam)
 			}
 		}
@@ -164,16 +191,140 @@ func Main() {
 	args := dargs{WindowSize: 250,
 		MaxMeanDepth: 0,
 		MinCov:       4,
+		Thresholds:   "1,10,20",
+		GapDepth:     1,
+		Stat:         "mean",
+		ChunkSize:    step,
 		Q:            1}
 	p := arg.MustParse(&args)
 	if args.Prefix == "" {
 		p.Fail("you must specify an output prefix")
 	}
-	runtime.GOMAXPROCS(args.Processes)
-	run(args)
+	for _, t := range strings.Split(args.Thresholds, ",") {
+		v, err := strconv.Atoi(strings.TrimSpace(t))
+		if err != nil {
+			p.Fail(fmt.Sprintf("bad value in --thresholds: %s", t))
+		}
+		args.thresholds = append(args.thresholds, v)
+	}
+	sort.Ints(args.thresholds)
+	if args.LongReads {
+		// the in-process depth uses the full CIGAR so large soft-clips, deletions and supplementary
+		// alignments are handled without a pileup.
+		args.Events = true
+	}
+	if args.MaxLowMapQ > 0 && !args.Events {
+		p.Fail("--max-low-mapq requires --events")
+	}
+	if args.Quantize != "" {
+		if !args.Events {
+			p.Fail("--quantize requires --events")
+		}
+		var err error
+		if args.quantize, err = parseQuantize(args.Quantize); err != nil {
+			p.Fail(err.Error())
+		}
+	}
+	if args.NoOverlaps && !args.Events {
+		p.Fail("--no-double-count-overlaps requires --events")
+	}
+	if (args.IncludeFlags != "" || args.ExcludeFlags != "") && !args.Events {
+		p.Fail("--include-flags and --exclude-flags require --events")
+	}
+	if (args.Downsample != 0 || args.MaxDepth != 0) && !args.Events {
+		p.Fail("--downsample and --max-depth require --events")
+	}
+	if args.Downsample < 0 || args.Downsample > 1 {
+		p.Fail("--downsample must be between 0 and 1")
+	}
+	if args.MaxDepth < 0 {
+		p.Fail("--max-depth must be at least 0")
+	}
+	if args.ChunkSize < 1 {
+		p.Fail("--chunk-size must be at least 1")
+	}
+	step = args.ChunkSize
+	args.filter = filter{minMapQ: args.Q, minBaseQ: args.BaseQ, noOverlaps: args.NoOverlaps,
+		downsample: args.Downsample, maxDepth: args.MaxDepth}
+	var err error
+	if args.filter.include, err = parseFlags(args.IncludeFlags, 0); err != nil {
+		p.Fail(err.Error())
+	}
+	if args.filter.exclude, err = parseFlags(args.ExcludeFlags, skipFlags); err != nil {
+		p.Fail(err.Error())
+	}
+	var ok bool
+	if args.stat, ok = windowStats[args.Stat]; !ok {
+		p.Fail(fmt.Sprintf("--stat must be one of mean median min or max, got: %s", args.Stat))
+	}
+	if args.Stat != "mean" && !args.Events {
+		p.Fail("--stat requires --events")
+	}
+	if args.ByStrand && !args.Events {
+		p.Fail("--by-strand requires --events")
+	}
+	if args.ByStrand && len(args.Bams) > 1 {
+		p.Fail("--by-strand is not supported with more than 1 bam")
+	}
+	if isGFF(args.Bed) {
+		if !args.Events {
+			p.Fail("a GTF or GFF3 --bed requires --events")
+		}
+		args.Genes = true
+	}
+	if args.Genes && (args.Bed == "" || !args.Events) {
+		p.Fail("--genes requires --bed and --events")
+	}
+	if args.Counts && (args.Bed == "" || !args.Events) {
+		p.Fail("--counts requires --bed and --events")
+	}
+	if args.Gaps && !args.Events {
+		p.Fail("--gaps requires --events")
+	}
+	if args.BigWig && !args.Events {
+		p.Fail("--bigwig requires --events")
+	}
+	if args.D4 && !args.Events {
+		p.Fail("--d4 requires --events")
+	}
+	if args.D4 {
+		if _, err := exec.LookPath("d4tools"); err != nil {
+			p.Fail("--d4 requires d4tools on the $PATH")
+		}
+	}
+	if args.Tabix {
+		// the index needs sorted output.
+		args.Bgzip, args.Ordered = true, true
+	}
+	if len(args.Bams) > 1 && !args.Events {
+		p.Fail("more than 1 bam requires --events")
+	}
+	if args.Fai != "" {
+		if args.genome, err = goleft.ReadGenome(args.Fai); err != nil {
+			p.Fail(err.Error())
+		}
+	}
+	args.Bam = args.Bams[0]
+	setProcesses(args.Processes)
+	if len(args.Bams) > 1 {
+		runMatrix(args)
+	} else if args.Events {
+		runEvents(args)
+	} else {
+		run(args)
+	}
 	os.Exit(exitCode)
 }
 
+// setProcesses limits the goroutines to n, if it is given, and returns the limit. process.Runner starts
+// that many samtools commands at once.
+func setProcesses(n int) int {
+	if n > 0 {
+		runtime.GOMAXPROCS(n)
+	}
+	return runtime.GOMAXPROCS(0)
+}
+
 type ipos struct {
 	start int
 }
@@ -194,7 +345,7 @@ func getStats(fa *faidx.Faidx, chrom string, start, end int) string {
 	}
 	st, err := fa.Stats(chrom, start, end)
 	if err != nil {
-		log.Println(err)
+		goleft.Warnf("depth: %s", err)
 	}
 	return fmt.Sprintf("\t%.3g\t%.3g\t%.3g", st.GC, st.CpG, st.Masked)
 }
@@ -259,7 +410,10 @@ func run(args dargs) {
 			return err
 		}
 		// this is the bounds of the region echo'd before the samtools depth call.
-		chrom, regionStart, regionEnd := chromStartEndFromLine(region)
+		chrom, regionStart, regionEnd, err := chromStartEndFromLine(region)
+		if err != nil {
+			return err
+		}
 		lastWindow := max(0, regionStart/args.WindowSize)
 		var cache [2]ipos
 		cache[0].start = regionStart - 1
@@ -383,18 +537,15 @@ func run(args dargs) {
 	if args.Chrom != "" {
 		chrom = "." + args.Chrom
 	}
-	fhca, err := xopen.Wopen(fmt.Sprintf("%s%s.callable.bed", args.Prefix, chrom))
+	fhca, err := openBed(fmt.Sprintf("%s%s.callable.bed", args.Prefix, chrom), args.Bgzip, args.Tabix)
 	pcheck(err)
-	fhhd, err := xopen.Wopen(fmt.Sprintf("%s%s.depth.bed", args.Prefix, chrom))
+	fhhd, err := openBed(fmt.Sprintf("%s%s.depth.bed", args.Prefix, chrom), args.Bgzip, args.Tabix)
 	pcheck(err)
-	defer fhca.Flush()
-	defer fhhd.Flush()
 	opts := process.Options{Retries: 1, CallBack: callback, Ordered: args.Ordered}
 
 	for cmd := range process.Runner(genCommands(args), cancel, &opts) {
 		if ex := cmd.ExitCode(); ex != 0 && cmd.Err != io.EOF {
-			c := color.New(color.BgRed).Add(color.Bold)
-			fmt.Fprintf(os.Stderr, "%s\n", c.SprintFunc()(fmt.Sprintf("ERROR with command: %s", cmd)))
+			goleft.Warnf("depth: error with command: %s", cmd)
 			exitCode = max(exitCode, ex)
 		}
 		if cmd.Err == io.EOF {
@@ -402,7 +553,7 @@ func run(args dargs) {
 		}
 		caPath, err := cmd.ReadString('\n')
 		if err != nil {
-			log.Println(cmd.CmdStr, err, cmd.Err)
+			goleft.Warnf("depth: %s: %v %v", cmd.CmdStr, err, cmd.Err)
 		}
 		caSrc, err := xopen.Ropen(strings.TrimSpace(caPath))
 		pcheck(err)
@@ -411,7 +562,7 @@ func run(args dargs) {
 
 		hdPath, err := cmd.ReadString('\n')
 		if err != nil {
-			log.Println(err)
+			goleft.Warnf("depth: %s", err)
 		}
 		hdSrc, err := xopen.Ropen(strings.TrimSpace(hdPath))
 		pcheck(err)
@@ -419,8 +570,6 @@ func run(args dargs) {
 		os.Remove(strings.TrimSpace(hdPath))
 		cmd.Cleanup()
 	}
-	fhca.Flush()
-	fhca.Close()
-	fhhd.Flush()
-	fhhd.Close()
+	pcheck(fhca.Close())
+	pcheck(fhhd.Close())
 }
@@ -0,0 +1,50 @@
+package depth
+
+import (
+	"container/heap"
+	"hash/fnv"
+	"math"
+)
+
+// keepRead reports whether the read with name is in the fraction of reads kept by --downsample. It
+// depends only on the name so the mates of a pair are kept or dropped together and the same reads
+// are kept in every run and job.
+func keepRead(name string, fraction float64) bool {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return float64(h.Sum32()) < fraction*(math.MaxUint32+1)
+}
+
+// depthCap drops reads for --max-depth. Reads arrive sorted by position and a read is dropped if
+// the reads already counted that cover its start number at least max.
+type depthCap struct {
+	max int
+	// ends are the end positions of the counted reads that may still cover the next read.
+	ends intHeap
+}
+
+// add reports whether the read from start to end is counted and, if so, adds it.
+func (c *depthCap) add(start, end int) bool {
+	for len(c.ends) > 0 && c.ends[0] <= start {
+		heap.Pop(&c.ends)
+	}
+	if len(c.ends) >= c.max {
+		return false
+	}
+	heap.Push(&c.ends, end)
+	return true
+}
+
+// intHeap is a min-heap of ints for container/heap.
+type intHeap []int
+
+func (h intHeap) Len() int            { return len(h) }
+func (h intHeap) Less(i, j int) bool  { return h[i] < h[j] }
+func (h intHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *intHeap) Push(x interface{}) { *h = append(*h, x.(int)) }
+func (h *intHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
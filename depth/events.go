@@ -0,0 +1,1214 @@
+package depth
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/biogo/hts/bam"
+	"github.com/biogo/hts/sam"
+	"github.com/brentp/faidx"
+	"github.com/brentp/goleft"
+	"github.com/brentp/goleft/bamio"
+	"github.com/brentp/goleft/bigwig"
+	"github.com/brentp/xopen"
+)
+
+// skipFlags are the reads that samtools depth also ignores by default.
+const skipFlags = sam.Unmapped | sam.Secondary | sam.QCFail | sam.Duplicate
+
+// flagNames are the names used by samtools for each flag.
+var flagNames = map[string]sam.Flags{
+	"PAIRED":        sam.Paired,
+	"PROPER_PAIR":   sam.ProperPair,
+	"UNMAP":         sam.Unmapped,
+	"MUNMAP":        sam.MateUnmapped,
+	"REVERSE":       sam.Reverse,
+	"MREVERSE":      sam.MateReverse,
+	"READ1":         sam.Read1,
+	"READ2":         sam.Read2,
+	"SECONDARY":     sam.Secondary,
+	"QCFAIL":        sam.QCFail,
+	"DUP":           sam.Duplicate,
+	"SUPPLEMENTARY": sam.Supplementary,
+}
+
+// parseFlags parses flags given as an integer (e.g. 1796 or 0x704) or as names separated by '|'
+// or ',' (e.g. UNMAP|DUP). An empty string gives def.
+func parseFlags(s string, def sam.Flags) (sam.Flags, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return def, nil
+	}
+	if v, err := strconv.ParseUint(s, 0, 16); err == nil {
+		return sam.Flags(v), nil
+	}
+	var f sam.Flags
+	for _, name := range strings.FieldsFunc(s, func(r rune) bool { return r == '|' || r == ',' }) {
+		v, ok := flagNames[strings.ToUpper(strings.TrimSpace(name))]
+		if !ok {
+			return 0, fmt.Errorf("depth: unknown flag: %s", name)
+		}
+		f |= v
+	}
+	return f, nil
+}
+
+// RecordReader is satisfied by a *bam.Reader, a *bamio.Reader and by iterReader.
+type RecordReader interface {
+	Read() (*sam.Record, error)
+}
+
+// emptyReader is used for chromosomes without any reads.
+type emptyReader struct{}
+
+func (emptyReader) Read() (*sam.Record, error) { return nil, io.EOF }
+
+// iterReader adapts a bam.Iterator to a RecordReader.
+type iterReader struct {
+	*bam.Iterator
+}
+
+func (it iterReader) Read() (*sam.Record, error) {
+	if !it.Next() {
+		if err := it.Error(); err != nil {
+			return nil, err
+		}
+		return nil, io.EOF
+	}
+	return it.Record(), nil
+}
+
+// filter is the reads and bases that are counted by chromDepth.
+type filter struct {
+	minMapQ int
+	// minBaseQ is the base quality below which a base is not counted. 0 counts every base.
+	minBaseQ int
+	// reads must have all of the include flags and none of the exclude flags.
+	include, exclude sam.Flags
+	// noOverlaps counts the bases where the mates of a pair overlap only once.
+	noOverlaps bool
+	// downsample is the fraction of read pairs that are kept. 0 keeps every read.
+	downsample float64
+	// maxDepth is the number of reads that can cover the start of another before it is dropped. 0
+	// keeps every read.
+	maxDepth int
+}
+
+// chromDepth returns the depth at every base of ref from reads that pass f. Rather than a pileup,
+// each aligned block of a read adds 1 at its start and subtracts 1 at its end so the depth is the
+// cumulative sum of these events. This is the algorithm used by mosdepth. If withRaw is true, it
+// also returns the depth from reads of any mapping quality.
+func chromDepth(rdr RecordReader, ref *sam.Reference, f filter, withRaw bool) (depth, raw []int32, err error) {
+	depth, raw, _, err = strandDepth(rdr, ref, f, withRaw, false)
+	return depth, raw, err
+}
+
+// strandDepth is chromDepth that, if byStrand is true, also returns the depth from reverse-strand
+// reads. The forward-strand depth is depth - rev. Where the mates of a pair overlap and f.noOverlaps
+// is set, the overlap is counted for the strand of the first mate.
+func strandDepth(rdr RecordReader, ref *sam.Reference, f filter, withRaw, byStrand bool) (depth, raw, rev []int32, err error) {
+	return spanDepth(rdr, ref, f, 0, ref.Len(), withRaw, byStrand, &depthBuf{})
+}
+
+// depthBuf holds the arrays for the depth of a job so they can be reused by a worker for each of
+// its jobs rather than allocated for each. They grow to the span of the largest job so, as jobs
+// span at most --chunk-size bases, the memory of a worker does not depend on the length of the
+// chromosome or on the depth.
+type depthBuf struct {
+	depth, raw, rev []int32
+}
+
+// get returns a buffer of n values that are 0.
+func (b *depthBuf) get(a *[]int32, n int) []int32 {
+	if cap(*a) < n {
+		*a = make([]int32, n)
+	}
+	*a = (*a)[:n]
+	for i := range *a {
+		(*a)[i] = 0
+	}
+	return *a
+}
+
+// minMates is the number of first mates held for --no-double-count-overlaps before those whose
+// mate was not seen are dropped.
+const minMates = 1024
+
+// spanDepth is strandDepth for only the bases from start to end using the arrays in buf. The
+// returned slices have end - start values with depth[i] the depth at start + i. They are only
+// valid until buf is used again.
+func spanDepth(rdr RecordReader, ref *sam.Reference, f filter, start, end int, withRaw, byStrand bool, buf *depthBuf) (depth, raw, rev []int32, err error) {
+	n := end - start + 1
+	depth = buf.get(&buf.depth, n)
+	if withRaw {
+		raw = buf.get(&buf.raw, n)
+	}
+	if byStrand {
+		rev = buf.get(&buf.rev, n)
+	}
+	// the first mate of each pair that overlaps its mate, by read name.
+	var mates map[string]mate
+	if f.noOverlaps {
+		mates = make(map[string]mate)
+	}
+	maxMates := minMates
+	var dcap *depthCap
+	if f.maxDepth > 0 {
+		dcap = &depthCap{max: f.maxDepth}
+	}
+	for {
+		rec, err := rdr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if rec.Ref == nil || rec.Ref.ID() != ref.ID() || rec.Flags&f.exclude != 0 || rec.Flags&f.include != f.include {
+			continue
+		}
+		pass := int(rec.MapQ) >= f.minMapQ
+		if !pass && !withRaw {
+			continue
+		}
+		if f.downsample > 0 && !keepRead(rec.Name, f.downsample) {
+			continue
+		}
+		if dcap != nil && !dcap.add(rec.Pos, rec.End()) {
+			continue
+		}
+		blocks := clipBlocks(alignedBlocks(rec, ref.Len(), f.minBaseQ), start, end)
+		reverse := rev != nil && rec.Flags&sam.Reverse != 0
+		for _, b := range blocks {
+			bs, be := b.start-start, b.end-start
+			if pass {
+				depth[bs]++
+				depth[be]--
+				if reverse {
+					rev[bs]++
+					rev[be]--
+				}
+			}
+			if withRaw {
+				raw[bs]++
+				raw[be]--
+			}
+		}
+		if mates == nil {
+			continue
+		}
+		if len(mates) > maxMates {
+			// in deep data, the first mates whose mate was skipped, e.g. as a duplicate, would
+			// otherwise be held to the end of the job.
+			dropMates(mates, rec.Pos)
+			maxMates = max(minMates, 2*len(mates))
+		}
+		if m, ok := mates[rec.Name]; ok {
+			delete(mates, rec.Name)
+			// remove the bases that were already counted for the first mate.
+			for _, o := range overlaps(m.blocks, blocks) {
+				ostart, oend := o.start-start, o.end-start
+				if pass && m.pass {
+					depth[ostart]--
+					depth[oend]++
+					if reverse {
+						rev[ostart]--
+						rev[oend]++
+					}
+				}
+				if withRaw {
+					raw[ostart]--
+					raw[oend]++
+				}
+			}
+		} else if overlapsMate(rec) {
+			mates[rec.Name] = mate{blocks: blocks, pass: pass, matePos: rec.MatePos}
+		}
+	}
+	cumsum(depth[:n-1])
+	if withRaw {
+		cumsum(raw[:n-1])
+		raw = raw[:n-1]
+	}
+	if byStrand {
+		cumsum(rev[:n-1])
+		rev = rev[:n-1]
+	}
+	return depth[:n-1], raw, rev, nil
+}
+
+// dropMates removes the first mates whose mate starts before pos. As reads are sorted, the mate was
+// not counted and will not be seen.
+func dropMates(mates map[string]mate, pos int) {
+	for name, m := range mates {
+		if m.matePos < pos {
+			delete(mates, name)
+		}
+	}
+}
+
+// clipBlocks limits the blocks to the bases from start to end and removes those outside.
+func clipBlocks(blocks []region, start, end int) []region {
+	clipped := blocks[:0]
+	for _, b := range blocks {
+		if b.start, b.end = max(b.start, start), min(b.end, end); b.start < b.end {
+			clipped = append(clipped, b)
+		}
+	}
+	return clipped
+}
+
+// mate holds the aligned blocks of the first read of a pair until its overlapping mate is seen.
+type mate struct {
+	blocks []region
+	// pass is true if the read met the mapping quality cutoff.
+	pass bool
+	// matePos is the start of the mate.
+	matePos int
+}
+
+// alignedBlocks returns the intervals of ref covered by the match operations of rec. If minBaseQ is
+// above 0, the blocks are split to leave out bases with a lower base quality.
+func alignedBlocks(rec *sam.Record, refLen int, minBaseQ int) []region {
+	var blocks []region
+	// qualities of 0xff mean that they are missing so every base is kept.
+	useQual := minBaseQ > 0 && len(rec.Qual) > 0 && rec.Qual[0] != 0xff
+	pos, qpos := rec.Pos, 0
+	for _, co := range rec.Cigar {
+		t := co.Type()
+		if t == sam.CigarMatch || t == sam.CigarEqual || t == sam.CigarMismatch {
+			if !useQual {
+				blocks = append(blocks, region{pos, min(pos+co.Len(), refLen)})
+			} else {
+				start := -1
+				for i := 0; i < co.Len(); i++ {
+					ok := int(rec.Qual[qpos+i]) >= minBaseQ
+					if ok && start == -1 {
+						start = pos + i
+					} else if !ok && start != -1 {
+						blocks = append(blocks, region{start, min(pos+i, refLen)})
+						start = -1
+					}
+				}
+				if start != -1 {
+					blocks = append(blocks, region{start, min(pos+co.Len(), refLen)})
+				}
+			}
+		}
+		c := t.Consumes()
+		if c.Reference == 1 {
+			pos += co.Len()
+		}
+		if c.Query == 1 {
+			qpos += co.Len()
+		}
+	}
+	return blocks
+}
+
+// overlapsMate reports whether rec is the first read of a pair and its mate starts within rec.
+func overlapsMate(rec *sam.Record) bool {
+	if rec.Flags&sam.Paired == 0 || rec.Flags&sam.MateUnmapped != 0 || rec.MateRef == nil || rec.MateRef.ID() != rec.Ref.ID() {
+		return false
+	}
+	return rec.MatePos >= rec.Pos && rec.MatePos < rec.End()
+}
+
+// overlaps returns the intervals covered by both a and b.
+func overlaps(a, b []region) []region {
+	var out []region
+	for _, x := range a {
+		for _, y := range b {
+			if s, e := max(x.start, y.start), min(x.end, y.end); s < e {
+				out = append(out, region{s, e})
+			}
+		}
+	}
+	return out
+}
+
+// ChromDepth returns the depth at every base of ref from the reads in rdr with mapping quality of
+// at least minMapQ. Unmapped, secondary, QC-fail and duplicate reads are skipped as in samtools depth.
+func ChromDepth(rdr RecordReader, ref *sam.Reference, minMapQ int) ([]int32, error) {
+	depth, _, err := chromDepth(rdr, ref, filter{minMapQ: minMapQ, exclude: skipFlags}, false)
+	return depth, err
+}
+
+// Depth returns the depth at every base of chrom in the bam or cram at path. reference is only
+// needed for a cram.
+func Depth(path, reference, chrom string, minMapQ int) ([]int32, error) {
+	idx, err := readIndex(path)
+	if err != nil {
+		return nil, err
+	}
+	h, err := bamio.Header(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, ref := range h.Refs() {
+		if ref.Name() != chrom {
+			continue
+		}
+		rdr, ref, done, err := openChrom(path, reference, idx, chrom, 0, ref.Len(), goleft.BgzfWorkers(1))
+		if err != nil {
+			return nil, err
+		}
+		defer done()
+		return ChromDepth(rdr, ref, minMapQ)
+	}
+	return nil, fmt.Errorf("depth: chromosome %s not found in %s", chrom, path)
+}
+
+func cumsum(a []int32) {
+	var d int32
+	for i, v := range a {
+		d += v
+		a[i] = d
+	}
+}
+
+// region is a 0-based, half-open interval on a chromosome.
+type region struct {
+	start, end int
+}
+
+// chromJob is the work for a single chromosome. Without a bed file, regions covers the whole chromosome
+// or, after splitJobs, a part of it.
+// names are from the 4th column of the bed file for each region.
+type chromJob struct {
+	ref     *sam.Reference
+	regions []region
+	names   []string
+	// labels are the gene and exon number of each region from a GTF or GFF3.
+	labels []string
+	// from is the end of the previous job on the same chromosome after splitJobs. Reads that start
+	// before it were also read for that job.
+	from int
+}
+
+// readBedJobs groups the regions in the bed file by chromosome in the order they are first seen.
+// A GTF or GFF3 gives the exons of each gene as in readGFFJobs.
+func readBedJobs(path string, h *sam.Header) ([]chromJob, error) {
+	if isGFF(path) {
+		return readGFFJobs(path, h)
+	}
+	refs := make(map[string]*sam.Reference, len(h.Refs()))
+	for _, ref := range h.Refs() {
+		refs[ref.Name()] = ref
+	}
+	rdr, err := xopen.Ropen(path)
+	if err != nil {
+		return nil, err
+	}
+	defer rdr.Close()
+	var jobs []chromJob
+	seen := make(map[string]int)
+	for l := 1; ; l++ {
+		line, err := rdr.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 && line[0] != '#' && !bytes.HasPrefix(line, []byte("track")) {
+			chrom, start, end, perr := chromStartEndFromLine(line)
+			if perr != nil {
+				return nil, &goleft.ParseError{Path: path, Line: l, Err: perr}
+			}
+			ref, ok := refs[chrom]
+			if !ok {
+				goleft.Warnf("depth: chromosome %s from %s not found in bam header", chrom, path)
+			} else {
+				i, ok := seen[chrom]
+				if !ok {
+					i = len(jobs)
+					seen[chrom] = i
+					jobs = append(jobs, chromJob{ref: ref})
+				}
+				jobs[i].regions = append(jobs[i].regions, region{max(start, 0), min(end, ref.Len())})
+				jobs[i].names = append(jobs[i].names, bedName(line))
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return jobs, nil
+}
+
+// bedName returns the 4th column of a bed line or "" if there are fewer columns.
+func bedName(line []byte) string {
+	toks := bytes.SplitN(bytes.TrimRight(line, "\r\n"), []byte{'\t'}, 5)
+	if len(toks) < 4 {
+		return ""
+	}
+	return string(bytes.TrimSpace(toks[3]))
+}
+
+// openChrom returns a reader over the reads from start to end of chrom in the bam or cram at path,
+// the reference for chrom from that file's header and a function to close the reader. rd is the
+// number of goroutines to decompress the reads.
+func openChrom(path, fasta string, idx *bamio.Index, chrom string, start, end, rd int) (RecordReader, *sam.Reference, func(), error) {
+	var br *bamio.Reader
+	var err error
+	if bamio.IsCRAM(path) || bamio.IsHtsget(path) {
+		br, err = bamio.OpenRegion(path, fasta, fmt.Sprintf("%s:%d-%d", chrom, start+1, end), rd)
+	} else {
+		br, err = bamio.Open(path, fasta, rd)
+	}
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	// use the reference from this reader's header so the IDs match the records.
+	var ref *sam.Reference
+	for _, r := range br.Header().Refs() {
+		if r.Name() == chrom {
+			ref = r
+			break
+		}
+	}
+	if ref == nil {
+		br.Close()
+		return nil, nil, nil, fmt.Errorf("depth: chromosome %s not found in %s", chrom, path)
+	}
+	if idx == nil {
+		return br, ref, func() { br.Close() }, nil
+	}
+	chunks, err := idx.Chunks(ref, start, end)
+	if err != nil {
+		// no reads for this chromosome.
+		br.Close()
+		return emptyReader{}, ref, func() {}, nil
+	}
+	it, err := bam.NewIterator(br.Reader, chunks)
+	if err != nil {
+		br.Close()
+		return nil, nil, nil, err
+	}
+	return iterReader{it}, ref, func() { it.Close(); br.Close() }, nil
+}
+
+// span returns the smallest interval containing all of the regions.
+func (j chromJob) span() (start, end int) {
+	start, end = j.ref.Len(), 0
+	for _, reg := range j.regions {
+		start, end = min(start, reg.start), max(end, reg.end)
+	}
+	return start, end
+}
+
+// chromJobs returns the chromosomes and regions to process either from the bed file or from the header.
+// Only --chrom or the contigs in --fai are kept if they are given.
+func chromJobs(args dargs, h *sam.Header) ([]chromJob, error) {
+	var jobs []chromJob
+	if args.Bed != "" {
+		var err error
+		if jobs, err = readBedJobs(args.Bed, h); err != nil {
+			return nil, err
+		}
+	} else {
+		for _, ref := range h.Refs() {
+			jobs = append(jobs, chromJob{ref: ref, regions: []region{{0, ref.Len()}}})
+		}
+	}
+	if args.Chrom == "" && args.genome == nil {
+		return jobs, nil
+	}
+	var keep []chromJob
+	for _, j := range jobs {
+		if (args.Chrom == "" || j.ref.Name() == args.Chrom) && args.genome.Has(j.ref.Name()) {
+			keep = append(keep, j)
+		}
+	}
+	return keep, nil
+}
+
+// splitJobs splits each job into consecutive jobs that span at most size bases so that a large
+// chromosome is processed in parallel. size is rounded down to a multiple of windowSize and a
+// whole chromosome is split at multiples of size so that the windows are the same as without
+// splitting. Regions from a bed file, which have names, are not split but are grouped into jobs.
+func splitJobs(jobs []chromJob, size, windowSize int) []chromJob {
+	size = max(1, size/windowSize) * windowSize
+	var split []chromJob
+	for _, j := range jobs {
+		if j.names == nil {
+			for _, reg := range j.regions {
+				for s := reg.start; s < reg.end; {
+					e := min(reg.end, (s/size+1)*size)
+					split = append(split, chromJob{ref: j.ref, regions: []region{{s, e}}, from: s})
+					s = e
+				}
+			}
+			continue
+		}
+		cur := chromJob{ref: j.ref}
+		var start, end int
+		for i, reg := range j.regions {
+			if len(cur.regions) == 0 {
+				start, end = reg.start, reg.end
+			} else if max(end, reg.end)-min(start, reg.start) > size {
+				split = append(split, cur)
+				cur = chromJob{ref: j.ref, from: end}
+				start, end = reg.start, reg.end
+			}
+			start, end = min(start, reg.start), max(end, reg.end)
+			cur.regions = append(cur.regions, reg)
+			cur.names = append(cur.names, j.names[i])
+			if j.labels != nil {
+				cur.labels = append(cur.labels, j.labels[i])
+			}
+		}
+		if len(cur.regions) > 0 {
+			split = append(split, cur)
+		}
+	}
+	return split
+}
+
+// readIndex returns the index for a bam or nil for a cram or htsget URL for which samtools or the
+// server finds the reads of a region.
+func readIndex(path string) (*bamio.Index, error) {
+	if bamio.IsCRAM(path) || bamio.IsHtsget(path) {
+		return nil, nil
+	}
+	return bamio.ReadIndex(path)
+}
+
+// writeWindows writes the depth in each window from start to end summarized by stat, e.g.
+// meanDepth. depth[i] is the depth at start + i. Windows are aligned to multiples of windowSize so
+// only the first and last may be smaller. If rev is not nil, the forward and reverse-strand depths
+// summarized by stat are added as the last 2 columns.
+func writeWindows(w io.Writer, fa *faidx.Faidx, chrom string, depth, rev []int32, start, end, windowSize int, stat windowStat) {
+	var fwd []int32
+	for ws := start / windowSize * windowSize; ws < end; ws += windowSize {
+		s, e := max(ws, start), min(ws+windowSize, end)
+		fmt.Fprintf(w, "%s\t%d\t%d\t%.4g%s", chrom, s, e, stat(depth[s-start:e-start]), getStats(fa, chrom, s, e))
+		if rev != nil {
+			fwd = fwd[:0]
+			for i := s - start; i < e-start; i++ {
+				fwd = append(fwd, depth[i]-rev[i])
+			}
+			fmt.Fprintf(w, "\t%.4g\t%.4g", stat(fwd), stat(rev[s-start:e-start]))
+		}
+		fmt.Fprintln(w)
+	}
+}
+
+// windowStat summarizes the depth of the bases of a window.
+type windowStat func([]int32) float64
+
+// windowStats are the values of --stat.
+var windowStats = map[string]windowStat{
+	"mean":   meanDepth,
+	"median": medianDepth,
+	"min":    minDepth,
+	"max":    maxDepth,
+}
+
+func meanDepth(depth []int32) float64 {
+	if len(depth) == 0 {
+		return 0
+	}
+	sum := 0
+	for _, d := range depth {
+		sum += int(d)
+	}
+	return float64(sum) / float64(len(depth))
+}
+
+// medianDepth is the median of depth. With an even number of bases, it is the mean of the middle 2.
+func medianDepth(depth []int32) float64 {
+	n := len(depth)
+	if n == 0 {
+		return 0
+	}
+	vals := append([]int32{}, depth...)
+	sort.Slice(vals, func(i, j int) bool { return vals[i] < vals[j] })
+	return float64(vals[(n-1)/2]+vals[n/2]) / 2
+}
+
+func minDepth(depth []int32) float64 {
+	if len(depth) == 0 {
+		return 0
+	}
+	m := depth[0]
+	for _, d := range depth[1:] {
+		if d < m {
+			m = d
+		}
+	}
+	return float64(m)
+}
+
+func maxDepth(depth []int32) float64 {
+	m := int32(0)
+	for _, d := range depth {
+		if d > m {
+			m = d
+		}
+	}
+	return float64(m)
+}
+
+// classify returns the coverage class of a base. raw is the depth including reads below the
+// mapping quality cutoff and is only used when maxLowMapQ > 0. Then, bases where more than that
+// fraction of reads have low mapping quality are POOR_MAPPING_QUALITY as in GATK's CallableLoci.
+func classify(depth, raw int32, args dargs) string {
+	if args.MaxLowMapQ > 0 && raw > 0 {
+		if float64(raw-depth)/float64(raw) > args.MaxLowMapQ {
+			return "POOR_MAPPING_QUALITY"
+		}
+		if depth == 0 {
+			return "LOW_COVERAGE"
+		}
+	}
+	return getCovClass(int(depth), args.MinCov, args.MaxMeanDepth)
+}
+
+// writeCallable writes the runs of bases from start to end with the same coverage class and adds
+// the number of bases in each class to counts. depth[i] and raw[i] are at start + i.
+func writeCallable(w io.Writer, chrom string, depth, raw []int32, start, end int, args dargs, counts map[string]int) {
+	last := ""
+	runStart := start
+	var r int32
+	for i := start; i < end; i++ {
+		if raw != nil {
+			r = raw[i-start]
+		}
+		c := classify(depth[i-start], r, args)
+		if c != last {
+			if last != "" {
+				fmt.Fprintf(w, "%s\t%d\t%d\t%s\n", chrom, runStart, i, last)
+				counts[last] += i - runStart
+			}
+			runStart, last = i, c
+		}
+	}
+	if last != "" {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\n", chrom, runStart, end, last)
+		counts[last] += end - runStart
+	}
+}
+
+// runWriter writes the runs of bases with a label in the 4th column from consecutive jobs. The
+// last run of each job is held so that it can be joined to the first run of the next if they meet
+// with the same label, as happens where splitJobs split a chromosome.
+type runWriter struct {
+	w    io.Writer
+	last []byte
+}
+
+// add writes the lines in b, which must end with a newline.
+func (rw *runWriter) add(b []byte) error {
+	if len(b) == 0 {
+		return nil
+	}
+	if rw.last != nil {
+		first := b[:bytes.IndexByte(b, '\n')+1]
+		if j := joinRuns(rw.last, first); j != nil {
+			rw.last, b = j, b[len(first):]
+			if len(b) == 0 {
+				return nil
+			}
+		}
+		if err := rw.flush(); err != nil {
+			return err
+		}
+	}
+	i := bytes.LastIndexByte(b[:len(b)-1], '\n') + 1
+	if _, err := rw.w.Write(b[:i]); err != nil {
+		return err
+	}
+	rw.last = append([]byte{}, b[i:]...)
+	return nil
+}
+
+// flush writes the held run.
+func (rw *runWriter) flush() error {
+	_, err := rw.w.Write(rw.last)
+	rw.last = nil
+	return err
+}
+
+// joinRuns returns a single line for the runs a and b if b starts where a ends with the same
+// chromosome and label. Otherwise, it returns nil.
+func joinRuns(a, b []byte) []byte {
+	ta := bytes.SplitN(bytes.TrimRight(a, "\n"), []byte{'\t'}, 4)
+	tb := bytes.SplitN(bytes.TrimRight(b, "\n"), []byte{'\t'}, 4)
+	if len(ta) < 4 || len(tb) < 4 || !bytes.Equal(ta[0], tb[0]) || !bytes.Equal(ta[2], tb[1]) || !bytes.Equal(ta[3], tb[3]) {
+		return nil
+	}
+	return []byte(fmt.Sprintf("%s\t%s\t%s\t%s\n", ta[0], ta[1], tb[2], ta[3]))
+}
+
+// quantize holds the bounds of the bins for quantized output and a label for each bin.
+type quantize struct {
+	bounds []int
+	labels []string
+}
+
+// parseQuantize parses bins like 0:1:4:100: where each pair of adjacent values gives a half-open
+// depth interval. An empty first value is 0 and an empty last value is unbounded. If the first
+// value is above 0, lower depths are put in an extra first bin.
+func parseQuantize(s string) (*quantize, error) {
+	toks := strings.Split(s, ":")
+	if len(toks) < 2 {
+		return nil, fmt.Errorf("depth: expected at least 2 values separated by ':' in quantize: %s", s)
+	}
+	q := &quantize{}
+	for i, t := range toks {
+		if t == "" && (i == 0 || i == len(toks)-1) {
+			if i == 0 {
+				q.bounds = append(q.bounds, 0)
+			} else {
+				q.bounds = append(q.bounds, math.MaxInt32)
+			}
+			continue
+		}
+		v, err := strconv.Atoi(t)
+		if err != nil {
+			return nil, fmt.Errorf("depth: bad value in quantize: %s", s)
+		}
+		if len(q.bounds) > 0 && v <= q.bounds[len(q.bounds)-1] {
+			return nil, fmt.Errorf("depth: values in quantize must be increasing: %s", s)
+		}
+		q.bounds = append(q.bounds, v)
+	}
+	if q.bounds[0] > 0 {
+		q.bounds = append([]int{0}, q.bounds...)
+	}
+	for i := 0; i < len(q.bounds)-1; i++ {
+		hi := strconv.Itoa(q.bounds[i+1])
+		if q.bounds[i+1] == math.MaxInt32 {
+			hi = "inf"
+		}
+		q.labels = append(q.labels, fmt.Sprintf("%d:%s", q.bounds[i], hi))
+	}
+	return q, nil
+}
+
+// bin returns the index of the bin containing d or -1 if it is beyond the last bin.
+func (q *quantize) bin(d int32) int {
+	// the first bin with an upper bound above d.
+	i := sort.SearchInts(q.bounds[1:], int(d)+1)
+	if i == len(q.labels) {
+		return -1
+	}
+	return i
+}
+
+// writeQuantized writes the runs of bases from start to end with depth in the same bin.
+// depth[i] is the depth at start + i. Bases with depth beyond the last bin are not reported.
+func writeQuantized(w io.Writer, chrom string, depth []int32, start, end int, q *quantize) {
+	last := -1
+	runStart := start
+	for i := start; i < end; i++ {
+		b := q.bin(depth[i-start])
+		if b != last {
+			if last != -1 {
+				fmt.Fprintf(w, "%s\t%d\t%d\t%s\n", chrom, runStart, i, q.labels[last])
+			}
+			runStart, last = i, b
+		}
+	}
+	if last != -1 {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\n", chrom, runStart, end, q.labels[last])
+	}
+}
+
+// depthRun is an interval of bases with the same depth.
+type depthRun struct {
+	start, end, depth int32
+}
+
+// depthRuns returns the runs of bases from start to end with the same, non-zero depth. depth[i] is
+// the depth at start + i.
+func depthRuns(depth []int32, start, end int) []depthRun {
+	var runs []depthRun
+	for i := start; i < end; {
+		d := depth[i-start]
+		j := i + 1
+		for j < end && depth[j-start] == d {
+			j++
+		}
+		if d != 0 {
+			runs = append(runs, depthRun{int32(i), int32(j), d})
+		}
+		i = j
+	}
+	return runs
+}
+
+// gapRuns returns the runs of bases from start to end with depth below minDepth. depth[i] is the
+// depth at start + i.
+func gapRuns(depth []int32, start, end int, minDepth int32) []region {
+	var gaps []region
+	for i := start; i < end; i++ {
+		if depth[i-start] >= minDepth {
+			continue
+		}
+		j := i + 1
+		for j < end && depth[j-start] < minDepth {
+			j++
+		}
+		gaps = append(gaps, region{i, j})
+		i = j
+	}
+	return gaps
+}
+
+// callableClasses are the coverage classes in the order they are reported in the summary.
+var callableClasses = []string{"CALLABLE", "NO_COVERAGE", "LOW_COVERAGE", "EXCESSIVE_COVERAGE", "POOR_MAPPING_QUALITY"}
+
+// writeCallableSummary writes the number of bases in each coverage class.
+func writeCallableSummary(path string, counts map[string]int) error {
+	fh, err := xopen.Wopen(path)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(fh, "state\tnBases")
+	for _, c := range callableClasses {
+		fmt.Fprintf(fh, "%s\t%d\n", c, counts[c])
+	}
+	return fh.Close()
+}
+
+// regionHeader returns the header for the per-region summary with a column for each threshold.
+// With exons from a GTF or GFF3, it has the gene and exon number after the end.
+func regionHeader(thresholds []int, exons bool) string {
+	h := "#chrom\tstart\tend"
+	if exons {
+		h += "\tgene\texon"
+	}
+	h += "\tmean\tmedian\tmin\tmax"
+	for _, t := range thresholds {
+		h += fmt.Sprintf("\t%dx", t)
+	}
+	return h + "\n"
+}
+
+// writeRegion writes the mean, median, min and max depth of the region and the fraction of
+// bases with depth at or above each threshold. depth[i] is the depth at start + i. A label is
+// written after the end.
+func writeRegion(w io.Writer, chrom, label string, depth []int32, start, end int, thresholds []int) {
+	if end <= start {
+		return
+	}
+	vals := make([]int, end-start)
+	sum := 0
+	for i, d := range depth[:end-start] {
+		vals[i] = int(d)
+		sum += int(d)
+	}
+	sort.Ints(vals)
+	n := len(vals)
+	fmt.Fprintf(w, "%s\t%d\t%d", chrom, start, end)
+	if label != "" {
+		fmt.Fprintf(w, "\t%s", label)
+	}
+	fmt.Fprintf(w, "\t%.4g\t%.4g\t%d\t%d", float64(sum)/float64(n),
+		float64(vals[(n-1)/2]+vals[n/2])/2, vals[0], vals[n-1])
+	for _, t := range thresholds {
+		// vals is sorted so this is the index of the first base with depth >= t.
+		k := sort.SearchInts(vals, t)
+		fmt.Fprintf(w, "\t%.4g", float64(n-k)/float64(n))
+	}
+	fmt.Fprintln(w)
+}
+
+// runEvents calculates depth in-process for each chromosome, split into parts of at most
+// --chunk-size bases, in parallel and writes the same
+// $prefix.depth.bed and $prefix.callable.bed as run along with the bases in each coverage class to
+// $prefix.callable.summary.txt. If a bed file is given, only those regions are reported and
+// $prefix.regions.bed has summary stats for each region. With --counts, $prefix.counts.bed has the
+// bases and indels at each base of the bed. With --genes, $prefix.genes.txt has the
+// coverage of the regions of each gene named in the bed.
+func runEvents(args dargs) {
+	h, err := bamio.Header(args.Bam)
+	pcheck(err)
+	idx, err := readIndex(args.Bam)
+	pcheck(err)
+	if args.Processes < 1 {
+		args.Processes = 1
+	}
+	jobs, err := chromJobs(args, h)
+	pcheck(err)
+
+	chrom := ""
+	if args.Chrom != "" {
+		chrom = "." + args.Chrom
+	}
+	fhca, err := openBed(fmt.Sprintf("%s%s.callable.bed", args.Prefix, chrom), args.Bgzip, args.Tabix)
+	pcheck(err)
+	fhhd, err := openBed(fmt.Sprintf("%s%s.depth.bed", args.Prefix, chrom), args.Bgzip, args.Tabix)
+	pcheck(err)
+	var fhrg *bedWriter
+	if args.Bed != "" {
+		fhrg, err = openBed(fmt.Sprintf("%s%s.regions.bed", args.Prefix, chrom), args.Bgzip, args.Tabix)
+		pcheck(err)
+		_, err = fhrg.WriteString(regionHeader(args.thresholds, isGFF(args.Bed)))
+		pcheck(err)
+	}
+
+	var fhg *bedWriter
+	if args.Gaps {
+		fhg, err = openBed(fmt.Sprintf("%s%s.gaps.bed", args.Prefix, chrom), args.Bgzip, args.Tabix)
+		pcheck(err)
+		_, err = fhg.WriteString("#chrom\tstart\tend\tlength\n")
+		pcheck(err)
+	}
+
+	var fhc *bedWriter
+	if args.Counts {
+		fhc, err = openBed(fmt.Sprintf("%s%s.counts.bed", args.Prefix, chrom), args.Bgzip, args.Tabix)
+		pcheck(err)
+		_, err = fhc.WriteString(countsHeader)
+		pcheck(err)
+	}
+
+	var fhq *bedWriter
+	if args.quantize != nil {
+		fhq, err = openBed(fmt.Sprintf("%s%s.quantized.bed", args.Prefix, chrom), args.Bgzip, args.Tabix)
+		pcheck(err)
+	}
+
+	chroms := make([]bigwig.Chrom, len(jobs))
+	for i, j := range jobs {
+		chroms[i] = bigwig.Chrom{Name: j.ref.Name(), Len: j.ref.Len()}
+	}
+	var bw *bigwig.Writer
+	var fhbw *os.File
+	if args.BigWig {
+		fhbw, err = os.Create(fmt.Sprintf("%s%s.depth.bw", args.Prefix, chrom))
+		pcheck(err)
+		bw, err = bigwig.NewWriter(fhbw, chroms)
+		pcheck(err)
+	}
+	var d4 *d4Writer
+	if args.D4 {
+		d4, err = newD4Writer(fmt.Sprintf("%s%s.depth.d4", args.Prefix, chrom), chroms)
+		pcheck(err)
+	}
+	// split large chromosomes so that they are processed in parallel.
+	jobs = splitJobs(jobs, step, args.WindowSize)
+
+	type result struct {
+		i                                int
+		hd, callable, regions, quantized bytes.Buffer
+		pileup                           bytes.Buffer
+		counts                           map[string]int
+		runs                             []depthRun
+		gaps                             []region
+		longReads                        *longReadStats
+		genes                            map[string]*geneCounts
+	}
+	jobc := make(chan int)
+	results := make(chan *result, args.Processes)
+	var wg sync.WaitGroup
+	wg.Add(args.Processes)
+	for k := 0; k < args.Processes; k++ {
+		go func() {
+			defer wg.Done()
+			var fa *faidx.Faidx
+			if args.Stats {
+				var err error
+				fa, err = faidx.New(args.Reference)
+				pcheck(err)
+				defer fa.Close()
+			}
+			// the reference bases of --counts.
+			var cfa *faidx.Faidx
+			if fhc != nil {
+				var err error
+				cfa, err = faidx.New(args.Reference)
+				pcheck(err)
+				defer cfa.Close()
+			}
+			var buf depthBuf
+			for i := range jobc {
+				job := jobs[i]
+				start, end := job.span()
+				rdr, ref, done, err := openChrom(args.Bam, args.Reference, idx, job.ref.Name(), start, end, goleft.BgzfWorkers(args.Processes))
+				pcheck(err)
+				var lr *longReadReader
+				if args.LongReads {
+					lr = &longReadReader{RecordReader: rdr, from: job.from, to: end}
+					rdr = lr
+				}
+				var cr *countReader
+				if fhc != nil {
+					cr = &countReader{RecordReader: rdr, ref: ref, f: args.filter, p: newPileup(job.regions)}
+					rdr = cr
+				}
+				depth, raw, rev, err := spanDepth(rdr, ref, args.filter, start, end, args.MaxLowMapQ > 0, args.ByStrand, &buf)
+				done()
+				pcheck(err)
+				r := &result{i: i, counts: make(map[string]int)}
+				if lr != nil {
+					r.longReads = &lr.stats
+				}
+				name := job.ref.Name()
+				for k, reg := range job.regions {
+					// the depth of the bases of the region.
+					sub := func(a []int32) []int32 {
+						if a == nil {
+							return nil
+						}
+						return a[reg.start-start : reg.end-start]
+					}
+					d := sub(depth)
+					writeWindows(&r.hd, fa, name, d, sub(rev), reg.start, reg.end, args.WindowSize, args.stat)
+					writeCallable(&r.callable, name, d, sub(raw), reg.start, reg.end, args, r.counts)
+					if fhrg != nil {
+						label := ""
+						if job.labels != nil {
+							label = job.labels[k]
+						}
+						writeRegion(&r.regions, name, label, d, reg.start, reg.end, args.thresholds)
+					}
+					if cr != nil {
+						writeCounts(&r.pileup, cfa, name, cr.p, reg.start, reg.end)
+					}
+					if fhq != nil {
+						writeQuantized(&r.quantized, name, d, reg.start, reg.end, args.quantize)
+					}
+					if fhg != nil {
+						r.gaps = append(r.gaps, gapRuns(d, reg.start, reg.end, int32(args.GapDepth))...)
+					}
+					if bw != nil || d4 != nil {
+						r.runs = append(r.runs, depthRuns(d, reg.start, reg.end)...)
+					}
+				}
+				if args.Genes {
+					r.genes = jobGenes(job, depth, start, args.thresholds)
+				}
+				results <- r
+			}
+		}()
+	}
+	// a job is started only when fewer than maxPending per process are running or waiting to be
+	// written so that a slow job does not hold up the output of every later one in memory.
+	slots := make(chan bool, maxPending*args.Processes)
+	go func() {
+		for i := range jobs {
+			slots <- true
+			jobc <- i
+		}
+		close(jobc)
+		wg.Wait()
+		close(results)
+	}()
+
+	// write in the order of the chromosomes in the header or bed.
+	pending := make(map[int]*result)
+	counts := make(map[string]int)
+	genes := make(map[string]*geneCounts)
+	var longReads longReadStats
+	callable, quantized := &runWriter{w: fhca}, &runWriter{w: fhq}
+	var lastRun depthRun
+	var lastChrom string
+	addRun := func() {
+		if lastRun.depth == 0 {
+			return
+		}
+		if bw != nil {
+			pcheck(bw.Add(lastChrom, int(lastRun.start), int(lastRun.end), float32(lastRun.depth)))
+		}
+		if d4 != nil {
+			pcheck(d4.Add(lastChrom, int(lastRun.start), int(lastRun.end), lastRun.depth))
+		}
+	}
+	// gaps are held like the runs so that those meeting where a chromosome was split are merged.
+	var lastGap region
+	var lastGapChrom string
+	addGap := func() {
+		if lastGap.end > lastGap.start {
+			_, err := fmt.Fprintf(fhg, "%s\t%d\t%d\t%d\n", lastGapChrom, lastGap.start, lastGap.end, lastGap.end-lastGap.start)
+			pcheck(err)
+		}
+	}
+	next := 0
+	for r := range results {
+		pending[r.i] = r
+		for p, ok := pending[next]; ok; p, ok = pending[next] {
+			_, err := io.Copy(fhhd, &p.hd)
+			pcheck(err)
+			pcheck(callable.add(p.callable.Bytes()))
+			if fhrg != nil {
+				_, err = io.Copy(fhrg, &p.regions)
+				pcheck(err)
+			}
+			if fhq != nil {
+				pcheck(quantized.add(p.quantized.Bytes()))
+			}
+			if fhc != nil {
+				_, err = io.Copy(fhc, &p.pileup)
+				pcheck(err)
+			}
+			for _, rn := range p.runs {
+				// join the runs that meet where a chromosome was split.
+				if lastRun.end == rn.start && lastRun.depth == rn.depth && lastChrom == jobs[p.i].ref.Name() {
+					lastRun.end = rn.end
+					continue
+				}
+				addRun()
+				lastRun, lastChrom = rn, jobs[p.i].ref.Name()
+			}
+			for _, g := range p.gaps {
+				if lastGap.end == g.start && lastGapChrom == jobs[p.i].ref.Name() {
+					lastGap.end = g.end
+					continue
+				}
+				addGap()
+				lastGap, lastGapChrom = g, jobs[p.i].ref.Name()
+			}
+			for c, n := range p.counts {
+				counts[c] += n
+			}
+			if p.longReads != nil {
+				longReads.merge(p.longReads)
+			}
+			mergeGenes(genes, p.genes)
+			delete(pending, next)
+			next++
+			<-slots
+		}
+	}
+	pcheck(callable.flush())
+	pcheck(fhca.Close())
+	pcheck(fhhd.Close())
+	if fhrg != nil {
+		pcheck(fhrg.Close())
+	}
+	if fhg != nil {
+		addGap()
+		pcheck(fhg.Close())
+	}
+	if fhq != nil {
+		pcheck(quantized.flush())
+		pcheck(fhq.Close())
+	}
+	if fhc != nil {
+		pcheck(fhc.Close())
+	}
+	addRun()
+	if bw != nil {
+		pcheck(bw.Close())
+		pcheck(fhbw.Close())
+	}
+	if d4 != nil {
+		pcheck(d4.Close())
+	}
+	pcheck(writeCallableSummary(fmt.Sprintf("%s%s.callable.summary.txt", args.Prefix, chrom), counts))
+	if args.LongReads {
+		pcheck(writeLongReadSummary(fmt.Sprintf("%s%s.long-reads.txt", args.Prefix, chrom), &longReads))
+	}
+	if args.Genes {
+		pcheck(writeGenes(fmt.Sprintf("%s%s.genes.txt", args.Prefix, chrom), geneCoverages(geneOrder(jobs), genes), args.thresholds))
+	}
+}
@@ -0,0 +1,688 @@
+package depth
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"testing"
+
+	"github.com/biogo/hts/sam"
+	"github.com/brentp/goleft/bigwig"
+	"github.com/brentp/xopen"
+)
+
+func TestParseQuantize(t *testing.T) {
+	q, err := parseQuantize("0:1:4:100:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := []string{"0:1", "1:4", "4:100", "100:inf"}; !reflect.DeepEqual(q.labels, exp) {
+		t.Errorf("expected labels %v, got: %v", exp, q.labels)
+	}
+	for d, exp := range map[int32]int{0: 0, 1: 1, 3: 1, 4: 2, 99: 2, 100: 3, 5000: 3} {
+		if b := q.bin(d); b != exp {
+			t.Errorf("expected depth %d in bin %d, got: %d", d, exp, b)
+		}
+	}
+
+	q, err = parseQuantize("10:20")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := []string{"0:10", "10:20"}; !reflect.DeepEqual(q.labels, exp) {
+		t.Errorf("expected labels %v, got: %v", exp, q.labels)
+	}
+	if b := q.bin(20); b != -1 {
+		t.Errorf("expected depth beyond the last bin to give -1, got: %d", b)
+	}
+
+	for _, bad := range []string{"4", "4:1", "a:b"} {
+		if _, err := parseQuantize(bad); err == nil {
+			t.Errorf("expected error for %s", bad)
+		}
+	}
+}
+
+func TestWriteQuantized(t *testing.T) {
+	q, err := parseQuantize(":1:3:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	writeQuantized(&b, "1", []int32{0, 1, 2, 5, 6, 0}, 1, 7, q)
+	exp := "1\t1\t2\t0:1\n1\t2\t4\t1:3\n1\t4\t6\t3:inf\n1\t6\t7\t0:1\n"
+	if b.String() != exp {
+		t.Errorf("expected:\n%s\ngot:\n%s", exp, b.String())
+	}
+}
+
+func TestDepth(t *testing.T) {
+	d, err := Depth("test/t.bam", "", "chr22", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tot int64
+	for _, v := range d {
+		tot += int64(v)
+	}
+	if tot == 0 {
+		t.Errorf("expected some depth on chr22")
+	}
+	if _, err := Depth("test/t.bam", "", "chrNone", 0); err == nil {
+		t.Errorf("expected error for missing chromosome")
+	}
+}
+
+func TestBaseCounts(t *testing.T) {
+	for _, chrom := range []string{"chrM", "chr22"} {
+		d, err := Depth("test/t.bam", "", chrom, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// positions that are not sorted and in groups more than 16KB apart.
+		positions := []int{15300, 100, 15301, 16000, 40000}
+		counts, err := BaseCounts("test/t.bam", "", chrom, positions, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, pos := range positions {
+			if pos < len(d) && counts[i].Depth() != int(d[pos]) {
+				t.Errorf("%s:%d: expected depth %d, got %d from %+v", chrom, pos, d[pos], counts[i].Depth(), counts[i])
+			}
+		}
+	}
+}
+
+type sliceReader []*sam.Record
+
+func (s *sliceReader) Read() (*sam.Record, error) {
+	if len(*s) == 0 {
+		return nil, io.EOF
+	}
+	r := (*s)[0]
+	*s = (*s)[1:]
+	return r, nil
+}
+
+func TestNoOverlaps(t *testing.T) {
+	ref, err := sam.NewReference("chr1", "", "", 100, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sam.NewHeader(nil, []*sam.Reference{ref}); err != nil {
+		t.Fatal(err)
+	}
+	cigar := []sam.CigarOp{sam.NewCigarOp(sam.CigarMatch, 20)}
+	pair := func() sliceReader {
+		// mates at 10-30 and 20-40 overlap at 20-30.
+		seq := bytes.Repeat([]byte{'A'}, 20)
+		a, err := sam.NewRecord("r1", ref, ref, 10, 20, 40, 60, cigar, seq, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := sam.NewRecord("r1", ref, ref, 20, 10, -40, 60, cigar, seq, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		a.Flags, b.Flags = sam.Paired|sam.Read1, sam.Paired|sam.Read2
+		return sliceReader{a, b}
+	}
+	rdr := pair()
+	d, _, err := chromDepth(&rdr, ref, filter{exclude: skipFlags}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d[25] != 2 || d[15] != 1 || d[35] != 1 {
+		t.Errorf("expected double-counted overlap, got: %v", d[:45])
+	}
+	rdr = pair()
+	d, raw, err := chromDepth(&rdr, ref, filter{exclude: skipFlags, noOverlaps: true}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 10; i < 40; i++ {
+		if d[i] != 1 || raw[i] != 1 {
+			t.Fatalf("expected depth of 1 at %d, got: %d %d", i, d[i], raw[i])
+		}
+	}
+	if d[9] != 0 || d[40] != 0 {
+		t.Errorf("unexpected depth outside the pair: %v", d[:45])
+	}
+
+	// the second mate is on the reverse strand so its overlap goes to the first mate's forward strand.
+	rdr = pair()
+	rdr[1].Flags |= sam.Reverse
+	d, _, rev, err := strandDepth(&rdr, ref, filter{exclude: skipFlags, noOverlaps: true}, false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rev[15] != 0 || rev[25] != 0 || rev[35] != 1 || d[25]-rev[25] != 1 {
+		t.Errorf("unexpected reverse-strand depth: %v", rev[:45])
+	}
+	var b bytes.Buffer
+	writeWindows(&b, nil, "chr1", d, rev, 0, 40, 20, meanDepth)
+	if exp := "chr1\t0\t20\t0.5\t0.5\t0\nchr1\t20\t40\t1\t0.5\t0.5\n"; b.String() != exp {
+		t.Errorf("expected strand columns:\n%s\ngot:\n%s", exp, b.String())
+	}
+}
+
+func TestWindowStats(t *testing.T) {
+	// a few bases of extreme depth pull up the mean but not the median.
+	d := []int32{10, 10, 12, 10, 900, 10, 11, 10, 3, 10}
+	var b bytes.Buffer
+	for _, stat := range []string{"mean", "median", "min", "max"} {
+		writeWindows(&b, nil, "chr1", d, nil, 0, 10, 5, windowStats[stat])
+	}
+	exp := "chr1\t0\t5\t188.4\nchr1\t5\t10\t8.8\n" +
+		"chr1\t0\t5\t10\nchr1\t5\t10\t10\n" +
+		"chr1\t0\t5\t10\nchr1\t5\t10\t3\n" +
+		"chr1\t0\t5\t900\nchr1\t5\t10\t11\n"
+	if b.String() != exp {
+		t.Errorf("expected:\n%s\ngot:\n%s", exp, b.String())
+	}
+	if m := medianDepth([]int32{4, 1, 3, 2}); m != 2.5 {
+		t.Errorf("expected the mean of the middle 2 values, got %v", m)
+	}
+}
+
+func TestParseFlags(t *testing.T) {
+	for s, exp := range map[string]sam.Flags{"": skipFlags, "1796": skipFlags, "0x704": skipFlags,
+		"UNMAP|SECONDARY|QCFAIL|DUP": skipFlags, "dup,paired": sam.Duplicate | sam.Paired} {
+		f, err := parseFlags(s, skipFlags)
+		if err != nil || f != exp {
+			t.Errorf("%q: expected %d, got %d (%v)", s, exp, f, err)
+		}
+	}
+	if _, err := parseFlags("NOTAFLAG", 0); err == nil {
+		t.Errorf("expected error for unknown flag")
+	}
+}
+
+func TestFilter(t *testing.T) {
+	ref, err := sam.NewReference("chr1", "", "", 100, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sam.NewHeader(nil, []*sam.Reference{ref}); err != nil {
+		t.Fatal(err)
+	}
+	cigar := []sam.CigarOp{sam.NewCigarOp(sam.CigarSoftClipped, 2), sam.NewCigarOp(sam.CigarMatch, 10)}
+	qual := []byte{30, 30, 30, 30, 5, 5, 30, 30, 30, 30, 30, 30}
+	rec, err := sam.NewRecord("r1", ref, nil, 10, -1, 0, 60, cigar, bytes.Repeat([]byte{'A'}, 12), qual, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the low quality bases are at 12 and 13 after the soft-clip.
+	rdr := sliceReader{rec}
+	d, _, err := chromDepth(&rdr, ref, filter{minBaseQ: 20, exclude: skipFlags}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := []int32{1, 1, 0, 0, 1, 1, 1, 1, 1, 1}
+	if !reflect.DeepEqual(d[10:20], exp) {
+		t.Errorf("expected %v, got %v", exp, d[10:20])
+	}
+
+	rec.Flags = sam.Duplicate
+	rdr = sliceReader{rec}
+	if d, _, _ = chromDepth(&rdr, ref, filter{exclude: skipFlags}, false); d[15] != 0 {
+		t.Errorf("expected duplicate to be excluded")
+	}
+	rdr = sliceReader{rec}
+	if d, _, _ = chromDepth(&rdr, ref, filter{exclude: sam.Unmapped}, false); d[15] != 1 {
+		t.Errorf("expected duplicate to be included")
+	}
+	rdr = sliceReader{rec}
+	if d, _, _ = chromDepth(&rdr, ref, filter{include: sam.Paired}, false); d[15] != 0 {
+		t.Errorf("expected unpaired read to be excluded by include flags")
+	}
+}
+
+func TestDownsample(t *testing.T) {
+	ref, err := sam.NewReference("chr1", "", "", 100, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sam.NewHeader(nil, []*sam.Reference{ref}); err != nil {
+		t.Fatal(err)
+	}
+	cigar := []sam.CigarOp{sam.NewCigarOp(sam.CigarMatch, 20)}
+	seq := bytes.Repeat([]byte{'A'}, 20)
+	// reads returns 1000 reads at 10-30 and, with the same names, their mates at 20-40.
+	reads := func() sliceReader {
+		var rdr sliceReader
+		for _, pos := range []int{10, 20} {
+			for i := 0; i < 1000; i++ {
+				rec, err := sam.NewRecord(fmt.Sprintf("r%d", i), ref, nil, pos, -1, 0, 60, cigar, seq, nil, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				rdr = append(rdr, rec)
+			}
+		}
+		return rdr
+	}
+	rdr := reads()
+	d, _, err := chromDepth(&rdr, ref, filter{exclude: skipFlags, downsample: 0.1}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d[15] < 50 || d[15] > 150 {
+		t.Errorf("expected about 100 reads with --downsample 0.1, got: %d", d[15])
+	}
+	if d[15] != d[35] || d[25] != 2*d[15] {
+		t.Errorf("expected the mates to be kept together, got: %d %d %d", d[15], d[25], d[35])
+	}
+
+	rdr = reads()
+	if d, _, err = chromDepth(&rdr, ref, filter{exclude: skipFlags, maxDepth: 30}, false); err != nil {
+		t.Fatal(err)
+	}
+	// the reads at 20 start where 30 reads already overlap.
+	if d[15] != 30 || d[25] != 30 || d[35] != 0 {
+		t.Errorf("expected depth capped at 30, got: %d %d %d", d[15], d[25], d[35])
+	}
+}
+
+func TestLongReadReader(t *testing.T) {
+	nm, err := sam.NewAux(sam.NewTag("NM"), 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cigar := sam.Cigar{sam.NewCigarOp(sam.CigarSoftClipped, 100), sam.NewCigarOp(sam.CigarMatch, 900)}
+	supp := sam.Cigar{sam.NewCigarOp(sam.CigarHardClipped, 900), sam.NewCigarOp(sam.CigarMatch, 100)}
+	recs := sliceReader{
+		{Cigar: cigar, AuxFields: sam.AuxFields{nm}},
+		{Cigar: supp, Flags: sam.Supplementary, AuxFields: sam.AuxFields{nm}},
+		{Cigar: cigar, Flags: sam.Secondary, AuxFields: sam.AuxFields{nm}},
+		{Cigar: cigar, Flags: sam.Unmapped},
+	}
+	lr := &longReadReader{RecordReader: &recs}
+	for {
+		if _, err := lr.Read(); err != nil {
+			break
+		}
+	}
+	s := lr.stats
+	if len(s.lengths) != 1 || s.lengths[0] != 1000 || s.supplementary != 1 {
+		t.Errorf("expected 1 primary of length 1000 and 1 supplementary, got: %+v", s)
+	}
+	if s.columns != 1000 || s.edits != 40 {
+		t.Errorf("expected 40 edits in 1000 columns, got: %d %d", s.edits, s.columns)
+	}
+}
+
+func TestJobGenes(t *testing.T) {
+	ref, err := sam.NewReference("chr1", "", "", 10, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job := chromJob{ref: ref,
+		regions: []region{{0, 4}, {2, 6}, {8, 10}, {6, 8}},
+		names:   []string{"A", "A", "B", ""}}
+	depth := []int32{0, 5, 10, 20, 20, 10, 3, 3, 30, 40}
+	genes := jobGenes(job, depth, 0, []int{1, 10, 20})
+	if len(genes) != 2 {
+		t.Fatalf("expected 2 genes, got: %d", len(genes))
+	}
+	// the overlap of the regions of A is counted once.
+	a := genes["A"].coverage("A")
+	if a.Bases != 6 || a.Min != 0 || a.Mean != 65.0/6 {
+		t.Errorf("unexpected coverage for A: %+v", a)
+	}
+	if exp := []float64{5.0 / 6, 4.0 / 6, 2.0 / 6}; !reflect.DeepEqual(a.AtLeast, exp) {
+		t.Errorf("expected %v for A, got: %v", exp, a.AtLeast)
+	}
+
+	// genes are merged across chromosomes.
+	counts := make(map[string]*geneCounts)
+	mergeGenes(counts, genes)
+	mergeGenes(counts, jobGenes(chromJob{ref: ref, regions: []region{{6, 8}}, names: []string{"B"}}, depth, 0, []int{1, 10, 20}))
+	b := geneCoverages([]string{"B", "C"}, counts)
+	if len(b) != 1 || b[0].Bases != 4 || b[0].Min != 3 || b[0].Mean != 19 {
+		t.Fatalf("unexpected coverage for B: %+v", b)
+	}
+	if exp := []float64{1, 0.5, 0.5}; !reflect.DeepEqual(b[0].AtLeast, exp) {
+		t.Errorf("expected %v for B, got: %v", exp, b[0].AtLeast)
+	}
+}
+
+func TestSplitJobs(t *testing.T) {
+	ref, err := sam.NewReference("chr1", "", "", 2500, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the size is rounded down to 1000 so the windows of a split chromosome are not changed.
+	jobs := splitJobs([]chromJob{{ref: ref, regions: []region{{0, 2500}}}}, 1100, 250)
+	if len(jobs) != 3 {
+		t.Fatalf("expected 3 jobs, got: %d", len(jobs))
+	}
+	for i, exp := range []region{{0, 1000}, {1000, 2000}, {2000, 2500}} {
+		if jobs[i].regions[0] != exp || jobs[i].from != exp.start {
+			t.Errorf("expected job %d to cover %v, got: %v from %d", i, exp, jobs[i].regions, jobs[i].from)
+		}
+	}
+
+	// regions from a bed are grouped but not split.
+	bed := chromJob{ref: ref, regions: []region{{0, 100}, {200, 1200}, {1300, 1400}, {1500, 1600}}, names: []string{"a", "b", "", "c"}}
+	jobs = splitJobs([]chromJob{bed}, 1000, 100)
+	if len(jobs) != 3 {
+		t.Fatalf("expected 3 jobs, got: %d", len(jobs))
+	}
+	if !reflect.DeepEqual(jobs[1].regions, []region{{200, 1200}}) || jobs[1].from != 100 {
+		t.Errorf("unexpected second job: %+v", jobs[1])
+	}
+	if !reflect.DeepEqual(jobs[2].names, []string{"", "c"}) || jobs[2].from != 1200 {
+		t.Errorf("unexpected last job: %+v", jobs[2])
+	}
+}
+
+func TestSpanDepth(t *testing.T) {
+	ref, err := sam.NewReference("chr1", "", "", 100, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sam.NewHeader(nil, []*sam.Reference{ref}); err != nil {
+		t.Fatal(err)
+	}
+	cigar := []sam.CigarOp{sam.NewCigarOp(sam.CigarMatch, 20)}
+	reads := func() sliceReader {
+		var rdr sliceReader
+		for i, pos := range []int{5, 15, 45} {
+			rec, err := sam.NewRecord(fmt.Sprintf("r%d", i), ref, nil, pos, -1, 0, 60, cigar, bytes.Repeat([]byte{'A'}, 20), nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rdr = append(rdr, rec)
+		}
+		return rdr
+	}
+	rdr := reads()
+	exp, _, err := chromDepth(&rdr, ref, filter{exclude: skipFlags}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp = append([]int32{}, exp...)
+
+	// the buffer is reused so each span must be cleared of the previous depth.
+	var buf depthBuf
+	for _, s := range []region{{20, 50}, {0, 20}, {50, 100}} {
+		rdr = reads()
+		d, _, _, err := spanDepth(&rdr, ref, filter{exclude: skipFlags}, s.start, s.end, false, false, &buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(d, exp[s.start:s.end]) {
+			t.Errorf("expected depth %v from %d to %d, got: %v", exp[s.start:s.end], s.start, s.end, d)
+		}
+	}
+	if cap(buf.depth) != 51 {
+		t.Errorf("expected the buffer to hold only the largest span, got: %d", cap(buf.depth))
+	}
+}
+
+func TestDropMates(t *testing.T) {
+	mates := map[string]mate{"a": {matePos: 10}, "b": {matePos: 20}}
+	dropMates(mates, 20)
+	if _, ok := mates["b"]; len(mates) != 1 || !ok {
+		t.Errorf("expected only the mate at 20 to be kept, got: %v", mates)
+	}
+
+	ref, err := sam.NewReference("chr1", "", "", 10000, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sam.NewHeader(nil, []*sam.Reference{ref}); err != nil {
+		t.Fatal(err)
+	}
+	cigar := []sam.CigarOp{sam.NewCigarOp(sam.CigarMatch, 20)}
+	seq := bytes.Repeat([]byte{'A'}, 20)
+	var rdr sliceReader
+	add := func(name string, pos, matePos int, flags sam.Flags) {
+		rec, err := sam.NewRecord(name, ref, ref, pos, matePos, 0, 60, cigar, seq, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec.Flags = sam.Paired | flags
+		rdr = append(rdr, rec)
+	}
+	// the mates of these are duplicates so the first mates are never matched.
+	for i := 0; i < 3*minMates; i++ {
+		add(fmt.Sprintf("o%d", i), i, i+10, sam.Read1)
+		add(fmt.Sprintf("o%d", i), i+10, i, sam.Read2|sam.Duplicate)
+	}
+	sort.SliceStable(rdr, func(i, j int) bool { return rdr[i].Pos < rdr[j].Pos })
+	add("p", 5000, 5010, sam.Read1)
+	add("p", 5010, 5000, sam.Read2)
+	d, _, err := chromDepth(&rdr, ref, filter{exclude: skipFlags, noOverlaps: true}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 5000; i < 5030; i++ {
+		if d[i] != 1 {
+			t.Fatalf("expected depth of 1 at %d, got: %d", i, d[i])
+		}
+	}
+}
+
+func TestRunWriter(t *testing.T) {
+	var b bytes.Buffer
+	rw := &runWriter{w: &b}
+	for _, s := range []string{"1\t0\t5\tA\n1\t5\t10\tB\n", "1\t10\t15\tB\n1\t15\t20\tA\n", "1\t20\t25\tA\n", "2\t25\t30\tA\n"} {
+		if err := rw.add([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := rw.flush(); err != nil {
+		t.Fatal(err)
+	}
+	if exp := "1\t0\t5\tA\n1\t5\t15\tB\n1\t15\t25\tA\n2\t25\t30\tA\n"; b.String() != exp {
+		t.Errorf("expected:\n%s\ngot:\n%s", exp, b.String())
+	}
+}
+
+func TestD4Writer(t *testing.T) {
+	// a stand-in for d4tools that keeps the genome and bedGraph it is sent as the output.
+	dir := t.TempDir()
+	script := "#!/bin/sh\n[ \"$1\" = create ] && [ \"$2\" = -g ] && cat \"$3\" \"$4\" > \"$5\"\n"
+	if err := os.WriteFile(filepath.Join(dir, "d4tools"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	path := filepath.Join(dir, "t.depth.d4")
+	d, err := newD4Writer(path, []bigwig.Chrom{{Name: "1", Len: 100}, {Name: "2", Len: 50}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, err := range []error{d.Add("1", 0, 10, 3), d.Add("2", 5, 20, 1), d.Close()} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := "1\t100\n2\t50\n1\t0\t10\t3\n2\t5\t20\t1\n"; string(got) != exp {
+		t.Errorf("expected:\n%s\ngot:\n%s", exp, got)
+	}
+	if _, err := os.Stat(path + ".tmp.bedgraph"); !os.IsNotExist(err) {
+		t.Errorf("expected the bedGraph to be removed")
+	}
+}
+
+func TestOpenBed(t *testing.T) {
+	dir := t.TempDir()
+	lines := "#chrom\tstart\tend\tdepth\n1\t0\t10\t3\n1\t10\t20\t4\n2\t5\t20\t1\n"
+	for _, c := range []struct {
+		name         string
+		bgzip, index bool
+		out          string
+	}{{"a.bed", false, false, "a.bed"}, {"b.bed", true, false, "b.bed.gz"}, {"c.bed", true, true, "c.bed.gz"}} {
+		w, err := openBed(filepath.Join(dir, c.name), c.bgzip, c.index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.WriteString(lines); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		rdr, err := xopen.Ropen(filepath.Join(dir, c.out))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(rdr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != lines {
+			t.Errorf("%s: expected:\n%s\ngot:\n%s", c.name, lines, got)
+		}
+		if _, err := os.Stat(filepath.Join(dir, c.out+".tbi")); os.IsNotExist(err) == c.index {
+			t.Errorf("%s: expected an index only with index", c.name)
+		}
+	}
+}
+
+func TestGapRuns(t *testing.T) {
+	depth := []int32{0, 0, 3, 1, 0, 2, 0, 0}
+	if gaps := gapRuns(depth, 0, len(depth), 1); !reflect.DeepEqual(gaps, []region{{0, 2}, {4, 5}, {6, 8}}) {
+		t.Errorf("unexpected gaps: %v", gaps)
+	}
+	if gaps := gapRuns(depth[1:6], 1, 6, 2); !reflect.DeepEqual(gaps, []region{{1, 2}, {3, 5}}) {
+		t.Errorf("unexpected gaps below 2: %v", gaps)
+	}
+}
+
+func TestReadGFFJobs(t *testing.T) {
+	ref, err := sam.NewReference("chr1", "", "", 10000, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := sam.NewHeader(nil, []*sam.Reference{ref})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	// G1 is on the minus strand and its 2 transcripts share an exon that is longer in one.
+	gtf := `chr1	src	gene	101	600	.	-	.	gene_id "g1"; gene_name "G1";
+chr1	src	exon	101	200	.	-	.	gene_id "g1"; transcript_id "t1"; gene_name "G1";
+chr1	src	exon	151	250	.	-	.	gene_id "g1"; transcript_id "t2"; gene_name "G1";
+chr1	src	exon	501	600	.	-	.	gene_id "g1"; transcript_id "t1"; gene_name "G1";
+chr2	src	exon	1	10	.	+	.	gene_id "g3"; transcript_id "t4";
+chr1	src	exon	301	400	.	+	.	gene_id "g2"; transcript_id "t3";
+`
+	gff3 := `##gff-version 3
+chr1	src	gene	101	600	.	-	.	ID=gene:g1;Name=G1
+chr1	src	mRNA	101	600	.	-	.	ID=transcript:t1;Parent=gene:g1
+chr1	src	exon	101	200	.	-	.	Parent=transcript:t1
+chr1	src	exon	151	250	.	-	.	Parent=transcript:t2
+chr1	src	mRNA	151	250	.	-	.	ID=transcript:t2;Parent=gene:g1
+chr1	src	exon	501	600	.	-	.	Parent=transcript:t1
+chr1	src	exon	301	400	.	+	.	Parent=transcript:t3
+chr1	src	mRNA	301	400	.	+	.	ID=transcript:t3;Parent=g2
+chr1	src	gene	301	400	.	+	.	ID=g2
+`
+	for name, content := range map[string]string{"a.gtf": gtf, "a.gff3": gff3} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		jobs, err := readBedJobs(path, h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(jobs) != 1 {
+			t.Fatalf("%s: expected 1 job for chr1, got: %d", name, len(jobs))
+		}
+		j := jobs[0]
+		if exp := []region{{100, 250}, {300, 400}, {500, 600}}; !reflect.DeepEqual(j.regions, exp) {
+			t.Errorf("%s: expected regions %v, got: %v", name, exp, j.regions)
+		}
+		if exp := []string{"G1", "g2", "G1"}; !reflect.DeepEqual(j.names, exp) {
+			t.Errorf("%s: expected names %v, got: %v", name, exp, j.names)
+		}
+		// the exons of G1 are numbered from its 5' end.
+		if exp := []string{"G1\t2", "g2\t1", "G1\t1"}; !reflect.DeepEqual(j.labels, exp) {
+			t.Errorf("%s: expected labels %q, got: %q", name, exp, j.labels)
+		}
+	}
+}
+
+func TestPileup(t *testing.T) {
+	ref, err := sam.NewReference("chr1", "", "", 100, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sam.NewHeader(nil, []*sam.Reference{ref}); err != nil {
+		t.Fatal(err)
+	}
+	cigar := []sam.CigarOp{sam.NewCigarOp(sam.CigarMatch, 3), sam.NewCigarOp(sam.CigarInsertion, 1),
+		sam.NewCigarOp(sam.CigarMatch, 2), sam.NewCigarOp(sam.CigarDeletion, 2), sam.NewCigarOp(sam.CigarMatch, 3)}
+	// the A after the insertion at 13 has a low base quality.
+	qual := []byte{30, 30, 30, 30, 5, 30, 30, 30, 30}
+	rec, err := sam.NewRecord("r1", ref, nil, 10, -1, 0, 60, cigar, []byte("ACGTACGTA"), qual, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// overlapping regions are merged.
+	p := newPileup([]region{{12, 20}, {50, 52}, {10, 14}})
+	if len(p.regions) != 2 || len(p.counts) != 12 {
+		t.Fatalf("expected 2 regions of 12 bases, got %v", p.regions)
+	}
+	p.add(rec, 20)
+	if c := p.at(10); c.Base('A') != 1 || c.Depth() != 1 {
+		t.Errorf("expected an A at 10, got %+v", *c)
+	}
+	if c := p.at(12); c.Base('G') != 1 || c.Ins != 1 {
+		t.Errorf("expected a G and an insertion at 12, got %+v", *c)
+	}
+	if c := p.at(13); c.Depth() != 0 {
+		t.Errorf("expected the low quality base at 13 to be skipped, got %+v", *c)
+	}
+	for _, pos := range []int{15, 16} {
+		if c := p.at(pos); c.Del != 1 || c.Depth() != 0 {
+			t.Errorf("expected a deletion at %d, got %+v", pos, *c)
+		}
+	}
+	if c := p.at(19); c.Base('a') != 1 {
+		t.Errorf("expected an A at 19, got %+v", *c)
+	}
+	if p.at(30) != nil || p.at(52) != nil || p.at(50) == nil {
+		t.Errorf("expected counts only in the regions")
+	}
+
+	var buf bytes.Buffer
+	writeCounts(&buf, nil, "chr1", p, 12, 13)
+	if exp := "chr1\t12\t13\tN\t0\t0\t1\t0\t0\t1\t0\t0\n"; buf.String() != exp {
+		t.Errorf("expected %q, got %q", exp, buf.String())
+	}
+
+	rec.Flags = sam.Duplicate
+	rdr := &countReader{RecordReader: &sliceReader{rec}, ref: ref, f: filter{exclude: skipFlags}, p: newPileup([]region{{10, 20}})}
+	if _, err := rdr.Read(); err != nil {
+		t.Fatal(err)
+	}
+	if c := rdr.p.at(10); c.Depth() != 0 {
+		t.Errorf("expected duplicate to be excluded")
+	}
+}
+
+func TestSetProcesses(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(0))
+	if n := setProcesses(3); n != 3 || runtime.GOMAXPROCS(0) != 3 {
+		t.Errorf("expected the samtools commands to be limited to the 3 processes, got: %d", n)
+	}
+	// without -p the limit is left as is, which is the --threads or the number of CPUs.
+	if n := setProcesses(0); n != 3 {
+		t.Errorf("expected the limit to be unchanged, got: %d", n)
+	}
+}
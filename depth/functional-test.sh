@@ -99,7 +99,7 @@ done
 assert_exit_code 0
 
 
-run check_empty ./goleft depth --windowsize 10 --q 1 --mincov 4 --reference test/hg19.fa --processes 1 --stats --prefix x test/t-empty.bam
+run check_empty ./goleft depth --windowsize 10 -Q 1 --mincov 4 --reference test/hg19.fa --processes 1 --stats --prefix x test/t-empty.bam
 assert_exit_code 0
 assert_equal "$(check_with_fai_bt test/hg19.fa.fai x.depth.bed)" ""
 assert_equal "$(check_with_fai_bt test/hg19.fa.fai x.callable.bed)" ""
@@ -107,12 +107,57 @@ assert_equal "$(check_uniq x.depth.bed)" "OK"
 assert_equal "$(check_uniq x.callable.bed)" "OK"
 
 
-run check_empty_window ./goleft depth --bed test/windows.bed --windowsize 10 --q 1 --mincov 4 --reference test/hg19.fa --processes 1 --stats --prefix x test/t-empty.bam
+run check_empty_window ./goleft depth --bed test/windows.bed --windowsize 10 -Q 1 --mincov 4 --reference test/hg19.fa --processes 1 --stats --prefix x test/t-empty.bam
 assert_exit_code 0
 assert_equal "$(check_with_bed_bt x.depth.bed test/windows.bed)" ""
 assert_equal "$(check_with_bed_bt x.callable.bed test/windows.bed)" ""
 assert_equal "$(check_uniq x.depth.bed bed)" "OK"
 assert_equal "$(check_uniq x.callable.bed bed)" "OK"
 
+for w in 100 71 1000000000; do
+    run check_events_window$w ./goleft depth --events -Q 1 --windowsize $w --stats --prefix x --reference test/hg19.fa test/t.bam
+    assert_exit_code 0
+    assert_equal "$(check_with_fai_bt test/hg19.fa.fai x.depth.bed)" ""
+    assert_equal "$(check_with_fai_bt test/hg19.fa.fai x.callable.bed)" ""
+    assert_equal "$(check_uniq x.depth.bed)" "OK"
+    assert_equal "$(check_uniq x.callable.bed)" "OK"
+done
+
+run compare_events_to_samtools python test/cmp.py x.depth.bed test/t.bam
+assert_exit_code 0
+
+run check_events_empty ./goleft depth --events --windowsize 10 -Q 1 --mincov 4 --reference test/hg19.fa -p 2 --prefix x test/t-empty.bam
+assert_exit_code 0
+assert_equal "$(check_with_fai_bt test/hg19.fa.fai x.depth.bed)" ""
+assert_equal "$(check_with_fai_bt test/hg19.fa.fai x.callable.bed)" ""
+
+run check_events_bed ./goleft depth --events --bed test/windows.bed -Q 1 --windowsize 71 --thresholds 1,10 --prefix x --reference test/hg19.fa test/t.bam
+assert_exit_code 0
+assert_equal "$(check_with_bed_bt x.depth.bed test/windows.bed)" ""
+assert_equal "$(check_with_bed_bt x.callable.bed test/windows.bed)" ""
+assert_equal "$(grep -vc '^#' x.regions.bed)" "$(wc -l < test/windows.bed)"
+assert_equal "$(head -1 x.regions.bed)" "$(echo -e '#chrom\tstart\tend\tmean\tmedian\tmin\tmax\t1x\t10x')"
+
+run check_events_callable ./goleft depth --events -Q 20 --max-low-mapq 0.1 --mincov 10 --maxmeandepth 1000 --prefix x --reference test/hg19.fa test/t.bam
+assert_exit_code 0
+assert_equal "$(check_with_fai_bt test/hg19.fa.fai x.callable.bed)" ""
+assert_equal "$(check_uniq x.callable.bed)" "OK"
+assert_equal "$(awk 'NR > 1 { s += $2 } END { print s }' x.callable.summary.txt)" "$(awk '{ s += $2 } END { print s }' test/hg19.fa.fai)"
+
+run check_events_matrix ./goleft depth --events -Q 1 --windowsize 1000 -p 2 --prefix x --reference test/hg19.fa test/t.bam test/t-empty.bam
+assert_exit_code 0
+assert_equal "$(zcat x.depth.matrix.bed.gz | head -1 | awk '{ print NF }')" "5"
+assert_equal "$(zcat x.depth.matrix.bed.gz | awk 'NR > 1 && $5 != 0' | wc -l)" "0"
+assert_equal "$(check_with_fai_bt test/hg19.fa.fai <(zcat x.depth.matrix.bed.gz | grep -v '^#'))" ""
+
+run check_events_quantize ./goleft depth --events -Q 1 --quantize 0:1:10:500: --prefix x --reference test/hg19.fa test/t.bam
+assert_exit_code 0
+assert_equal "$(check_with_fai_bt test/hg19.fa.fai x.quantized.bed)" ""
+assert_equal "$(check_uniq x.quantized.bed)" "OK"
+
+run check_events_bigwig ./goleft depth --events --bigwig -Q 1 --prefix x --reference test/hg19.fa test/t.bam
+assert_exit_code 0
+assert_equal "$(head -c 4 x.depth.bw | od -An -tx4 | tr -d ' ')" "888ffc26"
+
 
 echo -e "\nFINISHED OK"
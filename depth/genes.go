@@ -0,0 +1,206 @@
+package depth
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/brentp/goleft"
+	"github.com/brentp/goleft/bamio"
+	"github.com/brentp/xopen"
+)
+
+// GeneCoverage is the coverage of the target bases of a gene. Bases in overlapping targets are
+// counted once.
+type GeneCoverage struct {
+	Name  string
+	Bases int
+	Mean  float64
+	Min   int
+	// AtLeast is the fraction of bases with depth at or above each threshold.
+	AtLeast []float64
+}
+
+// geneCounts accumulates the depth of the bases of a gene across chromosomes.
+type geneCounts struct {
+	bases   int
+	sum     int64
+	min     int32
+	atLeast []int
+}
+
+// add counts the bases of reg. depth[i] is the depth at start + i.
+func (g *geneCounts) add(depth []int32, start int, reg region, thresholds []int) {
+	if g.atLeast == nil {
+		g.atLeast = make([]int, len(thresholds))
+	}
+	for _, d := range depth[reg.start-start : reg.end-start] {
+		if g.bases == 0 || d < g.min {
+			g.min = d
+		}
+		g.bases++
+		g.sum += int64(d)
+		for i, t := range thresholds {
+			if int(d) >= t {
+				g.atLeast[i]++
+			}
+		}
+	}
+}
+
+func (g *geneCounts) merge(o *geneCounts) {
+	if o.bases == 0 {
+		return
+	}
+	if g.bases == 0 || o.min < g.min {
+		g.min = o.min
+	}
+	if g.atLeast == nil {
+		g.atLeast = make([]int, len(o.atLeast))
+	}
+	g.bases += o.bases
+	g.sum += o.sum
+	for i, n := range o.atLeast {
+		g.atLeast[i] += n
+	}
+}
+
+func (g *geneCounts) coverage(name string) GeneCoverage {
+	c := GeneCoverage{Name: name, Bases: g.bases, Min: int(g.min), AtLeast: make([]float64, len(g.atLeast))}
+	if g.bases == 0 {
+		return c
+	}
+	c.Mean = float64(g.sum) / float64(g.bases)
+	for i, n := range g.atLeast {
+		c.AtLeast[i] = float64(n) / float64(g.bases)
+	}
+	return c
+}
+
+// mergeRegions sorts the regions and merges those that overlap.
+func mergeRegions(regs []region) []region {
+	regs = append([]region{}, regs...)
+	sort.Slice(regs, func(i, j int) bool { return regs[i].start < regs[j].start })
+	var merged []region
+	for _, r := range regs {
+		if n := len(merged); n > 0 && r.start <= merged[n-1].end {
+			merged[n-1].end = max(merged[n-1].end, r.end)
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// jobGenes returns the counts for each named gene in the job. Regions without a name are skipped.
+// depth[i] is the depth at start + i.
+func jobGenes(job chromJob, depth []int32, start int, thresholds []int) map[string]*geneCounts {
+	byName := make(map[string][]region)
+	for i, reg := range job.regions {
+		if i < len(job.names) && job.names[i] != "" {
+			byName[job.names[i]] = append(byName[job.names[i]], reg)
+		}
+	}
+	genes := make(map[string]*geneCounts, len(byName))
+	for name, regs := range byName {
+		g := &geneCounts{}
+		for _, reg := range mergeRegions(regs) {
+			g.add(depth, start, reg, thresholds)
+		}
+		genes[name] = g
+	}
+	return genes
+}
+
+// geneOrder returns the gene names in the order they are first seen in the jobs.
+func geneOrder(jobs []chromJob) []string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, j := range jobs {
+		for _, n := range j.names {
+			if n != "" && !seen[n] {
+				seen[n] = true
+				names = append(names, n)
+			}
+		}
+	}
+	return names
+}
+
+// writeGenes writes the number of target bases, the mean and min depth and the fraction of bases
+// at or above each threshold for each gene.
+func writeGenes(path string, genes []GeneCoverage, thresholds []int) error {
+	fh, err := xopen.Wopen(path)
+	if err != nil {
+		return err
+	}
+	fmt.Fprint(fh, "#gene\tbases\tmean\tmin")
+	for _, t := range thresholds {
+		fmt.Fprintf(fh, "\t%dx", t)
+	}
+	fmt.Fprintln(fh)
+	for _, g := range genes {
+		fmt.Fprintf(fh, "%s\t%d\t%.4g\t%d", g.Name, g.Bases, g.Mean, g.Min)
+		for _, f := range g.AtLeast {
+			fmt.Fprintf(fh, "\t%.4f", f)
+		}
+		fmt.Fprintln(fh)
+	}
+	return fh.Close()
+}
+
+// GeneCompleteness returns the coverage of each gene named in the 4th column of the bed file from
+// the reads in the bam or cram at path with mapping quality of at least minMapQ. The genes are in
+// the order they are first seen in the bed and AtLeast has a value for each threshold. reference is
+// only needed for a cram.
+func GeneCompleteness(path, reference, bed string, minMapQ int, thresholds []int) ([]GeneCoverage, error) {
+	h, err := bamio.Header(path)
+	if err != nil {
+		return nil, err
+	}
+	idx, err := readIndex(path)
+	if err != nil {
+		return nil, err
+	}
+	jobs, err := readBedJobs(bed, h)
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[string]*geneCounts)
+	var buf depthBuf
+	for _, job := range jobs {
+		start, end := job.span()
+		rdr, ref, done, err := openChrom(path, reference, idx, job.ref.Name(), start, end, goleft.BgzfWorkers(1))
+		if err != nil {
+			return nil, err
+		}
+		depth, _, _, err := spanDepth(rdr, ref, filter{minMapQ: minMapQ, exclude: skipFlags}, start, end, false, false, &buf)
+		done()
+		if err != nil {
+			return nil, err
+		}
+		mergeGenes(counts, jobGenes(job, depth, start, thresholds))
+	}
+	return geneCoverages(geneOrder(jobs), counts), nil
+}
+
+// mergeGenes adds the counts for each gene in o to counts.
+func mergeGenes(counts, o map[string]*geneCounts) {
+	for name, g := range o {
+		c, ok := counts[name]
+		if !ok {
+			c = &geneCounts{}
+			counts[name] = c
+		}
+		c.merge(g)
+	}
+}
+
+func geneCoverages(names []string, counts map[string]*geneCounts) []GeneCoverage {
+	genes := make([]GeneCoverage, 0, len(names))
+	for _, n := range names {
+		if c, ok := counts[n]; ok {
+			genes = append(genes, c.coverage(n))
+		}
+	}
+	return genes
+}
@@ -0,0 +1,199 @@
+package depth
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/biogo/hts/sam"
+	"github.com/brentp/goleft"
+	"github.com/brentp/xopen"
+)
+
+// isGFF reports whether path is a GTF or GFF3 by the extension.
+func isGFF(path string) bool {
+	p := strings.TrimSuffix(strings.ToLower(path), ".gz")
+	return strings.HasSuffix(p, ".gtf") || strings.HasSuffix(p, ".gff") || strings.HasSuffix(p, ".gff3")
+}
+
+// gffExon is an exon of a gene with a 0-based, half-open interval.
+type gffExon struct {
+	chrom, gene string
+	start, end  int
+	reverse     bool
+}
+
+// gffAttr returns the value of key from the attributes of a GFF3 (key=value;) or GTF (key "value";).
+func gffAttr(attrs, key string) string {
+	for _, kv := range strings.Split(attrs, ";") {
+		kv = strings.TrimSpace(kv)
+		if strings.HasPrefix(kv, key+"=") {
+			return kv[len(key)+1:]
+		}
+		if strings.HasPrefix(kv, key+" ") {
+			return strings.Trim(kv[len(key)+1:], `"`)
+		}
+	}
+	return ""
+}
+
+// readGFFExons returns the exons in the GTF or GFF3 at path with the name of their gene. A GTF
+// exon has the gene_name or gene_id. A GFF3 exon has the Name of the gene that its transcript is
+// from, following the Parent of each feature up to one without a Parent, or that gene's ID.
+func readGFFExons(path string) ([]gffExon, error) {
+	rdr, err := xopen.Ropen(path)
+	if err != nil {
+		return nil, err
+	}
+	defer rdr.Close()
+	var exons []gffExon
+	// parents[k] is the GFF3 Parent of each exon in exons.
+	var parents []string
+	parent := make(map[string]string)
+	names := make(map[string]string)
+	for i := 1; ; i++ {
+		line, err := rdr.ReadString('\n')
+		if strings.HasPrefix(line, "##FASTA") {
+			break
+		}
+		if line = strings.TrimRight(line, "\r\n"); len(line) > 0 && line[0] != '#' {
+			toks := strings.Split(line, "\t")
+			if len(toks) < 9 {
+				return nil, &goleft.ParseError{Path: path, Line: i, Err: fmt.Errorf("depth: expected 9 columns in GFF line: %q", line)}
+			}
+			attrs := toks[8]
+			if id := gffAttr(attrs, "ID"); id != "" {
+				parent[id] = strings.Split(gffAttr(attrs, "Parent"), ",")[0]
+				if n := gffAttr(attrs, "Name"); n != "" {
+					names[id] = n
+				}
+			}
+			if toks[2] == "exon" {
+				start, serr := strconv.Atoi(toks[3])
+				end, eerr := strconv.Atoi(toks[4])
+				if serr != nil || eerr != nil || end < start {
+					return nil, &goleft.ParseError{Path: path, Line: i, Err: fmt.Errorf("depth: bad start or end in GFF line: %q", line)}
+				}
+				gene := gffAttr(attrs, "gene_name")
+				if gene == "" {
+					gene = gffAttr(attrs, "gene_id")
+				}
+				// GFF is 1-based and closed.
+				exons = append(exons, gffExon{chrom: toks[0], gene: gene, start: start - 1, end: end, reverse: toks[6] == "-"})
+				parents = append(parents, strings.Split(gffAttr(attrs, "Parent"), ",")[0])
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	for k := range exons {
+		if exons[k].gene != "" {
+			continue
+		}
+		p := parents[k]
+		// the depth limits the walk in case of a cycle.
+		for d := 0; d < 10 && parent[p] != ""; d++ {
+			p = parent[p]
+		}
+		if n, ok := names[p]; ok {
+			p = n
+		}
+		if p == "" {
+			return nil, fmt.Errorf("depth: exon at %s:%d-%d in %s has no gene", exons[k].chrom, exons[k].start+1, exons[k].end, path)
+		}
+		exons[k].gene = p
+	}
+	return exons, nil
+}
+
+// flattenExons merges the overlapping exons of the transcripts of each gene and numbers the merged
+// exons of each gene from 1 in the direction of transcription. The exons are sorted by start.
+func flattenExons(exons []gffExon) ([]gffExon, []int) {
+	type key struct{ chrom, gene string }
+	byGene := make(map[key][]gffExon)
+	var order []key
+	for _, e := range exons {
+		k := key{e.chrom, e.gene}
+		if _, ok := byGene[k]; !ok {
+			order = append(order, k)
+		}
+		byGene[k] = append(byGene[k], e)
+	}
+	var flat []gffExon
+	var numbers []int
+	for _, k := range order {
+		es := byGene[k]
+		sort.Slice(es, func(i, j int) bool { return es[i].start < es[j].start })
+		merged := es[:1]
+		for _, e := range es[1:] {
+			if last := &merged[len(merged)-1]; e.start <= last.end {
+				last.end = max(last.end, e.end)
+				continue
+			}
+			merged = append(merged, e)
+		}
+		for i, e := range merged {
+			flat = append(flat, e)
+			if e.reverse {
+				numbers = append(numbers, len(merged)-i)
+			} else {
+				numbers = append(numbers, i+1)
+			}
+		}
+	}
+	idx := make([]int, len(flat))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.SliceStable(idx, func(a, b int) bool { return flat[idx[a]].start < flat[idx[b]].start })
+	sorted, sortedNumbers := make([]gffExon, len(flat)), make([]int, len(flat))
+	for i, j := range idx {
+		sorted[i], sortedNumbers[i] = flat[j], numbers[j]
+	}
+	return sorted, sortedNumbers
+}
+
+// readGFFJobs returns a job for each chromosome, in the order they are first seen, with the merged
+// exons of each gene in the GTF or GFF3 at path as the regions. The regions are named for the gene
+// and labeled with the gene and the exon number for $prefix.regions.bed.
+func readGFFJobs(path string, h *sam.Header) ([]chromJob, error) {
+	exons, err := readGFFExons(path)
+	if err != nil {
+		return nil, err
+	}
+	refs := make(map[string]*sam.Reference, len(h.Refs()))
+	for _, ref := range h.Refs() {
+		refs[ref.Name()] = ref
+	}
+	flat, numbers := flattenExons(exons)
+	var jobs []chromJob
+	seen := make(map[string]int)
+	for k, e := range flat {
+		i, ok := seen[e.chrom]
+		if !ok {
+			ref, found := refs[e.chrom]
+			if !found {
+				goleft.Warnf("depth: chromosome %s from %s not found in bam header", e.chrom, path)
+				seen[e.chrom] = -1
+				continue
+			}
+			i = len(jobs)
+			seen[e.chrom] = i
+			jobs = append(jobs, chromJob{ref: ref})
+		}
+		if i < 0 {
+			continue
+		}
+		j := &jobs[i]
+		j.regions = append(j.regions, region{max(e.start, 0), min(e.end, j.ref.Len())})
+		j.names = append(j.names, e.gene)
+		j.labels = append(j.labels, fmt.Sprintf("%s\t%d", e.gene, numbers[k]))
+	}
+	return jobs, nil
+}
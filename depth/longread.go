@@ -0,0 +1,71 @@
+package depth
+
+import (
+	"fmt"
+
+	"github.com/biogo/hts/sam"
+	"github.com/brentp/goleft/bamio"
+	"github.com/brentp/xopen"
+)
+
+// longReadStats holds the read lengths and alignment identity for --long-reads.
+type longReadStats struct {
+	// lengths of the primary alignments including clips.
+	lengths       []int
+	supplementary int
+	// alignment columns and edits from the NM tag of primary and supplementary alignments.
+	columns, edits int
+}
+
+func (s *longReadStats) merge(o *longReadStats) {
+	s.lengths = append(s.lengths, o.lengths...)
+	s.supplementary += o.supplementary
+	s.columns += o.columns
+	s.edits += o.edits
+}
+
+// longReadReader tallies the longReadStats of the mapped, non-secondary reads that pass through it.
+// Only reads that start from from to to (if to is above 0) are tallied so that those read for more
+// than 1 job of a split chromosome are counted once. Others are passed through.
+type longReadReader struct {
+	RecordReader
+	from, to int
+	stats    longReadStats
+}
+
+func (r *longReadReader) Read() (*sam.Record, error) {
+	rec, err := r.RecordReader.Read()
+	if err != nil || rec.Flags&(sam.Unmapped|sam.Secondary) != 0 || rec.Pos < r.from || (r.to > 0 && rec.Pos >= r.to) {
+		return rec, err
+	}
+	if rec.Flags&sam.Supplementary != 0 {
+		r.stats.supplementary++
+	} else {
+		r.stats.lengths = append(r.stats.lengths, bamio.ReadLength(rec))
+	}
+	if c, e, ok := bamio.Identity(rec); ok {
+		r.stats.columns += c
+		r.stats.edits += e
+	}
+	return rec, nil
+}
+
+// writeLongReadSummary writes the number of reads, the read N50, the fraction of alignments that are
+// supplementary and the alignment identity. The identity is NA without NM tags.
+func writeLongReadSummary(path string, s *longReadStats) error {
+	fh, err := xopen.Wopen(path)
+	if err != nil {
+		return err
+	}
+	identity := "NA"
+	if s.columns > 0 {
+		identity = fmt.Sprintf("%.4f", 1-float64(s.edits)/float64(s.columns))
+	}
+	supp := 0.0
+	if n := len(s.lengths) + s.supplementary; n > 0 {
+		supp = float64(s.supplementary) / float64(n)
+	}
+	fmt.Fprintln(fh, "reads\tread_len_n50\tsupplementary_fraction\tidentity")
+	fmt.Fprintf(fh, "%d\t%d\t%.4f\t%s\n", len(s.lengths), bamio.N50(s.lengths), supp, identity)
+	return fh.Close()
+}
@@ -0,0 +1,121 @@
+package depth
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/brentp/goleft"
+	"github.com/brentp/goleft/bamio"
+)
+
+// runMatrix calculates the depth of every bam with the events algorithm and writes a single
+// bgzipped matrix of the depth (summarized by --stat) in each window with a column per sample to
+// $prefix.depth.matrix.bed.gz. Parts of at most --chunk-size bases are processed in parallel; within
+// a part, the samples are done in turn so that only 1 depth array per process is in memory.
+func runMatrix(args dargs) {
+	if args.Processes < 1 {
+		args.Processes = 1
+	}
+	idxs := make([]*bamio.Index, len(args.Bams))
+	names := make([]string, len(args.Bams))
+	var jobs []chromJob
+	for i, b := range args.Bams {
+		h, err := bamio.Header(b)
+		pcheck(err)
+		names[i] = bamio.SampleName(h, b)
+		idxs[i], err = readIndex(b)
+		pcheck(err)
+		if i == 0 {
+			jobs, err = chromJobs(args, h)
+			pcheck(err)
+		}
+	}
+
+	chrom := ""
+	if args.Chrom != "" {
+		chrom = "." + args.Chrom
+	}
+	w, err := openBed(fmt.Sprintf("%s%s.depth.matrix.bed", args.Prefix, chrom), true, args.Tabix)
+	pcheck(err)
+	_, err = fmt.Fprintf(w, "#chrom\tstart\tend\t%s\n", strings.Join(names, "\t"))
+	pcheck(err)
+	jobs = splitJobs(jobs, step, args.WindowSize)
+
+	type result struct {
+		i   int
+		buf bytes.Buffer
+	}
+	jobc := make(chan int)
+	results := make(chan *result, args.Processes)
+	var wg sync.WaitGroup
+	wg.Add(args.Processes)
+	for k := 0; k < args.Processes; k++ {
+		go func() {
+			defer wg.Done()
+			var buf depthBuf
+			for i := range jobc {
+				job := jobs[i]
+				start, end := job.span()
+				var wins []region
+				for _, reg := range job.regions {
+					for ws := reg.start / args.WindowSize * args.WindowSize; ws < reg.end; ws += args.WindowSize {
+						wins = append(wins, region{max(ws, reg.start), min(ws+args.WindowSize, reg.end)})
+					}
+				}
+				// means[window][sample]
+				means := make([][]float64, len(wins))
+				for wi := range means {
+					means[wi] = make([]float64, len(args.Bams))
+				}
+				for s, b := range args.Bams {
+					rdr, ref, done, err := openChrom(b, args.Reference, idxs[s], job.ref.Name(), start, end, goleft.BgzfWorkers(args.Processes))
+					pcheck(err)
+					depth, _, _, err := spanDepth(rdr, ref, args.filter, start, end, false, false, &buf)
+					done()
+					pcheck(err)
+					for wi, win := range wins {
+						means[wi][s] = args.stat(depth[win.start-start : win.end-start])
+					}
+				}
+				res := &result{i: i}
+				for wi, win := range wins {
+					fmt.Fprintf(&res.buf, "%s\t%d\t%d", job.ref.Name(), win.start, win.end)
+					for _, m := range means[wi] {
+						fmt.Fprintf(&res.buf, "\t%.4g", m)
+					}
+					res.buf.WriteByte('\n')
+				}
+				results <- res
+			}
+		}()
+	}
+	// a job is started only when fewer than maxPending are running or waiting to be written.
+	slots := make(chan bool, maxPending*args.Processes)
+	go func() {
+		for i := range jobs {
+			slots <- true
+			jobc <- i
+		}
+		close(jobc)
+		wg.Wait()
+		close(results)
+	}()
+
+	// write in the order of the chromosomes in the header or bed.
+	pending := make(map[int]*result)
+	next := 0
+	for r := range results {
+		pending[r.i] = r
+		for p, ok := pending[next]; ok; p, ok = pending[next] {
+			_, err := io.Copy(w, &p.buf)
+			pcheck(err)
+			delete(pending, next)
+			next++
+			<-slots
+		}
+	}
+	pcheck(w.Close())
+}
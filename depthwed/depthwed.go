@@ -12,6 +12,7 @@ import (
 	"strings"
 
 	arg "github.com/alexflint/go-arg"
+	"github.com/brentp/goleft"
 	"github.com/brentp/xopen"
 )
 
@@ -61,8 +62,8 @@ func run(args cliargs) {
 	}
 	stdout.WriteString(strings.Join(names, "\t") + "\n")
 
-	depths, eof := next(beds, args.Size)
-	for ; !eof; depths, eof = next(beds, args.Size) {
+	depths, eof := next(beds, args.Beds, args.Size)
+	for ; !eof; depths, eof = next(beds, args.Beds, args.Size) {
 		fmt.Fprintf(stdout, "%s\t%d\t%d", depths[0].chrom, depths[0].start, depths[0].end)
 		for _, d := range depths {
 			fmt.Fprintf(stdout, "\t%d", d.depth)
@@ -114,7 +115,8 @@ func getNextChrom(r *bufio.Reader) string {
 	return chrom
 }
 
-func next(beds []*xopen.Reader, size int) (depths []depth, eof bool) {
+// next sums the depths from each of beds (opened from paths) until the windows cover size bases.
+func next(beds []*xopen.Reader, paths []string, size int) (depths []depth, eof bool) {
 	depths = make([]depth, len(beds))
 	eof = false
 	k := 0
@@ -129,21 +131,21 @@ func next(beds []*xopen.Reader, size int) (depths []depth, eof bool) {
 			line, err := bed.ReadString('\n')
 			if err == io.EOF {
 				if i > 0 && !eof {
-					panic("not all files have same number of records")
+					log.Fatalf("depthwed: %s has fewer records than %s", paths[i], paths[0])
 				}
 				eof = true
 				continue
 			} else if err != nil {
-				panic(err)
+				log.Fatalf("depthwed: error reading %s: %s", paths[i], err)
 			}
 			if k == 0 {
 				depths[i] = sFromLine(line)
 				if depths[i].chrom != chrom {
-					log.Fatalf("got unexpected chromosome from %s: %s", bed, depths[i].chrom)
+					log.Fatalf("depthwed: got unexpected chromosome from %s: %s", paths[i], depths[i].chrom)
 				}
 				if size%(depths[i].end-depths[i].start) != 0 && !endSeen {
 					endSeen = true
-					log.Printf("size %d indivisible by interval in line: %s likely chromosome change.", size, line)
+					goleft.Warnf("depthwed: size %d indivisible by interval in line: %s likely chromosome change.", size, line)
 				}
 			} else {
 				tmp := sFromLine(line)
@@ -0,0 +1,264 @@
+// Package depthwindow corrects the binned coverage from goleft depth for GC content and
+// mappability and reports log2 ratios for CNV segmentation.
+package depthwindow
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	arg "github.com/alexflint/go-arg"
+	"github.com/brentp/faidx"
+	"github.com/brentp/goleft"
+	"github.com/brentp/xopen"
+)
+
+var cli = &struct {
+	Reference      string  `arg:"-r,required,help:reference fasta used to get the GC content of each window"`
+	Mappability    string  `arg:"-m,help:optional bigWig or bed (chrom start end score) of mappability from 0 to 1. bases without a value have a mappability of 0"`
+	MinMappability float64 `arg:"--min-mappability,help:windows with a mean mappability below this are excluded. only used with --mappability"`
+	MaxN           float64 `arg:"--max-n,help:windows with a greater proportion of N in the reference are excluded"`
+	Fai            string  `arg:"--fai,help:optional .fai or genome file. only windows on its contigs are used"`
+	Depth          string  `arg:"positional,required,help:depth.bed from goleft depth with the mean depth of each window"`
+}{MinMappability: 0.5, MaxN: 0.1}
+
+// window is a region from the depth.bed with its GC content, mappability and corrected depth.
+type window struct {
+	chrom      string
+	start, end int
+	depth      float64
+	gc         float64
+	// mappability is NaN if it was not given.
+	mappability float64
+	corrected   float64
+}
+
+// readWindows reads the chrom, start, end and mean depth from each line of a depth.bed.
+func readWindows(path string) ([]*window, error) {
+	rdr, err := xopen.Ropen(path)
+	if err != nil {
+		return nil, err
+	}
+	defer rdr.Close()
+	var ws []*window
+	for n := 1; ; n++ {
+		line, err := rdr.ReadString('\n')
+		if line = strings.TrimRight(line, "\r\n"); len(line) > 0 && line[0] != '#' {
+			toks := strings.SplitN(line, "\t", 5)
+			if len(toks) < 4 {
+				return nil, &goleft.ParseError{Path: path, Line: n, Err: fmt.Errorf("depthwindow: expected at least 4 fields, got: %q", line)}
+			}
+			w := &window{chrom: toks[0], mappability: math.NaN()}
+			if w.start, err = strconv.Atoi(toks[1]); err != nil {
+				return nil, &goleft.ParseError{Path: path, Line: n, Err: err}
+			}
+			if w.end, err = strconv.Atoi(toks[2]); err != nil || w.end <= w.start {
+				return nil, &goleft.ParseError{Path: path, Line: n, Err: fmt.Errorf("depthwindow: bad end in line: %q", line)}
+			}
+			if w.depth, err = strconv.ParseFloat(toks[3], 64); err != nil {
+				return nil, &goleft.ParseError{Path: path, Line: n, Err: err}
+			}
+			ws = append(ws, w)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ws, nil
+}
+
+// gcContent returns the proportion of G and C among the non-N bases of seq and the proportion of N.
+func gcContent(seq string) (gc, n float64) {
+	g, ns := 0, 0
+	for i := 0; i < len(seq); i++ {
+		switch seq[i] {
+		case 'G', 'C', 'g', 'c':
+			g++
+		case 'N', 'n':
+			ns++
+		}
+	}
+	if ns == len(seq) {
+		return 0, 1
+	}
+	return float64(g) / float64(len(seq)-ns), float64(ns) / float64(len(seq))
+}
+
+// setGC sets the GC content of each window and returns the windows with at most maxN N's.
+func setGC(ws []*window, fa *faidx.Faidx, maxN float64) ([]*window, error) {
+	kept := ws[:0]
+	for _, w := range ws {
+		seq, err := fa.Get(w.chrom, w.start, w.end)
+		if err != nil {
+			return nil, fmt.Errorf("depthwindow: error getting sequence for %s:%d-%d: %s", w.chrom, w.start, w.end, err)
+		}
+		var n float64
+		if w.gc, n = gcContent(seq); n <= maxN {
+			kept = append(kept, w)
+		}
+	}
+	return kept, nil
+}
+
+// minBinWindows is the fewest windows used to get the median depth of a GC or mappability bin.
+// Sparse bins, usually at extreme GC, borrow windows from adjacent bins.
+const minBinWindows = 50
+
+// correctBins multiplies the corrected depth of each window by the median of all windows divided by
+// the median of the windows in the same bin. bin returns the bin, from 0 to nBins-1, of a window.
+// Windows without depth, e.g. deletions or gaps, are left out of the medians so they do not drag
+// down the factor of their bin, and bins without a median are left as is.
+func correctBins(ws []*window, nBins int, bin func(*window) int) {
+	bins := make([][]float64, nBins)
+	all := make([]float64, 0, len(ws))
+	for _, w := range ws {
+		if w.corrected == 0 {
+			continue
+		}
+		b := bin(w)
+		bins[b] = append(bins[b], w.corrected)
+		all = append(all, w.corrected)
+	}
+	med := median(all)
+	if med == 0 {
+		return
+	}
+	factors := make([]float64, nBins)
+	for b := range bins {
+		factors[b] = 1
+		if len(bins[b]) == 0 {
+			continue
+		}
+		vals := append([]float64{}, bins[b]...)
+		for d := 1; len(vals) < minBinWindows && (b-d >= 0 || b+d < nBins); d++ {
+			if b-d >= 0 {
+				vals = append(vals, bins[b-d]...)
+			}
+			if b+d < nBins {
+				vals = append(vals, bins[b+d]...)
+			}
+		}
+		if m := median(vals); m > 0 {
+			factors[b] = med / m
+		}
+	}
+	for _, w := range ws {
+		w.corrected *= factors[bin(w)]
+	}
+}
+
+func median(vals []float64) float64 {
+	if len(vals) == 0 {
+		return 0
+	}
+	s := append([]float64{}, vals...)
+	sort.Float64s(s)
+	if len(s)%2 == 0 {
+		return (s[len(s)/2-1] + s[len(s)/2]) / 2
+	}
+	return s[len(s)/2]
+}
+
+// correct sets the corrected depth of each window by the median depth of windows with the same GC
+// percent and then, if the windows have a mappability, by the median of windows in the same 0.05
+// bin of mappability.
+func correct(ws []*window) {
+	for _, w := range ws {
+		w.corrected = w.depth
+	}
+	correctBins(ws, 101, func(w *window) int { return int(0.5 + 100*w.gc) })
+	if len(ws) > 0 && !math.IsNaN(ws[0].mappability) {
+		correctBins(ws, 21, func(w *window) int { return int(0.5 + 20*w.mappability) })
+	}
+}
+
+// minLog2 is reported for windows with a corrected depth of 0.
+const minLog2 = -10
+
+// write writes each window with the log2 of its corrected depth relative to the median of all windows.
+func write(out io.Writer, ws []*window) error {
+	vals := make([]float64, len(ws))
+	for i, w := range ws {
+		vals[i] = w.corrected
+	}
+	med := median(vals)
+	fmt.Fprintln(out, "#chrom\tstart\tend\tdepth\tgc\tmappability\tcorrected\tlog2")
+	for _, w := range ws {
+		l2 := float64(minLog2)
+		if w.corrected > 0 && med > 0 {
+			l2 = math.Max(minLog2, math.Log2(w.corrected/med))
+		}
+		m := "NA"
+		if !math.IsNaN(w.mappability) {
+			m = fmt.Sprintf("%.3f", w.mappability)
+		}
+		if _, err := fmt.Fprintf(out, "%s\t%d\t%d\t%.2f\t%.3f\t%s\t%.2f\t%.3f\n", w.chrom, w.start, w.end, w.depth, w.gc, m, w.corrected, l2); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Main is called from the goleft dispatcher.
+func Main() {
+	arg.MustParse(cli)
+	ws, err := readWindows(cli.Depth)
+	if err != nil {
+		log.Fatal(err)
+	}
+	n := len(ws)
+	if cli.Fai != "" {
+		g, err := goleft.ReadGenome(cli.Fai)
+		if err != nil {
+			log.Fatal(err)
+		}
+		kept := ws[:0]
+		for _, w := range ws {
+			if g.Has(w.chrom) {
+				kept = append(kept, w)
+			}
+		}
+		ws = kept
+	}
+	fa, err := faidx.New(cli.Reference)
+	if err != nil {
+		log.Fatalf("depthwindow: error opening reference: %s", err)
+	}
+	defer fa.Close()
+	if ws, err = setGC(ws, fa, cli.MaxN); err != nil {
+		log.Fatal(err)
+	}
+	if cli.Mappability != "" {
+		if err := setMappability(ws, cli.Mappability); err != nil {
+			log.Fatal(err)
+		}
+		kept := ws[:0]
+		for _, w := range ws {
+			if w.mappability >= cli.MinMappability {
+				kept = append(kept, w)
+			}
+		}
+		ws = kept
+	}
+	goleft.Infof("depthwindow: excluded %d of %d windows", n-len(ws), n)
+	if len(ws) == 0 {
+		log.Fatalf("depthwindow: no windows remain in %s", cli.Depth)
+	}
+	correct(ws)
+	w := bufio.NewWriter(os.Stdout)
+	if err := write(w, ws); err != nil {
+		log.Fatal(err)
+	}
+	if err := w.Flush(); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,96 @@
+package depthwindow
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGCContent(t *testing.T) {
+	if gc, n := gcContent("GGCCAANN"); gc != 4.0/6 || n != 0.25 {
+		t.Errorf("unexpected gc: %v or N: %v", gc, n)
+	}
+	if _, n := gcContent("NNNN"); n != 1 {
+		t.Errorf("expected all N, got: %v", n)
+	}
+}
+
+func TestCorrect(t *testing.T) {
+	// windows at 40% GC have twice the depth of those at 60% GC.
+	var ws []*window
+	for i := 0; i < 200; i++ {
+		w := &window{chrom: "1", start: i * 100, end: (i + 1) * 100, gc: 0.4, depth: 40, mappability: math.NaN()}
+		if i%2 == 1 {
+			w.gc, w.depth = 0.6, 20
+		}
+		ws = append(ws, w)
+	}
+	// a deletion of 1 copy at 40% GC.
+	ws[10].depth = 20
+	correct(ws)
+	if ws[0].corrected != ws[1].corrected {
+		t.Fatalf("expected GC bias to be removed, got: %v %v", ws[0].corrected, ws[1].corrected)
+	}
+	var buf bytes.Buffer
+	if err := write(&buf, ws); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(buf.String(), "\n")
+	if !strings.HasSuffix(lines[1], "\tNA\t20.00\t0.000") || !strings.HasSuffix(lines[11], "\t-1.000") {
+		t.Errorf("unexpected output:\n%s\n%s", lines[1], lines[11])
+	}
+}
+
+func TestCorrectZero(t *testing.T) {
+	// windows at 60% GC have half the depth of those at 40% GC and more of them have no reads.
+	var ws []*window
+	for i := 0; i < 300; i++ {
+		w := &window{chrom: "1", start: i * 100, end: (i + 1) * 100, gc: 0.4, depth: 40, mappability: math.NaN()}
+		if i%3 != 0 {
+			w.gc, w.depth = 0.6, 20
+			if i%3 == 2 {
+				w.depth = 0
+			}
+		}
+		ws = append(ws, w)
+	}
+	correct(ws)
+	if ws[0].corrected != ws[1].corrected || ws[0].corrected == 0 || ws[2].corrected != 0 {
+		t.Errorf("expected windows without depth to be left out of the medians, got: %v %v %v", ws[0].corrected, ws[1].corrected, ws[2].corrected)
+	}
+
+	// without depth in any window there is nothing to correct.
+	for _, w := range ws {
+		w.depth = 0
+	}
+	correct(ws)
+	for _, w := range ws {
+		if w.corrected != 0 {
+			t.Fatalf("expected a corrected depth of 0, got: %v", w.corrected)
+		}
+	}
+}
+
+func TestSetMappability(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "goleft-depthwindow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	p := filepath.Join(tmp, "map.bed")
+	if err := ioutil.WriteFile(p, []byte("track name=map\n1\t0\t150\t1\n1\t150\t175\t0.5\n2\t0\t10\t1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ws := []*window{{chrom: "1", start: 100, end: 200}, {chrom: "1", start: 0, end: 100}, {chrom: "3", start: 0, end: 100}}
+	if err := setMappability(ws, p); err != nil {
+		t.Fatal(err)
+	}
+	// 50 bases at 1, 25 at 0.5 and 25 without a value.
+	if ws[0].mappability != 0.625 || ws[1].mappability != 1 || ws[2].mappability != 0 {
+		t.Errorf("unexpected mappability: %v %v %v", ws[0].mappability, ws[1].mappability, ws[2].mappability)
+	}
+}
@@ -0,0 +1,115 @@
+package depthwindow
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/brentp/goleft"
+	"github.com/brentp/goleft/bigwig"
+	"github.com/brentp/xopen"
+)
+
+// isBigWig returns true if the path has a bigWig extension.
+func isBigWig(path string) bool {
+	p := strings.ToLower(path)
+	return strings.HasSuffix(p, ".bw") || strings.HasSuffix(p, ".bigwig")
+}
+
+// setMappability sets the mean mappability of each window from the intervals in the bigWig or bed
+// at path. Values are clamped to [0, 1] and bases without a value count as 0.
+func setMappability(ws []*window, path string) error {
+	byChrom := make(map[string][]*window)
+	for _, w := range ws {
+		w.mappability = 0
+		byChrom[w.chrom] = append(byChrom[w.chrom], w)
+	}
+	for _, cws := range byChrom {
+		sort.Slice(cws, func(i, j int) bool { return cws[i].start < cws[j].start })
+	}
+	add := func(chrom string, start, end int, v float32) error {
+		cws := byChrom[chrom]
+		m := float64(v)
+		if m < 0 {
+			m = 0
+		} else if m > 1 {
+			m = 1
+		}
+		// windows are sorted by start and do not overlap so the first with end > start is the first to overlap.
+		i := sort.Search(len(cws), func(i int) bool { return cws[i].end > start })
+		for ; i < len(cws) && cws[i].start < end; i++ {
+			w := cws[i]
+			o := min(w.end, end) - max(w.start, start)
+			w.mappability += m * float64(o)
+		}
+		return nil
+	}
+	var err error
+	if isBigWig(path) {
+		err = readBigWig(path, add)
+	} else {
+		err = readBed(path, add)
+	}
+	if err != nil {
+		return err
+	}
+	for _, w := range ws {
+		w.mappability /= float64(w.end - w.start)
+	}
+	return nil
+}
+
+func readBigWig(path string, fn func(chrom string, start, end int, v float32) error) error {
+	fh, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	br, err := bigwig.NewReader(fh)
+	if err != nil {
+		return err
+	}
+	return br.Intervals(fn)
+}
+
+// readBed calls fn with the chrom, start, end and score of each line of a bed or bedGraph.
+func readBed(path string, fn func(chrom string, start, end int, v float32) error) error {
+	rdr, err := xopen.Ropen(path)
+	if err != nil {
+		return err
+	}
+	defer rdr.Close()
+	for n := 1; ; n++ {
+		line, err := rdr.ReadString('\n')
+		if line = strings.TrimRight(line, "\r\n"); len(line) > 0 && line[0] != '#' && !strings.HasPrefix(line, "track") {
+			toks := strings.SplitN(line, "\t", 5)
+			if len(toks) < 4 {
+				return &goleft.ParseError{Path: path, Line: n, Err: fmt.Errorf("depthwindow: expected chrom, start, end and score, got: %q", line)}
+			}
+			start, e := strconv.Atoi(toks[1])
+			if e != nil {
+				return &goleft.ParseError{Path: path, Line: n, Err: e}
+			}
+			end, e := strconv.Atoi(toks[2])
+			if e != nil {
+				return &goleft.ParseError{Path: path, Line: n, Err: e}
+			}
+			v, e := strconv.ParseFloat(toks[3], 32)
+			if e != nil {
+				return &goleft.ParseError{Path: path, Line: n, Err: e}
+			}
+			if e := fn(toks[0], start, end, float32(v)); e != nil {
+				return e
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -276,6 +276,21 @@ func (e *EMD) Type(d float32) int {
 	return e.adjustCN(cn, df)
 }
 
+// LogLikelihoods returns the natural log of the poisson likelihood of depth d for each copy-number
+// given the depth of each bin in Lambda.
+func (e *EMD) LogLikelihoods(d float32) []float64 {
+	k := int(0.5 + d)
+	ll := make([]float64, len(e.Lambda))
+	for cn, mu := range e.Lambda {
+		// avoid log(0) for the CN0 bin when the median is 0.
+		if mu < eps {
+			mu = eps
+		}
+		ll[cn] = logpmf(k, mu)
+	}
+	return ll
+}
+
 // adjustCN for copy-number 1 and 3. Use poisson PMF to make sure they
 // are better than CN2. If not, set to CN2.
 func (e *EMD) adjustCN(cn int, depth float64) int {
@@ -330,20 +345,25 @@ func (c *Cache) Add(e *EMD) []*CNV {
 }
 
 func (c *Cache) Clear(p *Position) []*CNV {
+	if c.last == nil {
+		return nil
+	}
 	if p == nil {
 		p = &Position{End: c.last.Position.End + 10000, Start: c.last.Position.Start + 10000}
 	}
 	cnvs := make([]*CNV, 0, 5)
-	keys := make([]int, len(c.cnvs))
+	keys := make([]int, 0, len(c.cnvs))
 	L := p.End - p.Start
 	for si, emd := range c.cnvs {
 		// not a big enough gap yet.
 		if p.Start-emd[len(emd)-1].Position.End < 3*L {
 			continue
 		}
-		cnvs = append(cnvs, makecnvs(emd, si))
-		cnvs[len(cnvs)-1].PSize = len(c.cnvs)
 		keys = append(keys, si)
+		if cnv := makecnvs(emd, si); cnv != nil {
+			cnv.PSize = len(c.cnvs)
+			cnvs = append(cnvs, cnv)
+		}
 	}
 	for _, key := range keys {
 		delete(c.cnvs, key)
@@ -351,17 +371,32 @@ func (c *Cache) Clear(p *Position) []*CNV {
 	return cnvs
 }
 
+// Flush returns all of the CNVs in the cache regardless of position and resets it. This is used at the
+// end of a chromosome.
+func (c *Cache) Flush() []*CNV {
+	cnvs := make([]*CNV, 0, len(c.cnvs))
+	for si, emd := range c.cnvs {
+		if cnv := makecnvs(emd, si); cnv != nil {
+			cnv.PSize = len(c.cnvs)
+			cnvs = append(cnvs, cnv)
+		}
+	}
+	c.cnvs = nil
+	c.last = nil
+	return cnvs
+}
+
 // merge individal aberrant depth calls into CNVs.
 func makecnvs(es []*EMD, sampleI int) *CNV {
 	var cnv *CNV
 	// in here, we know we have adjacent calls from  same sample.
-	for i, es := range es {
+	for _, es := range es {
 		fc := es.Log2FC()[sampleI]
 		if fc > -0.5 && fc < 0.3 {
 			continue
 		}
 		cn := es.Type(es.Depths[sampleI])
-		if i == 0 {
+		if cnv == nil {
 			cnv = &CNV{SampleI: sampleI, CN: []int{cn}, Depth: []float32{es.Depths[sampleI]},
 				Position: []Position{es.Position}, Log2FC: []float32{float32(fc)}}
 			continue
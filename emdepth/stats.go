@@ -22,6 +22,17 @@ func pmf(k int, mu float64) float64 {
 	return math.Exp(float64(k)*math.Log(mu) - float64(sign)*lg - mu)
 }
 
+// logpmf is the natural log of the poisson probability of k given mu.
+func logpmf(k int, mu float64) float64 {
+	var lg float64
+	if k < len(gammas) {
+		lg = gammas[k]
+	} else {
+		lg, _ = math.Lgamma(float64(k + 1))
+	}
+	return float64(k)*math.Log(mu) - lg - mu
+}
+
 func cdf(mu float64, k int) float64 {
 	var tot float64
 	for ; k >= 0; k-- {
@@ -0,0 +1,18 @@
+package goleft
+
+import "fmt"
+
+// ParseError is returned for a malformed line in an input file such as a bed or fai.
+type ParseError struct {
+	Path string
+	// Line is the 1-based line number in Path.
+	Line int
+	Err  error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("%s:%d: %s", e.Path, e.Line, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *ParseError) Unwrap() error { return e.Err }
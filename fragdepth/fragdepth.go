@@ -0,0 +1,404 @@
+// Package fragdepth reports the depth of paired-end fragments rather than of reads. Each
+// properly-paired fragment covers the bases from the start of its leftmost read to the end of its
+// mate, including the unsequenced insert between them, and is counted once. This is the coverage of
+// the DNA molecules that cfDNA and ATAC-seq analyses need.
+package fragdepth
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+
+	arg "github.com/alexflint/go-arg"
+	"github.com/biogo/hts/bam"
+	"github.com/biogo/hts/sam"
+	"github.com/brentp/goleft"
+	"github.com/brentp/goleft/bamio"
+	"github.com/brentp/goleft/tabix"
+)
+
+var cli = &struct {
+	MinMapQ    int    `arg:"-Q,--min-mapq,help:mapping quality cutoff for both reads of a fragment. the mate is checked from its MQ tag when present."`
+	MinInsert  int    `arg:"--min-insert,help:fragments shorter than this are not counted."`
+	MaxInsert  int    `arg:"--max-insert,help:fragments longer than this are not counted."`
+	WindowSize int    `arg:"-w,help:report the mean fragment depth in windows of this size rather than runs of bases with the same depth."`
+	Chrom      string `arg:"-c,help:optional chromosome to limit analysis"`
+	Reference  string `arg:"-r,help:path to reference fasta. required for cram."`
+	Processes  int    `arg:"-p,help:number of processors to parallelize."`
+	Fai        string `arg:"--fai,help:optional .fai or genome file. only its contigs are reported."`
+	Prefix     string `arg:"required,help:prefix for the output $prefix.fragdepth.bed.gz"`
+	Bam        string `arg:"positional,required,help:paired-end bam or cram for which to calculate fragment depth."`
+}{MinMapQ: 1, MaxInsert: 1000, Processes: 1}
+
+// step is the size of the jobs that a chromosome is split into.
+var step = 10000000
+
+// skipFlags are the reads that do not start a counted fragment.
+const skipFlags = sam.Unmapped | sam.MateUnmapped | sam.Secondary | sam.Supplementary | sam.Duplicate | sam.QCFail
+
+var mqTag = sam.Tag([2]byte{'M', 'Q'})
+
+func pcheck(e error) {
+	if e != nil {
+		log.Fatal(e)
+	}
+}
+
+// options are the fragments that are counted.
+type options struct {
+	minMapQ, minInsert, maxInsert int
+}
+
+// counts are the fragments that were counted and those that were skipped for their length.
+type counts struct {
+	fragments, short, long int
+}
+
+func (c *counts) add(o counts) {
+	c.fragments += o.fragments
+	c.short += o.short
+	c.long += o.long
+}
+
+// fragment returns the span of the fragment that rec is the leftmost read of. ok is false if rec is
+// not the leftmost read of a proper pair that passes the mapping quality cutoff. The leftmost read
+// is the one with a positive template length.
+func fragment(rec *sam.Record, minMapQ int) (start, end int, ok bool) {
+	if rec.Flags&sam.ProperPair == 0 || rec.Flags&skipFlags != 0 || rec.TempLen <= 0 || int(rec.MapQ) < minMapQ {
+		return 0, 0, false
+	}
+	if rec.Ref == nil || rec.MateRef == nil || rec.Ref.ID() != rec.MateRef.ID() {
+		return 0, 0, false
+	}
+	if mq, ok := mateMapQ(rec); ok && mq < minMapQ {
+		return 0, 0, false
+	}
+	return rec.Pos, rec.Pos + rec.TempLen, true
+}
+
+// mateMapQ returns the mapping quality of the mate of rec from its MQ tag. ok is false if rec has no
+// MQ tag.
+func mateMapQ(rec *sam.Record) (mq int, ok bool) {
+	aux := rec.AuxFields.Get(mqTag)
+	if aux == nil {
+		return 0, false
+	}
+	switch v := aux.Value().(type) {
+	case uint8:
+		return int(v), true
+	case int8:
+		return int(v), true
+	case uint16:
+		return int(v), true
+	case int16:
+		return int(v), true
+	case int32:
+		return int(v), true
+	}
+	return 0, false
+}
+
+// recordReader is satisfied by a *bamio.Reader and by iterReader.
+type recordReader interface {
+	Read() (*sam.Record, error)
+}
+
+// emptyReader is used for regions without any reads.
+type emptyReader struct{}
+
+func (emptyReader) Read() (*sam.Record, error) { return nil, io.EOF }
+
+// iterReader adapts a bam.Iterator to a recordReader.
+type iterReader struct {
+	*bam.Iterator
+}
+
+func (it iterReader) Read() (*sam.Record, error) {
+	if !it.Next() {
+		if err := it.Error(); err != nil {
+			return nil, err
+		}
+		return nil, io.EOF
+	}
+	return it.Record(), nil
+}
+
+// fragDepth returns the depth of the fragments from start to end of ref where depth[i] is of base
+// start+i. rdr must be sorted and must include the reads starting up to o.maxInsert before start
+// so that the fragments that only reach into the region from before it are counted. Only the
+// fragments that start in the region are added to the counts so that a chromosome split into
+// regions is counted once.
+func fragDepth(rdr recordReader, ref *sam.Reference, start, end int, o options) ([]int32, counts, error) {
+	var c counts
+	depth := make([]int32, end-start+1)
+	for {
+		rec, err := rdr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, c, err
+		}
+		if rec.Ref == nil || rec.Ref.ID() != ref.ID() {
+			continue
+		}
+		if rec.Pos >= end {
+			break
+		}
+		fs, fe, ok := fragment(rec, o.minMapQ)
+		if !ok {
+			continue
+		}
+		counted := fs >= start
+		n := fe - fs
+		if n < o.minInsert || n > o.maxInsert {
+			if counted && n < o.minInsert {
+				c.short++
+			} else if counted {
+				c.long++
+			}
+			continue
+		}
+		if counted {
+			c.fragments++
+		}
+		fs, fe = max(fs, start), min(fe, end)
+		if fe <= fs {
+			continue
+		}
+		depth[fs-start]++
+		depth[fe-start]--
+	}
+	var d int32
+	for i := range depth {
+		d += depth[i]
+		depth[i] = d
+	}
+	return depth[:end-start], c, nil
+}
+
+// job is a region of a chromosome that is processed at once.
+type job struct {
+	ref        *sam.Reference
+	start, end int
+}
+
+// splitJobs returns the chromosomes in h, limited to chrom and the contigs in genome if they are
+// given, split into jobs of at most step bases. The size is a multiple of windowSize so the windows
+// are the same as without splitting.
+func splitJobs(h *sam.Header, chrom string, genome *goleft.Genome, windowSize int) []job {
+	size := step
+	if windowSize > 0 {
+		size = max(1, step/windowSize) * windowSize
+	}
+	var jobs []job
+	for _, ref := range h.Refs() {
+		if (chrom != "" && ref.Name() != chrom) || !genome.Has(ref.Name()) {
+			continue
+		}
+		for s := 0; s < ref.Len(); s += size {
+			jobs = append(jobs, job{ref: ref, start: s, end: min(s+size, ref.Len())})
+		}
+	}
+	return jobs
+}
+
+// openJob returns a reader over the reads of j and those starting up to maxInsert before it, the
+// reference for j from the header of the reader and a function to close the reader.
+func openJob(path, fasta string, idx *bamio.Index, j job, maxInsert, rd int) (recordReader, *sam.Reference, func(), error) {
+	start := max(0, j.start-maxInsert)
+	var br *bamio.Reader
+	var err error
+	if bamio.IsCRAM(path) {
+		br, err = bamio.OpenRegion(path, fasta, fmt.Sprintf("%s:%d-%d", j.ref.Name(), start+1, j.end), rd)
+	} else {
+		br, err = bamio.Open(path, fasta, rd)
+	}
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	// use the reference from this reader's header so the IDs match the records.
+	var ref *sam.Reference
+	for _, r := range br.Header().Refs() {
+		if r.Name() == j.ref.Name() {
+			ref = r
+			break
+		}
+	}
+	if ref == nil {
+		br.Close()
+		return nil, nil, nil, fmt.Errorf("fragdepth: chromosome %s not found in %s", j.ref.Name(), path)
+	}
+	if bamio.IsCRAM(path) {
+		return br, ref, func() { br.Close() }, nil
+	}
+	chunks, err := idx.Chunks(ref, start, j.end)
+	if err != nil {
+		// no reads for this region.
+		br.Close()
+		return emptyReader{}, ref, func() {}, nil
+	}
+	it, err := bam.NewIterator(br.Reader, chunks)
+	if err != nil {
+		br.Close()
+		return nil, nil, nil, err
+	}
+	return iterReader{it}, ref, func() { it.Close(); br.Close() }, nil
+}
+
+// run is an interval of bases with the same fragment depth.
+type run struct {
+	start, end int
+	depth      int32
+}
+
+// depthRuns returns the runs of bases with the same, non-zero depth where depth[i] is of base
+// start+i.
+func depthRuns(depth []int32, start int) []run {
+	var runs []run
+	for i := 0; i < len(depth); {
+		j := i + 1
+		for j < len(depth) && depth[j] == depth[i] {
+			j++
+		}
+		if depth[i] != 0 {
+			runs = append(runs, run{start + i, start + j, depth[i]})
+		}
+		i = j
+	}
+	return runs
+}
+
+// writeWindows writes the mean depth in each window where depth[i] is of base start+i. Windows are
+// aligned to multiples of windowSize so only the last of a chromosome may be smaller.
+func writeWindows(w io.Writer, chrom string, depth []int32, start, windowSize int) {
+	end := start + len(depth)
+	for ws := start / windowSize * windowSize; ws < end; ws += windowSize {
+		s, e := max(ws, start), min(ws+windowSize, end)
+		var sum int64
+		for _, d := range depth[s-start : e-start] {
+			sum += int64(d)
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%.4g\n", chrom, s, e, float64(sum)/float64(e-s))
+	}
+}
+
+func Main() {
+	p := arg.MustParse(cli)
+	if cli.MaxInsert < 1 {
+		p.Fail("--max-insert must be at least 1")
+	}
+	if cli.MinInsert > cli.MaxInsert {
+		p.Fail("--min-insert must not be greater than --max-insert")
+	}
+	var genome *goleft.Genome
+	if cli.Fai != "" {
+		var err error
+		if genome, err = goleft.ReadGenome(cli.Fai); err != nil {
+			p.Fail(err.Error())
+		}
+	}
+	if cli.Processes < 1 {
+		cli.Processes = 1
+	}
+
+	h, err := bamio.Header(cli.Bam)
+	pcheck(err)
+	var idx *bamio.Index
+	if !bamio.IsCRAM(cli.Bam) {
+		idx, err = bamio.ReadIndex(cli.Bam)
+		pcheck(err)
+	}
+	jobs := splitJobs(h, cli.Chrom, genome, cli.WindowSize)
+	if len(jobs) == 0 {
+		log.Fatalf("fragdepth: no chromosomes to report in %s", cli.Bam)
+	}
+	o := options{minMapQ: cli.MinMapQ, minInsert: cli.MinInsert, maxInsert: cli.MaxInsert}
+
+	fh, err := tabix.Create(cli.Prefix+".fragdepth.bed.gz", 1)
+	pcheck(err)
+	w := bufio.NewWriter(fh)
+
+	type result struct {
+		i       int
+		runs    []run
+		windows bytes.Buffer
+		counts  counts
+	}
+	jobc := make(chan int)
+	results := make(chan *result, cli.Processes)
+	var wg sync.WaitGroup
+	wg.Add(cli.Processes)
+	for k := 0; k < cli.Processes; k++ {
+		go func() {
+			defer wg.Done()
+			for i := range jobc {
+				j := jobs[i]
+				rdr, ref, done, err := openJob(cli.Bam, cli.Reference, idx, j, o.maxInsert, goleft.BgzfWorkers(cli.Processes))
+				pcheck(err)
+				depth, c, err := fragDepth(rdr, ref, j.start, j.end, o)
+				done()
+				pcheck(err)
+				r := &result{i: i, counts: c}
+				if cli.WindowSize > 0 {
+					writeWindows(&r.windows, j.ref.Name(), depth, j.start, cli.WindowSize)
+				} else {
+					r.runs = depthRuns(depth, j.start)
+				}
+				results <- r
+			}
+		}()
+	}
+	go func() {
+		for i := range jobs {
+			jobc <- i
+		}
+		close(jobc)
+		wg.Wait()
+		close(results)
+	}()
+
+	// write in the order of the chromosomes in the header. runs are held so that those meeting
+	// where a chromosome was split are joined.
+	pending := make(map[int]*result)
+	var total counts
+	var last run
+	var lastChrom string
+	addRun := func() {
+		if last.depth != 0 {
+			_, err := fmt.Fprintf(w, "%s\t%d\t%d\t%d\n", lastChrom, last.start, last.end, last.depth)
+			pcheck(err)
+		}
+	}
+	next := 0
+	for r := range results {
+		pending[r.i] = r
+		for p, ok := pending[next]; ok; p, ok = pending[next] {
+			chrom := jobs[p.i].ref.Name()
+			_, err := io.Copy(w, &p.windows)
+			pcheck(err)
+			for _, rn := range p.runs {
+				if last.end == rn.start && last.depth == rn.depth && lastChrom == chrom {
+					last.end = rn.end
+					continue
+				}
+				addRun()
+				last, lastChrom = rn, chrom
+			}
+			total.add(p.counts)
+			delete(pending, next)
+			next++
+		}
+	}
+	addRun()
+	pcheck(w.Flush())
+	pcheck(fh.Close())
+
+	goleft.Infof("counted %d fragments. skipped %d shorter than --min-insert and %d longer than --max-insert", total.fragments, total.short, total.long)
+	if total.fragments == 0 {
+		goleft.Warnf("fragdepth: no properly-paired fragments in %s. fragdepth needs paired-end reads", cli.Bam)
+	}
+}
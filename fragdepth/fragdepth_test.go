@@ -0,0 +1,154 @@
+package fragdepth
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/biogo/hts/sam"
+	"github.com/brentp/goleft/bamio"
+)
+
+type sliceReader []*sam.Record
+
+func (s *sliceReader) Read() (*sam.Record, error) {
+	if len(*s) == 0 {
+		return nil, io.EOF
+	}
+	r := (*s)[0]
+	*s = (*s)[1:]
+	return r, nil
+}
+
+func TestFragDepth(t *testing.T) {
+	ref, err := sam.NewReference("chr1", "", "", 1000, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sam.NewHeader(nil, []*sam.Reference{ref}); err != nil {
+		t.Fatal(err)
+	}
+	cigar := []sam.CigarOp{sam.NewCigarOp(sam.CigarMatch, 20)}
+	seq := bytes.Repeat([]byte{'A'}, 20)
+	// pair adds mates at pos and pos + tlen - 20 with flags.
+	var rdr sliceReader
+	pair := func(pos, tlen int, flags sam.Flags) {
+		a, err := sam.NewRecord("r", ref, ref, pos, pos+tlen-20, tlen, 60, cigar, seq, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := sam.NewRecord("r", ref, ref, pos+tlen-20, pos, -tlen, 60, cigar, seq, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		a.Flags, b.Flags = flags|sam.Read1, flags|sam.Read2|sam.Reverse
+		rdr = append(rdr, a, b)
+	}
+	proper := sam.Paired | sam.ProperPair
+	pair(100, 100, proper)
+	pair(150, 30, proper)
+	// not proper, a duplicate and too long.
+	pair(120, 100, sam.Paired)
+	pair(130, 100, proper|sam.Duplicate)
+	pair(140, 600, proper)
+	// starts before the region and reaches into it.
+	pair(50, 80, proper)
+	sort.SliceStable(rdr, func(i, j int) bool { return rdr[i].Pos < rdr[j].Pos })
+
+	d, c, err := fragDepth(&rdr, ref, 100, 300, options{minMapQ: 1, minInsert: 50, maxInsert: 500})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := (counts{fragments: 1, short: 1, long: 1}); c != exp {
+		t.Errorf("expected counts %+v, got: %+v", exp, c)
+	}
+	// the fragment at 150 is too short so the insert between the mates at 100 is counted once.
+	for i, exp := range map[int]int32{100: 2, 129: 2, 130: 1, 160: 1, 199: 1, 200: 0} {
+		if d[i-100] != exp {
+			t.Errorf("expected depth %d at %d, got: %d", exp, i, d[i-100])
+		}
+	}
+	if len(d) != 200 {
+		t.Errorf("expected 200 bases, got: %d", len(d))
+	}
+}
+
+func TestFragmentMateMapQ(t *testing.T) {
+	ref, err := sam.NewReference("chr1", "", "", 1000, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sam.NewHeader(nil, []*sam.Reference{ref}); err != nil {
+		t.Fatal(err)
+	}
+	mq, err := sam.NewAux(mqTag, uint8(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec, err := sam.NewRecord("r", ref, ref, 10, 100, 110, 60, []sam.CigarOp{sam.NewCigarOp(sam.CigarMatch, 10)}, bytes.Repeat([]byte{'A'}, 10), nil, []sam.Aux{mq})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec.Flags = sam.Paired | sam.ProperPair | sam.Read1
+	if s, e, ok := fragment(rec, 0); !ok || s != 10 || e != 120 {
+		t.Errorf("expected fragment 10-120, got: %d-%d %v", s, e, ok)
+	}
+	if _, _, ok := fragment(rec, 1); ok {
+		t.Errorf("expected fragment with a mate of mapping quality 0 to be skipped")
+	}
+}
+
+func TestDepthRuns(t *testing.T) {
+	runs := depthRuns([]int32{0, 1, 1, 2, 0, 0, 2}, 10)
+	if exp := []run{{11, 13, 1}, {13, 14, 2}, {16, 17, 2}}; !reflect.DeepEqual(runs, exp) {
+		t.Errorf("expected %v, got: %v", exp, runs)
+	}
+}
+
+// TestSplit checks that the depth of a chromosome split into jobs is the same as without splitting.
+func TestSplit(t *testing.T) {
+	path := "../depth/test/t.bam"
+	h, err := bamio.Header(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx, err := bamio.ReadIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := options{minMapQ: 1, maxInsert: 1000}
+	depth := func(jobs []job) ([]int32, counts) {
+		var all []int32
+		var tot counts
+		for _, j := range jobs {
+			rdr, ref, done, err := openJob(path, "", idx, j, o.maxInsert, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			d, c, err := fragDepth(rdr, ref, j.start, j.end, o)
+			done()
+			if err != nil {
+				t.Fatal(err)
+			}
+			all = append(all, d...)
+			tot.add(c)
+		}
+		return all, tot
+	}
+	whole, wc := depth(splitJobs(h, "chrM", nil, 0))
+	defer func(s int) { step = s }(step)
+	step = 1000
+	jobs := splitJobs(h, "chrM", nil, 100)
+	if len(jobs) < 10 {
+		t.Fatalf("expected chrM to be split, got %d jobs", len(jobs))
+	}
+	split, sc := depth(jobs)
+	if wc.fragments == 0 || wc != sc {
+		t.Errorf("expected the same counts, got: %+v and %+v", wc, sc)
+	}
+	if !reflect.DeepEqual(whole, split) {
+		t.Errorf("expected the same depth with split jobs")
+	}
+}
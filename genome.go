@@ -0,0 +1,73 @@
+package goleft
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/brentp/xopen"
+)
+
+// Contig is a sequence in a Genome.
+type Contig struct {
+	Name string
+	Len  int
+}
+
+// Genome is the contigs given with --fai. Programs that accept --fai only report these contigs so
+// that their output lines up and unplaced contigs are dropped the same way by each.
+type Genome struct {
+	// Contigs are in the order of the file.
+	Contigs []Contig
+	lengths map[string]int
+}
+
+// ReadGenome reads the name and length of each contig from the first 2 columns of a .fai or a
+// genome file as used by bedtools.
+func ReadGenome(path string) (*Genome, error) {
+	rdr, err := xopen.Ropen(path)
+	if err != nil {
+		return nil, err
+	}
+	defer rdr.Close()
+	g := &Genome{lengths: make(map[string]int)}
+	for n := 1; ; n++ {
+		line, err := rdr.ReadString('\n')
+		if line = strings.TrimRight(line, "\r\n"); len(strings.TrimSpace(line)) > 0 && line[0] != '#' {
+			toks := strings.SplitN(line, "\t", 3)
+			if len(toks) < 2 {
+				return nil, &ParseError{Path: path, Line: n, Err: fmt.Errorf("goleft: expected name and length in line: %q", line)}
+			}
+			l, e := strconv.Atoi(strings.TrimSpace(toks[1]))
+			if e != nil {
+				return nil, &ParseError{Path: path, Line: n, Err: fmt.Errorf("goleft: bad length in line: %q", line)}
+			}
+			g.Contigs = append(g.Contigs, Contig{Name: toks[0], Len: l})
+			g.lengths[toks[0]] = l
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return g, nil
+}
+
+// Has returns true if the contig is in the genome. Every contig is in a nil Genome so that
+// programs can call it without checking whether --fai was given.
+func (g *Genome) Has(name string) bool {
+	if g == nil {
+		return true
+	}
+	_, ok := g.lengths[name]
+	return ok
+}
+
+// Len returns the length of the contig and false if it is not in the genome.
+func (g *Genome) Len(name string) (int, bool) {
+	l, ok := g.lengths[name]
+	return l, ok
+}
@@ -1,3 +1,130 @@
 package goleft
 
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"time"
+)
+
 const Version = "0.1.12"
+
+// Verbosity is set by the goleft --verbosity flag. At 0, only warnings and errors are logged; at 1
+// (the default), progress is also logged and 2 adds the source file and line of each message.
+var Verbosity = 1
+
+// Threads is set by the goleft --threads flag. It is the number of goroutines that programs use
+// together to decompress bgzf and to process regions or files in parallel. At 0 (the default), it is
+// the number of CPUs.
+var Threads = 0
+
+// NumThreads returns Threads or, if it is not set, the number of CPUs.
+func NumThreads() int {
+	if Threads > 0 {
+		return Threads
+	}
+	return runtime.NumCPU()
+}
+
+// BgzfWorkers returns the number of goroutines to decompress each of n bams or regions that are read
+// at once so that, together, they use NumThreads. It is at least 1.
+func BgzfWorkers(n int) int {
+	if n < 1 {
+		n = 1
+	}
+	if w := NumThreads() / n; w > 1 {
+		return w
+	}
+	return 1
+}
+
+// Program is the name of the running program. It is added to each message with --log-format json.
+var Program = "goleft"
+
+// jsonLog is set by SetLogFormat and mu serializes the messages written to it.
+var (
+	jsonLog io.Writer
+	mu      sync.Mutex
+	start   = time.Now()
+)
+
+// logRecord is a single message with --log-format json.
+type logRecord struct {
+	Time    string  `json:"time"`
+	Level   string  `json:"level"`
+	Program string  `json:"program"`
+	Elapsed float64 `json:"elapsed_seconds"`
+	Msg     string  `json:"msg"`
+	Source  string  `json:"source,omitempty"`
+}
+
+// SetLogFormat sets the format of log messages to "text" (the default) or "json" where each message
+// is a line with the time, level, program, seconds since the start and the message so that logs from
+// all programs can be parsed the same way. With json, messages from the log package (log.Fatal) are
+// errors.
+func SetLogFormat(format string) error {
+	switch format {
+	case "text":
+		jsonLog = nil
+	case "json":
+		jsonLog = os.Stderr
+		log.SetFlags(0)
+		log.SetOutput(stdWriter{})
+	default:
+		return fmt.Errorf("goleft: --log-format must be text or json; got: %s", format)
+	}
+	return nil
+}
+
+// stdWriter writes the messages from the log package as errors.
+type stdWriter struct{}
+
+func (stdWriter) Write(p []byte) (int, error) {
+	msg := string(p)
+	if n := len(msg); n > 0 && msg[n-1] == '\n' {
+		msg = msg[:n-1]
+	}
+	writeJSON("error", msg, "")
+	return len(p), nil
+}
+
+func writeJSON(level, msg, source string) {
+	now := time.Now()
+	b, _ := json.Marshal(logRecord{Time: now.Format(time.RFC3339Nano), Level: level, Program: Program,
+		Elapsed: now.Sub(start).Seconds(), Msg: msg, Source: source})
+	mu.Lock()
+	jsonLog.Write(append(b, '\n'))
+	mu.Unlock()
+}
+
+func output(level, msg string) {
+	if jsonLog == nil {
+		// 3 is the caller of Infof or Warnf.
+		log.Output(3, msg)
+		return
+	}
+	source := ""
+	if Verbosity > 1 {
+		if _, file, line, ok := runtime.Caller(2); ok {
+			source = fmt.Sprintf("%s:%d", filepath.Base(file), line)
+		}
+	}
+	writeJSON(level, msg, source)
+}
+
+// Infof logs progress messages that are not shown with --verbosity 0.
+func Infof(format string, v ...interface{}) {
+	if Verbosity > 0 {
+		output("info", fmt.Sprintf(format, v...))
+	}
+}
+
+// Warnf logs problems with the input or output that do not stop the program. These are always shown.
+func Warnf(format string, v ...interface{}) {
+	output("warning", fmt.Sprintf(format, v...))
+}
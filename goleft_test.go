@@ -0,0 +1,80 @@
+package goleft
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestJSONLog(t *testing.T) {
+	if err := SetLogFormat("xml"); err == nil {
+		t.Errorf("expected an error for an unknown format")
+	}
+	if err := SetLogFormat("json"); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		SetLogFormat("text")
+		log.SetFlags(log.LstdFlags)
+		log.SetOutput(os.Stderr)
+	}()
+	var buf bytes.Buffer
+	jsonLog = &buf
+	Program, Verbosity = "depth", 2
+	defer func() { Program, Verbosity = "goleft", 1 }()
+
+	Infof("depth: %d chunks", 3)
+	Warnf("depth: odd")
+	log.Print("depth: from the log package")
+	dec := json.NewDecoder(&buf)
+	for _, exp := range []logRecord{{Level: "info", Msg: "depth: 3 chunks"}, {Level: "warning", Msg: "depth: odd"},
+		{Level: "error", Msg: "depth: from the log package"}} {
+		var r logRecord
+		if err := dec.Decode(&r); err != nil {
+			t.Fatal(err)
+		}
+		if r.Level != exp.Level || r.Msg != exp.Msg || r.Program != "depth" || r.Time == "" {
+			t.Errorf("expected %+v, got: %+v", exp, r)
+		}
+		if (r.Source != "") != (exp.Level != "error") {
+			t.Errorf("expected a source only for Infof and Warnf, got: %q", r.Source)
+		}
+	}
+}
+
+func TestBgzfWorkers(t *testing.T) {
+	defer func(n int) { Threads = n }(Threads)
+	Threads = 8
+	for n, exp := range map[int]int{0: 8, 1: 8, 3: 2, 8: 1, 16: 1} {
+		if got := BgzfWorkers(n); got != exp {
+			t.Errorf("expected %d workers for %d files, got: %d", exp, n, got)
+		}
+	}
+	Threads = 0
+	if NumThreads() < 1 {
+		t.Errorf("expected the number of CPUs without --threads")
+	}
+}
+
+func TestMultiQC(t *testing.T) {
+	m := MultiQC{ID: "x", Section: "X", Headers: []MultiQCHeader{{Key: "z", Title: "Z", Max: 1}, {Key: "a", Title: "A"}},
+		Data: map[string]map[string]interface{}{"s1": {"z": 0.5, "a": "hg19"}}}
+	b, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the headers are in order rather than sorted by key as for a map.
+	if s := string(b); !strings.Contains(s, `"headers":{"z":{"title":"Z","max":1},"a":{"title":"A"}}`) {
+		t.Errorf("unexpected headers in %s", s)
+	}
+	var v map[string]interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		t.Fatal(err)
+	}
+	if v["plot_type"] != "table" || v["data"].(map[string]interface{})["s1"].(map[string]interface{})["a"] != "hg19" {
+		t.Errorf("unexpected custom content: %v", v)
+	}
+}
@@ -15,7 +15,7 @@ import (
 
 func main() {
 	if len(os.Args) < 3 {
-		fmt.Println("\nUsage: anonymize-for-indexcov name *.bam.\n\nThis will create files like sample_0001.bam through sample_$name_$n.bam with read-groups and file names changed as well.\n")
+		fmt.Print("\nUsage: anonymize-for-indexcov name *.bam.\n\nThis will create files like sample_0001.bam through sample_$name_$n.bam with read-groups and file names changed as well.\n")
 		os.Exit(1)
 	}
 	if xopen.Exists(os.Args[1]) {
@@ -24,13 +24,13 @@ func main() {
 	for i := 2; i < len(os.Args); i++ {
 		f, err := os.Open(os.Args[i])
 		if err != nil {
-			panic(err)
+			log.Fatal(err)
 		}
 		name := fmt.Sprintf("sample_%s_%04d", os.Args[1], i-1)
 
 		br, err := bam.NewReader(f, 1)
 		if err != nil {
-			panic(err)
+			log.Fatal(err)
 		}
 		defer f.Close()
 		defer br.Close()
@@ -38,32 +38,32 @@ func main() {
 		rgs := br.Header().RGs()
 		hdr, err := sam.NewHeader(nil, br.Header().Refs())
 		if err != nil {
-			panic(err)
+			log.Fatal(err)
 		}
 		if len(rgs) == 0 {
 			fmt.Fprintf(os.Stderr, "no readgroups in %s\n", os.Args[i])
 		}
 		rg, err := sam.NewReadGroup(name, "", strconv.Itoa(i-1), "XX", "indexcov-anon", "illumina", "", name, "", "", time.Now(), 1000)
 		if err != nil {
-			panic(err)
+			log.Fatal(err)
 		}
 		if err := hdr.AddReadGroup(rg); err != nil {
-			panic(err)
+			log.Fatal(err)
 		}
 
 		fo, err := os.Create(fmt.Sprintf("%s.bam", name))
 		if err != nil {
-			panic(err)
+			log.Fatal(err)
 		}
 		defer fo.Close()
 
 		o, err := bam.NewWriter(fo, hdr, 1)
 		if err != nil {
-			panic(err)
+			log.Fatal(err)
 		}
 
 		if err := o.Close(); err != nil {
-			panic(err)
+			log.Fatal(err)
 		}
 		bai := ""
 		if _, err := os.Stat(f.Name() + ".bai"); err == nil {
@@ -72,10 +72,10 @@ func main() {
 			bai = f.Name()[:len(f.Name())-4] + ".bai"
 		}
 		if bai == "" {
-			panic(fmt.Sprintf("unable to find bam index for %s", f.Name()))
+			log.Fatalf("unable to find bam index for %s", f.Name())
 		}
 		if err := exec.Command("cp", "-f", bai, fmt.Sprintf("%s.bam.bai", name)).Run(); err != nil {
-			panic(err)
+			log.Fatal(err)
 		}
 		fmt.Printf("wrote: %s.bam\n", name)
 	}
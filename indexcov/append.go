@@ -0,0 +1,101 @@
+package indexcov
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/biogo/hts/sam"
+	"github.com/brentp/goleft"
+	"github.com/brentp/xopen"
+)
+
+// appendScale is used to store the scaled coverage from a previous run as integers in Index.refs.
+const appendScale = 1000000
+
+// readExisting reads the scaled coverage of each sample from the bed.gz of a previous run so that
+// --append can add samples without reading the indexes of the existing samples again. It returns an
+// Index for each sample that gives the same values from NormalizedDepth.
+func readExisting(path string, h *sam.Header) ([]*Index, []string, error) {
+	rdr, err := xopen.Ropen(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rdr.Close()
+
+	refIDs := make(map[string]int, len(h.Refs()))
+	for _, ref := range h.Refs() {
+		refIDs[ref.Name()] = ref.ID()
+	}
+
+	var names []string
+	// depths[sample][refID][tile]
+	var depths [][][]float32
+	for n := 1; ; n++ {
+		line, err := rdr.ReadString('\n')
+		if len(line) > 0 {
+			toks := strings.Split(strings.TrimRight(line, "\r\n"), "\t")
+			if names == nil {
+				if !strings.HasPrefix(line, "#chrom") || len(toks) < 4 {
+					return nil, nil, fmt.Errorf("indexcov: expected header in %s", path)
+				}
+				names = toks[3:]
+				depths = make([][][]float32, len(names))
+				for k := range depths {
+					depths[k] = make([][]float32, len(h.Refs()))
+				}
+			} else {
+				if len(toks) != len(names)+3 {
+					return nil, nil, &goleft.ParseError{Path: path, Line: n, Err: fmt.Errorf("indexcov: expected %d fields, got: %q", len(names)+3, line)}
+				}
+				id, ok := refIDs[toks[0]]
+				if !ok {
+					return nil, nil, &goleft.ParseError{Path: path, Line: n, Err: fmt.Errorf("indexcov: chromosome %s not found in header", toks[0])}
+				}
+				start, err := strconv.Atoi(toks[1])
+				if err != nil {
+					return nil, nil, &goleft.ParseError{Path: path, Line: n, Err: err}
+				}
+				tile := start / TileWidth
+				for k, v := range toks[3:] {
+					d, err := strconv.ParseFloat(v, 32)
+					if err != nil {
+						return nil, nil, &goleft.ParseError{Path: path, Line: n, Err: err}
+					}
+					for len(depths[k][id]) <= tile {
+						depths[k][id] = append(depths[k][id], 0)
+					}
+					depths[k][id][tile] = float32(d)
+				}
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if names == nil {
+		return nil, nil, fmt.Errorf("indexcov: no samples found in %s", path)
+	}
+
+	idxs := make([]*Index, len(names))
+	for k, sdepths := range depths {
+		refs := make([][]int64, len(sdepths))
+		for id, d := range sdepths {
+			if len(d) == 0 {
+				continue
+			}
+			refs[id] = make([]int64, len(d)+1)
+			var cum int64
+			for i, v := range d {
+				cum += int64(v*appendScale + 0.5)
+				refs[id][i+1] = cum
+			}
+		}
+		idxs[k] = &Index{refs: refs, path: path, medianSizePerTile: appendScale}
+	}
+	return idxs, names, nil
+}
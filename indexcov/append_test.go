@@ -0,0 +1,94 @@
+package indexcov
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/biogo/hts/sam"
+)
+
+// writeBed writes the scaled coverage of a run of indexcov with each of the samples at depth
+// across chromosome 1 and at 1 and 0 copies of X and Y.
+func writeBed(t *testing.T, path string, depth float32, names ...string) {
+	fh, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+	gz := gzip.NewWriter(fh)
+	fmt.Fprintf(gz, "#chrom\tstart\tend\t%s\n", strings.Join(names, "\t"))
+	for _, c := range []struct {
+		chrom string
+		depth float32
+	}{{"1", depth}, {"X", 0.5}, {"Y", 0}} {
+		for i := 0; i < 5; i++ {
+			vals := make([]string, len(names))
+			for k := range vals {
+				vals[k] = fmt.Sprintf("%.2f", c.depth)
+			}
+			fmt.Fprintf(gz, "%s\t%d\t%d\t%s\n", c.chrom, i*TileWidth, (i+1)*TileWidth, strings.Join(vals, "\t"))
+		}
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAppendCohortNorm(t *testing.T) {
+	var refs []*sam.Reference
+	for _, name := range []string{"1", "X", "Y"} {
+		ref, err := sam.NewReference(name, "", "", 5*TileWidth, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		refs = append(refs, ref)
+	}
+	h, err := sam.NewHeader(nil, refs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	regions, err := getRegions(h, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmp, err := ioutil.TempDir("", "goleft-indexcov")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	writeBed(t, filepath.Join(tmp, "old.bed.gz"), 2, "a", "b")
+	writeBed(t, filepath.Join(tmp, "new.bed.gz"), 2, "c")
+	idxs, names, err := readExisting(filepath.Join(tmp, "old.bed.gz"), h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nidxs, nnames, err := readExisting(filepath.Join(tmp, "new.bed.gz"), h)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cli.sex, cli.CohortNorm = []string{"X", "Y"}, true
+	defer func() { cli.sex, cli.CohortNorm = nil, false }()
+	// the appended sample is the only one from the bams but with the existing ones there are enough
+	// to normalize by the cohort so each sample has the median depth.
+	_, offs, _, _, _ := run(regions, refs[1:], append(idxs, nidxs...), append(names, nnames...), filepath.Join(tmp, "append"))
+	for k, o := range offs {
+		if o.in != 5 || o.hi != 0 {
+			t.Errorf("expected the bins of sample %d to be normalized to 1, got: %+v", k, o)
+		}
+	}
+
+	// the existing samples alone are too few so their depth is left as is.
+	_, offs, _, _, _ = run(regions, refs[1:], idxs, names, filepath.Join(tmp, "old"))
+	for k, o := range offs {
+		if o.in != 0 || o.hi != 5 {
+			t.Errorf("expected the bins of sample %d to not be normalized, got: %+v", k, o)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package indexcov
+
+import (
+	"strings"
+
+	"github.com/biogo/hts/sam"
+)
+
+// normChrom returns the chromosome name without a chr prefix and with M for MT so that the names
+// from bams aligned to references that use "chr1" and "1" match.
+func normChrom(name string) string {
+	name = strings.TrimPrefix(name, "chr")
+	if name == "MT" {
+		return "M"
+	}
+	return name
+}
+
+// excluded returns true if the chromosome is an alt, decoy or HLA contig that is left out of the
+// normalization and plots with --exclude-alts, --exclude-decoys or --exclude-hla or if it is not
+// in --fai.
+func excluded(name string) bool {
+	if !cli.genome.Has(name) {
+		return true
+	}
+	if cli.ExcludeAlts && strings.HasSuffix(name, "_alt") {
+		return true
+	}
+	if cli.ExcludeDecoys && (strings.HasSuffix(name, "_decoy") || name == "hs37d5" || normChrom(name) == "EBV") {
+		return true
+	}
+	return cli.ExcludeHLA && strings.HasPrefix(name, "HLA-")
+}
+
+// matchRefs returns the ID in refs of each reference in want, matched by normChrom, or -1 for
+// those that are not in refs. It returns nil if the names and order are the same in both.
+func matchRefs(want, refs []*sam.Reference) []int {
+	same := len(want) == len(refs)
+	for i := 0; same && i < len(want); i++ {
+		same = want[i].Name() == refs[i].Name()
+	}
+	if same {
+		return nil
+	}
+	byName := make(map[string]int, len(refs))
+	for _, ref := range refs {
+		byName[normChrom(ref.Name())] = ref.ID()
+	}
+	ids := make([]int, len(want))
+	for i, ref := range want {
+		id, ok := byName[normChrom(ref.Name())]
+		if !ok {
+			id = -1
+		}
+		ids[i] = id
+	}
+	return ids
+}
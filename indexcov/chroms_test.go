@@ -0,0 +1,47 @@
+package indexcov
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/biogo/hts/sam"
+)
+
+func TestMatchRefs(t *testing.T) {
+	refs := func(names ...string) []*sam.Reference {
+		var rs []*sam.Reference
+		for _, n := range names {
+			r, err := sam.NewReference(n, "", "", 1000, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rs = append(rs, r)
+		}
+		if _, err := sam.NewHeader(nil, rs); err != nil {
+			t.Fatal(err)
+		}
+		return rs
+	}
+	first := refs("chr1", "chr2", "chrX", "chrM", "chr1_KI270706v1_random")
+	if ids := matchRefs(first, refs("chr1", "chr2", "chrX", "chrM", "chr1_KI270706v1_random")); ids != nil {
+		t.Errorf("expected nil for the same references, got: %v", ids)
+	}
+	ids := matchRefs(first, refs("1", "X", "2", "MT", "GL000191.1"))
+	if exp := []int{0, 2, 1, 3, -1}; !reflect.DeepEqual(ids, exp) {
+		t.Errorf("expected %v, got: %v", exp, ids)
+	}
+}
+
+func TestExcluded(t *testing.T) {
+	defer func() { cli.ExcludeAlts, cli.ExcludeDecoys, cli.ExcludeHLA = false, false, false }()
+	names := []string{"chr1", "chr6_GL000250v2_alt", "chrUn_JTFH01000001v1_decoy", "hs37d5", "chrEBV", "HLA-A*01:01:01:01"}
+	if excluded(names[1]) {
+		t.Errorf("expected no exclusions without flags")
+	}
+	cli.ExcludeAlts, cli.ExcludeDecoys, cli.ExcludeHLA = true, true, true
+	for i, n := range names {
+		if exp := i > 0; excluded(n) != exp {
+			t.Errorf("expected excluded(%s) to be %v", n, exp)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package indexcov
+
+import (
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/JaderDias/movingmedian"
+)
+
+const (
+	// cnvWindow is the number of bins in the moving median used to smooth the depth.
+	cnvWindow = 7
+	// cnvMinBins is the minimum number of 16KB bins for a candidate (7 bins is ~115KB).
+	cnvMinBins = 7
+	// smoothed scaled coverage below cnvDel is a candidate deletion and above cnvDup is a
+	// candidate duplication. a single copy change in a diploid gives 0.5 or 1.5.
+	cnvDel = float32(0.7)
+	cnvDup = float32(1.3)
+)
+
+// cnv is a candidate deletion or duplication in a single sample.
+type cnv struct {
+	start, end int // in bins
+	sample     int
+	dup        bool
+	mean       float32
+}
+
+// smooth returns the centered moving median of vals.
+func smooth(vals []float32, window int) []float32 {
+	out := make([]float32, len(vals))
+	if len(vals) == 0 {
+		return out
+	}
+	mid := window / 2
+	mm := movingmedian.NewMovingMedian(window)
+	for i := 0; i < mid && i < len(vals); i++ {
+		mm.Push(float64(vals[i]))
+	}
+	for i := range vals {
+		if i+mid < len(vals) {
+			mm.Push(float64(vals[i+mid]))
+		}
+		out[i] = float32(mm.Median())
+	}
+	return out
+}
+
+// callCNVs finds runs of at least cnvMinBins bins where the smoothed depth of a sample is
+// outside of (cnvDel, cnvDup). Bins where every sample has a depth of 0 are gaps in the
+// reference (e.g. the centromere) and they end any run.
+func callCNVs(depths [][]float32) []cnv {
+	longest := 0
+	for _, d := range depths {
+		if len(d) > longest {
+			longest = len(d)
+		}
+	}
+	gap := make([]bool, longest)
+	for i := range gap {
+		gap[i] = true
+		for _, d := range depths {
+			if i < len(d) && d[i] != 0 {
+				gap[i] = false
+				break
+			}
+		}
+	}
+
+	var calls []cnv
+	for s, d := range depths {
+		sm := smooth(d, cnvWindow)
+		// state is -1 for a deletion, 1 for a duplication and 0 otherwise.
+		state, start := 0, 0
+		end := func(i int) {
+			if state != 0 && i-start >= cnvMinBins {
+				var sum float32
+				for _, v := range d[start:i] {
+					sum += v
+				}
+				calls = append(calls, cnv{start: start, end: i, sample: s, dup: state == 1, mean: sum / float32(i-start)})
+			}
+		}
+		for i, v := range sm {
+			st := 0
+			if !gap[i] {
+				if v < cnvDel {
+					st = -1
+				} else if v > cnvDup {
+					st = 1
+				}
+			}
+			if st != state {
+				end(i)
+				state, start = st, i
+			}
+		}
+		end(len(sm))
+	}
+	sort.Slice(calls, func(i, j int) bool {
+		if calls[i].start != calls[j].start {
+			return calls[i].start < calls[j].start
+		}
+		return calls[i].sample < calls[j].sample
+	})
+	return calls
+}
+
+// writeCNVs writes the candidate CNVs for a region that starts at offset.
+func writeCNVs(w io.Writer, chrom string, offset int, depths [][]float32, names []string) {
+	for _, c := range callCNVs(depths) {
+		typ := "DEL"
+		if c.dup {
+			typ = "DUP"
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%s\t%d\t%.2f\n", chrom, offset+c.start*TileWidth, offset+c.end*TileWidth,
+			names[c.sample], typ, c.end-c.start, c.mean)
+	}
+}
@@ -0,0 +1,50 @@
+package indexcov
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCallCNVs(t *testing.T) {
+	n := 60
+	depths := make([][]float32, 2)
+	for s := range depths {
+		depths[s] = make([]float32, n)
+		for i := range depths[s] {
+			depths[s][i] = 1
+		}
+	}
+	// a deletion of 10 bins in sample 0 with a single noisy bin.
+	for i := 10; i < 20; i++ {
+		depths[0][i] = 0.5
+	}
+	depths[0][14] = 1.1
+	// a duplication too short to report in sample 0.
+	for i := 30; i < 33; i++ {
+		depths[0][i] = 1.5
+	}
+	// a duplication in sample 1 that is ended by a gap.
+	for i := 35; i < 50; i++ {
+		depths[1][i] = 1.5
+	}
+	for i := 45; i < 48; i++ {
+		depths[0][i], depths[1][i] = 0, 0
+	}
+
+	calls := callCNVs(depths)
+	if len(calls) != 2 {
+		t.Fatalf("expected 2 calls, got: %v", calls)
+	}
+	if c := calls[0]; c.sample != 0 || c.dup || c.start != 10 || c.end != 20 {
+		t.Errorf("unexpected deletion: %+v", c)
+	}
+	if c := calls[1]; c.sample != 1 || !c.dup || c.start != 35 || c.end != 45 || c.mean != 1.5 {
+		t.Errorf("unexpected duplication: %+v", c)
+	}
+
+	var buf bytes.Buffer
+	writeCNVs(&buf, "chr1", 16384, depths, []string{"a", "b"})
+	if exp := "chr1\t180224\t344064\ta\tDEL\t10\t0.56\n"; buf.String()[:len(exp)] != exp {
+		t.Errorf("expected %q, got: %q", exp, buf.String())
+	}
+}
@@ -0,0 +1,158 @@
+package indexcov
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/brentp/goleft/bamio"
+)
+
+// craiSlice is a line from a .crai: the span of a slice on a reference, the offset of its container
+// and its size in bytes.
+type craiSlice struct {
+	ref       int
+	start     int
+	span      int
+	container int64
+	size      int64
+}
+
+func parseCraiLine(line string) (craiSlice, error) {
+	toks := strings.Split(strings.TrimSpace(line), "\t")
+	if len(toks) != 6 {
+		return craiSlice{}, fmt.Errorf("indexcov: expected 6 fields in crai line: %q", line)
+	}
+	var vals [6]int64
+	for i, t := range toks {
+		v, err := strconv.ParseInt(t, 10, 64)
+		if err != nil {
+			return craiSlice{}, fmt.Errorf("indexcov: bad value in crai line: %q", line)
+		}
+		vals[i] = v
+	}
+	// the fields are: reference id, alignment start (1-based), alignment span, container offset,
+	// slice offset and slice size.
+	return craiSlice{ref: int(vals[0]), start: int(vals[1]) - 1, span: int(vals[2]), container: vals[3], size: vals[5]}, nil
+}
+
+// readCrai calls fn with each slice in the .crai at path.
+func readCrai(path string, fn func(craiSlice)) error {
+	fh, err := bamio.OpenIndex(path)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	rdr := bufio.NewReader(fh)
+	// a .crai is gzipped but allow plain text.
+	if magic, _ := rdr.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(rdr)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		rdr = bufio.NewReader(gz)
+	}
+	for {
+		line, err := rdr.ReadString('\n')
+		if len(strings.TrimSpace(line)) > 0 {
+			s, perr := parseCraiLine(line)
+			if perr != nil {
+				return perr
+			}
+			fn(s)
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// craiRefs reads the .crai at path and returns, for each of nRefs references, the cumulative
+// bytes at the start of each 16KB tile. This is the same form as the linear index of a .bai so
+// the difference between adjacent values is the size of the data in a tile. The size of each slice
+// is split among the tiles it overlaps in proportion to the overlap.
+func craiRefs(path string, nRefs int) ([][]int64, error) {
+	sizes := make([][]float64, nRefs)
+	err := readCrai(path, func(s craiSlice) {
+		// unmapped slices have a reference of -1 and they don't contribute to coverage.
+		if s.ref >= 0 && s.ref < nRefs && s.span > 0 {
+			addSlice(&sizes[s.ref], s)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	refs := make([][]int64, nRefs)
+	for i, tiles := range sizes {
+		if len(tiles) == 0 {
+			continue
+		}
+		refs[i] = make([]int64, len(tiles)+1)
+		var cum float64
+		for k, v := range tiles {
+			refs[i][k] = int64(cum + 0.5)
+			cum += v
+		}
+		refs[i][len(tiles)] = int64(cum + 0.5)
+	}
+	return refs, nil
+}
+
+// addSlice adds the bytes of the slice to each tile that it overlaps.
+func addSlice(tiles *[]float64, s craiSlice) {
+	end := s.start + s.span
+	last := (end - 1) / TileWidth
+	for len(*tiles) <= last {
+		*tiles = append(*tiles, 0)
+	}
+	perBase := float64(s.size) / float64(s.span)
+	for t := s.start / TileWidth; t <= last; t++ {
+		ts, te := t*TileWidth, (t+1)*TileWidth
+		if ts < s.start {
+			ts = s.start
+		}
+		if te > end {
+			te = end
+		}
+		(*tiles)[t] += perBase * float64(te-ts)
+	}
+}
+
+// ContainerStarts reads the .crai at path and returns, for each of nRefs references, the sorted
+// 0-based position of the first read of each container with reads on that reference. A region of a
+// cram that starts at one of these does not start in the middle of a container.
+func ContainerStarts(path string, nRefs int) ([][]int, error) {
+	// the start of each container on each reference by the offset of the container.
+	starts := make([]map[int64]int, nRefs)
+	err := readCrai(path, func(s craiSlice) {
+		if s.ref < 0 || s.ref >= nRefs || s.span <= 0 {
+			return
+		}
+		if starts[s.ref] == nil {
+			starts[s.ref] = make(map[int64]int)
+		}
+		if st, ok := starts[s.ref][s.container]; !ok || s.start < st {
+			starts[s.ref][s.container] = s.start
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	out := make([][]int, nRefs)
+	for i, m := range starts {
+		for _, st := range m {
+			out[i] = append(out[i], st)
+		}
+		sort.Ints(out[i])
+	}
+	return out, nil
+}
@@ -0,0 +1,53 @@
+package indexcov
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestCraiRefs(t *testing.T) {
+	f, err := ioutil.TempFile("", "goleft-crai")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	// a slice covering exactly the first 2 tiles of ref 0, a slice in the 3rd tile and an unmapped slice.
+	f.WriteString("0\t1\t32768\t100\t10\t2000\n0\t32769\t100\t3000\t10\t500\n-1\t0\t0\t5000\t10\t999\n")
+	f.Close()
+
+	refs, err := craiRefs(f.Name(), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := []int64{0, 1000, 2000, 2500}; !reflect.DeepEqual(refs[0], exp) {
+		t.Errorf("expected %v, got: %v", exp, refs[0])
+	}
+	if len(refs[1]) != 0 {
+		t.Errorf("expected no tiles for ref without slices, got: %v", refs[1])
+	}
+
+	if _, err := parseCraiLine("0\t1\t2"); err == nil {
+		t.Errorf("expected error for short line")
+	}
+}
+
+func TestContainerStarts(t *testing.T) {
+	f, err := ioutil.TempFile("", "goleft-crai")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	// 2 slices in the container at 100, a container at 3000 that spans refs 0 and 1 and an unmapped slice.
+	f.WriteString("0\t501\t1000\t100\t10\t2000\n0\t11\t100\t100\t2100\t500\n0\t2001\t100\t3000\t10\t500\n1\t21\t100\t3000\t600\t500\n-1\t0\t0\t5000\t10\t999\n")
+	f.Close()
+
+	starts, err := ContainerStarts(f.Name(), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := [][]int{{10, 2000}, {20}, nil}; !reflect.DeepEqual(starts, exp) {
+		t.Errorf("expected %v, got: %v", exp, starts)
+	}
+}
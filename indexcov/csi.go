@@ -0,0 +1,53 @@
+package indexcov
+
+import "github.com/brentp/goleft/bamio"
+
+// csiRefs reads the .csi at path and returns, for each reference, the virtual offsets at the start of
+// each 16KB tile in the same form as the linear index of a .bai along with the mapped reads of each
+// reference. A .csi has no linear index so the offsets are from the bins at the deepest level which,
+// unlike the fixed layout of a .bai, cover 2^min_shift bases. When that is not 16KB, the offsets are
+// interpolated between the starts of the bins.
+func csiRefs(path string) ([][]int64, []uint64, error) {
+	idx, err := bamio.ReadIndexFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	refs := make([][]int64, idx.NumRefs())
+	mapped := make([]uint64, len(refs))
+	for r := range refs {
+		leaves, shift, _ := idx.Leaves(r)
+		refs[r] = csiTiles(leaves, shift)
+		mapped[r], _ = idx.Mapped(r)
+	}
+	return refs, mapped, nil
+}
+
+// csiTiles returns the offsets at the start of each tile from those at the start of each bin of
+// 2^minShift bases. Bins without reads (-1) get the offset of the previous bin as in the linear
+// index of a .bai.
+func csiTiles(leaves []int64, minShift uint) []int64 {
+	for i := range leaves {
+		if leaves[i] < 0 {
+			if i > 0 {
+				leaves[i] = leaves[i-1]
+			} else {
+				leaves[i] = 0
+			}
+		}
+	}
+	w := 1 << minShift
+	if w == TileWidth {
+		return leaves
+	}
+	n := (len(leaves)*w + TileWidth - 1) / TileWidth
+	tiles := make([]int64, n)
+	for i := range tiles {
+		p := i * TileWidth
+		k := p / w
+		tiles[i] = leaves[k]
+		if k+1 < len(leaves) {
+			tiles[i] += int64(float64(leaves[k+1]-leaves[k]) * float64(p%w) / float64(w))
+		}
+	}
+	return tiles
+}
@@ -0,0 +1,66 @@
+package indexcov
+
+import (
+	"compress/gzip"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestCsiRefs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "t.bam.csi")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := gzip.NewWriter(f)
+	put := func(vs ...interface{}) {
+		for _, v := range vs {
+			binary.Write(w, binary.LittleEndian, v)
+		}
+	}
+	// the first bin of the deepest level and the pseudo-bin for a depth of 5.
+	leaf, pseudo := uint32(4681), uint32(37450)
+	w.Write([]byte("CSI\x01"))
+	// min_shift, depth, no aux and 2 references.
+	put(int32(14), int32(5), int32(0), int32(2))
+	// ref 0 has the root bin, which is not used, 2 leaf bins and the pseudo-bin with 42 mapped reads.
+	put(int32(4))
+	put(uint32(0), uint64(1<<16), int32(1), uint64(1<<16), uint64(900<<16))
+	put(leaf, uint64(100<<16), int32(1), uint64(100<<16), uint64(200<<16))
+	put(leaf+2, uint64(500<<16), int32(1), uint64(500<<16), uint64(900<<16))
+	put(pseudo, uint64(0), int32(2), uint64(100<<16), uint64(900<<16), uint64(42), uint64(3))
+	put(int32(0))
+	w.Close()
+	f.Close()
+
+	idx, err := ReadIndex(path, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := []int64{100 << 16, 100 << 16, 500 << 16}; !reflect.DeepEqual(idx.refs[0], exp) {
+		t.Errorf("expected %v, got: %v", exp, idx.refs[0])
+	}
+	if len(idx.refs[1]) != 0 {
+		t.Errorf("expected no tiles for ref without bins, got: %v", idx.refs[1])
+	}
+	if n, ok := idx.Mapped(0); !ok || n != 42 {
+		t.Errorf("expected 42 mapped reads, got: %d %v", n, ok)
+	}
+	if sizes := idx.TileSizes(0); !reflect.DeepEqual(sizes, []int64{0, 400}) {
+		t.Errorf("unexpected tile sizes: %v", sizes)
+	}
+}
+
+func TestCsiTiles(t *testing.T) {
+	// bins of 32KB are split between 2 tiles.
+	if got := csiTiles([]int64{0, 1000}, 15); !reflect.DeepEqual(got, []int64{0, 500, 1000, 1000}) {
+		t.Errorf("unexpected tiles from 32KB bins: %v", got)
+	}
+	// bins of 8KB are combined and an empty bin gets the previous offset.
+	if got := csiTiles([]int64{0, 10, -1, 30, 40}, 13); !reflect.DeepEqual(got, []int64{0, 10, 40}) {
+		t.Errorf("unexpected tiles from 8KB bins: %v", got)
+	}
+}
@@ -0,0 +1,230 @@
+package indexcov
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	arg "github.com/alexflint/go-arg"
+	"github.com/brentp/goleft"
+	"github.com/brentp/xopen"
+)
+
+var diffCli = &struct {
+	Threshold float64 `arg:"-t,help:a bin or chromosome has drifted if its normalized coverage changed by more than this."`
+	Bins      string  `arg:"help:optional path to write each bin that drifted in a sample."`
+	RunA      string  `arg:"positional,required,help:directory of the first indexcov run."`
+	RunB      string  `arg:"positional,required,help:directory of the second indexcov run."`
+}{Threshold: 0.2}
+
+// covRun is the normalized coverage of each sample in each bin from the bed.gz of an indexcov run.
+type covRun struct {
+	path    string
+	samples []string
+	chroms  []string
+	// bins[chrom][start] is the bin starting at start.
+	bins map[string]map[int]covBin
+	// starts of the bins of each chromosome in order.
+	starts map[string][]int
+}
+
+// covBin is the end and the coverage of each sample for a bin of a covRun.
+type covBin struct {
+	end  int
+	vals []float32
+}
+
+// findRun returns the bed.gz in the directory from an indexcov run.
+func findRun(dir string) (string, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*-indexcov.bed.gz"))
+	if err != nil {
+		return "", err
+	}
+	if len(paths) != 1 {
+		return "", fmt.Errorf("indexcov: expected a single *-indexcov.bed.gz in %s, found %d", dir, len(paths))
+	}
+	return paths[0], nil
+}
+
+func readRun(path string) (*covRun, error) {
+	rdr, err := xopen.Ropen(path)
+	if err != nil {
+		return nil, err
+	}
+	defer rdr.Close()
+	r := &covRun{path: path, bins: make(map[string]map[int]covBin), starts: make(map[string][]int)}
+	for n := 1; ; n++ {
+		line, err := rdr.ReadString('\n')
+		if len(strings.TrimSpace(line)) > 0 {
+			toks := strings.Split(strings.TrimRight(line, "\r\n"), "\t")
+			if r.samples == nil {
+				if !strings.HasPrefix(line, "#chrom") || len(toks) < 4 {
+					return nil, fmt.Errorf("indexcov: expected header in %s", path)
+				}
+				r.samples = toks[3:]
+			} else {
+				if len(toks) != len(r.samples)+3 {
+					return nil, &goleft.ParseError{Path: path, Line: n, Err: fmt.Errorf("indexcov: expected %d fields, got: %q", len(r.samples)+3, line)}
+				}
+				start, err := strconv.Atoi(toks[1])
+				if err != nil {
+					return nil, &goleft.ParseError{Path: path, Line: n, Err: err}
+				}
+				end, err := strconv.Atoi(toks[2])
+				if err != nil {
+					return nil, &goleft.ParseError{Path: path, Line: n, Err: err}
+				}
+				vals := make([]float32, len(r.samples))
+				for k, v := range toks[3:] {
+					d, err := strconv.ParseFloat(v, 32)
+					if err != nil {
+						return nil, &goleft.ParseError{Path: path, Line: n, Err: err}
+					}
+					vals[k] = float32(d)
+				}
+				chrom := toks[0]
+				if _, ok := r.bins[chrom]; !ok {
+					r.chroms = append(r.chroms, chrom)
+					r.bins[chrom] = make(map[int]covBin)
+				}
+				r.bins[chrom][start] = covBin{end: end, vals: vals}
+				r.starts[chrom] = append(r.starts[chrom], start)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if r.samples == nil {
+		return nil, fmt.Errorf("indexcov: no samples found in %s", path)
+	}
+	return r, nil
+}
+
+// chromDrift is the change in the coverage of a sample on a chromosome between 2 runs.
+type chromDrift struct {
+	sample, chrom string
+	bins          int
+	meanA, meanB  float64
+	// changed is the number of bins where the coverage changed by more than the threshold.
+	changed int
+}
+
+// binDrift is a bin where the coverage of a sample changed by more than the threshold.
+type binDrift struct {
+	sample, chrom string
+	start, end    int
+	a, b          float32
+}
+
+// drift compares the samples that are in both runs over the bins that are in both runs.
+func drift(a, b *covRun, threshold float64) ([]chromDrift, []binDrift) {
+	bIdx := make(map[string]int, len(b.samples))
+	for k, s := range b.samples {
+		bIdx[s] = k
+	}
+	var chroms []chromDrift
+	var bins []binDrift
+	for ka, s := range a.samples {
+		kb, ok := bIdx[s]
+		if !ok {
+			continue
+		}
+		for _, chrom := range a.chroms {
+			bb, ok := b.bins[chrom]
+			if !ok {
+				continue
+			}
+			c := chromDrift{sample: s, chrom: chrom}
+			for _, start := range a.starts[chrom] {
+				binB, ok := bb[start]
+				if !ok {
+					continue
+				}
+				binA := a.bins[chrom][start]
+				va, vb := binA.vals[ka], binB.vals[kb]
+				c.bins++
+				c.meanA += float64(va)
+				c.meanB += float64(vb)
+				if math.Abs(float64(vb-va)) > threshold {
+					c.changed++
+					bins = append(bins, binDrift{sample: s, chrom: chrom, start: start, end: binA.end, a: va, b: vb})
+				}
+			}
+			if c.bins == 0 {
+				continue
+			}
+			c.meanA /= float64(c.bins)
+			c.meanB /= float64(c.bins)
+			chroms = append(chroms, c)
+		}
+	}
+	return chroms, bins
+}
+
+// unmatched returns the samples in a that are not in b.
+func unmatched(a, b []string) []string {
+	in := make(map[string]bool, len(b))
+	for _, s := range b {
+		in[s] = true
+	}
+	var out []string
+	for _, s := range a {
+		if !in[s] {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// diffMain compares 2 runs of indexcov. It is run by Main for `goleft indexcov diff`.
+func diffMain() {
+	arg.MustParse(diffCli)
+	var runs [2]*covRun
+	for i, dir := range []string{diffCli.RunA, diffCli.RunB} {
+		path, err := findRun(dir)
+		pcheck(err)
+		runs[i], err = readRun(path)
+		pcheck(err)
+	}
+	a, b := runs[0], runs[1]
+	if s := unmatched(a.samples, b.samples); len(s) > 0 {
+		goleft.Warnf("indexcov: %d samples only in %s: %s", len(s), diffCli.RunA, strings.Join(s, ","))
+	}
+	if s := unmatched(b.samples, a.samples); len(s) > 0 {
+		goleft.Warnf("indexcov: %d samples only in %s: %s", len(s), diffCli.RunB, strings.Join(s, ","))
+	}
+	chroms, bins := drift(a, b, diffCli.Threshold)
+	if len(chroms) == 0 {
+		log.Fatalf("indexcov: no samples and chromosomes in common between %s and %s", diffCli.RunA, diffCli.RunB)
+	}
+
+	w := bufio.NewWriter(os.Stdout)
+	defer w.Flush()
+	fmt.Fprintln(w, "#sample\tchrom\tbins\tmean_a\tmean_b\tdiff\tchanged_bins\tdrifted")
+	for _, c := range chroms {
+		d := c.meanB - c.meanA
+		fmt.Fprintf(w, "%s\t%s\t%d\t%.3f\t%.3f\t%.3f\t%d\t%v\n", c.sample, c.chrom, c.bins, c.meanA, c.meanB, d,
+			c.changed, math.Abs(d) > diffCli.Threshold)
+	}
+
+	if diffCli.Bins == "" {
+		return
+	}
+	fh, err := xopen.Wopen(diffCli.Bins)
+	pcheck(err)
+	fmt.Fprintln(fh, "#chrom\tstart\tend\tsample\ta\tb\tdiff")
+	for _, d := range bins {
+		fmt.Fprintf(fh, "%s\t%d\t%d\t%s\t%.3f\t%.3f\t%.3f\n", d.chrom, d.start, d.end, d.sample, d.a, d.b, d.b-d.a)
+	}
+	pcheck(fh.Close())
+}
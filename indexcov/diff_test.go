@@ -0,0 +1,75 @@
+package indexcov
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/brentp/xopen"
+)
+
+func writeRun(t *testing.T, dir, text string) {
+	fh, err := xopen.Wopen(filepath.Join(dir, filepath.Base(dir)+"-indexcov.bed.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fh.WriteString(text)
+	if err := fh.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDrift(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "indexcov-diff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	da, db := filepath.Join(tmp, "a"), filepath.Join(tmp, "b")
+	os.Mkdir(da, 0755)
+	os.Mkdir(db, 0755)
+	writeRun(t, da, `#chrom	start	end	s1	s2	s3
+chr1	0	16384	1	1	1
+chr1	16384	32768	1	1	1
+chr2	0	16384	1	1	1
+`)
+	// s1 drops on chr1, s2 is unchanged and s4 is not in a.
+	writeRun(t, db, `#chrom	start	end	s2	s1	s4
+chr1	0	16384	1	0.5	1
+chr1	16384	20000	1.1	0.4	1
+chr2	0	16384	1	1	1
+`)
+	pa, err := findRun(da)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := readRun(pa)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pb, _ := findRun(db)
+	b, err := readRun(pb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chroms, bins := drift(a, b, 0.2)
+	if len(chroms) != 4 {
+		t.Fatalf("expected 2 samples on 2 chromosomes, got: %+v", chroms)
+	}
+	c := chroms[0]
+	if c.sample != "s1" || c.chrom != "chr1" || c.bins != 2 || c.changed != 2 || c.meanB-c.meanA > -0.5 {
+		t.Errorf("unexpected drift for s1: %+v", c)
+	}
+	for _, c := range chroms[1:] {
+		if c.changed != 0 {
+			t.Errorf("unexpected drift: %+v", c)
+		}
+	}
+	if len(bins) != 2 || bins[1].end != 32768 {
+		t.Errorf("unexpected bins: %+v", bins)
+	}
+	if s := unmatched(b.samples, a.samples); len(s) != 1 || s[0] != "s4" {
+		t.Errorf("expected s4 to be unmatched, got: %v", s)
+	}
+}
@@ -6,12 +6,12 @@ import (
 	"html/template"
 	"io"
 	"log"
+	"math"
 	"os"
 	"path/filepath"
 	"sort"
 	"strings"
 	"sync"
-	"time"
 
 	arg "github.com/alexflint/go-arg"
 	"github.com/biogo/hts/bam"
@@ -20,6 +20,8 @@ import (
 	chartjs "github.com/brentp/go-chartjs"
 	"github.com/brentp/go-chartjs/types"
 	"github.com/brentp/goleft"
+	"github.com/brentp/goleft/bamio"
+	"github.com/brentp/goleft/tabix"
 	"github.com/gonum/floats"
 	"github.com/gonum/matrix/mat64"
 	"github.com/gonum/stat"
@@ -29,14 +31,34 @@ import (
 var Ploidy = 2
 
 var cli = &struct {
-	Directory string   `arg:"-d,required,help:directory for output files"`
-	IncludeGL bool     `arg:"-e,help:plot GL chromosomes like: GL000201.1 which are not plotted by default"`
-	Sex       string   `arg:"-X,help:comma delimited names of the sex chromosome(s) used to infer sex; The first will be used to populate the sex column in a ped file."`
-	Chrom     string   `arg:"-c,help:optional chromosome to extract depth. default is entire genome."`
-	Bam       []string `arg:"positional,required,help:bam(s) for which to estimate coverage"`
-	sex       []string `arg:"-"`
+	Directory     string         `arg:"-d,required,help:directory for output files"`
+	IncludeGL     bool           `arg:"-e,help:plot GL chromosomes like: GL000201.1 which are not plotted by default"`
+	ExcludeAlts   bool           `arg:"--exclude-alts,help:leave alt contigs (names ending in _alt) out of the normalization and output"`
+	ExcludeDecoys bool           `arg:"--exclude-decoys,help:leave decoy contigs (hs37d5 and names ending in _decoy) and EBV out of the normalization and output"`
+	ExcludeHLA    bool           `arg:"--exclude-hla,help:leave HLA contigs (names starting with HLA-) out of the normalization and output"`
+	Sex           string         `arg:"-X,help:comma delimited names of the sex chromosome(s) used to infer sex; The first will be used to populate the sex column in a ped file."`
+	Chrom         string         `arg:"-c,help:optional chromosome to extract depth. default is entire genome."`
+	CohortNorm    bool           `arg:"--cohort-norm,help:divide each bin by the median of all samples for that bin to remove bias shared across samples. not applied to sex chromosomes."`
+	Append        bool           `arg:"help:add the bams to the existing output in --directory. the existing samples are read from the bed.gz rather than from their indexes."`
+	Regions       string         `arg:"-r,help:optional bed file of regions to extract depth. output is limited to the 16KB bins that overlap them."`
+	Png           bool           `arg:"help:also write static png images of the sex and bin and PCA plots from index.html for use without javascript."`
+	Npz           bool           `arg:"--npz,help:also write the scaled coverage as a samples x bins float32 matrix to $prefix-indexcov.npz for numpy"`
+	Fai           string         `arg:"--fai,help:optional .fai or genome file. only its contigs are used for the normalization and output"`
+	Labels        string         `arg:"--labels,help:optional tab-delimited file of bam path and sample name with optional batch and group columns. the names replace those from the read-groups and plots are colored by group"`
+	Bam           []string       `arg:"positional,required,help:bam(s) or cram(s) for which to estimate coverage"`
+	sex           []string       `arg:"-"`
+	genome        *goleft.Genome `arg:"-"`
+	// labels and groups are the label and plot group of each sample with --labels.
+	labels []label  `arg:"-"`
+	groups []string `arg:"-"`
 }{Sex: "X,Y"}
 
+func pcheck(e error) {
+	if e != nil {
+		log.Fatal(e)
+	}
+}
+
 // MaxCN is the maximum normalized value.
 var MaxCN = float32(6)
 
@@ -48,21 +70,110 @@ type Index struct {
 	//mu                *sync.RWMutex
 	medianSizePerTile float64
 	refs              [][]int64
+	// refs from a .bai or .csi are virtual offsets so this is 16 to get bytes. it is 0 for a .crai.
+	vshift uint
+	// mapped reads of each reference from a .csi.
+	mapped []uint64
+	// ids is the ID in this index of each reference in the header of the first bam. It is nil if the
+	// headers have the same references.
+	ids []int
+	// skip is true for the references in this index that are excluded from the normalization.
+	skip []bool
+}
+
+// id returns the ID in this index of the reference with refID in the first bam or -1 if it is not
+// in this index.
+func (x *Index) id(refID int) int {
+	if x.ids == nil {
+		return refID
+	}
+	if refID >= len(x.ids) {
+		return -1
+	}
+	return x.ids[refID]
+}
+
+// ReadIndex reads the .bai, .csi or .crai index at ipath. nRefs is the number of references in the
+// header; it is only used for a .crai which does not record it.
+func ReadIndex(ipath string, nRefs int) (*Index, error) {
+	if strings.HasSuffix(ipath, ".csi") {
+		refs, mapped, err := csiRefs(ipath)
+		if err != nil {
+			return nil, err
+		}
+		return &Index{refs: refs, mapped: mapped, path: ipath, vshift: 16}, nil
+	}
+	if strings.HasSuffix(ipath, ".crai") {
+		refs, err := craiRefs(ipath, nRefs)
+		if err != nil {
+			return nil, err
+		}
+		return &Index{refs: refs, path: ipath}, nil
+	}
+	rdr, err := bamio.OpenIndex(ipath)
+	if err != nil {
+		return nil, err
+	}
+	defer rdr.Close()
+
+	dx, err := bam.ReadIndex(bufio.NewReader(rdr))
+	if err != nil {
+		return nil, err
+	}
+	return &Index{Index: dx, path: ipath, refs: getRefs(dx), vshift: 16}, nil
+}
+
+// Mapped returns the number of mapped reads on the reference as recorded in a .bai or .csi. ok is
+// false for a .crai which does not record it.
+func (x *Index) Mapped(refID int) (n uint64, ok bool) {
+	if x.mapped != nil {
+		if refID >= len(x.mapped) {
+			return 0, true
+		}
+		return x.mapped[refID], true
+	}
+	if x.Index == nil {
+		return 0, false
+	}
+	if refID >= x.Index.NumRefs() {
+		return 0, true
+	}
+	// a reference without reads has no stats.
+	st, _ := x.Index.ReferenceStats(refID)
+	return st.Mapped, true
+}
+
+// TileSizes returns the estimated number of compressed bytes in each 16KB tile of the reference.
+func (x *Index) TileSizes(refID int) []int64 {
+	if refID >= len(x.refs) || len(x.refs[refID]) < 2 {
+		return nil
+	}
+	ref := x.refs[refID]
+	sizes := make([]int64, len(ref)-1)
+	for i := range sizes {
+		if d := ref[i+1] - ref[i]; d > 0 {
+			sizes[i] = d >> x.vshift
+		}
+	}
+	return sizes
 }
 
 func vOffset(o bgzf.Offset) int64 {
 	return o.File<<16 | int64(o.Block)
 }
 
-// init sets the medianSizePerTile
+// init sets the medianSizePerTile. refs are read from the bam index unless they were already set
+// from a .crai.
 func (x *Index) init() {
-	x.refs = getRefs(x.Index)
+	if x.refs == nil {
+		x.refs = getRefs(x.Index)
+	}
 	x.Index = nil
 
 	// sizes is used to get the median.
 	sizes := make([]int64, 0, 16384)
 	for k := 0; k < len(x.refs)-1; k++ {
-		if len(x.refs[k]) < 2 {
+		if len(x.refs[k]) < 2 || (k < len(x.skip) && x.skip[k]) {
 			continue
 		}
 		for i, iv := range x.refs[k][1:] {
@@ -87,12 +198,16 @@ func (x *Index) init() {
 }
 
 // NormalizedDepth returns a list of numbers for the normalized depth of the given region.
-// Values are scaled to have a mean of 1. If end is 0, the full chromosome is returned.
+// Values are scaled to have a mean of 1. If end is 0, the full chromosome is returned. refID is
+// from the header of the first bam and nil is returned if that chromosome is not in this index.
 func (x *Index) NormalizedDepth(refID int, start int, end int) []float32 {
 
 	if x.medianSizePerTile == 0.0 {
 		x.init()
 	}
+	if refID = x.id(refID); refID < 0 || refID >= len(x.refs) {
+		return nil
+	}
 	ref := x.refs[refID]
 
 	si, ei := start/TileWidth, end/TileWidth
@@ -151,8 +266,8 @@ func CountsROC(counts []int) []float32 {
 	return roc
 }
 
-func getRef(b *bam.Reader, chrom string) *sam.Reference {
-	refs := b.Header().Refs()
+func getRef(h *sam.Header, chrom string) *sam.Reference {
+	refs := h.Refs()
 	if strings.HasPrefix(chrom, "chr") {
 		chrom = chrom[3:]
 	}
@@ -169,43 +284,26 @@ func getRef(b *bam.Reader, chrom string) *sam.Reference {
 	return nil
 }
 
+// getShortName returns the sample name of the bam or cram at b from its header or its file name.
 func getShortName(b string) string {
-
-	fh, err := os.Open(b)
+	hdr, err := bamio.Header(b)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer fh.Close()
-	br, err := bam.NewReader(fh, 1)
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer br.Close()
 	m := make(map[string]bool)
-	for _, rg := range br.Header().RGs() {
-		m[rg.Get(sam.Tag([2]byte{'S', 'M'}))] = true
+	for _, rg := range hdr.RGs() {
+		if sm := rg.Get(sam.Tag([2]byte{'S', 'M'})); sm != "" {
+			m[sm] = true
+		}
 	}
 	if len(m) > 1 {
-		log.Printf("warning: more than one tag for %s", b)
+		goleft.Warnf("indexcov: more than one tag for %s", b)
 	}
-	for sm := range m {
-		return sm
-	}
-	vs := strings.Split(b, "/")
-	v := vs[len(vs)-1]
-	vs = strings.SplitN(v, ".", 1)
-	return vs[len(vs)-1]
+	return bamio.SampleName(hdr, b)
 }
 
-func getWriter(base string) (*bgzf.Writer, error) {
-	fh, err := os.Create(fmt.Sprintf("%s.bed.gz", base))
-	if err != nil {
-		return nil, err
-	}
-	w := bgzf.NewWriter(fh, 1)
-	w.ModTime = time.Unix(0, 0)
-	w.OS = 0xff
-	return w, nil
+func getWriter(base string) (*tabix.Writer, error) {
+	return tabix.Create(fmt.Sprintf("%s.bed.gz", base), 1)
 }
 
 func zero(ints []int) {
@@ -228,35 +326,66 @@ func getDirectory(path string) (bool, error) {
 // Main is called from the goleft dispatcher
 func Main() {
 
+	if len(os.Args) > 1 && os.Args[1] == "diff" {
+		os.Args = append([]string{os.Args[0] + " diff"}, os.Args[2:]...)
+		diffMain()
+		return
+	}
 	chartjs.XFloatFormat = "%.0f"
 	p := arg.MustParse(cli)
 	if len(cli.Bam) == 0 {
 		p.Fail(fmt.Sprintf("indexcov: expected at least 1 bam: %s", os.Args))
 	}
 	cli.sex = strings.Split(strings.TrimSpace(cli.Sex), ",")
+	if cli.Fai != "" {
+		var err error
+		if cli.genome, err = goleft.ReadGenome(cli.Fai); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var ls labels
+	if cli.Labels != "" {
+		var err error
+		if ls, err = readLabels(cli.Labels); err != nil {
+			log.Fatal(err)
+		}
+	}
 
 	if exists, err := getDirectory(cli.Directory); err != nil || !exists {
 		log.Fatalf("indexcov: error creating specified directory: %s, %s", cli.Directory, err)
 	}
 
-	rdr, err := os.Open(cli.Bam[0])
+	hdr, err := bamio.Header(cli.Bam[0])
 	if err != nil {
-		log.Println(cli.Bam[0])
-		panic(err)
+		log.Fatalf("indexcov: error reading header from %s: %s", cli.Bam[0], err)
 	}
-	brdr, err := bam.NewReader(rdr, 2)
+
+	if cli.Chrom != "" && cli.Regions != "" {
+		p.Fail("indexcov: specify only one of --chrom and --regions")
+	}
+	regions, err := getRegions(hdr, cli.Chrom, cli.Regions)
 	if err != nil {
-		panic(err)
+		log.Fatal(err)
 	}
-
-	refs := brdr.Header().Refs()
-	if cli.Chrom != "" {
-		refs = append(refs, getRef(brdr, cli.Chrom))
+	kept := regions[:0]
+	for _, reg := range regions {
+		if !excluded(reg.ref.Name()) {
+			kept = append(kept, reg)
+		}
+	}
+	if len(kept) < len(regions) {
+		goleft.Infof("indexcov: excluded %d contigs", len(regions)-len(kept))
 	}
-	rdr.Close()
-	brdr.Close()
-	if refs == nil {
-		panic(fmt.Sprintf("indexcov: chromosome: %s not found", cli.Chrom))
+	regions = kept
+	// sex is always inferred from the entire sex chromosomes even if they are not in the regions.
+	var sexRefs []*sam.Reference
+	for _, ref := range hdr.Refs() {
+		for _, s := range cli.sex {
+			if s == ref.Name() {
+				sexRefs = append(sexRefs, ref)
+			}
+		}
 	}
 
 	names := make([]string, len(cli.Bam))
@@ -267,7 +396,10 @@ func Main() {
 	for k := 0; k < 4; k++ {
 		go func() {
 			for r := range ch {
-				idx, name, i := readIndex(r)
+				idx, name, i, err := readIndex(r, hdr)
+				if err != nil {
+					log.Fatalf("indexcov: error reading index for %s: %s", r.bamPath, err)
+				}
 				names[i] = name
 				idxs[i] = idx
 			}
@@ -280,12 +412,59 @@ func Main() {
 	}
 	close(ch)
 	wg.Wait()
+	if ls != nil {
+		cli.labels = make([]label, len(cli.Bam))
+		for i, b := range cli.Bam {
+			l, ok := ls.get(b)
+			if !ok {
+				goleft.Warnf("indexcov: %s is not in %s. using the name %s", b, cli.Labels, names[i])
+				l = label{sample: names[i]}
+			}
+			names[i], cli.labels[i] = l.sample, l
+		}
+	}
 
-	sexes, counts, pca8, chromNames, slopes := run(refs, idxs, names, getBase(cli.Directory))
+	if cli.Append {
+		oldIdxs, oldNames, err := readExisting(getBase(cli.Directory)+".bed.gz", hdr)
+		if err != nil {
+			log.Fatalf("indexcov: error reading existing output for --append: %s", err)
+		}
+		seen := make(map[string]bool, len(oldNames))
+		for _, n := range oldNames {
+			seen[n] = true
+		}
+		for _, n := range names {
+			if seen[n] {
+				log.Fatalf("indexcov: sample %s is already in %s", n, cli.Directory)
+			}
+		}
+		goleft.Infof("indexcov: appending %d samples to %d existing samples", len(names), len(oldNames))
+		idxs = append(oldIdxs, idxs...)
+		names = append(oldNames, names...)
+		if ls != nil {
+			// the earlier samples are matched by name as their paths are not in the output.
+			old := make([]label, len(oldNames))
+			for i, n := range oldNames {
+				if l, ok := ls.bySample(n); ok {
+					old[i] = l
+				} else {
+					old[i] = label{sample: n}
+				}
+			}
+			cli.labels = append(old, cli.labels...)
+		}
+	}
+	for _, l := range cli.labels {
+		cli.groups = append(cli.groups, l.colorGroup())
+	}
+	sexes, counts, pca8, chromNames, slopes := run(regions, sexRefs, idxs, names, getBase(cli.Directory))
+
+	// the copy-numbers of the first sex chromosome are nil if it is not in the bams.
+	pcheck(goleft.WriteMultiQC(getBase(cli.Directory)+"_mqc.json", multiQC(names, counts, slopes, cli.sex[0], sexes[cli.sex[0]])))
 
 	chartjs.XFloatFormat = "%.2f"
 	if indexPath := writeIndex(sexes, counts, cli.sex, names, cli.Directory, pca8, slopes, chromNames); indexPath != "" {
-		fmt.Fprintf(os.Stderr, "indexcov finished: see %s for overview of output\n", indexPath)
+		goleft.Infof("indexcov: finished. see %s for an overview of the output", indexPath)
 	}
 }
 
@@ -296,25 +475,39 @@ type rdi struct {
 
 // get an initialized index from a bamPath.
 // `i` is used in the return when parallelized to keep same order.
-func readIndex(r rdi) (*Index, string, int) {
+// The chromosomes are matched to those in first, the header of the first bam, by name so that
+// bams with and without the chr prefix or with a different order of chromosomes can be mixed.
+func readIndex(r rdi, first *sam.Header) (*Index, string, int, error) {
 	b := r.bamPath
 
-	rdr, err := os.Open(b + ".bai")
+	ipath, err := bamio.IndexPath(b)
 	if err != nil {
-		var terr error
-		rdr, terr = os.Open(b[:(len(b)-4)] + ".bai")
-		if terr != nil {
-			panic(err)
-		}
+		return nil, "", r.i, err
 	}
-
-	dx, err := bam.ReadIndex(bufio.NewReader(rdr))
+	hdr, err := bamio.Header(b)
+	if err != nil {
+		return nil, "", r.i, err
+	}
+	idx, err := ReadIndex(ipath, len(hdr.Refs()))
 	if err != nil {
-		panic(err)
+		return nil, "", r.i, err
+	}
+	idx.path = b
+	if idx.ids = matchRefs(first.Refs(), hdr.Refs()); idx.ids != nil {
+		missing := 0
+		for _, id := range idx.ids {
+			if id < 0 {
+				missing++
+			}
+		}
+		goleft.Infof("indexcov: matched the chromosomes of %s to %s by name. %d are missing", b, cli.Bam[0], missing)
+	}
+	idx.skip = make([]bool, len(hdr.Refs()))
+	for i, ref := range hdr.Refs() {
+		idx.skip[i] = excluded(ref.Name())
 	}
-	idx := &Index{Index: dx, path: b}
 	idx.init()
-	return idx, getShortName(b), r.i
+	return idx, getShortName(b), r.i, nil
 }
 
 // if there are more samples than this then the depth plots won't be drawn.
@@ -332,13 +525,13 @@ func sameChrom(as []string, b string) bool {
 			na = "chr" + a
 		}
 		if na == b {
-			log.Printf(`indexcov: found chromosome "%s", wanted "%s" please use exact chromosome names for --sex.`, b, a)
+			goleft.Warnf(`indexcov: found chromosome "%s", wanted "%s" please use exact chromosome names for --sex.`, b, a)
 		}
 	}
 	return false
 }
 
-func run(refs []*sam.Reference, idxs []*Index, names []string, base string) (map[string][]float64, []*counter, [][]uint8, []string, []float32) {
+func run(regions []region, sexRefs []*sam.Reference, idxs []*Index, names []string, base string) (map[string][]float64, []*counter, [][]uint8, []string, []float32) {
 	// keep a slice of charts since we plot all of the coverage roc charts in a single html file.
 	sexes := make(map[string][]float64)
 	counts := make([][]int, len(idxs))
@@ -349,31 +542,56 @@ func run(refs []*sam.Reference, idxs []*Index, names []string, base string) (map
 	offs := make([]*counter, len(idxs))
 	// uint8 to use less memory.
 	pca8 := make([][]uint8, len(idxs))
-	log.Printf("indexcov: running on %d indexes", len(idxs))
+	goleft.Infof("indexcov: running on %d indexes", len(idxs))
+	// names includes the samples from an earlier run with --append.
+	cohortNorm := cli.CohortNorm
+	if cohortNorm && len(names) < minCohort {
+		goleft.Warnf("indexcov: --cohort-norm needs at least %d samples, not normalizing", minCohort)
+		cohortNorm = false
+	}
 	if len(idxs) > maxSamples {
-		log.Printf("indexcov: creating only static (no interactive) plots for depth because # of samples %d is > %d\n", len(idxs), maxSamples)
+		goleft.Infof("indexcov: creating only static (no interactive) plots for depth because # of samples %d is > %d\n", len(idxs), maxSamples)
 	}
 
 	tmp, err := getWriter(base)
 	if err != nil {
-		panic(err)
+		pcheck(err)
 	}
-	defer tmp.Close()
+	defer func() {
+		// the index is for viewing so an error is not fatal.
+		if err := tmp.Close(); err != nil {
+			goleft.Warnf("indexcov: no index written for %s.bed.gz: %s", base, err)
+		}
+	}()
 	bgz := bufio.NewWriter(tmp)
 	defer bgz.Flush()
 
 	rtmp, err := os.Create(fmt.Sprintf("%s.roc", base))
 	if err != nil {
-		panic(err)
+		pcheck(err)
 	}
 	defer rtmp.Close()
 	rfh := bufio.NewWriter(rtmp)
 	defer rfh.Flush()
-	chromNames := make([]string, 0, len(refs))
+
+	ctmp, err := os.Create(fmt.Sprintf("%s.cnv.bed", base))
+	if err != nil {
+		pcheck(err)
+	}
+	defer ctmp.Close()
+	cfh := bufio.NewWriter(ctmp)
+	defer cfh.Flush()
+	fmt.Fprintln(cfh, "#chrom\tstart\tend\tsample\ttype\tbins\tmean")
+	chromNames := make([]string, 0, len(regions))
 
 	fmt.Fprintf(bgz, "#chrom\tstart\tend\t%s\n", strings.Join(names, "\t"))
-	for ir, ref := range refs {
-		chrom := ref.Name()
+	var npz *npzWriter
+	if cli.Npz {
+		npz, err = newNpzWriter(base+".npz", names)
+		pcheck(err)
+	}
+	for ir, reg := range regions {
+		ref, chrom, label := reg.ref, reg.ref.Name(), reg.name()
 		// Some samples may not have all the data, so we always take the longest sample for printing.
 		longest, longesti := 0, 0
 
@@ -382,11 +600,24 @@ func run(refs []*sam.Reference, idxs []*Index, names []string, base string) (map
 				pca8[k] = make([]uint8, 0, 2e5)
 				offs[k] = &counter{}
 			}
-			depths[k] = idx.NormalizedDepth(ref.ID(), 0, ref.Len())
+			depths[k] = idx.NormalizedDepth(ref.ID(), reg.start, reg.end)
 			if len(depths[k]) > longest {
 				longesti = k
 				longest = len(depths[k])
 			}
+		}
+		// the bed.gz always has the scaled coverage from the index so that --append can use it.
+		for i := 0; i < len(depths[longesti]); i++ {
+			fmt.Fprintf(bgz, "%s\t%d\t%d\t%s\n", chrom, reg.start+i*16384, reg.start+(i+1)*16384, depthsFor(depths, i))
+			if npz != nil {
+				pcheck(npz.Add(chrom, reg.start+i*16384, reg.start+(i+1)*16384, depths, i))
+			}
+		}
+		isSex := sameChrom(cli.sex, chrom)
+		if cohortNorm && !isSex {
+			cohortNormalize(depths)
+		}
+		for k := range idxs {
 			if ir == 0 {
 				counts[k] = make([]int, slots)
 			} else {
@@ -396,9 +627,8 @@ func run(refs []*sam.Reference, idxs []*Index, names []string, base string) (map
 			CountsAtDepth(depths[k], counts[k])
 		}
 
-		isSex := sameChrom(cli.sex, chrom)
 		if isSex {
-			if len(depths[longesti]) > 0 {
+			if len(depths[longesti]) > 0 && reg.whole() {
 				sexes[chrom] = GetCN(depths)
 			}
 		} else {
@@ -413,35 +643,47 @@ func run(refs []*sam.Reference, idxs []*Index, names []string, base string) (map
 				}
 				offs[k].count(depths[k], longest)
 			}
+			writeCNVs(cfh, chrom, reg.start, depths, names)
 		}
 
-		for i := 0; i < len(depths[longesti]); i++ {
-			fmt.Fprintf(bgz, "%s\t%d\t%d\t%s\n", chrom, i*16384, (i+1)*16384, depthsFor(depths, i))
-		}
 		if len(depths[longesti]) > 0 {
-			c, rocs := writeROCs(counts, names, chrom, rfh)
+			c, rocs := writeROCs(counts, names, label, rfh)
 			// only plot those with at least 3 regions.
 			if (cli.IncludeGL || !strings.HasPrefix(chrom, "GL")) && len(depths[longesti]) > 2 {
 				if !isSex && longest > 100 {
 					updateSlopes(rocs, float32(ref.Len())/1e6, slopes)
 					nSlopes++
 				}
-				chromNames = append(chromNames, chrom)
-				if err := plotDepths(depths, names, chrom, base, len(names) < maxSamples); err != nil {
-					panic(err)
+				chromNames = append(chromNames, label)
+				if err := plotDepths(depths, names, label, base, reg.start, len(names) < maxSamples); err != nil {
+					pcheck(err)
 				}
 				tmp := chartjs.XFloatFormat
 				chartjs.XFloatFormat = "%.2f"
 				c.Options.Legend = &chartjs.Legend{Display: types.False}
 				link := `<a href="index.html">back to index</a>`
-				saveCharts(fmt.Sprintf("%s-roc-%s.html", base, chrom), "", link, c)
+				saveCharts(fmt.Sprintf("%s-roc-%s.html", base, label), "", link, c)
 				chartjs.XFloatFormat = tmp
-				asPng(fmt.Sprintf("%s-roc-%s.png", base, chrom), c, 4, 3)
+				asPng(fmt.Sprintf("%s-roc-%s.png", base, label), c, 4, 3)
 			}
 		}
 	}
-	for i, s := range slopes {
-		slopes[i] = s / float32(nSlopes)
+	if npz != nil {
+		pcheck(npz.Close())
+	}
+	for _, ref := range sexRefs {
+		if _, ok := sexes[ref.Name()]; ok {
+			continue
+		}
+		for k, idx := range idxs {
+			depths[k] = idx.NormalizedDepth(ref.ID(), 0, ref.Len())
+		}
+		sexes[ref.Name()] = GetCN(depths)
+	}
+	if nSlopes > 0 {
+		for i, s := range slopes {
+			slopes[i] = s / float32(nSlopes)
+		}
 	}
 	checkSexes(sexes, cli.sex)
 	return sexes, offs, pca8, chromNames, slopes
@@ -480,7 +722,7 @@ func pca(pca8 [][]uint8, samples []string) (*mat64.Dense, []chartjs.Chart, strin
 	}
 	var pc stat.PC
 	if ok := pc.PrincipalComponents(mat, nil); !ok {
-		panic("indexcov: error with principal components")
+		log.Fatal("indexcov: error with principal components")
 	}
 
 	k := 5
@@ -488,9 +730,9 @@ func pca(pca8 [][]uint8, samples []string) (*mat64.Dense, []chartjs.Chart, strin
 	floats.Scale(1/floats.Sum(vars), vars)
 	if len(vars) < k {
 		k = len(vars)
-		log.Printf("got: %d, principal components", len(vars))
+		goleft.Infof("indexcov: got %d principal components", len(vars))
 		if k < 3 {
-			log.Printf("indexcov: %d principal components, not plotting", k)
+			goleft.Warnf("indexcov: %d principal components, not plotting", k)
 			return nil, nil, ""
 		}
 	}
@@ -511,7 +753,7 @@ func getBase(directory string) string {
 // write an index.html and a ped file. includes the PC projections and inferred sexes.
 func writeIndex(sexes map[string][]float64, counts []*counter, keys []string, samples []string, directory string, pca8 [][]uint8, slopes []float32, chromNames []string) string {
 	if len(sexes) == 0 {
-		log.Println("sex chromosomes not found, not writing index")
+		goleft.Warnf("indexcov: sex chromosomes not found, not writing index")
 		return ""
 	}
 	for _, k := range keys {
@@ -523,13 +765,74 @@ func writeIndex(sexes map[string][]float64, counts []*counter, keys []string, sa
 	pcs, pcaPlots, pcajs := pca(pca8, samples)
 	binChart, binjs := plotBins(counts, samples)
 
+	writePed(fmt.Sprintf("%s.ped", getBase(directory)), sexes, keys, samples, counts, slopes, pcs)
+
+	var sexChart *chartjs.Chart
+	var sexjs string
+	var err error
+
+	if len(keys) > 1 {
+		sexChart, sexjs, err = plotSex(sexes, keys[:2], samples)
+		if err != nil {
+			pcheck(err)
+		}
+	}
+	indexPath := fmt.Sprintf("%s%cindex.html", directory, os.PathSeparator)
+	wtr, err := os.Create(indexPath)
+	if err != nil {
+		pcheck(err)
+	}
+
+	chartMap := map[string]interface{}{"pcajs": template.JS(pcajs), "pcbjs": template.JS(pcajs),
+		"template": chartTemplate,
+		"sex":      sexChart,
+		"hasSex":   true,
+		"sexjs":    template.JS(sexjs),
+		"bin":      binChart,
+		"binjs":    template.JS(binjs),
+		"version":  goleft.Version,
+		"prefix":   getBase(directory),
+		"name":     filepath.Base(directory),
+		"chroms":   chromNames}
+	if len(pcaPlots) > 1 {
+		chartMap["pca"] = pcaPlots[0]
+		chartMap["pcb"] = pcaPlots[1]
+		chartMap["hasPCA"] = true
+	} else {
+		chartMap["hasPCA"] = false
+	}
+	if sexChart == nil {
+		chartMap["hasSex"] = false
+	}
+	chartMap["notmany"] = len(samples) <= maxSamples
+	if cli.Png {
+		base := getBase(directory)
+		if sexChart != nil {
+			asScatterPng(base+"-sex.png", *sexChart, 4, 4)
+		}
+		asScatterPng(base+"-bin.png", binChart, 4, 4)
+		if len(pcaPlots) > 1 {
+			asScatterPng(base+"-pca-1-2.png", pcaPlots[0], 4, 4)
+			asScatterPng(base+"-pca-1-3.png", pcaPlots[1], 4, 4)
+		}
+	}
+	if err := chartjs.SaveCharts(wtr, chartMap, chartjs.Chart{}); err != nil {
+		pcheck(err)
+	}
+	wtr.Close()
+	return indexPath
+}
+
+// writePed writes the ped file to path with the inferred sex of each sample, which is also added to
+// sexes as "_inferred", its bin counts and, if pcs is not nil, its PC projections.
+func writePed(path string, sexes map[string][]float64, keys []string, samples []string, counts []*counter, slopes []float32, pcs *mat64.Dense) {
 	sexes["_inferred"] = make([]float64, len(sexes[keys[0]]))
-	f, err := os.Create(fmt.Sprintf("%s.ped", getBase(directory)))
+	f, err := os.Create(path)
 	if err != nil {
-		panic(err)
+		pcheck(err)
 	}
 	defer f.Close()
-	hdr := make([]string, len(keys), len(keys)+7)
+	hdr := make([]string, len(keys), len(keys)+10)
 	for i, k := range keys {
 		hdr[i] = "CN" + k
 	}
@@ -537,6 +840,11 @@ func writeIndex(sexes map[string][]float64, counts []*counter, keys []string, sa
 	if pcs != nil {
 		hdr = append(hdr, "PC1\tPC2\tPC3\tPC4\tPC5")
 	}
+	if cli.labels != nil {
+		hdr = append(hdr, "batch", "group")
+	}
+	// later columns are added at the end so that those of earlier versions are where they were.
+	hdr = append(hdr, "p.lo", "noise")
 
 	fmt.Fprintf(f, "#family_id\tsample_id\tpaternal_id\tmaternal_id\tsex\tphenotype\t%s\n", strings.Join(hdr, "\t"))
 	tmpl := "unknown\t%s\t-9\t-9\t%d\t-9\t"
@@ -565,51 +873,13 @@ func writeIndex(sexes map[string][]float64, counts []*counter, keys []string, sa
 				fmt.Sprintf("%.2f", pcs.At(i, 3)),
 				fmt.Sprintf("%.2f", pcs.At(i, 4)))
 		}
-
-		fmt.Fprintln(f, strings.Join(s, "\t"))
-	}
-	var sexChart *chartjs.Chart
-	var sexjs string
-
-	if len(keys) > 1 {
-		sexChart, sexjs, err = plotSex(sexes, keys[:2], samples)
-		if err != nil {
-			panic(err)
+		if cli.labels != nil {
+			s = append(s, orUnknown(cli.labels[i].batch), orUnknown(cli.labels[i].group))
 		}
-	}
-	indexPath := fmt.Sprintf("%s%cindex.html", directory, os.PathSeparator)
-	wtr, err := os.Create(indexPath)
-	if err != nil {
-		panic(err)
-	}
+		s = append(s, fmt.Sprintf("%.4f", float64(cnt.low)/float64(cnt.out+cnt.in)), fmt.Sprintf("%.3f", cnt.noise()))
 
-	chartMap := map[string]interface{}{"pcajs": template.JS(pcajs), "pcbjs": template.JS(pcajs),
-		"template": chartTemplate,
-		"sex":      sexChart,
-		"hasSex":   true,
-		"sexjs":    template.JS(sexjs),
-		"bin":      binChart,
-		"binjs":    template.JS(binjs),
-		"version":  goleft.Version,
-		"prefix":   getBase(directory),
-		"name":     filepath.Base(directory),
-		"chroms":   chromNames}
-	if len(pcaPlots) > 1 {
-		chartMap["pca"] = pcaPlots[0]
-		chartMap["pcb"] = pcaPlots[1]
-		chartMap["hasPCA"] = true
-	} else {
-		chartMap["hasPCA"] = false
-	}
-	if sexChart == nil {
-		chartMap["hasSex"] = false
-	}
-	chartMap["notmany"] = len(samples) <= maxSamples
-	if err := chartjs.SaveCharts(wtr, chartMap, chartjs.Chart{}); err != nil {
-		panic(err)
+		fmt.Fprintln(f, strings.Join(s, "\t"))
 	}
-	wtr.Close()
-	return indexPath
 }
 
 // GetCN returns an float per sample estimating the number of copies of that chromosome.
@@ -638,18 +908,56 @@ func GetCN(depths [][]float32) []float64 {
 	return meds
 }
 
+// minCohort is the fewest samples for which it makes sense to normalize by the cohort median.
+const minCohort = 3
+
+// cohortNormalize divides the depth of each sample by the median depth of all samples in each bin
+// so that bias shared by all samples, e.g. mappability or GC, is removed. Bins with a median of 0
+// are left as is.
+func cohortNormalize(depths [][]float32) {
+	longest := 0
+	for _, d := range depths {
+		if len(d) > longest {
+			longest = len(d)
+		}
+	}
+	tmp := make([]float32, len(depths))
+	for i := 0; i < longest; i++ {
+		for k, d := range depths {
+			if i < len(d) {
+				tmp[k] = d[i]
+			} else {
+				tmp[k] = 0
+			}
+		}
+		sort.Slice(tmp, func(a, b int) bool { return tmp[a] < tmp[b] })
+		med := tmp[len(tmp)/2]
+		if med == 0 {
+			continue
+		}
+		for _, d := range depths {
+			if i < len(d) {
+				d[i] /= med
+				if d[i] > MaxCN {
+					d[i] = MaxCN
+				}
+			}
+		}
+	}
+}
+
 func saveCharts(path string, customjs string, customHTML string, charts ...chartjs.Chart) {
 	if len(charts) == 0 {
 		return
 	}
 	wtr, err := os.Create(path)
 	if err != nil {
-		panic(err)
+		pcheck(err)
 	}
 	defer wtr.Close()
 	if err := chartjs.SaveCharts(wtr, map[string]interface{}{"height": 550, "width": 650, "custom": template.JS(customjs),
 		"customHTML": template.HTML(customHTML)}, charts...); err != nil {
-		panic(err)
+		pcheck(err)
 	}
 }
 
@@ -667,7 +975,7 @@ func writeROCs(counts [][]int, names []string, chrom string, fh io.Writer) (char
 	rocs := getROCs(counts)
 	chart, err := plotROCs(rocs, names, chrom)
 	if err != nil {
-		panic(err)
+		pcheck(err)
 	}
 	fmt.Fprintf(fh, "#chrom\tcov\t%s\n", strings.Join(names, "\t"))
 	nSamples := len(names)
@@ -704,12 +1012,44 @@ type counter struct {
 	hi int
 	// count of sites inside of (0.85, 1.15)
 	in int
+	// diffs is a histogram of the absolute difference in scaled coverage between adjacent bins in
+	// steps of 1/noiseScale. The last bin holds all larger differences.
+	diffs [noiseBins]int
+}
+
+const (
+	noiseScale = 100
+	noiseBins  = 2*noiseScale + 1
+)
+
+// noise returns the median absolute difference in scaled coverage between adjacent bins that are
+// not missing (above 0.15). It is low for most samples as coverage changes slowly along the genome
+// and high for degraded or FFPE libraries with noisy coverage.
+func (c *counter) noise() float64 {
+	n := 0
+	for _, d := range c.diffs {
+		n += d
+	}
+	if n == 0 {
+		return 0
+	}
+	cum := 0
+	for i, d := range c.diffs {
+		if cum += d; 2*cum >= n {
+			return (float64(i) + 0.5) / noiseScale
+		}
+	}
+	return 0
 }
 
 // count values in or out of expected range of ~1.
 func (c *counter) count(depths []float32, n int) {
 	var i int
 	for ; i < len(depths); i++ {
+		if i > 0 && depths[i] >= 0.15 && depths[i-1] >= 0.15 {
+			d := math.Abs(float64(depths[i] - depths[i-1]))
+			c.diffs[int(math.Min(d*noiseScale, noiseBins-1))]++
+		}
 		if depths[i] < 0.85 || depths[i] > 1.15 {
 			c.out++
 			if depths[i] > 1.15 {
@@ -0,0 +1,141 @@
+package indexcov
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCohortNormalize(t *testing.T) {
+	depths := [][]float32{
+		{0.5, 1, 0, 2},
+		{0.5, 1.2, 0, 1},
+		{1, 0.8},
+	}
+	cohortNormalize(depths)
+	exp := [][]float32{
+		{1, 1, 0, 2},
+		{1, 1.2, 0, 1},
+		{2, 0.8},
+	}
+	if !reflect.DeepEqual(depths, exp) {
+		t.Errorf("expected %v, got: %v", exp, depths)
+	}
+}
+
+func TestScatterPng(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "goleft-indexcov")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	counts := []*counter{{out: 10, low: 2}, {out: 40, low: 20}, {out: 12, low: 3}}
+	chart, _ := plotBins(counts, []string{"a", "b", "c"})
+	p := filepath.Join(tmp, "bin.png")
+	asScatterPng(p, chart, 4, 4)
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(b, []byte("\x89PNG")) {
+		t.Errorf("expected a png in %s", p)
+	}
+}
+
+func TestProblems(t *testing.T) {
+	counts := []*counter{{out: 10, in: 1000}, {out: 12, in: 1000}, {out: 11, low: 1, in: 1000}, {out: 300, low: 2, in: 700}, {out: 9, low: 200, in: 800}}
+	slopes := []float32{0.9, 0.91, 0.9, 0.5, 0.89}
+	m := multiQC([]string{"a", "b", "c", "d", "e"}, counts, slopes, "X", []float64{1.02, 1.98, 1.5, 2.01, 0.99})
+	exp := map[string]string{"a": "none", "b": "none", "c": "ambiguous-sex", "d": "high-bias,uneven", "e": "missing-data"}
+	for s, e := range exp {
+		if got := m.Data[s]["problems"]; got != e {
+			t.Errorf("expected problems %q for %s, got: %q", e, s, got)
+		}
+	}
+	if m.Data["b"]["sex"] != 2 || m.Headers[0].Key != "CNX" {
+		t.Errorf("expected the CN of X and the inferred sex, got: %v %v", m.Headers[0], m.Data["b"])
+	}
+	// with fewer than minCohort samples, only the sex is checked.
+	if ps := problems(statsOf(counts[3:], slopes[3:], nil), false); len(ps[0]) != 0 || len(ps[1]) != 0 {
+		t.Errorf("expected no problems for 2 samples, got: %v", ps)
+	}
+}
+
+func TestNoise(t *testing.T) {
+	var smooth, noisy counter
+	smooth.count([]float32{1, 1.01, 1.02, 1, 0.99, 0, 0, 1}, 8)
+	noisy.count([]float32{1, 0.6, 1.4, 0.7, 1.3, 0, 0, 1}, 8)
+	if n := smooth.noise(); n > 0.03 {
+		t.Errorf("expected low noise for smooth coverage, got: %.3f", n)
+	}
+	// the missing bins are not used.
+	if n := noisy.noise(); n < 0.55 || n > 0.75 {
+		t.Errorf("expected noise near 0.6, got: %.3f", n)
+	}
+	if n := (&counter{}).noise(); n != 0 {
+		t.Errorf("expected no noise without bins, got: %.3f", n)
+	}
+
+	var counts []*counter
+	for _, step := range []float32{0.02, 0.03, 0.04, 0.03, 0.5} {
+		c := &counter{}
+		c.count([]float32{1, 1 + step, 1, 1 + step, 1}, 5)
+		counts = append(counts, c)
+	}
+	m := multiQC([]string{"a", "b", "c", "d", "e"}, counts, []float32{0.9, 0.9, 0.9, 0.9, 0.9}, "X", nil)
+	for s, e := range map[string]string{"a": "none", "d": "none", "e": "noisy"} {
+		if got := m.Data[s]["problems"]; got != e {
+			t.Errorf("expected problems %q for %s, got: %q", e, s, got)
+		}
+	}
+}
+
+func TestWritePed(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "goleft-indexcov")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	cli.labels = []label{{"a", "b1", "case"}, {"b", "b2", ""}}
+	defer func() { cli.labels = nil }()
+	sexes := map[string][]float64{"X": {1.02, 1.98}, "Y": {0.97, 0.01}}
+	counts := []*counter{{out: 10, low: 3, hi: 6, in: 90}, {out: 40, low: 30, hi: 5, in: 160}}
+	p := filepath.Join(tmp, "t.ped")
+	writePed(p, sexes, []string{"X", "Y"}, []string{"a", "b"}, counts, []float32{0.9, 0.8}, nil)
+
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expected a header and 2 samples, got: %q", lines)
+	}
+	hdr := strings.Split(lines[0], "\t")
+	// the columns of earlier versions are where they were.
+	if exp := []string{"CNX", "CNY", "bins.out", "bins.lo", "bins.hi", "bins.in", "slope", "p.out", "batch", "group", "p.lo", "noise"}; !reflect.DeepEqual(hdr[6:], exp) {
+		t.Errorf("expected columns %v, got: %v", exp, hdr[6:])
+	}
+	for i, exp := range [][]string{{"a", "1", "b1", "case", "0.0300"}, {"b", "2", "b2", "unknown", "0.1500"}} {
+		row := strings.Split(lines[i+1], "\t")
+		if len(row) != len(hdr) {
+			t.Fatalf("expected %d columns, got: %q", len(hdr), row)
+		}
+		if got := []string{row[1], row[4], row[14], row[15], row[16]}; !reflect.DeepEqual(got, exp) {
+			t.Errorf("expected the sample, sex, batch, group and bins.lo/(bins.in+bins.out) %v, got: %v", exp, got)
+		}
+	}
+	if !reflect.DeepEqual(sexes["_inferred"], []float64{1, 2}) {
+		t.Errorf("expected the inferred sexes, got: %v", sexes["_inferred"])
+	}
+}
+
+func TestGetShortName(t *testing.T) {
+	if name := getShortName("../depth/test/t.bam"); name != "Test1" {
+		t.Errorf("expected the SM of the read-group, got: %s", name)
+	}
+}
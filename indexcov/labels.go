@@ -0,0 +1,163 @@
+package indexcov
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/brentp/go-chartjs/types"
+	"github.com/brentp/goleft"
+	"github.com/brentp/xopen"
+)
+
+// label is the sample name, batch and group of a bam from --labels.
+type label struct {
+	sample, batch, group string
+}
+
+// labels are keyed by the path of the bam as it is given in the --labels file.
+type labels map[string]label
+
+// readLabels reads the tab-delimited --labels file with the path of each bam, its sample name and,
+// optionally, its batch and group. Lines starting with # are skipped.
+func readLabels(path string) (labels, error) {
+	rdr, err := xopen.Ropen(path)
+	if err != nil {
+		return nil, err
+	}
+	defer rdr.Close()
+	ls := make(labels)
+	for i := 1; ; i++ {
+		line, err := rdr.ReadString('\n')
+		if line = strings.TrimRight(line, "\r\n"); len(strings.TrimSpace(line)) > 0 && line[0] != '#' {
+			toks := strings.Split(line, "\t")
+			if len(toks) < 2 || toks[1] == "" {
+				return nil, &goleft.ParseError{Path: path, Line: i, Err: fmt.Errorf("indexcov: expected path and sample in line: %q", line)}
+			}
+			for len(toks) < 4 {
+				toks = append(toks, "")
+			}
+			ls[toks[0]] = label{sample: toks[1], batch: toks[2], group: toks[3]}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ls, nil
+}
+
+// get returns the label for the bam at path which is matched by the full path or by the file name.
+func (ls labels) get(path string) (label, bool) {
+	if l, ok := ls[path]; ok {
+		return l, true
+	}
+	base := filepath.Base(path)
+	for p, l := range ls {
+		if filepath.Base(p) == base {
+			return l, true
+		}
+	}
+	return label{}, false
+}
+
+// bySample returns the label with the sample name s. It is used for the samples from the output of
+// an earlier run with --append.
+func (ls labels) bySample(s string) (label, bool) {
+	for _, l := range ls {
+		if l.sample == s {
+			return l, true
+		}
+	}
+	return label{}, false
+}
+
+// colorGroup is the group used to color a sample: its group or, without one, its batch.
+func (l label) colorGroup() string {
+	if l.group != "" {
+		return l.group
+	}
+	return l.batch
+}
+
+// orUnknown returns s or "unknown" if it is empty as for the family_id in the ped file.
+func orUnknown(s string) string {
+	if s == "" {
+		return "unknown"
+	}
+	return s
+}
+
+// sampleGroups are the groups of samples from --labels. The scatter plots have a dataset for each.
+type sampleGroups struct {
+	names []string
+	// members are the indexes of the samples in each group.
+	members [][]int
+}
+
+// groupSamples returns the groups in order of name with the indexes of their samples. Without
+// groups, the n samples are in a single group named "samples".
+func groupSamples(groups []string, n int) sampleGroups {
+	if groups == nil {
+		m := make([]int, n)
+		for i := range m {
+			m[i] = i
+		}
+		return sampleGroups{names: []string{"samples"}, members: [][]int{m}}
+	}
+	idx := make(map[string][]int)
+	for i, g := range groups {
+		if g == "" {
+			g = "unlabeled"
+		}
+		idx[g] = append(idx[g], i)
+	}
+	var sg sampleGroups
+	for g := range idx {
+		sg.names = append(sg.names, g)
+	}
+	sort.Strings(sg.names)
+	for _, g := range sg.names {
+		sg.members = append(sg.members, idx[g])
+	}
+	return sg
+}
+
+// samples returns the names of the samples in each group for the tooltips.
+func (sg sampleGroups) samples(names []string) [][]string {
+	out := make([][]string, len(sg.members))
+	for k, m := range sg.members {
+		out[k] = make([]string, len(m))
+		for i, j := range m {
+			out[k][i] = names[j]
+		}
+	}
+	return out
+}
+
+// sampleColors returns the color of each of n samples: that of its group with --labels or otherwise
+// a color for each sample.
+func sampleColors(n int) []*types.RGBA {
+	colors := make([]*types.RGBA, n)
+	for i := range colors {
+		colors[i] = randomColor(i)
+	}
+	if cli.groups != nil {
+		sg := groupSamples(cli.groups, n)
+		for k, m := range sg.members {
+			for _, i := range m {
+				colors[i] = groupColor(k)
+			}
+		}
+	}
+	return colors
+}
+
+// groupColor returns the color of group k. Nearby seeds to randomColor give similar colors.
+func groupColor(k int) *types.RGBA {
+	return randomColor(1000 + 7919*k)
+}
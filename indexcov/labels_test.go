@@ -0,0 +1,60 @@
+package indexcov
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/brentp/goleft"
+)
+
+func TestReadLabels(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "meta.tsv")
+	data := "#path\tsample\tbatch\tgroup\ngs://bucket/3f2a.bam\tNA12878\tb1\tcase\n/data/77c1.cram\tNA12891\tb2\n"
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ls, err := readLabels(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l, ok := ls.get("gs://bucket/3f2a.bam"); !ok || l != (label{"NA12878", "b1", "case"}) {
+		t.Errorf("unexpected label for the full path: %+v %v", l, ok)
+	}
+	// matched by the file name and without a group the batch is used for the color.
+	l, ok := ls.get("local/77c1.cram")
+	if !ok || l.sample != "NA12891" || l.colorGroup() != "b2" {
+		t.Errorf("unexpected label for the file name: %+v %v", l, ok)
+	}
+	if _, ok := ls.get("other.bam"); ok {
+		t.Errorf("expected no label for other.bam")
+	}
+	if l, ok := ls.bySample("NA12878"); !ok || l.group != "case" {
+		t.Errorf("unexpected label by sample: %+v %v", l, ok)
+	}
+
+	if err := os.WriteFile(path, []byte("a.bam\tA\nb.bam\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err = readLabels(path)
+	var perr *goleft.ParseError
+	if !errors.As(err, &perr) || perr.Line != 2 {
+		t.Errorf("expected a ParseError at line 2, got: %v", err)
+	}
+}
+
+func TestGroupSamples(t *testing.T) {
+	sg := groupSamples([]string{"case", "", "control", "case"}, 4)
+	if exp := []string{"case", "control", "unlabeled"}; !reflect.DeepEqual(sg.names, exp) {
+		t.Errorf("expected groups %v, got: %v", exp, sg.names)
+	}
+	if exp := [][]string{{"a", "d"}, {"c"}, {"b"}}; !reflect.DeepEqual(sg.samples([]string{"a", "b", "c", "d"}), exp) {
+		t.Errorf("expected samples %v, got: %v", exp, sg.samples([]string{"a", "b", "c", "d"}))
+	}
+	if sg := groupSamples(nil, 3); len(sg.members) != 1 || len(sg.members[0]) != 3 {
+		t.Errorf("expected a single group without labels, got: %+v", sg)
+	}
+}
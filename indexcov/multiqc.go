@@ -0,0 +1,144 @@
+package indexcov
+
+import (
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/brentp/goleft"
+)
+
+// maxRobustZ is the number of scaled MADs from the cohort median beyond which a sample is flagged.
+const maxRobustZ = 4
+
+// sampleStats are the values of a sample in the ped file.
+type sampleStats struct {
+	pOut, pLo, slope, noise float64
+	// cn is the copy-number of the first --sex chromosome.
+	cn float64
+}
+
+func statsOf(counts []*counter, slopes []float32, cn []float64) []sampleStats {
+	st := make([]sampleStats, len(counts))
+	frac := func(a, b int) float64 {
+		if b == 0 {
+			return 0
+		}
+		return float64(a) / float64(b)
+	}
+	for i, c := range counts {
+		st[i] = sampleStats{pOut: frac(c.out, c.in), pLo: frac(c.low, c.out+c.in), slope: float64(slopes[i]), noise: c.noise()}
+		if cn != nil {
+			st[i].cn = cn[i]
+		}
+	}
+	return st
+}
+
+// outliers returns, for each value, how many scaled MADs it is from the median of all the values.
+// It is nil with fewer than minCohort values or a MAD of 0 so that no sample is flagged.
+func outliers(vals []float64) []float64 {
+	if len(vals) < minCohort {
+		return nil
+	}
+	median := func(v []float64) float64 {
+		s := append([]float64{}, v...)
+		sort.Float64s(s)
+		return (s[(len(s)-1)/2] + s[len(s)/2]) / 2
+	}
+	m := median(vals)
+	devs := make([]float64, len(vals))
+	for i, v := range vals {
+		devs[i] = math.Abs(v - m)
+	}
+	mad := 1.4826 * median(devs)
+	if mad == 0 {
+		return nil
+	}
+	z := make([]float64, len(vals))
+	for i, v := range vals {
+		z[i] = (v - m) / mad
+	}
+	return z
+}
+
+// problems returns the flags of each sample: high-bias and missing-data for a p.out or p.lo,
+// uneven for a slope and noisy for a bin-to-bin noise far from the rest of the cohort and
+// ambiguous-sex for a copy-number of the first sex chromosome that is not near a whole number.
+func problems(st []sampleStats, hasSex bool) [][]string {
+	get := func(f func(sampleStats) float64) []float64 {
+		v := make([]float64, len(st))
+		for i, s := range st {
+			v[i] = f(s)
+		}
+		return v
+	}
+	out := outliers(get(func(s sampleStats) float64 { return s.pOut }))
+	lo := outliers(get(func(s sampleStats) float64 { return s.pLo }))
+	slope := outliers(get(func(s sampleStats) float64 { return s.slope }))
+	noise := outliers(get(func(s sampleStats) float64 { return s.noise }))
+	ps := make([][]string, len(st))
+	for i, s := range st {
+		if out != nil && out[i] > maxRobustZ {
+			ps[i] = append(ps[i], "high-bias")
+		}
+		if lo != nil && lo[i] > maxRobustZ {
+			ps[i] = append(ps[i], "missing-data")
+		}
+		if slope != nil && slope[i] < -maxRobustZ {
+			ps[i] = append(ps[i], "uneven")
+		}
+		if noise != nil && noise[i] > maxRobustZ {
+			ps[i] = append(ps[i], "noisy")
+		}
+		if hasSex && math.Abs(s.cn-math.Round(s.cn)) > 0.3 {
+			ps[i] = append(ps[i], "ambiguous-sex")
+		}
+	}
+	return ps
+}
+
+// multiQC returns the inferred sex, bin statistics and problems of each sample as a table for MultiQC.
+// sex is the copy-number of the sex chromosome named chrom, or nil.
+func multiQC(samples []string, counts []*counter, slopes []float32, chrom string, sex []float64) goleft.MultiQC {
+	m := goleft.MultiQC{ID: "goleft_indexcov", Section: "goleft indexcov",
+		Description: "coverage bias and inferred sex from the bam indexes with goleft indexcov. problems are relative to the cohort",
+		Data:        make(map[string]map[string]interface{}, len(samples))}
+	if sex != nil {
+		m.Headers = append(m.Headers,
+			goleft.MultiQCHeader{Key: "CN" + chrom, Title: "CN " + chrom, Description: "estimated copy-number of " + chrom, Format: "{:,.2f}", Scale: "PuOr"},
+			goleft.MultiQCHeader{Key: "sex", Title: "Sex", Description: "copies of " + chrom + " rounded to a whole number", Format: "{:,.0f}"})
+	}
+	m.Headers = append(m.Headers,
+		goleft.MultiQCHeader{Key: "bins_out", Title: "Bins out", Description: "bins with scaled coverage outside of (0.85 1.15)", Format: "{:,.0f}", Scale: "OrRd"},
+		goleft.MultiQCHeader{Key: "bins_lo", Title: "Bins low", Description: "bins with scaled coverage below 0.15", Format: "{:,.0f}", Scale: "OrRd"},
+		goleft.MultiQCHeader{Key: "p_out", Title: "P out", Description: "bins.out / bins.in. high values indicate high-bias samples", Format: "{:,.2f}", Scale: "OrRd"},
+		goleft.MultiQCHeader{Key: "p_lo", Title: "P low", Description: "proportion of bins below 0.15. high values indicate missing data", Format: "{:,.4f}", Scale: "OrRd"},
+		goleft.MultiQCHeader{Key: "slope", Title: "Slope", Description: "how quickly the coverage ROC drops around 1. higher is more even", Format: "{:,.3f}", Scale: "RdYlGn"},
+		goleft.MultiQCHeader{Key: "noise", Title: "Noise", Description: "median difference in scaled coverage between adjacent bins. high values indicate degraded or FFPE libraries", Format: "{:,.3f}", Scale: "OrRd"},
+		goleft.MultiQCHeader{Key: "problems", Title: "Problems", Description: "high-bias missing-data uneven or noisy relative to the cohort and ambiguous-sex"})
+	st := statsOf(counts, slopes, sex)
+	ps := problems(st, sex != nil)
+	for i, s := range samples {
+		c := counts[i]
+		d := map[string]interface{}{"bins_out": c.out, "bins_lo": c.low, "p_out": number(st[i].pOut), "p_lo": number(st[i].pLo),
+			"slope": number(st[i].slope), "noise": number(st[i].noise), "problems": strings.Join(ps[i], ",")}
+		if len(ps[i]) == 0 {
+			d["problems"] = "none"
+		}
+		if sex != nil {
+			d["CN"+chrom] = number(sex[i])
+			d["sex"] = int(0.5 + sex[i])
+		}
+		m.Data[s] = d
+	}
+	return m
+}
+
+// number returns v or nil, which is null in JSON, if it is NaN or infinite.
+func number(v float64) interface{} {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return nil
+	}
+	return v
+}
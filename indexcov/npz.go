@@ -0,0 +1,157 @@
+package indexcov
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+	"unicode/utf8"
+)
+
+// npzWriter writes the scaled coverage to a NumPy .npz so that a matrix of thousands of samples
+// loads without parsing the bed.gz. The bins are written to a temporary file as they are seen and
+// copied into the .npz in Close once the number of bins is known.
+//
+// The .npz has depth (float32 samples x bins), samples, chrom, start and end.
+type npzWriter struct {
+	path    string
+	samples []string
+	tmp     *os.File
+	w       *bufio.Writer
+	buf     []byte
+	chroms  []string
+	starts  []int64
+	ends    []int64
+}
+
+func newNpzWriter(path string, samples []string) (*npzWriter, error) {
+	tmp, err := os.Create(path + ".tmp")
+	if err != nil {
+		return nil, err
+	}
+	return &npzWriter{path: path, samples: samples, tmp: tmp, w: bufio.NewWriter(tmp), buf: make([]byte, 4*len(samples))}, nil
+}
+
+// Add adds bin i of depths which has a slice for each sample. Samples without the bin have 0.
+func (n *npzWriter) Add(chrom string, start, end int, depths [][]float32, i int) error {
+	for k, d := range depths {
+		var v float32
+		if i < len(d) {
+			v = d[i]
+		}
+		binary.LittleEndian.PutUint32(n.buf[4*k:], math.Float32bits(v))
+	}
+	n.chroms = append(n.chroms, chrom)
+	n.starts = append(n.starts, int64(start))
+	n.ends = append(n.ends, int64(end))
+	_, err := n.w.Write(n.buf)
+	return err
+}
+
+// npyHeader is the header of a version 1.0 .npy padded so the data is aligned to 64 bytes.
+func npyHeader(descr string, fortran bool, shape ...int) []byte {
+	order := "False"
+	if fortran {
+		order = "True"
+	}
+	dims := make([]string, len(shape))
+	for i, s := range shape {
+		dims[i] = fmt.Sprint(s)
+	}
+	sh := strings.Join(dims, ", ")
+	if len(shape) == 1 {
+		sh += ","
+	}
+	h := fmt.Sprintf("{'descr': '%s', 'fortran_order': %s, 'shape': (%s), }", descr, order, sh)
+	// magic (6), version (2) and header length (2) then the header ending with a newline.
+	pad := 64 - (10+len(h)+1)%64
+	if pad == 64 {
+		pad = 0
+	}
+	h += strings.Repeat(" ", pad) + "\n"
+	b := append([]byte("\x93NUMPY\x01\x00"), byte(len(h)), byte(len(h)>>8))
+	return append(b, h...)
+}
+
+// unicodeArray returns the .npy of strs as a fixed-width UTF-32 array.
+func unicodeArray(strs []string) []byte {
+	width := 1
+	for _, s := range strs {
+		if n := utf8.RuneCountInString(s); n > width {
+			width = n
+		}
+	}
+	var b bytes.Buffer
+	b.Write(npyHeader(fmt.Sprintf("<U%d", width), false, len(strs)))
+	for _, s := range strs {
+		n := 0
+		for _, r := range s {
+			binary.Write(&b, binary.LittleEndian, uint32(r))
+			n++
+		}
+		b.Write(make([]byte, 4*(width-n)))
+	}
+	return b.Bytes()
+}
+
+func int64Array(vals []int64) []byte {
+	var b bytes.Buffer
+	b.Write(npyHeader("<i8", false, len(vals)))
+	binary.Write(&b, binary.LittleEndian, vals)
+	return b.Bytes()
+}
+
+// Close writes the .npz and removes the temporary file.
+func (n *npzWriter) Close() error {
+	if err := n.w.Flush(); err != nil {
+		return err
+	}
+	defer os.Remove(n.tmp.Name())
+	defer n.tmp.Close()
+	if _, err := n.tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	fh, err := os.Create(n.path)
+	if err != nil {
+		return err
+	}
+	z := zip.NewWriter(fh)
+	add := func(name string, parts ...io.Reader) error {
+		// stored rather than deflated so that loading is as fast as reading the file.
+		w, err := z.CreateHeader(&zip.FileHeader{Name: name + ".npy", Method: zip.Store})
+		if err != nil {
+			return err
+		}
+		for _, p := range parts {
+			if _, err := io.Copy(w, p); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	// the bins were written one after another with a value for each sample which is the column-major
+	// (fortran) order of a samples x bins matrix.
+	if err := add("depth", bytes.NewReader(npyHeader("<f4", true, len(n.samples), len(n.chroms))), n.tmp); err != nil {
+		fh.Close()
+		return err
+	}
+	for _, a := range []struct {
+		name string
+		data []byte
+	}{{"samples", unicodeArray(n.samples)}, {"chrom", unicodeArray(n.chroms)}, {"start", int64Array(n.starts)}, {"end", int64Array(n.ends)}} {
+		if err := add(a.name, bytes.NewReader(a.data)); err != nil {
+			fh.Close()
+			return err
+		}
+	}
+	if err := z.Close(); err != nil {
+		fh.Close()
+		return err
+	}
+	return fh.Close()
+}
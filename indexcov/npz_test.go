@@ -0,0 +1,82 @@
+package indexcov
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// readNpy returns the header and data of a .npy.
+func readNpy(t *testing.T, f *zip.File) (string, []byte) {
+	rc, err := f.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	b, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(b, []byte("\x93NUMPY\x01\x00")) {
+		t.Fatalf("%s: bad magic: %q", f.Name, b[:8])
+	}
+	n := 10 + int(binary.LittleEndian.Uint16(b[8:]))
+	if n%64 != 0 || b[n-1] != '\n' {
+		t.Errorf("%s: expected the header to be aligned and end with a newline", f.Name)
+	}
+	return string(bytes.TrimRight(b[10:n], " \n")), b[n:]
+}
+
+func TestNpz(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "t-indexcov.npz")
+	n, err := newNpzWriter(path, []string{"a", "sample-b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the second sample is missing the last bin.
+	depths := [][]float32{{1, 0.5, 2}, {1.5, 0.25}}
+	for i := range depths[0] {
+		if err := n.Add("chr1", i*16384, (i+1)*16384, depths, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := n.Close(); err != nil {
+		t.Fatal(err)
+	}
+	z, err := zip.OpenReader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer z.Close()
+	files := make(map[string]*zip.File)
+	for _, f := range z.File {
+		files[f.Name] = f
+	}
+
+	h, data := readNpy(t, files["depth.npy"])
+	if h != "{'descr': '<f4', 'fortran_order': True, 'shape': (2, 3), }" {
+		t.Errorf("unexpected depth header: %s", h)
+	}
+	vals := make([]float32, len(data)/4)
+	for i := range vals {
+		vals[i] = math.Float32frombits(binary.LittleEndian.Uint32(data[4*i:]))
+	}
+	// column-major: the samples of each bin in turn.
+	if exp := []float32{1, 1.5, 0.5, 0.25, 2, 0}; !reflect.DeepEqual(vals, exp) {
+		t.Errorf("expected: %v, got: %v", exp, vals)
+	}
+
+	h, data = readNpy(t, files["samples.npy"])
+	if h != "{'descr': '<U8', 'fortran_order': False, 'shape': (2,), }" || len(data) != 2*8*4 || data[0] != 'a' || data[32] != 's' {
+		t.Errorf("unexpected samples: %s %q", h, data)
+	}
+	h, data = readNpy(t, files["end.npy"])
+	if h != "{'descr': '<i8', 'fortran_order': False, 'shape': (3,), }" || binary.LittleEndian.Uint64(data[16:]) != 3*16384 {
+		t.Errorf("unexpected ends: %s %v", h, data)
+	}
+}
@@ -15,6 +15,7 @@ import (
 	"github.com/gonum/plot"
 	"github.com/gonum/plot/plotter"
 	"github.com/gonum/plot/vg"
+	"github.com/gonum/plot/vg/draw"
 )
 
 type vs struct {
@@ -59,7 +60,7 @@ func (v *vs) Sample(nth int) *vs {
 // truncate depth values above this to cnMax
 const cnMax = 2.5
 
-func asValues(vals []float32, multiplier float64) chartjs.Values {
+func asValues(vals []float32, multiplier float64, offset int) chartjs.Values {
 
 	// skip until we find non-zero.
 	v := vs{xs: make([]float64, 0, len(vals)), ys: make([]float64, 0, len(vals))}
@@ -69,7 +70,7 @@ func asValues(vals []float32, multiplier float64) chartjs.Values {
 			continue
 		}
 		seenNonZero = true
-		v.xs = append(v.xs, float64(i)*multiplier)
+		v.xs = append(v.xs, float64(offset)+float64(i)*multiplier)
 		if r > cnMax {
 			r = cnMax
 		}
@@ -87,7 +88,7 @@ func randomColor(s int) *types.RGBA {
 		A: 240}
 }
 
-func plotDepths(depths [][]float32, samples []string, chrom string, base string, writeHTML bool) error {
+func plotDepths(depths [][]float32, samples []string, chrom string, base string, offset int, writeHTML bool) error {
 	chart := chartjs.Chart{Label: chrom}
 	xa, err := chart.AddXAxis(chartjs.Axis{Type: chartjs.Linear, Position: chartjs.Bottom, ScaleLabel: &chartjs.ScaleLabel{FontSize: 16, LabelString: "position on " + chrom, Display: chartjs.True}})
 	if err != nil {
@@ -100,9 +101,10 @@ func plotDepths(depths [][]float32, samples []string, chrom string, base string,
 		return err
 	}
 
+	colors := sampleColors(len(depths))
 	for i, depth := range depths {
-		xys := asValues(depth, 16384)
-		c := randomColor(i)
+		xys := asValues(depth, 16384, offset)
+		c := colors[i]
 		dataset := chartjs.Dataset{Data: xys, Label: samples[i], Fill: chartjs.False, PointRadius: 0, BorderWidth: 0.5,
 			BorderColor: c, BackgroundColor: c, SteppedLine: chartjs.True, PointHitRadius: 6}
 		dataset.XAxisID = xa
@@ -136,7 +138,7 @@ func plotBins(counts []*counter, samples []string) (chartjs.Chart, string) {
 		LabelString: "total bins with depth < 0.15",
 		Display:     chartjs.True}})
 	if err != nil {
-		panic(err)
+		pcheck(err)
 	}
 
 	ya, err := chart.AddYAxis(chartjs.Axis{Type: chartjs.Linear, Position: chartjs.Left, ScaleLabel: &chartjs.ScaleLabel{FontSize: 16,
@@ -144,32 +146,41 @@ func plotBins(counts []*counter, samples []string) (chartjs.Chart, string) {
 		Display:     chartjs.True}})
 
 	if err != nil {
-		panic(err)
+		pcheck(err)
 	}
-	xys := &vs{xs: make([]float64, len(counts)), ys: make([]float64, len(counts))}
-	for i, c := range counts {
-		xys.xs[i] = float64(c.low)
-		xys.ys[i] = float64(c.out)
+	sg := groupSamples(cli.groups, len(samples))
+	for k, m := range sg.members {
+		xys := &vs{xs: make([]float64, len(m)), ys: make([]float64, len(m))}
+		for i, j := range m {
+			xys.xs[i] = float64(counts[j].low)
+			xys.ys[i] = float64(counts[j].out)
+		}
+		if len(sg.members) > 1 {
+			c = groupColor(k)
+		}
+		dataset := chartjs.Dataset{Data: xys, Label: sg.names[k], Fill: chartjs.False, PointHoverRadius: 6,
+			PointRadius: 4, BorderWidth: 0, BorderColor: &types.RGBA{R: 150, G: 150, B: 150, A: 150},
+			PointBackgroundColor: c, BackgroundColor: c, ShowLine: chartjs.False, PointHitRadius: 6}
+		dataset.XAxisID = xa
+		dataset.YAxisID = ya
+		chart.AddDataset(dataset)
 	}
-	dataset := chartjs.Dataset{Data: xys, Label: "samples", Fill: chartjs.False, PointHoverRadius: 6,
-		PointRadius: 4, BorderWidth: 0, BorderColor: &types.RGBA{R: 150, G: 150, B: 150, A: 150},
-		PointBackgroundColor: c, BackgroundColor: c, ShowLine: chartjs.False, PointHitRadius: 6}
-	dataset.XAxisID = xa
-	dataset.YAxisID = ya
-	chart.AddDataset(dataset)
 	chart.Options.Responsive = chartjs.False
 	chart.Options.Tooltip = &chartjs.Tooltip{Mode: "nearest"}
 	chart.Options.Legend = &chartjs.Legend{Display: chartjs.False}
-	sjson, err := json.Marshal(samples)
+	if len(sg.members) > 1 {
+		chart.Options.Legend.Display = chartjs.True
+	}
+	sjson, err := json.Marshal(sg.samples(samples))
 	if err != nil {
-		panic(err)
+		pcheck(err)
 	}
 	jsfunc := fmt.Sprintf(`
     bin_chart.options.tooltips.callbacks.title = function(tts, data) {
         var names = %s
         var out = []
         tts.forEach(function(ti) {
-            out.push(names[ti.index])
+            out.push(names[ti.datasetIndex][ti.index])
         })
         return out.join(",")
     }`, sjson)
@@ -181,6 +192,7 @@ func plotPCA(mat *mat64.Dense, samples []string, vars []float64) ([]chartjs.Char
 
 	var charts []chartjs.Chart
 	c := &types.RGBA{R: 110, G: 250, B: 59, A: 240}
+	sg := groupSamples(cli.groups, len(samples))
 
 	for _, pc := range []int{2, 3} {
 
@@ -189,7 +201,7 @@ func plotPCA(mat *mat64.Dense, samples []string, vars []float64) ([]chartjs.Char
 			LabelString: fmt.Sprintf("PC1 (variance explained: %.2f%%)", 100*vars[0]),
 			Display:     chartjs.True}})
 		if err != nil {
-			panic(err)
+			pcheck(err)
 		}
 
 		ya, err := c1.AddYAxis(chartjs.Axis{Type: chartjs.Linear, Position: chartjs.Left, ScaleLabel: &chartjs.ScaleLabel{FontSize: 16,
@@ -197,23 +209,35 @@ func plotPCA(mat *mat64.Dense, samples []string, vars []float64) ([]chartjs.Char
 			Display:     chartjs.True}})
 
 		if err != nil {
-			panic(err)
+			pcheck(err)
+		}
+		for k, m := range sg.members {
+			xys := &vs{xs: make([]float64, len(m)), ys: make([]float64, len(m))}
+			for i, j := range m {
+				xys.xs[i] = mat.At(j, 0)
+				xys.ys[i] = mat.At(j, pc-1)
+			}
+			if len(sg.members) > 1 {
+				c = groupColor(k)
+			}
+			dataset := chartjs.Dataset{Data: xys, Label: sg.names[k], Fill: chartjs.False, PointHoverRadius: 6,
+				PointRadius: 4,
+				BorderWidth: 0, BorderColor: &types.RGBA{R: 150, G: 150, B: 150, A: 150}, PointBackgroundColor: c, BackgroundColor: c, ShowLine: chartjs.False, PointHitRadius: 6}
+			dataset.XAxisID = xa
+			dataset.YAxisID = ya
+			c1.AddDataset(dataset)
 		}
-		xys := &vs{xs: mat64.Col(nil, 0, mat), ys: mat64.Col(nil, pc-1, mat)}
-		dataset := chartjs.Dataset{Data: xys, Label: "samples", Fill: chartjs.False, PointHoverRadius: 6,
-			PointRadius: 4,
-			BorderWidth: 0, BorderColor: &types.RGBA{R: 150, G: 150, B: 150, A: 150}, PointBackgroundColor: c, BackgroundColor: c, ShowLine: chartjs.False, PointHitRadius: 6}
-		dataset.XAxisID = xa
-		dataset.YAxisID = ya
-		c1.AddDataset(dataset)
 		c1.Options.Responsive = chartjs.False
 		c1.Options.Legend = &chartjs.Legend{Display: chartjs.False}
+		if len(sg.members) > 1 {
+			c1.Options.Legend.Display = chartjs.True
+		}
 		c1.Options.Tooltip = &chartjs.Tooltip{Mode: "nearest"}
 		charts = append(charts, c1)
 	}
-	sjson, err := json.Marshal(samples)
+	sjson, err := json.Marshal(sg.samples(samples))
 	if err != nil {
-		panic(err)
+		pcheck(err)
 	}
 	jsfunc := fmt.Sprintf(`
 	chart.options.hover.mode = 'index';
@@ -221,7 +245,7 @@ func plotPCA(mat *mat64.Dense, samples []string, vars []float64) ([]chartjs.Char
         var names = %s
         var out = []
         tts.forEach(function(ti) {
-            out.push(names[ti.index])
+            out.push(names[ti.datasetIndex][ti.index])
         })
         return out.join(",")
     }`, sjson)
@@ -244,9 +268,10 @@ func plotROCs(rocs [][]float32, samples []string, chrom string) (chartjs.Chart,
 		return chart, err
 	}
 
+	colors := sampleColors(len(rocs))
 	for i, roc := range rocs {
-		xys := asValues(roc, 1/float64(slots)*1/slotsMid)
-		c := randomColor(i)
+		xys := asValues(roc, 1/float64(slots)*1/slotsMid, 0)
+		c := colors[i]
 		dataset := chartjs.Dataset{Data: xys, Label: samples[i], Fill: chartjs.False, PointRadius: 0.0, BorderWidth: 2, BorderColor: c, PointBackgroundColor: c, BackgroundColor: c, PointHitRadius: 8, PointHoverRadius: 3}
 		dataset.XAxisID = xa
 		dataset.YAxisID = ya
@@ -301,7 +326,7 @@ func plotSex(sexes map[string][]float64, chroms []string, samples []string) (*ch
 	}
 	sjson, err := json.Marshal(jssamples)
 	if err != nil {
-		panic(err)
+		pcheck(err)
 	}
 	jsfunc := fmt.Sprintf(`
 	chart.options.hover.mode = 'index'
@@ -321,7 +346,7 @@ func plotSex(sexes map[string][]float64, chroms []string, samples []string) (*ch
 func asPng(path string, chart chartjs.Chart, wInches float64, hInches float64) {
 	p, err := plot.New()
 	if err != nil {
-		panic(err)
+		pcheck(err)
 	}
 	p.X.Label.Text = chart.Options.Scales.XAxes[0].ScaleLabel.LabelString
 	p.Y.Label.Text = chart.Options.Scales.YAxes[0].ScaleLabel.LabelString
@@ -349,7 +374,7 @@ func asPng(path string, chart chartjs.Chart, wInches float64, hInches float64) {
 
 		l, err := plotter.NewLine(data.(*vs))
 		if err != nil {
-			panic(err)
+			pcheck(err)
 		}
 		c := color.RGBA(*ds.BorderColor)
 		c.A = 255
@@ -359,6 +384,34 @@ func asPng(path string, chart chartjs.Chart, wInches float64, hInches float64) {
 		p.Add(l)
 	}
 	if err := p.Save(vg.Length(wInches)*vg.Inch, vg.Length(hInches)*vg.Inch, path); err != nil {
-		panic(err)
+		pcheck(err)
+	}
+}
+
+// asScatterPng is like asPng but draws the points of each dataset in chart; it is used for the plots
+// on the index page which otherwise exist only as javascript.
+func asScatterPng(path string, chart chartjs.Chart, wInches float64, hInches float64) {
+	p, err := plot.New()
+	if err != nil {
+		pcheck(err)
+	}
+	p.X.Label.Text = chart.Options.Scales.XAxes[0].ScaleLabel.LabelString
+	p.Y.Label.Text = chart.Options.Scales.YAxes[0].ScaleLabel.LabelString
+	for _, ds := range chart.Data.Datasets {
+		s, err := plotter.NewScatter(ds.Data.(*vs))
+		if err != nil {
+			pcheck(err)
+		}
+		s.GlyphStyle.Color = color.RGBA(*ds.PointBackgroundColor)
+		s.GlyphStyle.Radius = vg.Points(2.5)
+		s.GlyphStyle.Shape = draw.CircleGlyph{}
+		p.Add(s)
+		if len(chart.Data.Datasets) > 1 {
+			p.Legend.Add(ds.Label, s)
+		}
+	}
+	p.Legend.Top = true
+	if err := p.Save(vg.Length(wInches)*vg.Inch, vg.Length(hInches)*vg.Inch, path); err != nil {
+		pcheck(err)
 	}
 }
@@ -0,0 +1,112 @@
+package indexcov
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/biogo/hts/sam"
+	"github.com/brentp/goleft"
+	"github.com/brentp/xopen"
+)
+
+// region is a span of a reference for which to report coverage. A region that covers the
+// whole reference has start == 0 and end == ref.Len().
+type region struct {
+	ref        *sam.Reference
+	start, end int
+}
+
+func (r region) whole() bool {
+	return r.start == 0 && r.end == r.ref.Len()
+}
+
+// name is used in the output files and plots.
+func (r region) name() string {
+	if r.whole() {
+		return r.ref.Name()
+	}
+	return fmt.Sprintf("%s_%d_%d", r.ref.Name(), r.start, r.end)
+}
+
+// getRegions returns the regions to report given the --chrom and --regions arguments.
+func getRegions(h *sam.Header, chrom string, bedPath string) ([]region, error) {
+	if bedPath != "" {
+		return readRegions(h, bedPath)
+	}
+	if chrom != "" {
+		ref := getRef(h, chrom)
+		if ref == nil {
+			return nil, fmt.Errorf("indexcov: chromosome: %s not found", chrom)
+		}
+		return []region{{ref, 0, ref.Len()}}, nil
+	}
+	regs := make([]region, 0, len(h.Refs()))
+	for _, ref := range h.Refs() {
+		regs = append(regs, region{ref, 0, ref.Len()})
+	}
+	return regs, nil
+}
+
+// readRegions reads a bed file and returns the regions expanded to 16KB tiles, sorted by
+// the order of the references in the header with overlapping regions merged.
+func readRegions(h *sam.Header, path string) ([]region, error) {
+	rdr, err := xopen.Ropen(path)
+	if err != nil {
+		return nil, err
+	}
+	defer rdr.Close()
+
+	var regs []region
+	for n := 1; ; n++ {
+		line, err := rdr.ReadString('\n')
+		if len(line) > 0 && !strings.HasPrefix(line, "#") && !strings.HasPrefix(line, "track") && len(strings.TrimSpace(line)) > 0 {
+			toks := strings.SplitN(strings.TrimRight(line, "\r\n"), "\t", 4)
+			if len(toks) < 3 {
+				return nil, &goleft.ParseError{Path: path, Line: n, Err: fmt.Errorf("indexcov: expected at least 3 fields in bed line: %q", line)}
+			}
+			ref := getRef(h, toks[0])
+			if ref == nil {
+				return nil, &goleft.ParseError{Path: path, Line: n, Err: fmt.Errorf("indexcov: chromosome: %s not found", toks[0])}
+			}
+			start, serr := strconv.Atoi(toks[1])
+			end, eerr := strconv.Atoi(toks[2])
+			if serr != nil || eerr != nil || start < 0 || end <= start {
+				return nil, &goleft.ParseError{Path: path, Line: n, Err: fmt.Errorf("indexcov: bad interval in bed line: %q", line)}
+			}
+			if end > ref.Len() {
+				end = ref.Len()
+			}
+			regs = append(regs, region{ref, start / TileWidth * TileWidth, min(ref.Len(), (end+TileWidth-1)/TileWidth*TileWidth)})
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(regs) == 0 {
+		return nil, fmt.Errorf("indexcov: no regions found in %s", path)
+	}
+	sort.Slice(regs, func(i, j int) bool {
+		if regs[i].ref.ID() != regs[j].ref.ID() {
+			return regs[i].ref.ID() < regs[j].ref.ID()
+		}
+		return regs[i].start < regs[j].start
+	})
+	merged := regs[:1]
+	for _, r := range regs[1:] {
+		last := &merged[len(merged)-1]
+		if r.ref == last.ref && r.start <= last.end {
+			if r.end > last.end {
+				last.end = r.end
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged, nil
+}
@@ -0,0 +1,60 @@
+package indexcov
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/biogo/hts/sam"
+)
+
+func TestReadRegions(t *testing.T) {
+	r1, _ := sam.NewReference("chr1", "", "", 200000, nil, nil)
+	rx, _ := sam.NewReference("chrX", "", "", 100000, nil, nil)
+	h, err := sam.NewHeader(nil, []*sam.Reference{r1, rx})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := ioutil.TempFile("", "goleft-regions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	// out of order, overlapping after expansion to tiles and past the end of chrX.
+	f.WriteString("#header\nX\t90000\t200000\n1\t20000\t30000\tname\n1\t40000\t50000\n1\t100000\t100001\n")
+	f.Close()
+
+	regs, err := readRegions(h, f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := []struct {
+		name       string
+		start, end int
+		whole      bool
+	}{
+		{"chr1_16384_65536", 16384, 65536, false},
+		{"chr1_98304_114688", 98304, 114688, false},
+		{"chrX_81920_100000", 81920, 100000, false},
+	}
+	if len(regs) != len(exp) {
+		t.Fatalf("expected %d regions, got: %v", len(exp), regs)
+	}
+	for i, e := range exp {
+		if r := regs[i]; r.name() != e.name || r.start != e.start || r.end != e.end || r.whole() != e.whole {
+			t.Errorf("region %d: expected %v, got: %s %d %d", i, e, r.name(), r.start, r.end)
+		}
+	}
+
+	regs, err = getRegions(h, "X", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(regs) != 1 || !regs[0].whole() || regs[0].name() != "chrX" {
+		t.Errorf("expected a single region for all of chrX, got: %v", regs)
+	}
+	if _, err := getRegions(h, "chr2", ""); err == nil {
+		t.Errorf("expected error for missing chromosome")
+	}
+}
@@ -0,0 +1,89 @@
+package indexsplit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// formats are the values of --format for the scatter steps of different workflow engines.
+var formats = []string{"bed", "interval_list", "json", "files"}
+
+func validFormat(f string) bool {
+	for _, v := range formats {
+		if v == f {
+			return true
+		}
+	}
+	return false
+}
+
+// writeRegions writes the chunks to w in format. For files, a bed is written for each chunk at
+// $prefix.$i.bed and the paths are written to w.
+func writeRegions(w io.Writer, format, prefix string, chunks []chunk, chroms []chrom) error {
+	switch format {
+	case "interval_list":
+		return writeIntervalList(w, chunks, chroms)
+	case "json":
+		return writeJSON(w, chunks)
+	case "files":
+		return writeFiles(w, prefix, chunks)
+	}
+	for _, c := range chunks {
+		if _, err := fmt.Fprintf(w, "%s\t%d\t%d\n", c.chrom, c.start, c.end); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeIntervalList writes a Picard interval_list which has a sequence dictionary and 1-based,
+// closed intervals.
+func writeIntervalList(w io.Writer, chunks []chunk, chroms []chrom) error {
+	if _, err := fmt.Fprintln(w, "@HD\tVN:1.6\tSO:coordinate"); err != nil {
+		return err
+	}
+	for _, c := range chroms {
+		if _, err := fmt.Fprintf(w, "@SQ\tSN:%s\tLN:%d\n", c.name, c.length); err != nil {
+			return err
+		}
+	}
+	for i, c := range chunks {
+		if _, err := fmt.Fprintf(w, "%s\t%d\t%d\t+\tindexsplit_%d\n", c.chrom, c.start+1, c.end, i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeJSON writes an array of regions as chrom:start-end with 1-based starts so each can be given
+// directly to a tool as a region.
+func writeJSON(w io.Writer, chunks []chunk) error {
+	regions := make([]string, len(chunks))
+	for i, c := range chunks {
+		regions[i] = fmt.Sprintf("%s:%d-%d", c.chrom, c.start+1, c.end)
+	}
+	return json.NewEncoder(w).Encode(regions)
+}
+
+// writeFiles writes each chunk to its own bed and the path of each bed to w. The paths are numbered
+// so they sort in the order of the genome.
+func writeFiles(w io.Writer, prefix string, chunks []chunk) error {
+	if dir := filepath.Dir(prefix); dir != "." {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	for i, c := range chunks {
+		path := fmt.Sprintf("%s.%0*d.bed", prefix, len(fmt.Sprint(len(chunks)-1)), i)
+		if err := os.WriteFile(path, []byte(fmt.Sprintf("%s\t%d\t%d\n", c.chrom, c.start, c.end)), 0644); err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintln(w, path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,538 @@
+// Package indexsplit uses the bam or cram indexes to split the genome into regions with
+// roughly equal amounts of data.
+package indexsplit
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	arg "github.com/alexflint/go-arg"
+	"github.com/brentp/goleft"
+	"github.com/brentp/goleft/bamio"
+	"github.com/brentp/goleft/indexcov"
+	"github.com/brentp/xopen"
+)
+
+var cli = &struct {
+	N                  int      `arg:"-n,help:number of regions to split the genome into."`
+	MaxReads           int64    `arg:"--max-reads-per-chunk,help:split into as many regions as are needed so that each has at most this many estimated mapped reads. an alternative to -n."`
+	Fai                string   `arg:"required,help:fasta index (.fai) giving the chromosomes in the same order as the bams."`
+	Problematic        string   `arg:"help:optional bed file of regions (e.g. centromeres or a blacklist) that are output as their own regions so no other region spans them."`
+	ExcludeProblematic bool     `arg:"--exclude-problematic,help:leave the regions in --problematic out of the output."`
+	TSV                string   `arg:"--tsv,help:optional path to write the estimated compressed bytes and mapped reads of each region."`
+	Max                bool     `arg:"--max,help:balance regions by the most data in any one index in each tile rather than the sum across indexes."`
+	Format             string   `arg:"--format,help:output format: bed or interval_list (Picard) or json (an array of regions) or files (a bed per region named by --prefix)."`
+	Prefix             string   `arg:"--prefix,help:prefix of the per-region beds for --format files."`
+	Indexes            []string `arg:"positional,required,help:bai csi or crai index files (or the bams or crams) to use for splitting the genome."`
+}{Format: "bed", Prefix: "indexsplit"}
+
+func pcheck(e error) {
+	if e != nil {
+		log.Fatal(e)
+	}
+}
+
+type chrom struct {
+	name   string
+	length int
+}
+
+// chunk is a region of a chromosome and the estimated bytes of data in it across all indexes.
+type chunk struct {
+	chrom      string
+	start, end int
+	bytes      int64
+}
+
+// chunkSums estimates the sum in each chunk from the values, e.g. the mapped reads, in each tile.
+func chunkSums(chunks []chunk, reads [][]int64, chroms []chrom) []int64 {
+	ids := make(map[string]int, len(chroms))
+	for i, c := range chroms {
+		ids[c.name] = i
+	}
+	out := make([]int64, len(chunks))
+	for k, c := range chunks {
+		out[k] = int64(sumIn(reads[ids[c.chrom]], c.start, c.end) + 0.5)
+	}
+	return out
+}
+
+// readFai returns the chromosomes in the fai in order.
+func readFai(path string) ([]chrom, error) {
+	g, err := goleft.ReadGenome(path)
+	if err != nil {
+		return nil, err
+	}
+	chroms := make([]chrom, len(g.Contigs))
+	for i, c := range g.Contigs {
+		chroms[i] = chrom{c.Name, c.Len}
+	}
+	return chroms, nil
+}
+
+// indexPath returns path if it is an index or else the index of the bam or cram at path.
+func indexPath(path string) (string, error) {
+	if strings.HasSuffix(path, ".bai") || strings.HasSuffix(path, ".csi") || strings.HasSuffix(path, ".crai") {
+		return path, nil
+	}
+	return bamio.IndexPath(path)
+}
+
+// readIndex returns the index for path which is either an index or a bam or cram. It also returns the
+// count of mapped reads for each chromosome or nil if that is not known as for a .crai.
+func readIndex(path string, chroms []chrom) (*indexcov.Index, []uint64, error) {
+	ipath, err := indexPath(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	idx, err := indexcov.ReadIndex(ipath, len(chroms))
+	if err != nil {
+		return nil, nil, err
+	}
+	mapped := make([]uint64, len(chroms))
+	if _, ok := idx.Mapped(0); ok {
+		for i := range chroms {
+			mapped[i], _ = idx.Mapped(i)
+		}
+		return idx, mapped, nil
+	}
+	if !bamio.IsCRAM(path) {
+		return idx, nil, nil
+	}
+	// the .crai doesn't have read counts so we use samtools.
+	stats, err := bamio.IdxStats(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	for i, c := range chroms {
+		mapped[i] = stats[c.name]
+	}
+	return idx, mapped, nil
+}
+
+// tileSizes sums the bytes in each 16KB tile of each chromosome across all indexes. If the mapped
+// reads are known for every index, it also estimates the reads in each tile by assuming that each
+// byte of a chromosome in an index has the same number of reads.
+func tileSizes(idxs []*indexcov.Index, mapped [][]uint64, chroms []chrom) (sizes [][]int64, reads [][]int64) {
+	sizes = make([][]int64, len(chroms))
+	fsizes := make([][]float64, len(chroms))
+	haveReads := true
+	for k, idx := range idxs {
+		haveReads = haveReads && mapped[k] != nil
+		for i := range chroms {
+			tiles := idx.TileSizes(i)
+			var total int64
+			for t, s := range tiles {
+				for len(sizes[i]) <= t {
+					sizes[i] = append(sizes[i], 0)
+					fsizes[i] = append(fsizes[i], 0)
+				}
+				sizes[i][t] += s
+				total += s
+			}
+			if mapped[k] == nil || total == 0 {
+				continue
+			}
+			perByte := float64(mapped[k][i]) / float64(total)
+			for t, s := range tiles {
+				fsizes[i][t] += float64(s) * perByte
+			}
+		}
+	}
+	if !haveReads {
+		return sizes, nil
+	}
+	reads = make([][]int64, len(chroms))
+	for i, tiles := range fsizes {
+		reads[i] = make([]int64, len(tiles))
+		for t, r := range tiles {
+			reads[i][t] = int64(r + 0.5)
+		}
+	}
+	return sizes, reads
+}
+
+// tiler is implemented by indexcov.Index.
+type tiler interface {
+	TileSizes(refID int) []int64
+}
+
+// tileMax returns the largest bytes in any one index for each 16KB tile of each chromosome. For
+// joint-calling, the time for a region is bounded by the sample with the most data in it rather
+// than by the total.
+func tileMax(idxs []tiler, chroms []chrom) [][]int64 {
+	sizes := make([][]int64, len(chroms))
+	for _, idx := range idxs {
+		for i := range chroms {
+			for t, s := range idx.TileSizes(i) {
+				for len(sizes[i]) <= t {
+					sizes[i] = append(sizes[i], 0)
+				}
+				if s > sizes[i][t] {
+					sizes[i][t] = s
+				}
+			}
+		}
+	}
+	return sizes
+}
+
+// readTiler estimates the mapped reads in each tile of an index from its bytes by assuming that each
+// byte of a chromosome has the same number of reads as in tileSizes.
+type readTiler struct {
+	tiler
+	mapped []uint64
+}
+
+func (r readTiler) TileSizes(refID int) []int64 {
+	tiles := r.tiler.TileSizes(refID)
+	var total int64
+	for _, s := range tiles {
+		total += s
+	}
+	reads := make([]int64, len(tiles))
+	if total == 0 {
+		return reads
+	}
+	perByte := float64(r.mapped[refID]) / float64(total)
+	for t, s := range tiles {
+		reads[t] = int64(float64(s)*perByte + 0.5)
+	}
+	return reads
+}
+
+type interval struct {
+	start, end int
+}
+
+// readProblematic reads a bed file of regions that should not be part of any other chunk. The
+// intervals for each chromosome are sorted and merged.
+func readProblematic(path string) (map[string][]interval, error) {
+	rdr, err := xopen.Ropen(path)
+	if err != nil {
+		return nil, err
+	}
+	defer rdr.Close()
+	m := make(map[string][]interval)
+	for n := 1; ; n++ {
+		line, err := rdr.ReadString('\n')
+		if len(strings.TrimSpace(line)) > 0 && !strings.HasPrefix(line, "#") && !strings.HasPrefix(line, "track") {
+			toks := strings.SplitN(strings.TrimRight(line, "\r\n"), "\t", 4)
+			if len(toks) < 3 {
+				return nil, &goleft.ParseError{Path: path, Line: n, Err: fmt.Errorf("indexsplit: expected at least 3 fields in bed line: %q", line)}
+			}
+			s, serr := strconv.Atoi(toks[1])
+			e, eerr := strconv.Atoi(toks[2])
+			if serr != nil || eerr != nil || e <= s || s < 0 {
+				return nil, &goleft.ParseError{Path: path, Line: n, Err: fmt.Errorf("indexsplit: bad interval in bed line: %q", line)}
+			}
+			m[toks[0]] = append(m[toks[0]], interval{s, e})
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	for c, ivs := range m {
+		sort.Slice(ivs, func(i, j int) bool { return ivs[i].start < ivs[j].start })
+		merged := ivs[:1]
+		for _, iv := range ivs[1:] {
+			last := &merged[len(merged)-1]
+			if iv.start <= last.end {
+				if iv.end > last.end {
+					last.end = iv.end
+				}
+				continue
+			}
+			merged = append(merged, iv)
+		}
+		m[c] = merged
+	}
+	return m, nil
+}
+
+// segment is part of a chromosome that is either problematic or that is split into chunks.
+type segment struct {
+	interval
+	problem bool
+}
+
+// segments divides a chromosome of length into the problematic intervals and the stretches between them.
+func segments(length int, problems []interval) []segment {
+	var segs []segment
+	pos := 0
+	for _, p := range problems {
+		if p.start >= length {
+			break
+		}
+		if p.end > length {
+			p.end = length
+		}
+		if p.start > pos {
+			segs = append(segs, segment{interval{pos, p.start}, false})
+		}
+		segs = append(segs, segment{p, true})
+		pos = p.end
+	}
+	if pos < length {
+		segs = append(segs, segment{interval{pos, length}, false})
+	}
+	return segs
+}
+
+// bytesIn estimates the bytes in [start, end) from the bytes in each tile assuming the data is
+// uniform within a tile.
+func sumIn(tiles []int64, start, end int) float64 {
+	var b float64
+	for t := start / indexcov.TileWidth; t < len(tiles) && t*indexcov.TileWidth < end; t++ {
+		ts, te := t*indexcov.TileWidth, (t+1)*indexcov.TileWidth
+		if ts < start {
+			ts = start
+		}
+		if te > end {
+			te = end
+		}
+		b += float64(tiles[t]) * float64(te-ts) / indexcov.TileWidth
+	}
+	return b
+}
+
+// split divides the chromosomes into about n chunks with equal amounts of data. A chunk never spans
+// chromosomes so each chromosome has at least one chunk and there will be more than n chunks if there
+// are many chromosomes. Chunks end on 16KB tiles so a single tile with a lot of data is not split.
+// Each of the problems for a chromosome is a chunk on its own, or, if exclude is true, it is left out.
+// If the indexes have no data, each chromosome is a chunk.
+func split(sizes [][]int64, chroms []chrom, n int, problems map[string][]interval, exclude bool) []chunk {
+	var total float64
+	for i, c := range chroms {
+		for _, s := range segments(c.length, problems[c.name]) {
+			if !s.problem {
+				total += sumIn(sizes[i], s.start, s.end)
+			}
+		}
+	}
+	if total == 0 {
+		// without data every tile would meet the target so each chromosome is a chunk.
+		goleft.Warnf("indexsplit: the indexes have no data. writing a region for each chromosome")
+		return splitWhen(sizes, chroms, problems, exclude, func(acc, next float64) bool { return false })
+	}
+	target := total / float64(n)
+	return splitWhen(sizes, chroms, problems, exclude, func(acc, next float64) bool { return acc >= target })
+}
+
+// splitMax divides the chromosomes as split does into as many chunks as are needed so that none has
+// more than maxSize of data. A single tile or problematic region with more is still a chunk of its
+// own.
+func splitMax(sizes [][]int64, chroms []chrom, maxSize int64, problems map[string][]interval, exclude bool) []chunk {
+	return splitWhen(sizes, chroms, problems, exclude, func(acc, next float64) bool { return acc+next > float64(maxSize) })
+}
+
+// splitWhen walks along the tiles of each segment of each chromosome and ends a chunk after a tile when
+// full is true for the data in the chunk and that in the next tile.
+func splitWhen(sizes [][]int64, chroms []chrom, problems map[string][]interval, exclude bool, full func(acc, next float64) bool) []chunk {
+	var chunks []chunk
+	for i, c := range chroms {
+		for _, s := range segments(c.length, problems[c.name]) {
+			if s.problem {
+				if !exclude {
+					chunks = append(chunks, chunk{c.name, s.start, s.end, int64(sumIn(sizes[i], s.start, s.end) + 0.5)})
+				}
+				continue
+			}
+			start := s.start
+			var acc float64
+			for t := s.start / indexcov.TileWidth; ; t++ {
+				end := (t + 1) * indexcov.TileWidth
+				if end >= s.end {
+					acc += sumIn(sizes[i], max(start, t*indexcov.TileWidth), s.end)
+					break
+				}
+				acc += sumIn(sizes[i], max(start, t*indexcov.TileWidth), end)
+				if full(acc, sumIn(sizes[i], end, min(end+indexcov.TileWidth, s.end))) {
+					chunks = append(chunks, chunk{c.name, start, end, int64(acc + 0.5)})
+					start, acc = end, 0
+				}
+			}
+			chunks = append(chunks, chunk{c.name, start, s.end, int64(acc + 0.5)})
+		}
+	}
+	return chunks
+}
+
+// snap moves each boundary between adjacent chunks of a chromosome to the nearest of the starts of
+// the CRAM containers on that chromosome that is within both chunks so that a region query on each
+// chunk does not begin in the middle of a container that is also decoded for the previous chunk.
+// Boundaries at the edges of a problematic region are not moved. It returns the number moved.
+func snap(chunks []chunk, starts [][]int, chroms []chrom, problems map[string][]interval) int {
+	ids := make(map[string]int, len(chroms))
+	for i, c := range chroms {
+		ids[c.name] = i
+	}
+	moved := 0
+	for k := 0; k+1 < len(chunks); k++ {
+		a, b := &chunks[k], &chunks[k+1]
+		if a.chrom != b.chrom || a.end != b.start || ids[a.chrom] >= len(starts) {
+			continue
+		}
+		if atProblem(problems[a.chrom], a.end) {
+			continue
+		}
+		st := starts[ids[a.chrom]]
+		best := -1
+		i := sort.SearchInts(st, a.end)
+		for _, j := range []int{i - 1, i} {
+			if j < 0 || j >= len(st) || st[j] <= a.start || st[j] >= b.end {
+				continue
+			}
+			if best == -1 || abs(st[j]-a.end) < abs(best-a.end) {
+				best = st[j]
+			}
+		}
+		if best != -1 && best != a.end {
+			a.end, b.start = best, best
+			moved++
+		}
+	}
+	return moved
+}
+
+// atProblem reports whether pos is the start or end of one of the problems.
+func atProblem(problems []interval, pos int) bool {
+	for _, p := range problems {
+		if p.start == pos || p.end == pos {
+			return true
+		}
+	}
+	return false
+}
+
+func abs(a int) int {
+	if a < 0 {
+		return -a
+	}
+	return a
+}
+
+// Main is called from the goleft dispatcher.
+func Main() {
+	p := arg.MustParse(cli)
+	if (cli.N == 0) == (cli.MaxReads == 0) {
+		p.Fail("indexsplit: specify exactly one of -n or --max-reads-per-chunk")
+	}
+	if cli.N < 0 || cli.MaxReads < 0 {
+		p.Fail("indexsplit: -n and --max-reads-per-chunk must be at least 1")
+	}
+	if !validFormat(cli.Format) {
+		p.Fail(fmt.Sprintf("indexsplit: unknown --format %s", cli.Format))
+	}
+	chroms, err := readFai(cli.Fai)
+	pcheck(err)
+
+	idxs := make([]*indexcov.Index, len(cli.Indexes))
+	mapped := make([][]uint64, len(cli.Indexes))
+	crai := ""
+	for i, path := range cli.Indexes {
+		idxs[i], mapped[i], err = readIndex(path, chroms)
+		pcheck(err)
+		if ipath, _ := indexPath(path); crai == "" && strings.HasSuffix(ipath, ".crai") {
+			crai = ipath
+		}
+	}
+
+	var problems map[string][]interval
+	if cli.Problematic != "" {
+		problems, err = readProblematic(cli.Problematic)
+		pcheck(err)
+	} else if cli.ExcludeProblematic {
+		p.Fail("indexsplit: --exclude-problematic requires --problematic")
+	}
+
+	sizes, reads := tileSizes(idxs, mapped, chroms)
+	if cli.MaxReads > 0 && reads == nil {
+		log.Fatal("indexsplit: --max-reads-per-chunk requires the mapped reads of every index. use the crams rather than the .crai")
+	}
+	// tiles are the data in each tile that the regions are balanced on.
+	tiles := sizes
+	if cli.MaxReads > 0 {
+		tiles = reads
+	}
+	if cli.Max {
+		tilers := make([]tiler, len(idxs))
+		for i, idx := range idxs {
+			tilers[i] = idx
+			if cli.MaxReads > 0 {
+				tilers[i] = readTiler{idx, mapped[i]}
+			}
+		}
+		tiles = tileMax(tilers, chroms)
+	}
+	var chunks []chunk
+	if cli.MaxReads > 0 {
+		chunks = splitMax(tiles, chroms, cli.MaxReads, problems, cli.ExcludeProblematic)
+		over := 0
+		for _, c := range chunks {
+			if c.bytes > cli.MaxReads {
+				over++
+			}
+		}
+		if over > 0 {
+			goleft.Warnf("indexsplit: %d regions are a single 16KB tile or problematic region with more than %d reads", over, cli.MaxReads)
+		}
+		goleft.Infof("indexsplit: split into %d regions for --max-reads-per-chunk %d", len(chunks), cli.MaxReads)
+	} else {
+		chunks = split(tiles, chroms, cli.N, problems, cli.ExcludeProblematic)
+	}
+	if cli.Max || cli.MaxReads > 0 {
+		// the bytes in the tsv are always the total across indexes.
+		for k, b := range chunkSums(chunks, sizes, chroms) {
+			chunks[k].bytes = b
+		}
+	}
+	if crai != "" {
+		starts, err := indexcov.ContainerStarts(crai, len(chroms))
+		pcheck(err)
+		n := snap(chunks, starts, chroms, problems)
+		for k, b := range chunkSums(chunks, sizes, chroms) {
+			chunks[k].bytes = b
+		}
+		goleft.Infof("indexsplit: moved %d region boundaries to the start of a CRAM container in %s", n, crai)
+	}
+	w := bufio.NewWriter(os.Stdout)
+	defer w.Flush()
+	pcheck(writeRegions(w, cli.Format, cli.Prefix, chunks, chroms))
+	if cli.TSV != "" {
+		pcheck(writeTSV(cli.TSV, chunks, reads, chroms))
+	}
+}
+
+// writeTSV writes the bytes and reads in each chunk. reads are NA if they aren't known for all indexes.
+func writeTSV(path string, chunks []chunk, reads [][]int64, chroms []chrom) error {
+	if reads == nil {
+		goleft.Warnf("indexsplit: mapped read counts are not available for all indexes; writing NA")
+	}
+	fh, err := xopen.Wopen(path)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(fh, "#chrom\tstart\tend\tbytes\tmapped_reads")
+	var nreads []int64
+	if reads != nil {
+		nreads = chunkSums(chunks, reads, chroms)
+	}
+	for k, c := range chunks {
+		r := "NA"
+		if nreads != nil {
+			r = strconv.FormatInt(nreads[k], 10)
+		}
+		fmt.Fprintf(fh, "%s\t%d\t%d\t%d\t%s\n", c.chrom, c.start, c.end, c.bytes, r)
+	}
+	return fh.Close()
+}
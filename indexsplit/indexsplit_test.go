@@ -0,0 +1,168 @@
+package indexsplit
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplit(t *testing.T) {
+	chroms := []chrom{{"1", 5 * 16384}, {"2", 100}, {"3", 3 * 16384}}
+	sizes := [][]int64{{10, 10, 40, 0, 20}, nil, {10, 5, 5}}
+	// target is 100 / 4 = 25 bytes per chunk.
+	exp := []chunk{
+		{"1", 0, 3 * 16384, 60},
+		{"1", 3 * 16384, 5 * 16384, 20},
+		{"2", 0, 100, 0},
+		{"3", 0, 3 * 16384, 20},
+	}
+	if got := split(sizes, chroms, 4, nil, false); !reflect.DeepEqual(got, exp) {
+		t.Errorf("expected %v, got: %v", exp, got)
+	}
+
+	got := split(sizes, chroms, 1, nil, false)
+	if len(got) != len(chroms) {
+		t.Errorf("expected a chunk per chromosome, got: %v", got)
+	}
+
+	// empty indexes have a chunk per chromosome rather than one per tile.
+	empty := [][]int64{{0, 0, 0, 0, 0}, nil, {0, 0, 0}}
+	exp = []chunk{{"1", 0, 5 * 16384, 0}, {"2", 0, 100, 0}, {"3", 0, 3 * 16384, 0}}
+	if got := split(empty, chroms, 4, nil, false); !reflect.DeepEqual(got, exp) {
+		t.Errorf("expected a chunk per chromosome for empty indexes, got: %v", got)
+	}
+}
+
+func TestSplitMax(t *testing.T) {
+	chroms := []chrom{{"1", 5 * 16384}, {"2", 100}}
+	sizes := [][]int64{{10, 10, 40, 0, 20}, nil}
+	// a chunk ends before the tile that would take it above 25 and the tile with 40 is on its own.
+	exp := []chunk{
+		{"1", 0, 2 * 16384, 20},
+		{"1", 2 * 16384, 3 * 16384, 40},
+		{"1", 3 * 16384, 5 * 16384, 20},
+		{"2", 0, 100, 0},
+	}
+	if got := splitMax(sizes, chroms, 25, nil, false); !reflect.DeepEqual(got, exp) {
+		t.Errorf("expected %v, got: %v", exp, got)
+	}
+	// 10 times the data gives 10 times the chunks for the same maximum.
+	for i := range sizes[0] {
+		sizes[0][i] *= 10
+	}
+	if got := splitMax(sizes, chroms, 25, nil, false); len(got) != 6 {
+		t.Errorf("expected a chunk per tile with data, got: %v", got)
+	}
+}
+
+func TestReadTiler(t *testing.T) {
+	r := readTiler{tiles{{10, 30, 0}}, []uint64{100}}
+	if got, exp := r.TileSizes(0), []int64{25, 75, 0}; !reflect.DeepEqual(got, exp) {
+		t.Errorf("expected %v, got: %v", exp, got)
+	}
+}
+
+func TestSplitProblematic(t *testing.T) {
+	chroms := []chrom{{"1", 4 * 16384}}
+	sizes := [][]int64{{100, 100, 100, 100}}
+	// the middle half of tile 1 is problematic.
+	problems := map[string][]interval{"1": {{16384 + 4096, 16384 + 12288}}}
+	exp := []chunk{
+		{"1", 0, 16384 + 4096, 125},
+		{"1", 16384 + 4096, 16384 + 12288, 50},
+		{"1", 16384 + 12288, 3 * 16384, 125},
+		{"1", 3 * 16384, 4 * 16384, 100},
+	}
+	if got := split(sizes, chroms, 3, problems, false); !reflect.DeepEqual(got, exp) {
+		t.Errorf("expected %v, got: %v", exp, got)
+	}
+	exp = append(exp[:1], exp[2:]...)
+	if got := split(sizes, chroms, 3, problems, true); !reflect.DeepEqual(got, exp) {
+		t.Errorf("expected %v, got: %v", exp, got)
+	}
+}
+
+func TestSnap(t *testing.T) {
+	chroms := []chrom{{"1", 4 * 16384}, {"2", 16384}}
+	chunks := []chunk{
+		{"1", 0, 16384, 0},
+		{"1", 16384, 2 * 16384, 0},
+		{"1", 2 * 16384, 3 * 16384, 0},
+		{"1", 3 * 16384, 4 * 16384, 0},
+		{"2", 0, 16384, 0},
+	}
+	// the boundary at 16384 moves to the nearer container, that at 32768 has none within its chunks
+	// and that at 49152 is the start of a problematic region.
+	starts := [][]int{{0, 15000, 16000, 50000}, {100}}
+	problems := map[string][]interval{"1": {{3 * 16384, 3*16384 + 100}}}
+	if n := snap(chunks, starts, chroms, problems); n != 1 {
+		t.Errorf("expected 1 boundary to move, got: %d", n)
+	}
+	exp := []chunk{
+		{"1", 0, 16000, 0},
+		{"1", 16000, 2 * 16384, 0},
+		{"1", 2 * 16384, 3 * 16384, 0},
+		{"1", 3 * 16384, 4 * 16384, 0},
+		{"2", 0, 16384, 0},
+	}
+	if !reflect.DeepEqual(chunks, exp) {
+		t.Errorf("expected %v, got: %v", exp, chunks)
+	}
+}
+
+func TestChunkSums(t *testing.T) {
+	chroms := []chrom{{"1", 4 * 16384}, {"2", 16384}}
+	reads := [][]int64{{10, 20, 30, 40}, nil}
+	chunks := []chunk{{"1", 0, 16384 + 8192, 0}, {"1", 16384 + 8192, 4 * 16384, 0}, {"2", 0, 16384, 0}}
+	if got, exp := chunkSums(chunks, reads, chroms), []int64{20, 80, 0}; !reflect.DeepEqual(got, exp) {
+		t.Errorf("expected %v, got: %v", exp, got)
+	}
+}
+
+type tiles [][]int64
+
+func (t tiles) TileSizes(refID int) []int64 { return t[refID] }
+
+func TestTileMax(t *testing.T) {
+	chroms := []chrom{{"1", 3 * 16384}, {"2", 16384}}
+	// a deep sample has most of its data at the start of 1 and a shallow one at the end.
+	idxs := []tiler{tiles{{100, 10, 10}, {5}}, tiles{{20, 20, 60, 30}, nil}}
+	exp := [][]int64{{100, 20, 60, 30}, {5}}
+	if got := tileMax(idxs, chroms); !reflect.DeepEqual(got, exp) {
+		t.Errorf("expected %v, got: %v", exp, got)
+	}
+}
+
+func TestWriteRegions(t *testing.T) {
+	chroms := []chrom{{"1", 5 * 16384}, {"2", 100}}
+	chunks := []chunk{{"1", 0, 3 * 16384, 60}, {"1", 3 * 16384, 5 * 16384, 20}, {"2", 0, 100, 0}}
+	for format, exp := range map[string]string{
+		"bed":           "1\t0\t49152\n1\t49152\t81920\n2\t0\t100\n",
+		"interval_list": "@HD\tVN:1.6\tSO:coordinate\n@SQ\tSN:1\tLN:81920\n@SQ\tSN:2\tLN:100\n1\t1\t49152\t+\tindexsplit_0\n1\t49153\t81920\t+\tindexsplit_1\n2\t1\t100\t+\tindexsplit_2\n",
+		"json":          "[\"1:1-49152\",\"1:49153-81920\",\"2:1-100\"]\n",
+	} {
+		var buf bytes.Buffer
+		if err := writeRegions(&buf, format, "", chunks, chroms); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != exp {
+			t.Errorf("%s: expected:\n%s\ngot:\n%s", format, exp, buf.String())
+		}
+	}
+
+	prefix := filepath.Join(t.TempDir(), "shards", "s")
+	var buf bytes.Buffer
+	if err := writeRegions(&buf, "files", prefix, chunks, chroms); err != nil {
+		t.Fatal(err)
+	}
+	paths := strings.Fields(buf.String())
+	if len(paths) != 3 || paths[2] != prefix+".2.bed" {
+		t.Fatalf("unexpected paths: %v", paths)
+	}
+	if b, err := os.ReadFile(paths[1]); err != nil || string(b) != "1\t49152\t81920\n" {
+		t.Errorf("unexpected bed for the second region: %q %v", b, err)
+	}
+}
@@ -0,0 +1,460 @@
+// Package merge combines the per-sample output of covstats, depth and indexcov into a single table
+// and an HTML dashboard for a cohort.
+package merge
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	arg "github.com/alexflint/go-arg"
+	"github.com/brentp/goleft"
+	"github.com/brentp/xopen"
+)
+
+var cli = &struct {
+	Covstats []string `arg:"help:output(s) of covstats --format tsv."`
+	Depth    []string `arg:"help:$prefix.depth.bed file(s) from goleft depth. the sample is the prefix."`
+	Indexcov []string `arg:"help:output directory(s) of indexcov."`
+	Prefix   string   `arg:"-p,required,help:prefix for the $prefix.tsv table and the $prefix.html dashboard."`
+}{}
+
+func pcheck(e error) {
+	if e != nil {
+		log.Fatal(e)
+	}
+}
+
+// missing is written for a sample without a value for a column.
+const missing = "NA"
+
+// table holds the values of each column for each sample in the order they were added.
+type table struct {
+	samples []string
+	cols    []string
+	// vals[sample][col]
+	vals map[string]map[string]string
+	// batch is the indexcov run of each sample or, without indexcov, the file it was first seen in.
+	batch map[string]string
+}
+
+func newTable() *table {
+	return &table{vals: make(map[string]map[string]string), batch: make(map[string]string)}
+}
+
+func (t *table) set(sample, batch, col, val string) {
+	if _, ok := t.vals[sample]; !ok {
+		t.samples = append(t.samples, sample)
+		t.vals[sample] = make(map[string]string)
+		t.batch[sample] = batch
+	}
+	if _, ok := t.colIdx(col); !ok {
+		t.cols = append(t.cols, col)
+	}
+	t.vals[sample][col] = val
+}
+
+func (t *table) colIdx(col string) (int, bool) {
+	for i, c := range t.cols {
+		if c == col {
+			return i, true
+		}
+	}
+	return -1, false
+}
+
+func (t *table) get(sample, col string) string {
+	if v, ok := t.vals[sample][col]; ok {
+		return v
+	}
+	return missing
+}
+
+func (t *table) write(w io.Writer) error {
+	if _, err := fmt.Fprintf(w, "sample\tbatch\t%s\n", strings.Join(t.cols, "\t")); err != nil {
+		return err
+	}
+	row := make([]string, len(t.cols))
+	for _, s := range t.samples {
+		for i, c := range t.cols {
+			row[i] = t.get(s, c)
+		}
+		if _, err := fmt.Fprintf(w, "%s\t%s\t%s\n", s, t.batch[s], strings.Join(row, "\t")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// binSet is the coverage of each sample in each bin. Bins are keyed by chrom and start.
+type binSet struct {
+	keys    []string
+	samples []string
+	// vals[sample][bin]
+	vals [][]float64
+}
+
+// readLines calls fn with each non-empty line of path and its line number.
+func readLines(path string, fn func(line string, n int) error) error {
+	rdr, err := xopen.Ropen(path)
+	if err != nil {
+		return err
+	}
+	defer rdr.Close()
+	for n := 1; ; n++ {
+		line, err := rdr.ReadString('\n')
+		if line = strings.TrimRight(line, "\r\n"); len(line) > 0 {
+			if e := fn(line, n); e != nil {
+				return e
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// readCovstats adds the columns from the tsv output of covstats to t.
+func readCovstats(path string, t *table) error {
+	var hdr []string
+	return readLines(path, func(line string, n int) error {
+		toks := strings.Split(line, "\t")
+		if hdr == nil {
+			if toks[0] != "sample" {
+				return &goleft.ParseError{Path: path, Line: n, Err: fmt.Errorf("merge: expected header from covstats --format tsv, got: %q", line)}
+			}
+			if len(toks) > 1 && toks[1] == "read_group" {
+				return fmt.Errorf("merge: %s has a row per read-group. run covstats without --by-rg", path)
+			}
+			hdr = toks
+			return nil
+		}
+		if len(toks) != len(hdr) {
+			return &goleft.ParseError{Path: path, Line: n, Err: fmt.Errorf("merge: expected %d fields, got %d", len(hdr), len(toks))}
+		}
+		for i := 1; i < len(toks); i++ {
+			t.set(toks[0], filepath.Base(path), "covstats."+hdr[i], toks[i])
+		}
+		return nil
+	})
+}
+
+// depthSample is the summary of a single $prefix.depth.bed.
+type depthSample struct {
+	sample  string
+	mean    float64
+	zero    float64
+	keys    []string
+	windows []float64
+}
+
+// depthName returns the sample name from the path of a depth.bed which is the $prefix given to depth.
+func depthName(path string) string {
+	name := filepath.Base(path)
+	for _, suff := range []string{".gz", ".bed", ".depth"} {
+		name = strings.TrimSuffix(name, suff)
+	}
+	return name
+}
+
+func readDepth(path string) (*depthSample, error) {
+	d := &depthSample{sample: depthName(path)}
+	var bases, zero float64
+	err := readLines(path, func(line string, n int) error {
+		if line[0] == '#' {
+			return nil
+		}
+		toks := strings.SplitN(line, "\t", 5)
+		if len(toks) < 4 {
+			return &goleft.ParseError{Path: path, Line: n, Err: fmt.Errorf("merge: expected at least 4 fields, got: %q", line)}
+		}
+		start, err := strconv.Atoi(toks[1])
+		if err != nil {
+			return &goleft.ParseError{Path: path, Line: n, Err: err}
+		}
+		end, err := strconv.Atoi(toks[2])
+		if err != nil {
+			return &goleft.ParseError{Path: path, Line: n, Err: err}
+		}
+		v, err := strconv.ParseFloat(toks[3], 64)
+		if err != nil {
+			return &goleft.ParseError{Path: path, Line: n, Err: err}
+		}
+		l := float64(end - start)
+		bases += l
+		d.mean += v * l
+		if v == 0 {
+			zero += l
+		}
+		d.keys = append(d.keys, toks[0]+":"+toks[1])
+		d.windows = append(d.windows, v)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if bases == 0 {
+		return nil, fmt.Errorf("merge: no windows found in %s", path)
+	}
+	d.mean /= bases
+	d.zero = zero / bases
+	return d, nil
+}
+
+// readCallable returns the fraction of bases that are CALLABLE in a callable.summary.txt from depth --events.
+func readCallable(path string) (float64, error) {
+	var callable, total float64
+	err := readLines(path, func(line string, n int) error {
+		toks := strings.Split(line, "\t")
+		if len(toks) != 2 || toks[0] == "state" {
+			return nil
+		}
+		v, err := strconv.ParseFloat(toks[1], 64)
+		if err != nil {
+			return &goleft.ParseError{Path: path, Line: n, Err: err}
+		}
+		if toks[0] == "CALLABLE" {
+			callable = v
+		}
+		total += v
+		return nil
+	})
+	if err != nil || total == 0 {
+		return 0, err
+	}
+	return callable / total, nil
+}
+
+// addDepth adds the depth columns to t and returns the windows of each sample scaled by the median window.
+func addDepth(paths []string, t *table) *binSet {
+	bs := &binSet{}
+	for _, p := range paths {
+		d, err := readDepth(p)
+		pcheck(err)
+		// each depth.bed is a single sample so the directory is used as the batch.
+		batch := filepath.Base(filepath.Dir(p))
+		t.set(d.sample, batch, "depth.mean", fmt.Sprintf("%.2f", d.mean))
+		t.set(d.sample, batch, "depth.zero_fraction", fmt.Sprintf("%.4f", d.zero))
+		summary := strings.TrimSuffix(strings.TrimSuffix(p, ".gz"), "depth.bed") + "callable.summary.txt"
+		if _, err := os.Stat(summary); err == nil {
+			c, err := readCallable(summary)
+			pcheck(err)
+			t.set(d.sample, batch, "depth.callable_fraction", fmt.Sprintf("%.4f", c))
+		}
+		scaleByMedian(d.windows)
+		bs = bs.join(&binSet{keys: d.keys, samples: []string{d.sample}, vals: [][]float64{d.windows}})
+	}
+	return bs
+}
+
+// scaleByMedian divides each value by the median of the non-zero values.
+func scaleByMedian(vals []float64) {
+	tmp := make([]float64, 0, len(vals))
+	for _, v := range vals {
+		if v > 0 {
+			tmp = append(tmp, v)
+		}
+	}
+	if len(tmp) == 0 {
+		return
+	}
+	sort.Float64s(tmp)
+	med := tmp[len(tmp)/2]
+	for i := range vals {
+		vals[i] /= med
+	}
+}
+
+// join returns the bins that are in both b and o with the samples of both.
+func (b *binSet) join(o *binSet) *binSet {
+	if b == nil || len(b.samples) == 0 {
+		return o
+	}
+	idx := make(map[string]int, len(o.keys))
+	for i, k := range o.keys {
+		idx[k] = i
+	}
+	j := &binSet{samples: append(append([]string{}, b.samples...), o.samples...)}
+	var bi, oi []int
+	for i, k := range b.keys {
+		if k2, ok := idx[k]; ok {
+			j.keys = append(j.keys, k)
+			bi, oi = append(bi, i), append(oi, k2)
+		}
+	}
+	for _, vals := range b.vals {
+		v := make([]float64, len(bi))
+		for i, k := range bi {
+			v[i] = vals[k]
+		}
+		j.vals = append(j.vals, v)
+	}
+	for _, vals := range o.vals {
+		v := make([]float64, len(oi))
+		for i, k := range oi {
+			v[i] = vals[k]
+		}
+		j.vals = append(j.vals, v)
+	}
+	return j
+}
+
+// findOne returns the single file in dir that matches the pattern.
+func findOne(dir, pattern string) (string, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, pattern))
+	if err != nil {
+		return "", err
+	}
+	if len(paths) != 1 {
+		return "", fmt.Errorf("merge: expected a single %s in %s, found %d", pattern, dir, len(paths))
+	}
+	return paths[0], nil
+}
+
+// readPed adds the columns from the ped file of an indexcov run to t and returns the sex chromosomes.
+// The principal components are not added as they are specific to that run.
+func readPed(path, batch string, t *table) (map[string]bool, error) {
+	var hdr []string
+	sex := make(map[string]bool)
+	err := readLines(path, func(line string, n int) error {
+		toks := strings.Split(line, "\t")
+		if hdr == nil {
+			if !strings.HasPrefix(line, "#family_id") || len(toks) < 6 {
+				return &goleft.ParseError{Path: path, Line: n, Err: fmt.Errorf("merge: expected header from indexcov, got: %q", line)}
+			}
+			hdr = toks
+			for _, h := range hdr[6:] {
+				if strings.HasPrefix(h, "CN") {
+					sex[h[2:]] = true
+				}
+			}
+			return nil
+		}
+		if len(toks) != len(hdr) {
+			return &goleft.ParseError{Path: path, Line: n, Err: fmt.Errorf("merge: expected %d fields, got %d", len(hdr), len(toks))}
+		}
+		t.set(toks[1], batch, "indexcov.sex", toks[4])
+		// the indexcov run is the most likely batch so it is preferred to a covstats or depth file.
+		t.batch[toks[1]] = batch
+		for i := 6; i < len(toks); i++ {
+			if !strings.HasPrefix(hdr[i], "PC") {
+				t.set(toks[1], batch, "indexcov."+hdr[i], toks[i])
+			}
+		}
+		return nil
+	})
+	return sex, err
+}
+
+// readIndexcovBins reads the scaled coverage of each sample in each bin not on a sex chromosome.
+func readIndexcovBins(path string, sex map[string]bool) (*binSet, error) {
+	bs := &binSet{}
+	err := readLines(path, func(line string, n int) error {
+		toks := strings.Split(line, "\t")
+		if bs.samples == nil {
+			if !strings.HasPrefix(line, "#chrom") || len(toks) < 4 {
+				return &goleft.ParseError{Path: path, Line: n, Err: fmt.Errorf("merge: expected header from indexcov, got: %q", line)}
+			}
+			bs.samples = toks[3:]
+			bs.vals = make([][]float64, len(bs.samples))
+			return nil
+		}
+		if len(toks) != len(bs.samples)+3 {
+			return &goleft.ParseError{Path: path, Line: n, Err: fmt.Errorf("merge: expected %d fields, got %d", len(bs.samples)+3, len(toks))}
+		}
+		if sex[toks[0]] {
+			return nil
+		}
+		bs.keys = append(bs.keys, toks[0]+":"+toks[1])
+		for i, v := range toks[3:] {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return &goleft.ParseError{Path: path, Line: n, Err: err}
+			}
+			bs.vals[i] = append(bs.vals[i], f)
+		}
+		return nil
+	})
+	return bs, err
+}
+
+// addIndexcov adds the columns from each indexcov run to t and returns the bins shared by all runs.
+func addIndexcov(dirs []string, t *table) *binSet {
+	var bs *binSet
+	for _, dir := range dirs {
+		ped, err := findOne(dir, "*-indexcov.ped")
+		pcheck(err)
+		batch := filepath.Base(filepath.Clean(dir))
+		sex, err := readPed(ped, batch, t)
+		pcheck(err)
+		bed, err := findOne(dir, "*-indexcov.bed.gz")
+		pcheck(err)
+		b, err := readIndexcovBins(bed, sex)
+		pcheck(err)
+		bs = bs.join(b)
+	}
+	return bs
+}
+
+// Main is called from the dispatcher.
+func Main() {
+	arg.MustParse(cli)
+	if len(cli.Covstats)+len(cli.Depth)+len(cli.Indexcov) == 0 {
+		log.Fatal("merge: at least one of --covstats, --depth or --indexcov is required")
+	}
+	t := newTable()
+	for _, p := range cli.Covstats {
+		goleft.Infof("merge: %s", p)
+		pcheck(readCovstats(p, t))
+	}
+	var bins *binSet
+	if len(cli.Indexcov) > 0 {
+		bins = addIndexcov(cli.Indexcov, t)
+	}
+	if len(cli.Depth) > 0 {
+		dbins := addDepth(cli.Depth, t)
+		// indexcov bins cover the genome evenly so they are preferred for the PCA.
+		if bins == nil {
+			bins = dbins
+		}
+	}
+
+	var pcs [][]float64
+	var vars []float64
+	if bins != nil && len(bins.keys) > 0 {
+		pcs, vars = pca(bins)
+	} else if bins != nil {
+		goleft.Warnf("merge: no bins shared by all samples. not calculating principal components")
+	}
+	for i, pc := range pcs {
+		for k, v := range pc {
+			t.set(bins.samples[i], t.batch[bins.samples[i]], fmt.Sprintf("PC%d", k+1), fmt.Sprintf("%.2f", v))
+		}
+	}
+
+	f, err := os.Create(cli.Prefix + ".tsv")
+	pcheck(err)
+	w := bufio.NewWriter(f)
+	pcheck(t.write(w))
+	pcheck(w.Flush())
+	pcheck(f.Close())
+
+	f, err = os.Create(cli.Prefix + ".html")
+	pcheck(err)
+	var samples []string
+	if pcs != nil {
+		samples = bins.samples
+	}
+	pcheck(writeHTML(f, t, samples, pcs, vars, filepath.Base(cli.Prefix)))
+	pcheck(f.Close())
+	goleft.Infof("merge: wrote %d samples to %s.tsv and %s.html", len(t.samples), cli.Prefix, cli.Prefix)
+}
@@ -0,0 +1,110 @@
+package merge
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/brentp/xopen"
+)
+
+func write(t *testing.T, path, text string) {
+	fh, err := xopen.Wopen(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fh.WriteString(text)
+	if err := fh.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMergeTable(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "goleft-merge")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	cov := filepath.Join(tmp, "cov.tsv")
+	write(t, cov, "sample\tcoverage\tinsert_mean\ns1\t30.10\t350.00\ns2\t28.00\t360.00\n")
+	tbl := newTable()
+	if err := readCovstats(cov, tbl); err != nil {
+		t.Fatal(err)
+	}
+
+	run := filepath.Join(tmp, "run1")
+	os.Mkdir(run, 0755)
+	write(t, filepath.Join(run, "run1-indexcov.ped"), "#family_id\tsample_id\tpaternal_id\tmaternal_id\tsex\tphenotype\tCNX\tCNY\tslope\tPC1\n"+
+		"unknown\ts2\t-9\t-9\t1\t-9\t1.00\t1.00\t0.010\t3.2\n"+
+		"unknown\ts3\t-9\t-9\t2\t-9\t2.00\t0.00\t0.020\t-3.2\n")
+	write(t, filepath.Join(run, "run1-indexcov.bed.gz"), "#chrom\tstart\tend\ts2\ts3\n"+
+		"1\t0\t16384\t1\t0.9\n"+
+		"1\t16384\t32768\t1.1\t1\n"+
+		"X\t0\t16384\t0.5\t1\n")
+	bs := addIndexcov([]string{run}, tbl)
+	if len(bs.keys) != 2 {
+		t.Fatalf("expected sex chromosome bins to be excluded, got: %v", bs.keys)
+	}
+	if bs.vals[1][0] != 0.9 {
+		t.Fatalf("unexpected bin value: %v", bs.vals)
+	}
+
+	var buf bytes.Buffer
+	if err := tbl.write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	exp := `sample	batch	covstats.coverage	covstats.insert_mean	indexcov.sex	indexcov.CNX	indexcov.CNY	indexcov.slope
+s1	cov.tsv	30.10	350.00	NA	NA	NA	NA
+s2	run1	28.00	360.00	1	1.00	1.00	0.010
+s3	run1	NA	NA	2	2.00	0.00	0.020
+`
+	if buf.String() != exp {
+		t.Fatalf("unexpected table:\n%s\nexpected:\n%s", buf.String(), exp)
+	}
+}
+
+func TestReadDepth(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "goleft-merge")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	p := filepath.Join(tmp, "s1.depth.bed")
+	write(t, p, "1\t0\t100\t10\n1\t100\t200\t0\n1\t200\t400\t25\n")
+	d, err := readDepth(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.sample != "s1" {
+		t.Errorf("expected sample s1, got: %s", d.sample)
+	}
+	// (10*100 + 25*200) / 400
+	if d.mean != 15 || d.zero != 0.25 {
+		t.Errorf("unexpected mean: %v or zero fraction: %v", d.mean, d.zero)
+	}
+
+	write(t, p, "1\t0\t100\n")
+	if _, err := readDepth(p); err == nil || !strings.Contains(err.Error(), "s1.depth.bed:1:") {
+		t.Errorf("expected error with line number, got: %v", err)
+	}
+}
+
+func TestJoin(t *testing.T) {
+	a := &binSet{keys: []string{"1:0", "1:10", "2:0"}, samples: []string{"a"}, vals: [][]float64{{1, 2, 3}}}
+	b := &binSet{keys: []string{"2:0", "1:0"}, samples: []string{"b"}, vals: [][]float64{{6, 4}}}
+	var nilSet *binSet
+	if nilSet.join(a) != a {
+		t.Fatal("expected join with nil to return the other binSet")
+	}
+	j := a.join(b)
+	if strings.Join(j.keys, ",") != "1:0,2:0" || strings.Join(j.samples, ",") != "a,b" {
+		t.Fatalf("unexpected join: %v %v", j.keys, j.samples)
+	}
+	if j.vals[0][1] != 3 || j.vals[1][0] != 4 || j.vals[1][1] != 6 {
+		t.Fatalf("unexpected values: %v", j.vals)
+	}
+}
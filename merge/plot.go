@@ -0,0 +1,267 @@
+package merge
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"math/rand"
+
+	chartjs "github.com/brentp/go-chartjs"
+	"github.com/brentp/go-chartjs/types"
+	"github.com/brentp/goleft"
+	"github.com/gonum/floats"
+	"github.com/gonum/matrix/mat64"
+	"github.com/gonum/stat"
+)
+
+// nPCs is the maximum number of principal components that are reported.
+const nPCs = 5
+
+// pca returns the projection of each sample onto the first principal components of the bins and the
+// proportion of variance explained by each.
+func pca(bs *binSet) ([][]float64, []float64) {
+	if len(bs.samples) < 3 {
+		goleft.Warnf("merge: %d samples with bins, not calculating principal components", len(bs.samples))
+		return nil, nil
+	}
+	mat := mat64.NewDense(len(bs.samples), len(bs.keys), nil)
+	for i, row := range bs.vals {
+		mat.SetRow(i, row)
+	}
+	var pc stat.PC
+	if ok := pc.PrincipalComponents(mat, nil); !ok {
+		goleft.Warnf("merge: error with principal components")
+		return nil, nil
+	}
+	vars := pc.Vars(nil)
+	floats.Scale(1/floats.Sum(vars), vars)
+	k := nPCs
+	if len(vars) < k {
+		k = len(vars)
+	}
+	if k < 3 {
+		goleft.Warnf("merge: %d principal components, not plotting", k)
+		return nil, nil
+	}
+	var proj mat64.Dense
+	proj.Mul(mat, pc.Vectors(nil).Slice(0, len(bs.keys), 0, k))
+	pcs := make([][]float64, len(bs.samples))
+	for i := range pcs {
+		pcs[i] = mat64.Row(nil, i, &proj)
+	}
+	return pcs, vars[:k]
+}
+
+type vs struct {
+	xs []float64
+	ys []float64
+}
+
+func (v *vs) Xs() []float64 { return v.xs }
+func (v *vs) Ys() []float64 { return v.ys }
+func (v *vs) Rs() []float64 { return nil }
+
+func batchColor(i int) *types.RGBA {
+	rand.Seed(int64(i))
+	return &types.RGBA{R: uint8(rand.Intn(256)), G: uint8(rand.Intn(256)), B: uint8(rand.Intn(256)), A: 240}
+}
+
+// plotPCA makes a plot of PC1 against PC2 and of PC1 against PC3 with a dataset (and color) for each
+// batch so that batch effects stand out. It also returns the js to show the sample names on hover.
+func plotPCA(t *table, samples []string, pcs [][]float64, vars []float64) ([]chartjs.Chart, string, error) {
+	var batches []string
+	byBatch := make(map[string][]int)
+	for i, s := range samples {
+		b := t.batch[s]
+		if _, ok := byBatch[b]; !ok {
+			batches = append(batches, b)
+		}
+		byBatch[b] = append(byBatch[b], i)
+	}
+
+	var charts []chartjs.Chart
+	for _, pc := range []int{2, 3} {
+		c := chartjs.Chart{}
+		xa, err := c.AddXAxis(chartjs.Axis{Type: chartjs.Linear, Position: chartjs.Bottom, ScaleLabel: &chartjs.ScaleLabel{FontSize: 16,
+			LabelString: fmt.Sprintf("PC1 (variance explained: %.2f%%)", 100*vars[0]), Display: chartjs.True}})
+		if err != nil {
+			return nil, "", err
+		}
+		ya, err := c.AddYAxis(chartjs.Axis{Type: chartjs.Linear, Position: chartjs.Left, ScaleLabel: &chartjs.ScaleLabel{FontSize: 16,
+			LabelString: fmt.Sprintf("PC%d (variance explained: %.2f%%)", pc, 100*vars[pc-1]), Display: chartjs.True}})
+		if err != nil {
+			return nil, "", err
+		}
+		for k, b := range batches {
+			xys := &vs{}
+			for _, i := range byBatch[b] {
+				xys.xs = append(xys.xs, pcs[i][0])
+				xys.ys = append(xys.ys, pcs[i][pc-1])
+			}
+			col := batchColor(k)
+			d := chartjs.Dataset{Data: xys, Label: b, Fill: chartjs.False, PointRadius: 4, PointHoverRadius: 6, PointHitRadius: 6,
+				BorderWidth: 0, BorderColor: &types.RGBA{R: 150, G: 150, B: 150, A: 150}, PointBackgroundColor: col,
+				BackgroundColor: col, ShowLine: chartjs.False, XAxisID: xa, YAxisID: ya}
+			if err := c.AddDataset(d); err != nil {
+				return nil, "", err
+			}
+		}
+		c.Options.Responsive = chartjs.False
+		c.Options.Legend = &chartjs.Legend{Display: chartjs.False}
+		if len(batches) > 1 {
+			c.Options.Legend.Display = chartjs.True
+		}
+		c.Options.Tooltip = &chartjs.Tooltip{Mode: "nearest"}
+		charts = append(charts, c)
+	}
+
+	names := make([][]string, len(batches))
+	for k, b := range batches {
+		for _, i := range byBatch[b] {
+			names[k] = append(names[k], samples[i])
+		}
+	}
+	sjson, err := json.Marshal(names)
+	if err != nil {
+		return nil, "", err
+	}
+	js := fmt.Sprintf(`
+    chart.options.tooltips.callbacks.title = function(tts, data) {
+        var names = %s
+        var out = []
+        tts.forEach(function(ti) {
+            out.push(names[ti.datasetIndex][ti.index])
+        })
+        return out.join(",")
+    }`, sjson)
+	return charts, js, nil
+}
+
+// writeHTML writes the dashboard with the table of all values and the PCA plots.
+func writeHTML(w io.Writer, t *table, samples []string, pcs [][]float64, vars []float64, name string) error {
+	rows := make([][]string, len(t.samples))
+	for i, s := range t.samples {
+		rows[i] = append(rows[i], s, t.batch[s])
+		for _, c := range t.cols {
+			rows[i] = append(rows[i], t.get(s, c))
+		}
+	}
+	chartMap := map[string]interface{}{
+		"template": dashTemplate,
+		"name":     name,
+		"version":  goleft.Version,
+		"cols":     append([]string{"sample", "batch"}, t.cols...),
+		"rows":     rows,
+		"hasPCA":   false,
+	}
+	if pcs != nil {
+		charts, js, err := plotPCA(t, samples, pcs, vars)
+		if err != nil {
+			return err
+		}
+		chartMap["hasPCA"] = true
+		chartMap["pca"] = charts[0]
+		chartMap["pcb"] = charts[1]
+		chartMap["pcajs"] = template.JS(js)
+	}
+	return chartjs.SaveCharts(w, chartMap, chartjs.Chart{})
+}
+
+const dashTemplate = `<!DOCTYPE html>
+<html>
+    <head>
+{{ $name := index . "name" }}
+	<title>{{ $name }}:goleft merge</title>
+		<script src="{{ index . "JQuery" }}"></script>
+		<script src="{{ index . "ChartJS" }}"></script>
+		<style type="text/css">
+section {
+    width: 96%;
+    margin: auto;
+    padding: 8px;
+}
+
+.tt {
+	font-family: Lucida Console;
+    border: 2px solid #aaa;
+    padding: 2px;
+	height: auto;
+}
+
+.one {
+    width: 48%;
+    height: 380px;
+    float: left;
+    padding: 2px;
+}
+.two {
+    width: 48%;
+    margin-left: 48%;
+    height: 380px;
+    padding: 2px;
+}
+
+table {
+	border-collapse: collapse;
+	font-family: Lucida Console;
+	font-size: 0.8em;
+}
+th, td {
+	border: 1px solid #ccc;
+	padding: 2px 6px;
+	text-align: right;
+}
+		</style>
+
+    </head>
+    <body>
+<span class="top-help">
+This is the cohort summary from <a href="https://github.com/brentp/goleft">goleft merge</a> version {{ index . "version" }}.<br/>
+The same values are in <a href="{{ $name }}.tsv">{{ $name }}.tsv</a>.
+</span>
+
+{{ if index . "hasPCA" }}
+<section style="height:400px">
+	<div class="one">
+	<span class="tt">PCA: 1 vs 2</span>
+	<canvas id="canvas-pca" style="height:380px;width:380px"></canvas>
+	</div>
+
+	<div class="two">
+	<span class="tt">PCA: 1 vs 3</span>
+	<canvas id="canvas-pcb" style="height:380px;width:380px"></canvas>
+	</div>
+</section><hr/>
+{{ else }}
+<p>Fewer than 3 samples with bin coverage; PCA not shown.</p>
+{{ end }}
+
+<section>
+<table>
+	<tr>{{ range $c := index . "cols" }}<th>{{ $c }}</th>{{ end }}</tr>
+	{{ range $row := index . "rows" }}
+	<tr>{{ range $v := $row }}<td>{{ $v }}</td>{{ end }}</tr>
+	{{ end }}
+</table>
+</section>
+
+    </body>
+    <script>
+	Chart.defaults.global.animation.duration = 0;
+{{ if index . "hasPCA" }}
+    {{ $pca_json := index . "pca" }}
+	var pca_ctx = document.getElementById("canvas-pca").getContext("2d");
+	var pca_chart = new Chart(pca_ctx, {{ $pca_json }});
+	var chart = pca_chart
+	{{ index . "pcajs" }}
+
+    {{ $pcb_json := index . "pcb" }}
+	var pcb_ctx = document.getElementById("canvas-pcb").getContext("2d");
+	var pcb_chart = new Chart(pcb_ctx, {{ $pcb_json }});
+	var chart = pcb_chart
+	{{ index . "pcajs" }}
+{{ end }}
+    </script>
+</html>
+`
@@ -0,0 +1,81 @@
+package goleft
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"strings"
+)
+
+// MultiQC is a table for a MultiQC report. It is written as custom content which MultiQC finds
+// by the _mqc.json suffix of the file name.
+type MultiQC struct {
+	// ID is a unique id for the section and Section is its title in the report.
+	ID, Section, Description string
+	// Headers are the columns of the table in order.
+	Headers []MultiQCHeader
+	// Data has the values of each sample keyed by the Key of the headers.
+	Data map[string]map[string]interface{}
+}
+
+// MultiQCHeader is a column of a MultiQC table. The zero values are left to MultiQC.
+type MultiQCHeader struct {
+	Key         string  `json:"-"`
+	Title       string  `json:"title"`
+	Description string  `json:"description,omitempty"`
+	Format      string  `json:"format,omitempty"`
+	Suffix      string  `json:"suffix,omitempty"`
+	Scale       string  `json:"scale,omitempty"`
+	Min         float64 `json:"min,omitempty"`
+	Max         float64 `json:"max,omitempty"`
+}
+
+// MarshalJSON encodes m as MultiQC custom content with the headers in order.
+func (m MultiQC) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	field := func(k string, v interface{}) error {
+		kb, _ := json.Marshal(k)
+		vb, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		b.Write(kb)
+		b.WriteByte(':')
+		b.Write(vb)
+		return nil
+	}
+	b.WriteByte('{')
+	for _, kv := range [][2]string{{"id", m.ID}, {"section_name", m.Section}, {"description", m.Description}, {"plot_type", "table"}} {
+		field(kv[0], kv[1])
+		b.WriteByte(',')
+	}
+	field("pconfig", map[string]string{"id": m.ID + "_table", "title": m.Section})
+	b.WriteString(`,"headers":{`)
+	for i, h := range m.Headers {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		if err := field(h.Key, h); err != nil {
+			return nil, err
+		}
+	}
+	b.WriteString("},")
+	if err := field("data", m.Data); err != nil {
+		return nil, err
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+// WriteMultiQC writes m to path. It warns if the name does not end with _mqc.json as MultiQC would
+// not find it.
+func WriteMultiQC(path string, m MultiQC) error {
+	if !strings.HasSuffix(path, "_mqc.json") {
+		Warnf("%s does not end with _mqc.json so MultiQC will not find it", path)
+	}
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(b, '\n'), 0644)
+}
@@ -0,0 +1,236 @@
+// Package readlen summarizes the read lengths, base qualities by cycle and 3' soft-clips of a sample
+// of the reads in bams or crams.
+package readlen
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"sync"
+
+	arg "github.com/alexflint/go-arg"
+	"github.com/biogo/hts/sam"
+	"github.com/brentp/goleft"
+	"github.com/brentp/goleft/covstats"
+)
+
+var cli = struct {
+	N         int      `arg:"-n,help:number of reads to sample"`
+	Reference string   `arg:"-r,help:path to reference fasta. required for cram"`
+	Format    string   `arg:"help:output format. one of 'tsv' or 'json'"`
+	MinClip   int      `arg:"--min-clip,help:shortest soft-clip at the 3' end of a read that is counted as adapter-like"`
+	First     bool     `arg:"help:sample the first reads in the bam rather than reads from random offsets across the genome"`
+	Processes int      `arg:"-p,help:number of bams to summarize in parallel"`
+	Bams      []string `arg:"positional,required,help:bam(s) or cram(s) to summarize"`
+}{N: 100000, Format: "tsv", MinClip: 5, Processes: 1}
+
+// profile is the summary of the sampled reads of a sample.
+type profile struct {
+	Sample string `json:"sample"`
+	Path   string `json:"path"`
+	// Reads is the number of primary reads sampled.
+	Reads int `json:"reads"`
+	// Lengths is the number of reads of each length.
+	Lengths map[int]int `json:"read_lengths"`
+	// Quality1 and Quality2 are the mean base quality at each cycle, from the first base sequenced,
+	// of read 1 and read 2. Unpaired reads are in Quality1.
+	Quality1 []float64 `json:"quality_r1"`
+	Quality2 []float64 `json:"quality_r2,omitempty"`
+	// Clip3Frac is the fraction of the mapped reads with a soft-clip of at least --min-clip bases at
+	// the 3' end as from reading through a short insert into the adapter. Clip3Mean is the mean length
+	// of those clips.
+	Clip3Frac float64 `json:"clip3_fraction"`
+	Clip3Mean float64 `json:"clip3_mean_length"`
+
+	minClip      int
+	qsum         [2][]float64
+	qn           [2][]int
+	mapped       int
+	clips, clipN int
+}
+
+func newProfile(sample, path string, minClip int) *profile {
+	return &profile{Sample: sample, Path: path, Lengths: make(map[int]int), minClip: minClip}
+}
+
+// add adds a read and reports whether it was used. Secondary and supplementary alignments and
+// reads without a sequence are skipped.
+func (p *profile) add(rec *sam.Record) bool {
+	n := rec.Seq.Length
+	if rec.Flags&(sam.Secondary|sam.Supplementary) != 0 || n == 0 {
+		return false
+	}
+	p.Reads++
+	p.Lengths[n]++
+	rev := rec.Flags&sam.Reverse != 0
+	// qualities of 0xff are missing.
+	if len(rec.Qual) == n && rec.Qual[0] != 0xff {
+		m := 0
+		if rec.Flags&(sam.Paired|sam.Read2) == sam.Paired|sam.Read2 {
+			m = 1
+		}
+		for len(p.qsum[m]) < n {
+			p.qsum[m] = append(p.qsum[m], 0)
+			p.qn[m] = append(p.qn[m], 0)
+		}
+		for i, q := range rec.Qual {
+			// the bases of a reverse read are stored reverse-complemented so its first cycle is last.
+			c := i
+			if rev {
+				c = n - 1 - i
+			}
+			p.qsum[m][c] += float64(q)
+			p.qn[m][c]++
+		}
+	}
+	if rec.Flags&sam.Unmapped != 0 || len(rec.Cigar) == 0 {
+		return true
+	}
+	p.mapped++
+	co := rec.Cigar[len(rec.Cigar)-1]
+	if rev {
+		co = rec.Cigar[0]
+	}
+	if co.Type() == sam.CigarSoftClipped && co.Len() >= p.minClip {
+		p.clipN++
+		p.clips += co.Len()
+	}
+	return true
+}
+
+// finish sets the means from the sums.
+func (p *profile) finish() {
+	means := func(sum []float64, n []int) []float64 {
+		out := make([]float64, len(sum))
+		for i := range sum {
+			if n[i] > 0 {
+				out[i] = sum[i] / float64(n[i])
+			}
+		}
+		return out
+	}
+	p.Quality1 = means(p.qsum[0], p.qn[0])
+	p.Quality2 = means(p.qsum[1], p.qn[1])
+	if p.mapped > 0 {
+		p.Clip3Frac = float64(p.clipN) / float64(p.mapped)
+	}
+	if p.clipN > 0 {
+		p.Clip3Mean = float64(p.clips) / float64(p.clipN)
+	}
+}
+
+// summarize reads up to n primary reads from rdr.
+func summarize(rdr covstats.RecordReader, p *profile, n int) error {
+	for p.Reads < n {
+		rec, err := rdr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		p.add(rec)
+	}
+	p.finish()
+	return nil
+}
+
+func run(path string, opts covstats.Options) (*profile, error) {
+	s, err := covstats.OpenSampled(path, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+	p := newProfile(s.Sample, path, cli.MinClip)
+	if err := summarize(s, p, opts.N); err != nil {
+		return nil, err
+	}
+	if p.Reads == 0 {
+		return nil, fmt.Errorf("readlen: no reads found in %s", path)
+	}
+	return p, nil
+}
+
+// writeTSV writes a line for each value of p: the sample, the metric, the read length or 1-based
+// cycle for the metrics by length or cycle or "." and the value.
+func writeTSV(w io.Writer, p *profile) {
+	fmt.Fprintf(w, "%s\treads\t.\t%d\n", p.Sample, p.Reads)
+	lengths := make([]int, 0, len(p.Lengths))
+	for l := range p.Lengths {
+		lengths = append(lengths, l)
+	}
+	sort.Ints(lengths)
+	for _, l := range lengths {
+		fmt.Fprintf(w, "%s\tread_length\t%d\t%d\n", p.Sample, l, p.Lengths[l])
+	}
+	for m, qs := range [][]float64{p.Quality1, p.Quality2} {
+		for c, q := range qs {
+			fmt.Fprintf(w, "%s\tquality_r%d\t%d\t%.2f\n", p.Sample, m+1, c+1, q)
+		}
+	}
+	fmt.Fprintf(w, "%s\tclip3_fraction\t.\t%.4f\n", p.Sample, p.Clip3Frac)
+	fmt.Fprintf(w, "%s\tclip3_mean_length\t.\t%.1f\n", p.Sample, p.Clip3Mean)
+}
+
+// Main is called from the goleft dispatcher.
+func Main() {
+	p := arg.MustParse(&cli)
+	if cli.Format != "tsv" && cli.Format != "json" {
+		p.Fail("readlen: --format must be 'tsv' or 'json'")
+	}
+	if cli.N < 1 {
+		p.Fail("readlen: -n must be at least 1")
+	}
+	if cli.MinClip < 1 {
+		p.Fail("readlen: --min-clip must be at least 1")
+	}
+	if cli.Processes < 1 {
+		cli.Processes = 1
+	}
+	workers := min(cli.Processes, len(cli.Bams))
+	opts := covstats.DefaultOptions()
+	opts.N, opts.Reference, opts.First, opts.Threads = cli.N, cli.Reference, cli.First, goleft.BgzfWorkers(workers)
+
+	profiles := make([]*profile, len(cli.Bams))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for k := 0; k < workers; k++ {
+		go func() {
+			for i := range jobs {
+				goleft.Infof("readlen: %s", cli.Bams[i])
+				pr, err := run(cli.Bams[i], opts)
+				if err != nil {
+					log.Fatalf("readlen: error with %s: %s", cli.Bams[i], err)
+				}
+				profiles[i] = pr
+			}
+			wg.Done()
+		}()
+	}
+	for i := range cli.Bams {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	w := bufio.NewWriter(os.Stdout)
+	defer w.Flush()
+	if cli.Format == "json" {
+		enc := json.NewEncoder(w)
+		for _, pr := range profiles {
+			if err := enc.Encode(pr); err != nil {
+				log.Fatal(err)
+			}
+		}
+		return
+	}
+	fmt.Fprintln(w, "#sample\tmetric\tx\tvalue")
+	for _, pr := range profiles {
+		writeTSV(w, pr)
+	}
+}
@@ -0,0 +1,72 @@
+package readlen
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/biogo/hts/sam"
+	"github.com/brentp/goleft/covstats"
+)
+
+func TestProfile(t *testing.T) {
+	ref, err := sam.NewReference("chr1", "", "", 1000, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sam.NewHeader(nil, []*sam.Reference{ref}); err != nil {
+		t.Fatal(err)
+	}
+	read := func(flags sam.Flags, cigar []sam.CigarOp, qual []byte) *sam.Record {
+		rec, err := sam.NewRecord("r", ref, nil, 10, -1, 0, 60, cigar, bytes.Repeat([]byte{'A'}, len(qual)), qual, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec.Flags = flags
+		return rec
+	}
+	clipped := []sam.CigarOp{sam.NewCigarOp(sam.CigarSoftClipped, 6), sam.NewCigarOp(sam.CigarMatch, 4)}
+	p := newProfile("s", "s.bam", 5)
+	// the clip is at the 3' end of the reverse read but at the 5' end of the forward one.
+	p.add(read(sam.Paired|sam.Read1|sam.Reverse, clipped, []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}))
+	p.add(read(sam.Paired|sam.Read1, clipped, []byte{10, 9, 8, 7, 6, 5, 4, 3, 2, 1}))
+	p.add(read(sam.Paired|sam.Read2, []sam.CigarOp{sam.NewCigarOp(sam.CigarMatch, 4)}, []byte{30, 30, 30, 20}))
+	if p.add(read(sam.Paired|sam.Read2|sam.Supplementary, clipped, bytes.Repeat([]byte{2}, 10))) {
+		t.Errorf("expected a supplementary alignment to be skipped")
+	}
+	p.finish()
+
+	if p.Reads != 3 {
+		t.Errorf("expected 3 reads, got: %d", p.Reads)
+	}
+	if exp := map[int]int{10: 2, 4: 1}; !reflect.DeepEqual(p.Lengths, exp) {
+		t.Errorf("expected lengths %v, got: %v", exp, p.Lengths)
+	}
+	if exp := []float64{10, 9, 8, 7, 6, 5, 4, 3, 2, 1}; !reflect.DeepEqual(p.Quality1, exp) {
+		t.Errorf("expected read 1 qualities %v, got: %v", exp, p.Quality1)
+	}
+	if exp := []float64{30, 30, 30, 20}; !reflect.DeepEqual(p.Quality2, exp) {
+		t.Errorf("expected read 2 qualities %v, got: %v", exp, p.Quality2)
+	}
+	if p.Clip3Frac != 1.0/3 || p.Clip3Mean != 6 {
+		t.Errorf("expected a third of reads clipped by 6, got: %.3f %.1f", p.Clip3Frac, p.Clip3Mean)
+	}
+}
+
+func TestSampled(t *testing.T) {
+	s, err := covstats.OpenSampled("../depth/test/t.bam", covstats.Options{N: 200, First: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	p := newProfile(s.Sample, "t.bam", 5)
+	if err := summarize(s, p, 200); err != nil {
+		t.Fatal(err)
+	}
+	if s.Sample != "Test1" || p.Reads != 200 {
+		t.Errorf("expected 200 reads from Test1, got: %d from %s", p.Reads, s.Sample)
+	}
+	if len(p.Quality1) == 0 || len(p.Lengths) == 0 {
+		t.Errorf("expected qualities and lengths, got: %v %v", p.Quality1, p.Lengths)
+	}
+}
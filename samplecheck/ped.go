@@ -0,0 +1,63 @@
+package samplecheck
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/brentp/goleft"
+	"github.com/brentp/xopen"
+)
+
+// pedSample is the family and parents of a sample from a PED file.
+type pedSample struct {
+	family, dad, mom string
+}
+
+// readPed returns the samples in the PED file at path keyed by their ID.
+func readPed(path string) (map[string]pedSample, error) {
+	rdr, err := xopen.Ropen(path)
+	if err != nil {
+		return nil, err
+	}
+	defer rdr.Close()
+	samples := make(map[string]pedSample)
+	for i := 1; ; i++ {
+		line, err := rdr.ReadString('\n')
+		if line = strings.TrimSpace(line); len(line) > 0 && line[0] != '#' {
+			toks := strings.Fields(line)
+			if len(toks) < 4 {
+				return nil, &goleft.ParseError{Path: path, Line: i, Err: fmt.Errorf("samplecheck: expected at least 4 fields in ped line: %q", line)}
+			}
+			samples[toks[1]] = pedSample{family: toks[0], dad: toks[2], mom: toks[3]}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return samples, nil
+}
+
+// expected returns the relatedness of a and b expected from the PED file: 0.5 for a parent and
+// child or full siblings and 0 for samples from different families. It returns -1 if either
+// sample is not in the file or for other relatives which are not checked.
+func expected(samples map[string]pedSample, a, b string) float64 {
+	pa, aok := samples[a]
+	pb, bok := samples[b]
+	if !aok || !bok {
+		return -1
+	}
+	if pa.family != pb.family {
+		return 0
+	}
+	if pa.dad == b || pa.mom == b || pb.dad == a || pb.mom == a {
+		return 0.5
+	}
+	if pa.dad != "0" && pa.mom != "0" && pa.dad == pb.dad && pa.mom == pb.mom {
+		return 0.5
+	}
+	return -1
+}
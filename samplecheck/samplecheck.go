@@ -0,0 +1,458 @@
+// Package samplecheck estimates the relatedness of each pair of samples from the alleles of their
+// reads at common SNPs so that duplicates and sample swaps are found before variant calling.
+package samplecheck
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	arg "github.com/alexflint/go-arg"
+	"github.com/biogo/hts/bam"
+	"github.com/biogo/hts/sam"
+	"github.com/brentp/goleft"
+	"github.com/brentp/goleft/bamio"
+	"github.com/brentp/xopen"
+)
+
+var cli = &struct {
+	Sites     string   `arg:"-s,required,help:VCF of common biallelic SNPs at which to count reads. sites with an allele frequency near 0.5 are the most informative"`
+	Reference string   `arg:"-r,help:reference fasta. required for cram"`
+	Ped       string   `arg:"help:optional PED file of the expected relationships. parent-child and sibling pairs that are not related and pairs from different families that are related are flagged"`
+	MinDepth  int      `arg:"--min-depth,help:sites with fewer reads are not genotyped"`
+	MinMapQ   int      `arg:"-Q,--min-mapq,help:reads with a lower mapping quality are not counted"`
+	MinBaseQ  int      `arg:"-q,--min-base-quality,help:bases with a lower base quality are not counted"`
+	MinSites  int      `arg:"--min-sites,help:pairs genotyped at fewer of the same sites are flagged as low-sites"`
+	Processes int      `arg:"-p,help:number of bams or crams to read in parallel"`
+	Bams      []string `arg:"positional,required,help:bam(s) or cram(s) to compare"`
+}{MinDepth: 7, MinMapQ: 10, MinBaseQ: 10, MinSites: 200, Processes: 1}
+
+// skipFlags are the reads that are not counted.
+const skipFlags = sam.Unmapped | sam.Secondary | sam.QCFail | sam.Duplicate | sam.Supplementary
+
+// relatedness thresholds for the flags. Parent-child and sibling pairs are expected near 0.5,
+// unrelated pairs near 0 and duplicates near 1.
+const (
+	duplicate = 0.8
+	related   = 0.2
+)
+
+// site is a SNP from the VCF. pos is 0-based.
+type site struct {
+	chrom    string
+	pos      int
+	ref, alt byte
+}
+
+// readSites returns the biallelic SNPs from the VCF at path. Indels and multi-allelic sites
+// are skipped.
+func readSites(path string) ([]site, error) {
+	rdr, err := xopen.Ropen(path)
+	if err != nil {
+		return nil, err
+	}
+	defer rdr.Close()
+	var sites []site
+	for i := 1; ; i++ {
+		line, err := rdr.ReadString('\n')
+		if line = strings.TrimRight(line, "\r\n"); len(line) > 0 && line[0] != '#' {
+			toks := strings.SplitN(line, "\t", 6)
+			if len(toks) < 5 {
+				return nil, &goleft.ParseError{Path: path, Line: i, Err: fmt.Errorf("samplecheck: expected at least 5 fields in VCF line: %q", line)}
+			}
+			pos, err := strconv.Atoi(toks[1])
+			if err != nil {
+				return nil, &goleft.ParseError{Path: path, Line: i, Err: fmt.Errorf("samplecheck: bad position in VCF line: %q", line)}
+			}
+			ref, alt := strings.ToUpper(toks[3]), strings.ToUpper(toks[4])
+			if len(ref) == 1 && len(alt) == 1 && strings.Contains("ACGT", ref) && strings.Contains("ACGT", alt) && ref != alt {
+				sites = append(sites, site{chrom: toks[0], pos: pos - 1, ref: ref[0], alt: alt[0]})
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return sites, nil
+}
+
+// alleles is the number of reads with the reference and alternate base at a site.
+type alleles struct {
+	ref, alt int32
+}
+
+// genotype returns the number of alternate alleles from the allele fraction or -1 if there are
+// fewer than minDepth reads or the fraction is between those expected for a het and a hom.
+func (a alleles) genotype(minDepth int) int8 {
+	n := a.ref + a.alt
+	if n == 0 || int(n) < minDepth {
+		return -1
+	}
+	af := float64(a.alt) / float64(n)
+	switch {
+	case af <= 0.05:
+		return 0
+	case af >= 0.95:
+		return 2
+	case af >= 0.2 && af <= 0.8:
+		return 1
+	}
+	return -1
+}
+
+// locus is a site in the order of a bam. i is the index of the site in the VCF.
+type locus struct {
+	i, ref, pos int
+}
+
+// loci returns the sites on the references in h sorted by their order in h. The names are
+// matched with or without a chr prefix.
+func loci(sites []site, h *sam.Header) []locus {
+	ids := make(map[string]int, len(h.Refs()))
+	for _, ref := range h.Refs() {
+		ids[ref.Name()] = ref.ID()
+	}
+	var ls []locus
+	for i, s := range sites {
+		id, ok := ids[s.chrom]
+		if !ok {
+			id, ok = ids["chr"+s.chrom]
+		}
+		if !ok {
+			id, ok = ids[strings.TrimPrefix(s.chrom, "chr")]
+		}
+		if ok {
+			ls = append(ls, locus{i: i, ref: id, pos: s.pos})
+		}
+	}
+	sort.Slice(ls, func(a, b int) bool {
+		if ls[a].ref != ls[b].ref {
+			return ls[a].ref < ls[b].ref
+		}
+		return ls[a].pos < ls[b].pos
+	})
+	return ls
+}
+
+// readOffset returns the offset in the read of the base aligned to pos or false if pos is in a
+// deletion or is not covered by the read.
+func readOffset(rec *sam.Record, pos int) (int, bool) {
+	rpos, qpos := rec.Pos, 0
+	for _, co := range rec.Cigar {
+		n := co.Len()
+		switch co.Type() {
+		case sam.CigarMatch, sam.CigarEqual, sam.CigarMismatch:
+			if pos < rpos+n {
+				return qpos + pos - rpos, true
+			}
+			rpos += n
+			qpos += n
+		case sam.CigarDeletion, sam.CigarSkipped:
+			if pos < rpos+n {
+				return 0, false
+			}
+			rpos += n
+		case sam.CigarInsertion, sam.CigarSoftClipped:
+			qpos += n
+		}
+	}
+	return 0, false
+}
+
+// nybbles are the bases of the 4-bit encoding of sequences in a bam.
+const nybbles = "=ACMGRSVTWYHKDBN"
+
+// count adds the base of rec at the site to a.
+func count(a *alleles, rec *sam.Record, s site, minBaseQ int) {
+	off, ok := readOffset(rec, s.pos)
+	if !ok || off >= rec.Seq.Length {
+		return
+	}
+	if off < len(rec.Qual) && rec.Qual[off] != 0xff && int(rec.Qual[off]) < minBaseQ {
+		return
+	}
+	d := rec.Seq.Seq[off>>1]
+	if off&1 == 0 {
+		d >>= 4
+	}
+	switch nybbles[d&0xf] {
+	case s.ref:
+		a.ref++
+	case s.alt:
+		a.alt++
+	}
+}
+
+type recordReader interface {
+	Read() (*sam.Record, error)
+}
+
+type iterReader struct {
+	*bam.Iterator
+}
+
+func (r iterReader) Read() (*sam.Record, error) {
+	if r.Next() {
+		return r.Record(), nil
+	}
+	if err := r.Error(); err != nil {
+		return nil, err
+	}
+	return nil, io.EOF
+}
+
+// pileup counts the alleles at the loci from the sorted reads in rdr. It stops once the reads are
+// past the last locus.
+func pileup(rdr recordReader, ls []locus, sites []site, counts []alleles) error {
+	lo := 0
+	for lo < len(ls) {
+		rec, err := rdr.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if rec.Ref == nil || rec.Flags&skipFlags != 0 || int(rec.MapQ) < cli.MinMapQ {
+			continue
+		}
+		id := rec.Ref.ID()
+		for lo < len(ls) && (ls[lo].ref < id || ls[lo].ref == id && ls[lo].pos < rec.Pos) {
+			lo++
+		}
+		end := rec.End()
+		for j := lo; j < len(ls) && ls[j].ref == id && ls[j].pos < end; j++ {
+			count(&counts[ls[j].i], rec, sites[ls[j].i], cli.MinBaseQ)
+		}
+	}
+	return nil
+}
+
+// countAlleles returns the sample name and the alleles at each site for the bam or cram at path.
+// Bams are read at each site with the index. Crams are decoded by samtools in a single pass over
+// the sites.
+func countAlleles(path string, sites []site) (string, []alleles, error) {
+	counts := make([]alleles, len(sites))
+	if bamio.IsCRAM(path) {
+		h, err := bamio.Header(path)
+		if err != nil {
+			return "", nil, err
+		}
+		ls := loci(sites, h)
+		bed, err := writeBed(ls, h)
+		if err != nil {
+			return "", nil, err
+		}
+		defer os.Remove(bed)
+		br, err := bamio.OpenRegions(path, cli.Reference, bed, 1)
+		if err != nil {
+			return "", nil, err
+		}
+		defer br.Close()
+		return bamio.SampleName(h, path), counts, pileup(br, ls, sites, counts)
+	}
+	idx, err := bamio.ReadIndex(path)
+	if err != nil {
+		return "", nil, err
+	}
+	br, err := bamio.Open(path, cli.Reference, goleft.BgzfWorkers(cli.Processes))
+	if err != nil {
+		return "", nil, err
+	}
+	defer br.Close()
+	h := br.Header()
+	refs := h.Refs()
+	ls := loci(sites, h)
+	for len(ls) > 0 {
+		// loci in the same 16KB window of the index share a seek.
+		k := 1
+		for k < len(ls) && ls[k].ref == ls[0].ref && ls[k].pos-ls[k-1].pos < 1<<14 {
+			k++
+		}
+		group := ls[:k]
+		ls = ls[k:]
+		chunks, err := idx.Chunks(refs[group[0].ref], group[0].pos, group[k-1].pos+1)
+		if err != nil || len(chunks) == 0 {
+			continue
+		}
+		it, err := bam.NewIterator(br.Reader, chunks)
+		if err != nil {
+			return "", nil, err
+		}
+		err = pileup(iterReader{it}, group, sites, counts)
+		it.Close()
+		if err != nil {
+			return "", nil, err
+		}
+	}
+	return bamio.SampleName(h, path), counts, nil
+}
+
+// writeBed writes the loci to a temporary bed file for samtools view -L and returns its path.
+func writeBed(ls []locus, h *sam.Header) (string, error) {
+	fh, err := os.CreateTemp("", "samplecheck-*.bed")
+	if err != nil {
+		return "", err
+	}
+	w := bufio.NewWriter(fh)
+	refs := h.Refs()
+	for _, l := range ls {
+		fmt.Fprintf(w, "%s\t%d\t%d\n", refs[l.ref].Name(), l.pos, l.pos+1)
+	}
+	if err := w.Flush(); err != nil {
+		fh.Close()
+		return "", err
+	}
+	return fh.Name(), fh.Close()
+}
+
+// pair is the comparison of 2 samples at the sites where both are genotyped.
+type pair struct {
+	n, ibs0, ibs2, sharedHets, hetsA, hetsB int
+}
+
+func compare(a, b []int8) pair {
+	var p pair
+	for i, ga := range a {
+		gb := b[i]
+		if ga < 0 || gb < 0 {
+			continue
+		}
+		p.n++
+		switch {
+		case ga == gb:
+			p.ibs2++
+		case ga != 1 && gb != 1:
+			p.ibs0++
+		}
+		if ga == 1 {
+			p.hetsA++
+		}
+		if gb == 1 {
+			p.hetsB++
+		}
+		if ga == 1 && gb == 1 {
+			p.sharedHets++
+		}
+	}
+	return p
+}
+
+// relatedness is 1 for duplicates, 0.5 for first-degree relatives and 0 for unrelated samples.
+// Opposite homozygotes (IBS0) are not expected between parents and children.
+func (p pair) relatedness() float64 {
+	h := min(p.hetsA, p.hetsB)
+	if h == 0 {
+		return 0
+	}
+	return float64(p.sharedHets-2*p.ibs0) / float64(h)
+}
+
+// concordance is the fraction of sites with the same genotype.
+func (p pair) concordance() float64 {
+	if p.n == 0 {
+		return 0
+	}
+	return float64(p.ibs2) / float64(p.n)
+}
+
+// flag returns the problem with the pair, if any, given the expected relatedness from the ped
+// file or -1 if it is not known.
+func (p pair) flag(expected float64) string {
+	r := p.relatedness()
+	switch {
+	case p.n < cli.MinSites:
+		return "low-sites"
+	case r >= duplicate:
+		return "duplicate"
+	case expected == 0 && r >= related:
+		return "unexpected-relatedness"
+	case expected > 0 && r < related:
+		return "missing-relatedness"
+	}
+	return "ok"
+}
+
+// Main is called from the goleft dispatcher.
+func Main() {
+	arg.MustParse(cli)
+	if cli.Processes < 1 {
+		cli.Processes = 1
+	}
+	sites, err := readSites(cli.Sites)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(sites) == 0 {
+		log.Fatalf("samplecheck: no biallelic SNPs in %s", cli.Sites)
+	}
+	var fams map[string]pedSample
+	if cli.Ped != "" {
+		if fams, err = readPed(cli.Ped); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	names := make([]string, len(cli.Bams))
+	gts := make([][]int8, len(cli.Bams))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	wg.Add(cli.Processes)
+	for k := 0; k < cli.Processes; k++ {
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				goleft.Infof("samplecheck: %s", cli.Bams[i])
+				name, counts, err := countAlleles(cli.Bams[i], sites)
+				if err != nil {
+					log.Fatalf("samplecheck: error with %s: %s", cli.Bams[i], err)
+				}
+				g := make([]int8, len(counts))
+				called := 0
+				for j, c := range counts {
+					if g[j] = c.genotype(cli.MinDepth); g[j] >= 0 {
+						called++
+					}
+				}
+				goleft.Infof("samplecheck: genotyped %s at %d of %d sites", name, called, len(sites))
+				names[i], gts[i] = name, g
+			}
+		}()
+	}
+	for i := range cli.Bams {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	w := bufio.NewWriter(os.Stdout)
+	defer w.Flush()
+	fmt.Fprintln(w, "#sample_a\tsample_b\trelatedness\tconcordance\tn\tibs0\tibs2\tshared_hets\thets_a\thets_b\texpected\tflag")
+	flagged := 0
+	for a := 0; a < len(names); a++ {
+		for b := a + 1; b < len(names); b++ {
+			p := compare(gts[a], gts[b])
+			exp := expected(fams, names[a], names[b])
+			f := p.flag(exp)
+			if f != "ok" {
+				flagged++
+			}
+			es := "."
+			if exp >= 0 {
+				es = strconv.FormatFloat(exp, 'f', -1, 64)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%.3f\t%.3f\t%d\t%d\t%d\t%d\t%d\t%d\t%s\t%s\n", names[a], names[b], p.relatedness(),
+				p.concordance(), p.n, p.ibs0, p.ibs2, p.sharedHets, p.hetsA, p.hetsB, es, f)
+		}
+	}
+	goleft.Infof("samplecheck: flagged %d pairs", flagged)
+}
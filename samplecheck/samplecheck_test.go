@@ -0,0 +1,137 @@
+package samplecheck
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/biogo/hts/sam"
+)
+
+type sliceReader []*sam.Record
+
+func (s *sliceReader) Read() (*sam.Record, error) {
+	if len(*s) == 0 {
+		return nil, io.EOF
+	}
+	r := (*s)[0]
+	*s = (*s)[1:]
+	return r, nil
+}
+
+func TestReadSites(t *testing.T) {
+	vcf := filepath.Join(t.TempDir(), "sites.vcf")
+	data := "##fileformat=VCFv4.2\n#CHROM\tPOS\tID\tREF\tALT\n1\t10\t.\tA\tG\n1\t20\t.\tAT\tA\n1\t30\t.\tC\tT,G\n2\t5\trs1\tc\tt\n"
+	if err := os.WriteFile(vcf, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sites, err := readSites(vcf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := []site{{"1", 9, 'A', 'G'}, {"2", 4, 'C', 'T'}}
+	if !reflect.DeepEqual(sites, exp) {
+		t.Errorf("expected: %v, got: %v", exp, sites)
+	}
+}
+
+func TestGenotype(t *testing.T) {
+	for _, c := range []struct {
+		a   alleles
+		exp int8
+	}{{alleles{20, 0}, 0}, {alleles{10, 10}, 1}, {alleles{0, 20}, 2}, {alleles{3, 0}, -1}, {alleles{17, 3}, -1}} {
+		if g := c.a.genotype(7); g != c.exp {
+			t.Errorf("expected %d for %v, got: %d", c.exp, c.a, g)
+		}
+	}
+}
+
+func TestPileup(t *testing.T) {
+	ref, err := sam.NewReference("chr1", "", "", 100, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := sam.NewHeader(nil, []*sam.Reference{ref})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// reads at 10-20, the first with a deletion at 14-16 and the second with a G at 15.
+	del := []sam.CigarOp{sam.NewCigarOp(sam.CigarMatch, 4), sam.NewCigarOp(sam.CigarDeletion, 2), sam.NewCigarOp(sam.CigarMatch, 4)}
+	a, err := sam.NewRecord("a", ref, nil, 10, -1, 0, 60, del, []byte("AAAAAAAA"), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	match := []sam.CigarOp{sam.NewCigarOp(sam.CigarSoftClipped, 2), sam.NewCigarOp(sam.CigarMatch, 10)}
+	b, err := sam.NewRecord("b", ref, nil, 10, -1, 0, 60, match, []byte("TTAAAAAGAAAA"), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sites := []site{{"1", 15, 'A', 'G'}, {"chr1", 12, 'A', 'C'}, {"chr2", 12, 'A', 'C'}}
+	ls := loci(sites, h)
+	if len(ls) != 2 || ls[0].i != 1 || ls[1].i != 0 {
+		t.Fatalf("unexpected loci: %v", ls)
+	}
+	counts := make([]alleles, len(sites))
+	rdr := sliceReader{a, b}
+	if err := pileup(&rdr, ls, sites, counts); err != nil {
+		t.Fatal(err)
+	}
+	if exp := []alleles{{0, 1}, {2, 0}, {0, 0}}; !reflect.DeepEqual(counts, exp) {
+		t.Errorf("expected: %v, got: %v", exp, counts)
+	}
+}
+
+func TestCompare(t *testing.T) {
+	a := []int8{0, 1, 1, 2, 1, -1, 1, 0}
+	p := compare(a, a)
+	if p.relatedness() != 1 || p.concordance() != 1 || p.n != 7 {
+		t.Errorf("expected a sample to be identical to itself: %+v", p)
+	}
+	// opposite homozygotes at half of the hets.
+	b := []int8{1, 2, 0, 0, 1, 1, 1, 2}
+	p = compare(a, b)
+	if p.ibs0 != 2 || p.sharedHets != 2 || p.hetsA != 4 || p.hetsB != 3 {
+		t.Errorf("unexpected counts: %+v", p)
+	}
+	if r := p.relatedness(); r != (2.0-4.0)/3.0 {
+		t.Errorf("unexpected relatedness: %.3f", r)
+	}
+}
+
+func TestFlag(t *testing.T) {
+	cli.MinSites = 10
+	dup := pair{n: 100, ibs2: 100, sharedHets: 40, hetsA: 40, hetsB: 40}
+	unrelated := pair{n: 100, ibs0: 10, ibs2: 40, sharedHets: 20, hetsA: 40, hetsB: 40}
+	for _, c := range []struct {
+		p        pair
+		expected float64
+		flag     string
+	}{
+		{dup, -1, "duplicate"},
+		{unrelated, -1, "ok"},
+		{unrelated, 0.5, "missing-relatedness"},
+		{pair{n: 100, sharedHets: 20, hetsA: 40, hetsB: 40}, 0, "unexpected-relatedness"},
+		{pair{n: 5}, -1, "low-sites"},
+	} {
+		if f := c.p.flag(c.expected); f != c.flag {
+			t.Errorf("expected %s for %+v, got: %s", c.flag, c.p, f)
+		}
+	}
+}
+
+func TestExpected(t *testing.T) {
+	ped := map[string]pedSample{
+		"kid": {"f1", "dad", "mom"}, "sib": {"f1", "dad", "mom"}, "dad": {"f1", "0", "0"},
+		"mom": {"f1", "0", "0"}, "other": {"f2", "0", "0"},
+	}
+	for _, c := range []struct {
+		a, b string
+		exp  float64
+	}{{"kid", "dad", 0.5}, {"mom", "kid", 0.5}, {"kid", "sib", 0.5}, {"dad", "mom", -1}, {"kid", "other", 0}, {"kid", "missing", -1}} {
+		if e := expected(ped, c.a, c.b); e != c.exp {
+			t.Errorf("expected %v for %s, %s, got: %v", c.exp, c.a, c.b, e)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+// Package samplename prints the sample names from the read-groups of bam or cram headers.
+package samplename
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	arg "github.com/alexflint/go-arg"
+	"github.com/biogo/hts/sam"
+	"github.com/brentp/goleft"
+	"github.com/brentp/goleft/bamio"
+	"github.com/brentp/xopen"
+)
+
+var cli = &struct {
+	All   bool     `arg:"-a,help:print the SM of every read-group even if it is repeated."`
+	RG    bool     `arg:"--rg,help:print the ID and SM of each read-group."`
+	Check string   `arg:"help:tab-delimited file of path and expected sample. exit with an error if the SM of any file does not match."`
+	JSON  bool     `arg:"--json,help:print every read-group with its ID SM LB PL PU CN DS and DT as a line of JSON."`
+	Bams  []string `arg:"positional,help:bam(s) or cram(s) from which to print sample names. with more than 1 each line is prefixed with the path."`
+}{}
+
+var (
+	smTag = sam.Tag([2]byte{'S', 'M'})
+	plTag = sam.Tag([2]byte{'P', 'L'})
+	cnTag = sam.Tag([2]byte{'C', 'N'})
+	dsTag = sam.Tag([2]byte{'D', 'S'})
+	dtTag = sam.Tag([2]byte{'D', 'T'})
+)
+
+// readGroup is the ID and sample of a read-group.
+type readGroup struct {
+	id, sample string
+}
+
+// samples returns the ID and SM of the read-groups in h. If all is false, only the first read-group
+// with each sample is returned. Read-groups without an SM tag are skipped.
+func samples(h *sam.Header, all bool) []readGroup {
+	var rgs []readGroup
+	seen := make(map[string]bool)
+	for _, rg := range h.RGs() {
+		sm := rg.Get(smTag)
+		if sm == "" || (!all && seen[sm]) {
+			continue
+		}
+		seen[sm] = true
+		rgs = append(rgs, readGroup{rg.Name(), sm})
+	}
+	return rgs
+}
+
+// rgRecord is the metadata of a read-group that is printed with --json. Absent tags are omitted.
+type rgRecord struct {
+	Path         string `json:"path"`
+	ID           string `json:"ID"`
+	Sample       string `json:"SM,omitempty"`
+	Library      string `json:"LB,omitempty"`
+	Platform     string `json:"PL,omitempty"`
+	PlatformUnit string `json:"PU,omitempty"`
+	Center       string `json:"CN,omitempty"`
+	Description  string `json:"DS,omitempty"`
+	Date         string `json:"DT,omitempty"`
+}
+
+// records returns the metadata of every read-group in h including those without an SM tag.
+func records(path string, h *sam.Header) []rgRecord {
+	var recs []rgRecord
+	for _, rg := range h.RGs() {
+		r := rgRecord{
+			Path:         path,
+			ID:           rg.Name(),
+			Sample:       rg.Get(smTag),
+			Library:      rg.Library(),
+			Platform:     rg.Get(plTag),
+			PlatformUnit: rg.PlatformUnit(),
+			Center:       rg.Get(cnTag),
+			Description:  rg.Get(dsTag),
+		}
+		if !rg.Time().IsZero() {
+			r.Date = rg.Get(dtTag)
+		}
+		recs = append(recs, r)
+	}
+	return recs
+}
+
+// readSheet reads the path and expected sample from each line of a tab-delimited file.
+func readSheet(path string) (paths []string, expected map[string]string, err error) {
+	rdr, err := xopen.Ropen(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rdr.Close()
+	expected = make(map[string]string)
+	for i := 1; ; i++ {
+		line, err := rdr.ReadString('\n')
+		if line = strings.TrimSpace(line); len(line) > 0 && line[0] != '#' {
+			toks := strings.Split(line, "\t")
+			if len(toks) < 2 {
+				return nil, nil, &goleft.ParseError{Path: path, Line: i, Err: fmt.Errorf("samplename: expected path and sample in line: %q", line)}
+			}
+			if _, ok := expected[toks[0]]; !ok {
+				paths = append(paths, toks[0])
+			}
+			expected[toks[0]] = toks[1]
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return paths, expected, nil
+}
+
+// expectedFor finds the expected sample for path by the full path or the file name. It returns an
+// error if the path is not in expected or if the file name matches entries with different samples.
+func expectedFor(path string, expected map[string]string) (string, error) {
+	if sm, ok := expected[path]; ok {
+		return sm, nil
+	}
+	var matches []string
+	for p := range expected {
+		if filepath.Base(p) == filepath.Base(path) {
+			matches = append(matches, p)
+		}
+	}
+	if len(matches) == 0 {
+		return "", fmt.Errorf("samplename: %s not found in sample sheet", path)
+	}
+	sort.Strings(matches)
+	for _, p := range matches[1:] {
+		if expected[p] != expected[matches[0]] {
+			return "", fmt.Errorf("samplename: the file name of %s matches %s in the sample sheet with different samples", path, strings.Join(matches, ","))
+		}
+	}
+	return expected[matches[0]], nil
+}
+
+// check reports to stderr each of the bams that doesn't have exactly the expected sample and
+// returns the number of problems.
+func check(bams []string, expected map[string]string) int {
+	bad := 0
+	for _, path := range bams {
+		exp, err := expectedFor(path, expected)
+		if err != nil {
+			goleft.Warnf("%s", err)
+			bad++
+			continue
+		}
+		h, err := bamio.Header(path)
+		if err != nil {
+			goleft.Warnf("samplename: error reading header from %s: %s", path, err)
+			bad++
+			continue
+		}
+		var found []string
+		for _, rg := range samples(h, false) {
+			found = append(found, rg.sample)
+		}
+		if len(found) != 1 || found[0] != exp {
+			goleft.Warnf("samplename: mismatch for %s: expected %s, found: %s", path, exp, strings.Join(found, ","))
+			bad++
+		}
+	}
+	return bad
+}
+
+// Main is called from the goleft dispatcher.
+func Main() {
+	p := arg.MustParse(cli)
+	if cli.Check != "" {
+		paths, expected, err := readSheet(cli.Check)
+		if err != nil {
+			log.Fatal(err)
+		}
+		// without bams, every file in the sheet is checked.
+		if len(cli.Bams) == 0 {
+			cli.Bams = paths
+		}
+		if bad := check(cli.Bams, expected); bad > 0 {
+			log.Fatalf("samplename: %d of %d files did not match the sample sheet", bad, len(cli.Bams))
+		}
+		return
+	}
+	if len(cli.Bams) == 0 {
+		p.Fail("samplename: expected at least 1 bam")
+	}
+	w := bufio.NewWriter(os.Stdout)
+	defer w.Flush()
+	enc := json.NewEncoder(w)
+	for _, path := range cli.Bams {
+		h, err := bamio.Header(path)
+		if err != nil {
+			log.Fatalf("samplename: error reading header from %s: %s", path, err)
+		}
+		if cli.JSON {
+			recs := records(path, h)
+			if len(recs) == 0 {
+				w.Flush()
+				log.Fatalf("samplename: no read-group found in %s", path)
+			}
+			for _, r := range recs {
+				if err := enc.Encode(r); err != nil {
+					log.Fatal(err)
+				}
+			}
+			continue
+		}
+		rgs := samples(h, cli.All || cli.RG)
+		if len(rgs) == 0 {
+			w.Flush()
+			log.Fatalf("samplename: no read-group with an SM tag found in %s", path)
+		}
+		for _, rg := range rgs {
+			if len(cli.Bams) > 1 {
+				fmt.Fprintf(w, "%s\t", path)
+			}
+			if cli.RG {
+				fmt.Fprintf(w, "%s\t", rg.id)
+			}
+			fmt.Fprintln(w, rg.sample)
+		}
+	}
+}
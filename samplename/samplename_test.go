@@ -0,0 +1,88 @@
+package samplename
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/biogo/hts/sam"
+)
+
+func TestSamples(t *testing.T) {
+	h, err := sam.NewHeader(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rg := range [][2]string{{"rg1", "A"}, {"rg2", "B"}, {"rg3", "A"}, {"rg4", ""}} {
+		r, err := sam.NewReadGroup(rg[0], "", "", "", "", "", "", rg[1], "", "", time.Time{}, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := h.AddReadGroup(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, exp := samples(h, false), []readGroup{{"rg1", "A"}, {"rg2", "B"}}; !reflect.DeepEqual(got, exp) {
+		t.Errorf("expected %v, got: %v", exp, got)
+	}
+	if got, exp := samples(h, true), []readGroup{{"rg1", "A"}, {"rg2", "B"}, {"rg3", "A"}}; !reflect.DeepEqual(got, exp) {
+		t.Errorf("expected %v, got: %v", exp, got)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	bam := "../depth/test/t.bam"
+	if bad := check([]string{bam}, map[string]string{"/some/other/dir/t.bam": "Test1"}); bad != 0 {
+		t.Errorf("expected match by file name, got %d problems", bad)
+	}
+	if bad := check([]string{bam}, map[string]string{bam: "Test2"}); bad != 1 {
+		t.Errorf("expected a mismatch, got %d problems", bad)
+	}
+	if bad := check([]string{bam}, map[string]string{"x.bam": "Test1"}); bad != 1 {
+		t.Errorf("expected a problem for a file not in the sheet, got %d", bad)
+	}
+	// a file name in more than one directory of the sheet only matches if the samples agree.
+	if bad := check([]string{bam}, map[string]string{"/a/t.bam": "Test1", "/b/t.bam": "Test1"}); bad != 0 {
+		t.Errorf("expected a match for the same sample by file name, got %d problems", bad)
+	}
+	if bad := check([]string{bam}, map[string]string{"/a/t.bam": "Test1", "/b/t.bam": "Test2"}); bad != 1 {
+		t.Errorf("expected a problem for an ambiguous file name, got %d", bad)
+	}
+	if _, err := expectedFor(bam, map[string]string{"/a/t.bam": "Test1", "/b/t.bam": "Test2"}); err == nil || !strings.Contains(err.Error(), "/a/t.bam,/b/t.bam") {
+		t.Errorf("expected an error with the ambiguous paths, got: %v", err)
+	}
+}
+
+func TestRecords(t *testing.T) {
+	h, err := sam.NewHeader(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	date := time.Date(2017, 3, 1, 0, 0, 0, 0, time.UTC)
+	r1, err := sam.NewReadGroup("rg1", "BI", "", "lib1", "", "ILLUMINA", "H0164.2", "A", "", "", date, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r2, err := sam.NewReadGroup("rg2", "", "", "", "", "", "", "", "", "", time.Time{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range []*sam.ReadGroup{r1, r2} {
+		if err := h.AddReadGroup(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	recs := records("a.bam", h)
+	if len(recs) != 2 {
+		t.Fatalf("expected 2 read-groups, got: %d", len(recs))
+	}
+	exp := rgRecord{Path: "a.bam", ID: "rg1", Sample: "A", Library: "lib1", Platform: "ILLUMINA", PlatformUnit: "H0164.2", Center: "BI", Date: recs[0].Date}
+	if recs[0] != exp || !strings.HasPrefix(recs[0].Date, "2017-03-01") {
+		t.Errorf("unexpected record: %+v", recs[0])
+	}
+	if b, _ := json.Marshal(recs[1]); string(b) != `{"path":"a.bam","ID":"rg2"}` {
+		t.Errorf("expected absent tags to be omitted, got: %s", b)
+	}
+}
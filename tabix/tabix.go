@@ -0,0 +1,417 @@
+// Package tabix writes sorted, bgzip compressed bed files along with their tabix (.tbi) index in a
+// single pass so that the output can be queried with tabix or loaded as a track in IGV without
+// re-reading it. Lines starting with '#' are written but not indexed. If a line ends beyond 2^29,
+// the limit of a .tbi, a .csi is written instead as by tabix --csi.
+package tabix
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/biogo/hts/bgzf"
+)
+
+// ErrUnsorted is returned by Close if the lines were not sorted by position within each chromosome
+// or a chromosome was not contiguous. The bed.gz is complete but no index is written.
+var ErrUnsorted = errors.New("tabix: lines are not sorted so no index was written")
+
+const (
+	// minShift and depth are the binning scheme of tabix and BAI indexes. A .csi has more levels
+	// for longer chromosomes. Bins are found for maxDepth and moved to the levels of the index
+	// that is written once the longest chromosome is known.
+	minShift = 14
+	depth    = 5
+	maxDepth = 8
+	// ucsc is the format used by tabix -p bed: generic columns with 0-based starts.
+	ucsc = 0x10000
+)
+
+type chunk struct {
+	beg, end uint64
+}
+
+type refIndex struct {
+	name       string
+	bins       map[uint32][]chunk
+	linear     []uint64
+	first, end uint64
+	n          uint64
+	lastStart  int
+}
+
+// counter records the compressed size of each block. bgzf.Writer writes each block with a single
+// call to Write and in order.
+type counter struct {
+	w     io.Writer
+	sizes []uint64
+}
+
+func (c *counter) Write(b []byte) (int, error) {
+	c.sizes = append(c.sizes, uint64(len(b)))
+	return c.w.Write(b)
+}
+
+// Writer writes a bgzf compressed bed file to path and the index to path + ".tbi" on Close.
+type Writer struct {
+	path string
+	fh   *os.File
+	c    *counter
+	bg   *bgzf.Writer
+	// line holds a partial line until the rest is written.
+	line []byte
+
+	// block is the number of the current block and off is the position in it. Offsets in the
+	// index are in this form until Close when the sizes of the blocks are known.
+	block, off uint64
+	refs       []*refIndex
+	seen       map[string]bool
+	unsorted   bool
+	// maxEnd is the largest end of any line.
+	maxEnd int
+}
+
+// Create returns a Writer for the bed.gz at path with wc compression goroutines.
+func Create(path string, wc int) (*Writer, error) {
+	fh, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	c := &counter{w: fh}
+	bg := bgzf.NewWriter(c, wc)
+	// use a fixed header so the output is the same for the same input.
+	bg.ModTime = time.Unix(0, 0)
+	bg.OS = 0xff
+	return &Writer{path: path, fh: fh, c: c, bg: bg, seen: make(map[string]bool)}, nil
+}
+
+// Write writes the lines in b. A line may be split across calls.
+func (w *Writer) Write(b []byte) (int, error) {
+	n := len(b)
+	for len(b) > 0 {
+		i := bytes.IndexByte(b, '\n')
+		if i == -1 {
+			w.line = append(w.line, b...)
+			break
+		}
+		line := b[:i+1]
+		if len(w.line) > 0 {
+			line = append(w.line, line...)
+			w.line = w.line[:0]
+		}
+		if err := w.writeLine(line); err != nil {
+			return 0, err
+		}
+		b = b[i+1:]
+	}
+	return n, nil
+}
+
+// pseudo returns the position as a virtual offset with the block number in place of its offset in
+// the file.
+func (w *Writer) pseudo() uint64 {
+	return w.block<<16 | w.off
+}
+
+// writeLine writes a single line and adds it to the index. bgzf.Writer only splits a write across
+// blocks if it does not fit in an empty block.
+func (w *Writer) writeLine(line []byte) error {
+	if w.off != 0 && w.off+uint64(len(line)) > bgzf.BlockSize {
+		w.block++
+		w.off = 0
+	}
+	beg := w.pseudo()
+	if _, err := w.bg.Write(line); err != nil {
+		return err
+	}
+	w.off += uint64(len(line))
+	for w.off >= bgzf.BlockSize {
+		w.block++
+		w.off -= bgzf.BlockSize
+	}
+	if len(line) == 0 || line[0] == '#' || w.unsorted {
+		return nil
+	}
+	chrom, start, end, err := parseLine(line)
+	if err != nil {
+		return err
+	}
+	w.add(chrom, start, end, beg, w.pseudo())
+	return nil
+}
+
+// parseLine returns the chromosome, start and end from the first 3 columns of a bed line.
+func parseLine(line []byte) (string, int, int, error) {
+	toks := bytes.SplitN(bytes.TrimRight(line, "\r\n"), []byte{'\t'}, 4)
+	if len(toks) < 3 {
+		return "", 0, 0, fmt.Errorf("tabix: expected at least 3 columns in line: %q", line)
+	}
+	start, err := strconv.Atoi(string(toks[1]))
+	if err != nil {
+		return "", 0, 0, fmt.Errorf("tabix: bad start in line: %q", line)
+	}
+	end, err := strconv.Atoi(string(toks[2]))
+	if err != nil {
+		return "", 0, 0, fmt.Errorf("tabix: bad end in line: %q", line)
+	}
+	// an empty interval is indexed as the base at its start.
+	if end <= start {
+		end = start + 1
+	}
+	return string(toks[0]), start, end, nil
+}
+
+func (w *Writer) add(chrom string, start, end int, beg, stop uint64) {
+	var ref *refIndex
+	if n := len(w.refs); n > 0 && w.refs[n-1].name == chrom {
+		ref = w.refs[n-1]
+	} else {
+		if w.seen[chrom] {
+			w.unsorted = true
+			return
+		}
+		w.seen[chrom] = true
+		ref = &refIndex{name: chrom, bins: make(map[uint32][]chunk), first: beg}
+		w.refs = append(w.refs, ref)
+	}
+	if start < ref.lastStart {
+		w.unsorted = true
+		return
+	}
+	ref.lastStart = start
+	if end > w.maxEnd {
+		w.maxEnd = end
+	}
+	ref.end = stop
+	ref.n++
+
+	bin := reg2bin(start, end, maxDepth)
+	if cs := ref.bins[bin]; len(cs) > 0 && cs[len(cs)-1].end == beg {
+		cs[len(cs)-1].end = stop
+	} else {
+		ref.bins[bin] = append(cs, chunk{beg, stop})
+	}
+	for i := start >> minShift; i <= (end-1)>>minShift; i++ {
+		for len(ref.linear) <= i {
+			ref.linear = append(ref.linear, 0)
+		}
+		if ref.linear[i] == 0 {
+			// beg is at least 1 for an indexed line as the header line comes first, otherwise
+			// the first line is also the smallest offset which is the fill value below.
+			ref.linear[i] = beg
+		}
+	}
+}
+
+// firstBin returns the number of the first bin at level l.
+func firstBin(l int) uint32 {
+	return uint32(((1 << (3 * uint(l))) - 1) / 7)
+}
+
+// reg2bin returns the smallest bin that contains the 0-based, half-open interval in an index with
+// d levels.
+func reg2bin(beg, end, d int) uint32 {
+	end--
+	for l, s := d, minShift; l > 0; l, s = l-1, s+3 {
+		if beg>>s == end>>s {
+			return firstBin(l) + uint32(beg>>s)
+		}
+	}
+	return 0
+}
+
+// rebin returns the bin of an index with d levels that covers the same bases as bin from an index
+// with maxDepth levels. Bins that are larger than the root of the smaller index are the root.
+func rebin(bin uint32, d int) uint32 {
+	l := maxDepth
+	for bin < firstBin(l) {
+		l--
+	}
+	if l -= maxDepth - d; l <= 0 {
+		return 0
+	}
+	return firstBin(l) + bin - firstBin(l+maxDepth-d)
+}
+
+// binStart returns the first base of a bin in an index with d levels.
+func binStart(bin uint32, d int) int {
+	l := d
+	for bin < firstBin(l) {
+		l--
+	}
+	return int(bin-firstBin(l)) << uint(minShift+3*(d-l))
+}
+
+// indexDepth returns the number of levels that are needed for positions up to end. It is the depth
+// of a .tbi unless end is beyond its limit.
+func indexDepth(end int) int {
+	d := depth
+	for end > 1<<uint(minShift+3*d) {
+		d++
+	}
+	return d
+}
+
+// Close flushes the bed.gz and writes the index to path + ".tbi" or, if a line ends beyond 2^29,
+// to path + ".csi".
+func (w *Writer) Close() error {
+	if len(w.line) > 0 {
+		if err := w.writeLine(append(w.line, '\n')); err != nil {
+			return err
+		}
+	}
+	if err := w.bg.Close(); err != nil {
+		return err
+	}
+	if err := w.fh.Close(); err != nil {
+		return err
+	}
+	if w.unsorted {
+		return ErrUnsorted
+	}
+	// the file offset of each block from the sizes of the ones before it.
+	starts := make([]uint64, len(w.c.sizes)+1)
+	for i, s := range w.c.sizes {
+		starts[i+1] = starts[i] + s
+	}
+	real := func(v uint64) uint64 {
+		return starts[v>>16]<<16 | v&0xffff
+	}
+
+	d := indexDepth(w.maxEnd)
+	ext, other := ".tbi", ".csi"
+	if d > depth {
+		ext, other = other, ext
+	}
+	// an index from an earlier run would be used by tabix in place of this one.
+	os.Remove(w.path + other)
+	fh, err := os.Create(w.path + ext)
+	if err != nil {
+		return err
+	}
+	bg := bgzf.NewWriter(fh, 1)
+	bg.ModTime = time.Unix(0, 0)
+	bg.OS = 0xff
+	if err := w.writeIndex(bg, real, d); err != nil {
+		fh.Close()
+		return err
+	}
+	if err := bg.Close(); err != nil {
+		fh.Close()
+		return err
+	}
+	return fh.Close()
+}
+
+// writeIndex writes a .tbi or, if d is more than its depth, a .csi with d levels.
+func (w *Writer) writeIndex(iw io.Writer, real func(uint64) uint64, d int) error {
+	csi := d > depth
+	var names []byte
+	for _, ref := range w.refs {
+		names = append(append(names, ref.name...), 0)
+	}
+	// format, col_seq, col_beg, col_end, meta, skip and the names. For a .csi, these are the
+	// auxiliary data after the binning scheme.
+	conf := []interface{}{int32(ucsc), int32(1), int32(2), int32(3), int32('#'), int32(0), int32(len(names)), names}
+	hdr := append([]interface{}{[4]byte{'T', 'B', 'I', 1}, int32(len(w.refs))}, conf...)
+	if csi {
+		hdr = []interface{}{[4]byte{'C', 'S', 'I', 1}, int32(minShift), int32(d), int32(4*6 + 4 + len(names))}
+		hdr = append(append(hdr, conf...), int32(len(w.refs)))
+	}
+	for _, v := range hdr {
+		if err := binary.Write(iw, binary.LittleEndian, v); err != nil {
+			return err
+		}
+	}
+	for _, ref := range w.refs {
+		// windows without a line get the offset of the window before.
+		var last uint64
+		for i, v := range ref.linear {
+			if v == 0 {
+				ref.linear[i] = last
+			}
+			last = ref.linear[i]
+		}
+		bins := make(map[uint32][]chunk, len(ref.bins))
+		for bin, cs := range ref.bins {
+			b := rebin(bin, d)
+			bins[b] = append(bins[b], cs...)
+		}
+		var buf []interface{}
+		buf = append(buf, int32(len(bins)+1))
+		for _, bin := range sortedBins(bins) {
+			cs := mergeChunks(bins[bin])
+			buf = append(buf, bin)
+			if csi {
+				// a .csi has the offset of the first line that overlaps each bin in place of the
+				// linear index.
+				var loff uint64
+				if i := binStart(bin, d) >> minShift; i < len(ref.linear) {
+					loff = ref.linear[i]
+				}
+				buf = append(buf, real(loff))
+			}
+			buf = append(buf, int32(len(cs)))
+			for _, c := range cs {
+				buf = append(buf, real(c.beg), real(c.end))
+			}
+		}
+		// the pseudo-bin holds the offsets and number of lines for each reference.
+		buf = append(buf, firstBin(d+1)+1)
+		if csi {
+			buf = append(buf, uint64(0))
+		}
+		buf = append(buf, int32(2), real(ref.first), real(ref.end), ref.n, uint64(0))
+		if !csi {
+			buf = append(buf, int32(len(ref.linear)))
+			for _, v := range ref.linear {
+				buf = append(buf, real(v))
+			}
+		}
+		for _, v := range buf {
+			if err := binary.Write(iw, binary.LittleEndian, v); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// mergeChunks sorts the chunks and joins those that overlap or meet as happens when bins are
+// combined by rebin.
+func mergeChunks(cs []chunk) []chunk {
+	for i := 1; i < len(cs); i++ {
+		for j := i; j > 0 && cs[j].beg < cs[j-1].beg; j-- {
+			cs[j], cs[j-1] = cs[j-1], cs[j]
+		}
+	}
+	var out []chunk
+	for _, c := range cs {
+		if n := len(out); n > 0 && c.beg <= out[n-1].end {
+			if c.end > out[n-1].end {
+				out[n-1].end = c.end
+			}
+			continue
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+func sortedBins(bins map[uint32][]chunk) []uint32 {
+	keys := make([]uint32, 0, len(bins))
+	for k := range bins {
+		keys = append(keys, k)
+	}
+	for i := 1; i < len(keys); i++ {
+		for j := i; j > 0 && keys[j] < keys[j-1]; j-- {
+			keys[j], keys[j-1] = keys[j-1], keys[j]
+		}
+	}
+	return keys
+}
@@ -0,0 +1,196 @@
+package tabix
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/biogo/hts/bgzf"
+	"github.com/biogo/hts/sam"
+	"github.com/biogo/hts/tabix"
+	"github.com/brentp/goleft/bamio"
+)
+
+func before(a, b bgzf.Offset) bool {
+	return a.File < b.File || (a.File == b.File && a.Block < b.Block)
+}
+
+// readChunk returns the lines in the chunk.
+func readChunk(t *testing.T, bg *bgzf.Reader, c bgzf.Chunk) []string {
+	if err := bg.Seek(c.Begin); err != nil {
+		t.Fatal(err)
+	}
+	var lines []string
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		if _, err := bg.Read(b); err != nil {
+			t.Fatal(err)
+		}
+		line = append(line, b[0])
+		if b[0] != '\n' {
+			continue
+		}
+		lines = append(lines, string(line))
+		line = line[:0]
+		if !before(bg.LastChunk().End, c.End) {
+			return lines
+		}
+	}
+}
+
+func TestWriter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "t.bed.gz")
+	w, err := Create(path, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	type iv struct {
+		chrom      string
+		start, end int
+	}
+	var ivs []iv
+	fmt.Fprintln(w, "#chrom\tstart\tend\tname")
+	pad := strings.Repeat("x", 60)
+	for _, chrom := range []string{"chr1", "chr2", "chr10"} {
+		for i := 0; i < 3000; i++ {
+			// long intervals every 100 lines to use the larger bins.
+			v := iv{chrom, i * 1000, i*1000 + 500}
+			if i%100 == 0 {
+				v.end += 200000
+			}
+			ivs = append(ivs, v)
+			// split the lines across writes.
+			fmt.Fprintf(w, "%s\t%d\t%d\t%s", v.chrom, v.start, v.end, pad)
+			fmt.Fprintln(w)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	fh, err := os.Open(path + ".tbi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+	ibg, err := bgzf.NewReader(fh, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx, err := tabix.ReadFrom(ibg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := idx.Names(); strings.Join(names, ",") != "chr1,chr2,chr10" {
+		t.Fatalf("unexpected names: %v", names)
+	}
+
+	bfh, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bfh.Close()
+	bg, err := bgzf.NewReader(bfh, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range []iv{{"chr1", 0, 10}, {"chr2", 1234567, 1300000}, {"chr10", 2990000, 3000000}, {"chr1", 150000, 160000}} {
+		chunks, err := idx.Chunks(q.chrom, q.start, q.end)
+		if err != nil {
+			t.Fatal(err)
+		}
+		found := make(map[string]bool)
+		for _, c := range chunks {
+			for _, l := range readChunk(t, bg, c) {
+				found[l] = true
+			}
+		}
+		for _, v := range ivs {
+			if v.chrom != q.chrom || v.end <= q.start || v.start >= q.end {
+				continue
+			}
+			if l := fmt.Sprintf("%s\t%d\t%d\t%s\n", v.chrom, v.start, v.end, pad); !found[l] {
+				t.Errorf("%v: missing %q", q, l)
+			}
+		}
+	}
+}
+
+func TestUnsorted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "t.bed.gz")
+	w, err := Create(path, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprint(w, "chr1\t10\t20\nchr2\t10\t20\nchr1\t30\t40\n")
+	if err := w.Close(); err != ErrUnsorted {
+		t.Errorf("expected ErrUnsorted, got: %v", err)
+	}
+	if _, err := os.Stat(path + ".tbi"); !os.IsNotExist(err) {
+		t.Errorf("expected no index for unsorted input")
+	}
+}
+
+func TestCSI(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "t.bed.gz")
+	w, err := Create(path, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// an index from a run with shorter chromosomes.
+	os.WriteFile(path+".tbi", nil, 0644)
+	var lines []string
+	for i := 0; i < 2000; i++ {
+		s := 1<<30 + i*100000
+		lines = append(lines, fmt.Sprintf("chr1\t%d\t%d\n", s, s+500))
+	}
+	fmt.Fprint(w, "chr0\t10\t20\n"+strings.Join(lines, ""))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path + ".tbi"); !os.IsNotExist(err) {
+		t.Errorf("expected the .tbi to be removed")
+	}
+	idx, err := bamio.ReadIndexFile(path + ".csi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r0, _ := sam.NewReference("chr0", "", "", 100, nil, nil)
+	r1, _ := sam.NewReference("chr1", "", "", 1<<31-1, nil, nil)
+	if _, err := sam.NewHeader(nil, []*sam.Reference{r0, r1}); err != nil {
+		t.Fatal(err)
+	}
+	fh, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+	bg, err := bgzf.NewReader(fh, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunks, err := idx.Chunks(r1, 1<<30+500000, 1<<30+700001)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := make(map[string]bool)
+	for _, c := range chunks {
+		for _, l := range readChunk(t, bg, c) {
+			found[l] = true
+		}
+	}
+	for _, l := range lines[5:8] {
+		if !found[l] {
+			t.Errorf("missing %q", l)
+		}
+	}
+	if found[lines[0]] || found["chr0\t10\t20\n"] {
+		t.Errorf("expected only the nearby lines to be read")
+	}
+	if n, ok := idx.Mapped(1); !ok || n != 2000 {
+		t.Errorf("expected 2000 lines for chr1, got: %d", n)
+	}
+}